@@ -0,0 +1,107 @@
+// soraconvert rewrites a BBTrace recording in another format, e.g.
+//
+//	soraconvert -format compact SoraBBTrace.rec SoraBBTrace.sbtc
+//	soraconvert -format compact -compress zstd SoraBBTrace.rec SoraBBTrace.sbtc.zst
+//	soraconvert -format raw SoraBBTrace.sbtc SoraBBTrace.rec
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/firodj/pspsora/internal"
+	"github.com/klauspost/compress/zstd"
+)
+
+// convert writes in to a temporary file next to out and renames it over out
+// once done, so out is left as it was on failure.
+func convert(in, out string, format internal.TraceFormat, compress internal.TraceFormat) error {
+	in_info, err := os.Stat(in)
+	if err != nil {
+		return err
+	}
+	if out_info, err := os.Stat(out); err == nil && os.SameFile(in_info, out_info) {
+		return fmt.Errorf("%s: input and output are the same file", out)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(out), filepath.Base(out)+".*")
+	if err != nil {
+		return err
+	}
+	err = writeTrace(in, file, format, compress)
+	if err == nil {
+		// CreateTemp makes it private, give it the mode os.Create would
+		err = file.Chmod(0644)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), out)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func writeTrace(in string, file io.Writer, format internal.TraceFormat, compress internal.TraceFormat) error {
+	var err error
+	if format != internal.TraceCompact && compress != "" {
+		format = compress
+	}
+
+	switch format {
+	case internal.TraceCompact:
+		var w io.WriteCloser
+		switch compress {
+		case "":
+			return internal.WriteCompactTrace(in, file)
+		case internal.TraceGzip:
+			w = gzip.NewWriter(file)
+		case internal.TraceZstd:
+			if w, err = zstd.NewWriter(file); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported compression %q", compress)
+		}
+		if err := internal.WriteCompactTrace(in, w); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	case internal.TraceGzip, internal.TraceZstd:
+		return internal.WriteCompressedTrace(in, file, format)
+	case internal.TraceRaw:
+		tf, err := internal.OpenTrace(in)
+		if err != nil {
+			return err
+		}
+		defer tf.Close()
+		_, err = io.Copy(file, tf)
+		return err
+	}
+	return fmt.Errorf("unsupported format %q", format)
+}
+
+func main() {
+	format := flag.String("format", "compact", "output format: raw, gzip, zstd or compact")
+	compress := flag.String("compress", "", "compress the output with gzip or zstd")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: soraconvert [-format f] [-compress c] input output")
+		os.Exit(2)
+	}
+
+	err := convert(flag.Arg(0), flag.Arg(1), internal.TraceFormat(*format), internal.TraceFormat(*compress))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
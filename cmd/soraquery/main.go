@@ -0,0 +1,88 @@
+// soraquery streams the events of BBTrace recordings matching a query, e.g.
+//
+//	soraquery -q "kind=enter func=sce* thread=user_main nts=1e6..2e6"
+//	soraquery -q "from=0x0880xxxx bb=0x0890xxxx" SoraBBTrace.rec Battle.rec
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/firodj/pspsora/internal"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+// run returns the exit status, the deferred flush and close done first.
+func run() int {
+	home := os.Getenv("HOME")
+	if runtime.GOOS == "windows" {
+		home = os.Getenv("USERPROFILE")
+	}
+
+	dir := flag.String("dir", filepath.Join(home, "Sora"), "dump directory")
+	query := flag.String("q", "", "query, see internal.ParseTraceQuery")
+	as_json := flag.Bool("json", false, "print events as json lines")
+	output := flag.String("o", "", "write events to file instead of stdout")
+	length := flag.Int("n", 0, "stop after n trace records")
+	workers := flag.Int("j", 1, "parallel workers decoding chunks and running threads, the result is the same as with 1")
+	flag.Parse()
+
+	filter, err := internal.ParseTraceQuery(*query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+
+	doc, err := internal.NewSoraDocument(*dir, true, flag.Args()...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer doc.Delete()
+
+	// keep the document and parser logging out of the events
+	doc.Log = os.Stderr
+	doc.Parser.Workers = *workers
+
+	matches := 0
+	doc.Parser.OnEvent = func(ev *internal.TraceEvent) {
+		if !filter.Match(ev) {
+			return
+		}
+		matches++
+		if *as_json {
+			enc.Encode(ev)
+		} else {
+			fmt.Fprintln(w, ev.String())
+		}
+	}
+
+	status := 0
+	if err := doc.Parser.Parse(*length); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		status = 1
+	}
+	fmt.Fprintf(os.Stderr, "%d matching events\n", matches)
+	return status
+}
@@ -2,9 +2,21 @@ module github.com/firodj/pspsora
 
 go 1.19
 
+require (
+	github.com/davecgh/go-spew v1.1.1
+	github.com/klauspost/compress v1.17.4
+	github.com/stretchr/testify v1.8.0
+	github.com/uptrace/bun v1.1.8
+	github.com/uptrace/bun/dialect/sqlitedialect v1.1.8
+	github.com/uptrace/bun/driver/sqliteshim v1.1.8
+	github.com/uptrace/bun/extra/bundebug v1.1.8
+	github.com/wk8/go-ordered-map/v2 v2.0.0
+	golang.org/x/exp v0.0.0-20221006183845-316c7553db56
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/bahlo/generic-list-go v0.2.0 // indirect
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fatih/color v1.13.0 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
@@ -14,20 +26,12 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.15 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20200410134404-eec4a21b6bb0 // indirect
-	github.com/stretchr/testify v1.8.0 // indirect
 	github.com/tmthrgd/go-hex v0.0.0-20190904060850-447a3041c3bc // indirect
-	github.com/uptrace/bun v1.1.8 // indirect
-	github.com/uptrace/bun/dialect/sqlitedialect v1.1.8 // indirect
-	github.com/uptrace/bun/driver/sqliteshim v1.1.8 // indirect
-	github.com/uptrace/bun/extra/bundebug v1.1.8 // indirect
 	github.com/vmihailenco/msgpack/v5 v5.3.5 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
-	github.com/wk8/go-ordered-map/v2 v2.0.0 // indirect
-	golang.org/x/exp v0.0.0-20221006183845-316c7553db56 // indirect
 	golang.org/x/mod v0.6.0-dev.0.20220419223038-86c51ed26bb4 // indirect
 	golang.org/x/sys v0.0.0-20220825204002-c680a09ffe64 // indirect
 	golang.org/x/tools v0.1.12 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	lukechampine.com/uint128 v1.2.0 // indirect
 	modernc.org/cc/v3 v3.36.3 // indirect
 	modernc.org/ccgo/v3 v3.16.9 // indirect
@@ -1,9 +1,5 @@
 package internal
 
-import (
-	"fmt"
-)
-
 type BBYieldFunc func(state BBAnalState)
 
 type BBAnalState struct {
@@ -32,9 +28,6 @@ func (bbas *BBAnalState) SetBB(addr uint32) {
 }
 
 func (bbas *BBAnalState) SetBranch(addr uint32) {
-	if bbas.BranchAddr != 0 {
-		fmt.Printf("WARNING:\tSetBranch already set\n")
-	}
 	bbas.BranchAddr = addr
 }
 
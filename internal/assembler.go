@@ -0,0 +1,503 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// asmFormat is the fixed bits of an encoding and its operand fields, one
+// letter each:
+//
+//	d s t   GPR rd, rs, rt        D S T   FPR fd, fs, ft
+//	C F     COP0 and FPU control  h       shift amount
+//	i u     signed, unsigned imm  m       offset(base)
+//	b j     branch, jump target   c       syscall or break code
+//	k       cache op              p E I   ext/ins position, sizes
+type asmFormat struct {
+	bits   uint32
+	fields string
+}
+
+var asmFormats = buildAsmFormats()
+
+func buildAsmFormats() map[string]asmFormat {
+	formats := map[string]asmFormat{
+		"j":       {0x08000000, "j"},
+		"jal":     {0x0c000000, "j"},
+		"lui":     {0x3c000000, "tu"},
+		"rotr":    {0x00200002, "dth"},
+		"rotrv":   {0x00000046, "dts"},
+		"cache":   {0xbc000000, "km"},
+		"lwc1":    {0xc4000000, "Tm"},
+		"swc1":    {0xe4000000, "Tm"},
+		"mfc0":    {0x40000000, "tC"},
+		"mtc0":    {0x40800000, "tC"},
+		"eret":    {0x42000018, ""},
+		"mfc1":    {0x44000000, "tS"},
+		"cfc1":    {0x44400000, "tF"},
+		"mtc1":    {0x44800000, "tS"},
+		"ctc1":    {0x44c00000, "tF"},
+		"cvt.s.w": {0x46800020, "DS"},
+		"ext":     {0x7c000000, "tspE"},
+		"ins":     {0x7c000004, "tspI"},
+	}
+
+	for funct, name := range specialOps {
+		fields := "dst"
+		switch funct {
+		case 0x00, 0x02, 0x03:
+			fields = "dth"
+		case 0x04, 0x06, 0x07:
+			fields = "dts"
+		case 0x08:
+			fields = "s"
+		case 0x09, 0x16, 0x17:
+			fields = "ds"
+		case 0x0c, 0x0d:
+			fields = "c"
+		case 0x0f:
+			fields = ""
+		case 0x10, 0x12:
+			fields = "d"
+		case 0x11, 0x13:
+			fields = "s"
+		case 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x2e, 0x2f:
+			fields = "st"
+		}
+		formats[name] = asmFormat{funct, fields}
+	}
+	for rt, name := range regimmOps {
+		formats[name] = asmFormat{0x04000000 | rt<<16, "sb"}
+	}
+	for op, name := range branchOps {
+		fields := "stb"
+		if op&3 >= 2 {
+			fields = "sb"
+		}
+		formats[name] = asmFormat{op << 26, fields}
+	}
+	for op, name := range immOps {
+		fields := "tsi"
+		if op >= 0x0c {
+			fields = "tsu"
+		}
+		formats[name] = asmFormat{op << 26, fields}
+	}
+	for op, name := range memOps {
+		formats[name] = asmFormat{op << 26, "tm"}
+	}
+	for sa, name := range bshflOps {
+		formats[name] = asmFormat{0x7c000020 | sa<<6, "dt"}
+	}
+	for i, name := range bc1Ops {
+		formats[name] = asmFormat{0x45000000 | uint32(i)<<16, "b"}
+	}
+	for funct, name := range fpuOps {
+		fields := "DS"
+		if funct < 0x04 {
+			fields = "DST"
+		}
+		formats[name] = asmFormat{0x46000000 | funct, fields}
+	}
+	for i, cond := range fpuConds {
+		formats["c."+cond+".s"] = asmFormat{0x46000030 | uint32(i), "ST"}
+	}
+	return formats
+}
+
+// AsmInstruction is an assembled instruction and the source line it came
+// from, Line counting from 1.
+type AsmInstruction struct {
+	Address uint32
+	Word    uint32
+	Op      string
+	Line    int
+}
+
+// Assembler encodes Allegrex instructions from text, one per line, as the
+// decoder prints them. Labels end with ':', comments start with '#' or ';'.
+// Targets are addresses, labels of the text, functions, data items or
+// SymbolMap labels. The VFPU is not supported.
+type Assembler struct {
+	doc *SoraDocument
+
+	Labels map[string]uint32
+}
+
+func NewAssembler(doc *SoraDocument) *Assembler {
+	return &Assembler{doc: doc, Labels: make(map[string]uint32)}
+}
+
+type asmLine struct {
+	num   int
+	addr  uint32
+	op    string
+	args  []string
+	split bool // a pseudo instruction expanded into more
+}
+
+// asmSplit separates the mnemonic from the comma separated operands, a tab
+// or a space apart as in the Dizz text of the bridge.
+func asmSplit(line string) (string, []string) {
+	op, rest := strings.TrimSpace(line), ""
+	if pos := strings.IndexAny(op, " \t"); pos >= 0 {
+		op, rest = op[:pos], op[pos+1:]
+	}
+	var args []string
+	if rest = strings.TrimSpace(rest); rest != "" {
+		for _, arg := range strings.Split(rest, ",") {
+			args = append(args, strings.TrimSpace(arg))
+		}
+	}
+	return strings.ToLower(op), args
+}
+
+// Assemble encodes text to run at addr, every branch and jump must be
+// followed by its delay slot.
+func (asm *Assembler) Assemble(addr uint32, text string) ([]AsmInstruction, error) {
+	var lines []asmLine
+	for i, line := range strings.Split(text, "\n") {
+		if pos := strings.IndexAny(line, "#;"); pos >= 0 {
+			line = line[:pos]
+		}
+		line = strings.TrimSpace(line)
+		if pos := strings.Index(line, ":"); pos >= 0 && !strings.ContainsAny(line[:pos], " \t,(") {
+			asm.Labels[line[:pos]] = addr
+			line = strings.TrimSpace(line[pos+1:])
+		}
+		if line == "" {
+			continue
+		}
+
+		expanded := asmExpand(asmSplit(line))
+		for _, ex := range expanded {
+			lines = append(lines, asmLine{num: i + 1, addr: addr, op: ex.op, args: ex.args, split: len(expanded) > 1})
+			addr += 4
+		}
+	}
+
+	var result []AsmInstruction
+	for i, line := range lines {
+		word, err := asm.encode(line.addr, line.op, line.args)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line.num, err)
+		}
+		if i > 0 && asmHasDelaySlot(lines[i-1].op) {
+			switch {
+			case asmHasDelaySlot(line.op):
+				return nil, fmt.Errorf("line %d: %s in the delay slot of %s", line.num, line.op, lines[i-1].op)
+			case line.split:
+				return nil, fmt.Errorf("line %d: pseudo instruction does not fit the delay slot", line.num)
+			}
+		}
+		result = append(result, AsmInstruction{Address: line.addr, Word: word, Op: line.op, Line: line.num})
+	}
+	if n := len(lines); n > 0 && asmHasDelaySlot(lines[n-1].op) {
+		return nil, fmt.Errorf("line %d: %s without delay slot", lines[n-1].num, lines[n-1].op)
+	}
+	return result, nil
+}
+
+// AssembleOne encodes the single instruction in text at addr.
+func (asm *Assembler) AssembleOne(addr uint32, text string) (uint32, error) {
+	expanded := asmExpand(asmSplit(text))
+	if len(expanded) != 1 {
+		return 0, fmt.Errorf("%s is more than one instruction", text)
+	}
+	return asm.encode(addr, expanded[0].op, expanded[0].args)
+}
+
+func asmHasDelaySlot(op string) bool {
+	switch op {
+	case "j", "jal", "jr", "jalr":
+		return true
+	}
+	for _, name := range branchOps {
+		if op == name {
+			return true
+		}
+	}
+	for _, name := range regimmOps {
+		if op == name {
+			return true
+		}
+	}
+	for _, name := range bc1Ops {
+		if op == name {
+			return true
+		}
+	}
+	return false
+}
+
+type asmExpanded struct {
+	op   string
+	args []string
+}
+
+// asmExpand rewrites the pseudo instructions, li into lui and ori when the
+// value does not fit one instruction.
+func asmExpand(op string, args []string) []asmExpanded {
+	one := func(op string, args ...string) []asmExpanded {
+		return []asmExpanded{{op, args}}
+	}
+	switch {
+	case op == "nop" && len(args) == 0:
+		return one("sll", "zero", "zero", "0")
+	case op == "move" && len(args) == 2:
+		return one("addu", args[0], args[1], "zero")
+	case op == "jalr" && len(args) == 1:
+		return one("jalr", "ra", args[0])
+	case op == "b" && len(args) == 1:
+		return one("beq", "zero", "zero", args[0])
+	case op == "beqz" && len(args) == 2:
+		return one("beq", args[0], "zero", args[1])
+	case op == "bnez" && len(args) == 2:
+		return one("bne", args[0], "zero", args[1])
+	case op == "li" && len(args) == 2:
+		val, err := asmParseInt(args[1])
+		switch {
+		case err != nil:
+			return one("addiu", args[0], "zero", args[1])
+		case val >= -0x8000 && val < 0x8000:
+			return one("addiu", args[0], "zero", args[1])
+		case val >= 0 && val <= 0xffff:
+			return one("ori", args[0], "zero", args[1])
+		case uint32(val)&0xffff == 0:
+			return one("lui", args[0], fmt.Sprintf("0x%x", uint32(val)>>16))
+		}
+		return []asmExpanded{
+			{"lui", []string{args[0], fmt.Sprintf("0x%x", uint32(val)>>16)}},
+			{"ori", []string{args[0], args[0], fmt.Sprintf("0x%x", uint32(val)&0xffff)}},
+		}
+	}
+	return one(op, args...)
+}
+
+func asmParseInt(s string) (int64, error) {
+	return strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 0, 64)
+}
+
+func asmParseRegister(s string, class RegClass) (Register, error) {
+	name := strings.TrimPrefix(strings.TrimPrefix(s, "->"), "$")
+	if num, err := strconv.Atoi(name); err == nil && class == RegGPR && num >= 0 && num < 32 {
+		return GPR(num), nil
+	}
+	reg, ok := LookupRegister(name)
+	if !ok || reg.Class != class {
+		return Register{}, fmt.Errorf("expected %s register, got %q", class, s)
+	}
+	return reg, nil
+}
+
+// resolve is the address of a target or %hi/%lo operand, a number, the
+// decoder's ->$address or a name, Dizz writing ->name for a known one.
+func (asm *Assembler) resolve(s string) (uint32, error) {
+	if strings.HasPrefix(s, "->$") {
+		val, err := strconv.ParseUint(s[3:], 16, 32)
+		return uint32(val), err
+	}
+	s = strings.TrimPrefix(s, "->")
+	if val, err := asmParseInt(s); err == nil {
+		return uint32(val), nil
+	}
+	name, ofs := s, int64(0)
+	if pos := strings.LastIndexAny(s, "+-"); pos > 0 {
+		if val, err := asmParseInt(s[pos:]); err == nil {
+			name, ofs = s[:pos], val
+		}
+	}
+	if addr, ok := asm.Labels[name]; ok {
+		return addr + uint32(ofs), nil
+	}
+	if asm.doc != nil {
+		if funs := asm.doc.FunManager.GetByName(name); len(funs) > 0 {
+			return funs[0].Address + uint32(ofs), nil
+		}
+		if data := asm.doc.DataManager.GetByName(name); data != nil {
+			return data.Address + uint32(ofs), nil
+		}
+		if symmap := asm.doc.SymMap; symmap != nil {
+			if addr, ok := symmap.GetLabelValue(name); ok {
+				return addr + uint32(ofs), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown symbol %q", name)
+}
+
+// immediate parses a number or %hi(sym) and %lo(sym), hi being adjusted
+// for the sign of lo.
+func (asm *Assembler) immediate(s string) (int64, error) {
+	for _, reloc := range []string{"%hi(", "%lo("} {
+		if !strings.HasPrefix(s, reloc) || !strings.HasSuffix(s, ")") {
+			continue
+		}
+		addr, err := asm.resolve(s[len(reloc) : len(s)-1])
+		if err != nil {
+			return 0, err
+		}
+		if reloc == "%hi(" {
+			return int64((addr + 0x8000) >> 16), nil
+		}
+		return int64(int16(addr)), nil
+	}
+	return asmParseInt(s)
+}
+
+func (asm *Assembler) encode(addr uint32, op string, args []string) (uint32, error) {
+	format, ok := asmFormats[op]
+	if !ok {
+		return 0, fmt.Errorf("unknown instruction %q", op)
+	}
+	fields := format.fields
+	if len(args) != len(fields) {
+		return 0, fmt.Errorf("%s takes %d operands, got %d", op, len(fields), len(args))
+	}
+
+	word := format.bits
+	gpr := func(arg string, shift uint) error {
+		reg, err := asmParseRegister(arg, RegGPR)
+		word |= uint32(reg.Num) << shift
+		return err
+	}
+	fpr := func(arg string, shift uint, class RegClass) error {
+		reg, err := asmParseRegister(arg, class)
+		word |= uint32(reg.Num) << shift
+		return err
+	}
+	number := func(arg string, lo, hi int64) (int64, error) {
+		val, err := asm.immediate(arg)
+		if err != nil {
+			return 0, fmt.Errorf("bad number %q", arg)
+		}
+		if val < lo || val > hi {
+			return 0, fmt.Errorf("%s out of range", arg)
+		}
+		return val, nil
+	}
+
+	pos := int64(0)
+	for i, field := range fields {
+		arg := args[i]
+		var err error
+		switch field {
+		case 'd':
+			err = gpr(arg, 11)
+		case 's':
+			err = gpr(arg, 21)
+		case 't':
+			err = gpr(arg, 16)
+		case 'D':
+			err = fpr(arg, 6, RegFPR)
+		case 'S':
+			err = fpr(arg, 11, RegFPR)
+		case 'T':
+			err = fpr(arg, 16, RegFPR)
+		case 'F':
+			err = fpr(arg, 11, RegFCR)
+		case 'C':
+			err = fpr(arg, 11, RegCOP0)
+		case 'h', 'k':
+			var val int64
+			val, err = number(arg, 0, 31)
+			if field == 'h' {
+				word |= uint32(val) << 6
+			} else {
+				word |= uint32(val) << 16
+			}
+		case 'c':
+			var val int64
+			val, err = number(arg, 0, 0xfffff)
+			word |= uint32(val) << 6
+		case 'i':
+			var val int64
+			val, err = number(arg, -0x8000, 0x7fff)
+			word |= uint32(val) & 0xffff
+		case 'u':
+			var val int64
+			val, err = number(arg, 0, 0xffff)
+			word |= uint32(val)
+		case 'p':
+			pos, err = number(arg, 0, 31)
+			word |= uint32(pos) << 6
+		case 'E', 'I':
+			var size int64
+			size, err = number(arg, 1, 32-pos)
+			if field == 'E' {
+				word |= uint32(size-1) << 11
+			} else {
+				word |= uint32(pos+size-1) << 11
+			}
+		case 'm':
+			err = asm.encodeMem(&word, arg)
+		case 'b':
+			var target uint32
+			if target, err = asm.resolve(arg); err == nil {
+				delta := int64(int32(target-addr-4)) >> 2
+				switch {
+				case target&3 != 0:
+					err = fmt.Errorf("unaligned target 0x%08x", target)
+				case delta < -0x8000 || delta > 0x7fff:
+					err = fmt.Errorf("target 0x%08x out of branch range", target)
+				}
+				word |= uint32(delta) & 0xffff
+			}
+		case 'j':
+			var target uint32
+			if target, err = asm.resolve(arg); err == nil {
+				switch {
+				case target&3 != 0:
+					err = fmt.Errorf("unaligned target 0x%08x", target)
+				case target&0xf0000000 != (addr+4)&0xf0000000:
+					err = fmt.Errorf("target 0x%08x out of jump range", target)
+				}
+				word |= (target >> 2) & 0x3ffffff
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if dec := DecodeInstruction(addr, word); dec == nil || dec.Op != op {
+		return 0, fmt.Errorf("%s: encoding 0x%08x does not decode back", op, word)
+	}
+	return word, nil
+}
+
+// encodeMem parses offset(base), the offset may be %lo(sym).
+func (asm *Assembler) encodeMem(word *uint32, arg string) error {
+	open := strings.LastIndex(arg, "(")
+	if open < 0 || !strings.HasSuffix(arg, ")") {
+		return fmt.Errorf("expected offset(base), got %q", arg)
+	}
+	base, err := asmParseRegister(arg[open+1:len(arg)-1], RegGPR)
+	if err != nil {
+		return err
+	}
+	ofs := int64(0)
+	if s := strings.TrimSpace(arg[:open]); s != "" {
+		if ofs, err = asm.immediate(s); err != nil {
+			return fmt.Errorf("bad offset %q", s)
+		}
+	}
+	if ofs < -0x8000 || ofs > 0x7fff {
+		return fmt.Errorf("offset %d out of range", ofs)
+	}
+	*word |= uint32(base.Num)<<21 | uint32(ofs)&0xffff
+	return nil
+}
+
+// String prints the instruction the way the assembler reads it.
+func (dec *DecodedInstruction) String() string {
+	if len(dec.Operands) == 0 {
+		return dec.Op
+	}
+	oprs := make([]string, len(dec.Operands))
+	for i, opr := range dec.Operands {
+		oprs[i] = opr.String()
+	}
+	return dec.Op + " " + strings.Join(oprs, ", ")
+}
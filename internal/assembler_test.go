@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssembleRoundTrip(t *testing.T) {
+	asm := NewAssembler(newTestDocument())
+	cases := map[string]string{
+		"addiu v0, zero, 1":       "addiu v0, zero, 0x1",
+		"addiu sp, sp, -0x20":     "addiu sp, sp, -0x20",
+		"li v0, 1":                "addiu v0, zero, 0x1",
+		"li a0, 0xffff":           "ori a0, zero, 0xffff",
+		"li a0, 0x8800000":        "lui a0, 0x880",
+		"move a0, s0":             "addu a0, s0, zero",
+		"nop":                     "sll zero, zero, 0x0",
+		"lw ra, 0x14(sp)":         "lw ra, 0x14(sp)",
+		"sb $2, -4($29)":          "sb v0, -0x4(sp)",
+		"sw a0, (a1)":             "sw a0, 0x0(a1)",
+		"jr ra":                   "jr ra",
+		"jalr t9":                 "jalr ra, t9",
+		"jal 0x8804100":           "jal ->$08804100",
+		"j ->$08800000":           "j ->$08800000",
+		"beq a0, zero, 0x8804010": "beq a0, zero, ->$08804010",
+		"bnez a0, 0x8803ff0":      "bne a0, zero, ->$08803ff0",
+		"b 0x8804004":             "beq zero, zero, ->$08804004",
+		"bgezal a0, 0x8804008":    "bgezal a0, ->$08804008",
+		"blezl a1, 0x8804008":     "blezl a1, ->$08804008",
+		"sll t0, t1, 2":           "sll t0, t1, 0x2",
+		"rotr t0, t1, 8":          "rotr t0, t1, 0x8",
+		"rotrv t0, t1, t2":        "rotrv t0, t1, t2",
+		"srav t0, t1, t2":         "srav t0, t1, t2",
+		"mult a0, a1":             "mult a0, a1",
+		"mflo v0":                 "mflo v0",
+		"max v0, a0, a1":          "max v0, a0, a1",
+		"syscall 0x2015":          "syscall 0x2015",
+		"sync":                    "sync",
+		"ext v0, a0, 4, 8":        "ext v0, a0, 0x4, 0x8",
+		"ins v0, a0, 4, 8":        "ins v0, a0, 0x4, 0x8",
+		"seb v0, a0":              "seb v0, a0",
+		"wsbw v0, a0":             "wsbw v0, a0",
+		"lui a0, 0x880":           "lui a0, 0x880",
+		"andi v0, v0, 0xff":       "andi v0, v0, 0xff",
+		"lwc1 f12, 8(a0)":         "lwc1 f12, 0x8(a0)",
+		"add.s f0, f12, f14":      "add.s f0, f12, f14",
+		"neg.s f0, f12":           "neg.s f0, f12",
+		"c.lt.s f12, f14":         "c.lt.s f12, f14",
+		"cvt.s.w f0, f2":          "cvt.s.w f0, f2",
+		"bc1t 0x8804008":          "bc1t ->$08804008",
+		"mfc1 v0, f12":            "mfc1 v0, f12",
+		"ctc1 v0, fcr31":          "ctc1 v0, fcr31",
+		"mtc0 v0, Status":         "mtc0 v0, Status",
+		"cache 0x14, 0(a0)":       "cache 0x14, 0x0(a0)",
+	}
+	for text, want := range cases {
+		word, err := asm.AssembleOne(0x8804000, text)
+		if !assert.NoError(t, err, text) {
+			continue
+		}
+		dec := DecodeInstruction(0x8804000, word)
+		assert.Equal(t, want, dec.String(), text)
+
+		again, err := asm.AssembleOne(0x8804000, dec.String())
+		assert.NoError(t, err, dec.String())
+		assert.Equal(t, word, again, dec.String())
+	}
+}
+
+func TestAssembleDecodedWords(t *testing.T) {
+	asm := NewAssembler(nil)
+	words := []uint32{
+		0x27bdffe0, 0x8fbf0014, 0xafb00010, 0x03e00008, 0x0e201040, 0x10800003,
+		0x00850018, 0x7c823900, 0x44026000, 0x460e6000, 0x460e603c, 0xc4800008,
+		0x0000000c, 0x00021080, 0x3c040880, 0x34840001, 0x0320f809,
+	}
+	for _, word := range words {
+		dec := DecodeInstruction(0x8804000, word)
+		got, err := asm.AssembleOne(0x8804000, dec.String())
+		assert.NoError(t, err, dec.String())
+		assert.Equal(t, word, got, dec.String())
+	}
+}
+
+func TestAssembleSymbols(t *testing.T) {
+	doc := newEmuDocument()
+	putFunction(doc, "helper", 0x8800100, 8)
+	doc.DataManager.Create(0x8800200, 8, DataASCII, "message")
+
+	asm := NewAssembler(doc)
+	instrs, err := asm.Assemble(0x8800000, `
+		lui a0, %hi(str_08800200)   # message
+		addiu a0, a0, %lo(str_08800200)
+	loop:
+		jal helper
+		lw a1, %lo(str_08800200+4)(a0)
+		bnez v0, loop
+		nop
+		li v1, 0x12345678
+	`)
+	assert.NoError(t, err)
+	var got []string
+	for _, instr := range instrs {
+		got = append(got, DecodeInstruction(instr.Address, instr.Word).String())
+	}
+	assert.Equal(t, []string{
+		"lui a0, 0x880",
+		"addiu a0, a0, 0x200",
+		"jal ->$08800100",
+		"lw a1, 0x204(a0)",
+		"bne v0, zero, ->$08800008",
+		"sll zero, zero, 0x0",
+		"lui v1, 0x1234",
+		"ori v1, v1, 0x5678",
+	}, got)
+	assert.Equal(t, uint32(0x8800008), asm.Labels["loop"])
+	assert.Equal(t, 7, instrs[4].Line)
+
+	_, err = asm.Assemble(0x8800000, "jal missing\nnop")
+	assert.ErrorContains(t, err, `unknown symbol "missing"`)
+}
+
+func TestAssembleDizz(t *testing.T) {
+	doc := newEmuDocument()
+	putFunction(doc, "helper", 0x8800100, 8)
+
+	asm := NewAssembler(doc)
+	instrs, err := asm.Assemble(0x8804000, "addiu\tv0,zero,0x1\n"+
+		"li\tv0,0x1\n"+
+		"bne\tv0,zero,->$08804010\n"+
+		"lw\tra,0x14(sp)\n"+
+		"jal\t->helper\n"+
+		"nop\n"+
+		"jr\t->ra\n"+
+		"nop")
+	assert.NoError(t, err)
+	var got []string
+	for _, instr := range instrs {
+		got = append(got, DecodeInstruction(instr.Address, instr.Word).String())
+	}
+	assert.Equal(t, []string{
+		"addiu v0, zero, 0x1",
+		"addiu v0, zero, 0x1",
+		"bne v0, zero, ->$08804010",
+		"lw ra, 0x14(sp)",
+		"jal ->$08800100",
+		"sll zero, zero, 0x0",
+		"jr ra",
+		"sll zero, zero, 0x0",
+	}, got)
+}
+
+func TestAssembleErrors(t *testing.T) {
+	asm := NewAssembler(newTestDocument())
+	errors := map[string]string{
+		"jr ra":              "without delay slot",
+		"jr ra\nb 0x8804000": "in the delay slot",
+		"beq a0, a1, 0x8804000\nli a0, 0x12345678": "does not fit the delay slot",
+		"addiu v0, zero, 0x8000":                   "out of range",
+		"addiu v0, zero":                           "takes 3 operands",
+		"addu v0, f0, a0":                          "expected gpr register",
+		"frob v0":                                  "unknown instruction",
+		"j 0x18800000\nnop":                        "out of jump range",
+		"beq a0, a1, 0x8804002\nnop":               "unaligned target",
+		"beq a0, a1, 0x8904000\nnop":               "out of branch range",
+		"lw a0, 4[a1]":                             "expected offset(base)",
+	}
+	for text, want := range errors {
+		_, err := asm.Assemble(0x8804000, text)
+		assert.ErrorContains(t, err, want, text)
+	}
+}
+
+func TestPatchAsm(t *testing.T) {
+	doc := newEmuDocument()
+	patch, err := doc.PatchManager.PatchAsm(0x8800010, "jr ra\nli v0, 1", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "jr; addiu", patch.Comment)
+	word, _ := doc.Memory.Read32(0x8800014)
+	assert.Equal(t, uint32(0x24020001), word)
+}
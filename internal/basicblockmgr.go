@@ -2,6 +2,7 @@ package internal
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/firodj/pspsora/binarysearchtree"
 )
@@ -21,17 +22,60 @@ type BBRefKey struct {
 	To   uint32 `yaml:"to"`
 }
 
+type SoraBBRefKind string
+
+const (
+	RefUnknown     SoraBBRefKind = ""
+	RefBranch      SoraBBRefKind = "branch"      // taken branch or jump
+	RefFallthrough SoraBBRefKind = "fallthrough" // not taken, or the return site after a call
+	RefLikelySkip  SoraBBRefKind = "likely_skip" // not taken likely branch, delay slot skipped
+	RefCall        SoraBBRefKind = "call"
+	RefReturn      SoraBBRefKind = "return"
+	RefIndirect    SoraBBRefKind = "indirect" // jump by register
+	RefSyscall     SoraBBRefKind = "syscall"
+)
+
 type SoraBBRef struct {
-	BBRefKey
+	BBRefKey `yaml:",inline"`
+
+	Kind       SoraBBRefKind `yaml:"kind"`
+	VisitCount int64         `yaml:"visit_count"`
 
-	IsDynamic  bool // immediate or by reg/mem/ptr
-	IsAdjacent bool // next/prev
-	IsLinked   bool // call/linked
-	IsVisited  bool // by bbtrace
+	IsDynamic  bool `yaml:"is_dynamic"`  // immediate or by reg/mem/ptr
+	IsAdjacent bool `yaml:"is_adjacent"` // next/prev
+	IsLinked   bool `yaml:"is_linked"`   // call/linked
+	IsVisited  bool `yaml:"is_visited"`  // by bbtrace
+
+	Provenance string `yaml:"provenance,omitempty"` // how a static analysis found it
 }
 
 func (ref *SoraBBRef) SetAdjacent(v bool) *SoraBBRef {
-	ref.IsAdjacent = true
+	ref.IsAdjacent = v
+	return ref
+}
+
+// SetKind sets the edge kind and the flags implied by it.
+func (ref *SoraBBRef) SetKind(kind SoraBBRefKind) *SoraBBRef {
+	if kind == RefUnknown {
+		return ref
+	}
+	ref.Kind = kind
+
+	switch kind {
+	case RefFallthrough, RefLikelySkip, RefSyscall:
+		ref.IsAdjacent = true
+	case RefCall:
+		ref.IsLinked = true
+	case RefIndirect, RefReturn:
+		ref.IsDynamic = true
+	}
+	return ref
+}
+
+// Visit counts one traversal of the edge by the trace.
+func (ref *SoraBBRef) Visit() *SoraBBRef {
+	ref.VisitCount++
+	ref.IsVisited = true
 	return ref
 }
 
@@ -79,9 +123,8 @@ func (bbmanager *BasicBlockManager) Get(addr uint32) (bb *SoraBasicBlock) {
 	}
 
 	if bb != nil && bb.Address > addr {
-		bbmanager.basicBlocks.String()
-		err := fmt.Errorf("found=%d query=%d", bb.Address, addr)
-		panic(err)
+		bbmanager.doc.logf("ERROR:\tbb tree inconsistent, found=0x%08x query=0x%08x\n", bb.Address, addr)
+		bb = nil
 	}
 
 	return
@@ -121,6 +164,69 @@ func (bbmanager *BasicBlockManager) CreateReference(from_addr, to_addr uint32) *
 	return bbref
 }
 
+// ClassifyEdge tells the kind of the transfer from fromBB to to_addr by
+// looking at the instruction ending the block.
+func (bbmanager *BasicBlockManager) ClassifyEdge(fromBB *SoraBasicBlock, to_addr uint32) SoraBBRefKind {
+	instrmgr := bbmanager.doc.InstrManager
+
+	if fromBB.BranchAddress == 0 {
+		if last := instrmgr.Get(fromBB.LastAddress); last != nil && last.Mnemonic == "syscall" {
+			return RefSyscall
+		}
+		return RefFallthrough
+	}
+
+	brInstr := instrmgr.Get(fromBB.BranchAddress)
+	if brInstr == nil {
+		return RefUnknown
+	}
+	next_addr := fromBB.LastAddress + 4
+
+	switch {
+	case isReturnInstr(brInstr):
+		return RefReturn
+	case brInstr.Info.IsLinkedBranch:
+		if to_addr == next_addr {
+			return RefFallthrough
+		}
+		return RefCall
+	case brInstr.Info.IsBranchToRegister:
+		return RefIndirect
+	case to_addr == brInstr.Info.BranchTarget:
+		return RefBranch
+	case brInstr.Info.IsLikelyBranch && to_addr == brInstr.Address+8:
+		return RefLikelySkip
+	case to_addr == next_addr:
+		return RefFallthrough
+	}
+	return RefUnknown
+}
+
+// ResetVisits zeroes the visit counts, they restart with the trace profile.
+func (bbmanager *BasicBlockManager) ResetVisits() {
+	for _, ref := range bbmanager.refs {
+		ref.VisitCount = 0
+	}
+}
+
+// Refs returns every reference, the most visited first.
+func (bbmanager *BasicBlockManager) Refs() []*SoraBBRef {
+	result := make([]*SoraBBRef, 0, len(bbmanager.refs))
+	for _, ref := range bbmanager.refs {
+		result = append(result, ref)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].VisitCount != result[j].VisitCount {
+			return result[i].VisitCount > result[j].VisitCount
+		}
+		if result[i].From != result[j].From {
+			return result[i].From < result[j].From
+		}
+		return result[i].To < result[j].To
+	})
+	return result
+}
+
 func (bbmanager *BasicBlockManager) SplitAt(split_addr uint32) (prev_bb, split_bb *SoraBasicBlock) {
 	prev_bb = bbmanager.Get(split_addr)
 	if prev_bb == nil {
@@ -129,7 +235,7 @@ func (bbmanager *BasicBlockManager) SplitAt(split_addr uint32) (prev_bb, split_b
 		split_bb = prev_bb
 		return
 	} else if prev_bb.Address > split_addr {
-		fmt.Printf("ERROR:\tunable to split non exist bb 0x%08x\n", split_addr)
+		bbmanager.doc.logf("ERROR:\tunable to split non exist bb 0x%08x\n", split_addr)
 		return nil, nil
 	}
 
@@ -141,7 +247,7 @@ func (bbmanager *BasicBlockManager) SplitAt(split_addr uint32) (prev_bb, split_b
 	split_bb = bbmanager.Create(split_addr)
 	if split_bb == nil {
 		prev_bb.LastAddress = last_addr
-		fmt.Printf("ERROR:\tunable to create splitted bb at: 0x%08x, possibly exists?\n", split_addr)
+		bbmanager.doc.logf("ERROR:\tunable to create splitted bb at: 0x%08x, possibly exists?\n", split_addr)
 		return
 	}
 
@@ -151,6 +257,254 @@ func (bbmanager *BasicBlockManager) SplitAt(split_addr uint32) (prev_bb, split_b
 	}
 
 	split_bb.LastAddress = last_addr
-	bbmanager.CreateReference(prev_bb.Address, split_bb.Address).SetAdjacent(true)
+	// the end of the block moved, so do its outgoing edges
+	bbmanager.moveRefsFrom(prev_bb.Address, split_bb.Address, 0, 0)
+	bbmanager.CreateReference(prev_bb.Address, split_bb.Address).SetKind(RefFallthrough)
 	return
 }
+
+// CreateRange creates a block for [addr, last_addr], splitting an enclosing
+// block or truncating the range before a following one.
+func (bbmanager *BasicBlockManager) CreateRange(addr, last_addr, branch_addr uint32) *SoraBasicBlock {
+	if bb := bbmanager.Get(addr); bb != nil {
+		if bb.Address == addr {
+			return bb
+		}
+		_, split_bb := bbmanager.SplitAt(addr)
+		return split_bb
+	}
+
+	bb := bbmanager.Create(addr)
+	bb.LastAddress = last_addr
+	bb.BranchAddress = branch_addr
+
+	_, c := bbmanager.basicBlocks.FloorCeil(addr + 1)
+	if !c.End() && c.Value().Address <= last_addr {
+		next_bb := c.Value()
+		bb.LastAddress = next_bb.Address - 4
+		if bb.BranchAddress >= next_bb.Address {
+			bb.BranchAddress = 0
+		}
+		bbmanager.CreateReference(bb.Address, next_bb.Address).SetKind(RefFallthrough)
+	}
+
+	return bb
+}
+
+func removeAddr(addrs []uint32, addr uint32) []uint32 {
+	for i, ex_addr := range addrs {
+		if ex_addr == addr {
+			return append(addrs[:i], addrs[i+1:]...)
+		}
+	}
+	return addrs
+}
+
+func (bbmanager *BasicBlockManager) RemoveReference(from_addr, to_addr uint32) {
+	key := BBRefKey{
+		From: from_addr,
+		To:   to_addr,
+	}
+	if _, ok := bbmanager.refs[key]; !ok {
+		return
+	}
+
+	delete(bbmanager.refs, key)
+	bbmanager.refsToBB[to_addr] = removeAddr(bbmanager.refsToBB[to_addr], from_addr)
+	if len(bbmanager.refsToBB[to_addr]) == 0 {
+		delete(bbmanager.refsToBB, to_addr)
+	}
+	bbmanager.refsFromBB[from_addr] = removeAddr(bbmanager.refsFromBB[from_addr], to_addr)
+	if len(bbmanager.refsFromBB[from_addr]) == 0 {
+		delete(bbmanager.refsFromBB, from_addr)
+	}
+}
+
+func (bbmanager *BasicBlockManager) GetReference(from_addr, to_addr uint32) *SoraBBRef {
+	return bbmanager.refs[BBRefKey{From: from_addr, To: to_addr}]
+}
+
+func (bbmanager *BasicBlockManager) RefsFrom(addr uint32) []uint32 {
+	return bbmanager.refsFromBB[addr]
+}
+
+func (bbmanager *BasicBlockManager) RefsTo(addr uint32) []uint32 {
+	return bbmanager.refsToBB[addr]
+}
+
+func (bbmanager *BasicBlockManager) ForEach(cb func(bb *SoraBasicBlock)) {
+	bbmanager.basicBlocks.InOrderTraverse(cb)
+}
+
+// ForEachIn calls cb in order for the blocks overlapping addr..last_addr.
+func (bbmanager *BasicBlockManager) ForEachIn(addr, last_addr uint32, cb func(bb *SoraBasicBlock)) {
+	it, c := bbmanager.basicBlocks.FloorCeil(addr)
+	if it.End() || it.Value().LastAddress < addr {
+		it = c
+	}
+	for ; !it.End() && it.Value().Address <= last_addr; it = it.Next() {
+		cb(it.Value())
+	}
+}
+
+// moveRefsFrom moves the outgoing references of old_from to new_from,
+// retargeting those pointing to old_to.
+func (bbmanager *BasicBlockManager) moveRefsFrom(old_from, new_from, old_to, new_to uint32) {
+	for _, to_addr := range append([]uint32(nil), bbmanager.refsFromBB[old_from]...) {
+		ref := *bbmanager.refs[BBRefKey{From: old_from, To: to_addr}]
+		bbmanager.RemoveReference(old_from, to_addr)
+
+		if to_addr == old_to {
+			to_addr = new_to
+		}
+		moved := bbmanager.CreateReference(new_from, to_addr)
+		ref.BBRefKey = moved.BBRefKey
+		*moved = ref
+	}
+}
+
+// forgetBB drops bb_addr from the function owning it.
+func (bbmanager *BasicBlockManager) forgetBB(bb_addr uint32) {
+	if bbmanager.doc == nil || bbmanager.doc.FunManager == nil {
+		return
+	}
+	if fun := bbmanager.doc.FunManager.FindByAddress(bb_addr); fun != nil {
+		fun.BBAddresses = removeAddr(fun.BBAddresses, bb_addr)
+	}
+}
+
+// Remove deletes the block starting at addr together with its references.
+func (bbmanager *BasicBlockManager) Remove(addr uint32) error {
+	it := bbmanager.basicBlocks.Search(addr)
+	if it.End() {
+		return fmt.Errorf("no bb at 0x%08x", addr)
+	}
+
+	for _, to_addr := range append([]uint32(nil), bbmanager.refsFromBB[addr]...) {
+		bbmanager.RemoveReference(addr, to_addr)
+	}
+	for _, from_addr := range append([]uint32(nil), bbmanager.refsToBB[addr]...) {
+		bbmanager.RemoveReference(from_addr, addr)
+	}
+
+	bbmanager.basicBlocks.Remove(addr)
+	bbmanager.forgetBB(addr)
+	return nil
+}
+
+// Merge joins the block at addr with the adjacent next block when the only
+// edge between them is the fallthrough.
+func (bbmanager *BasicBlockManager) Merge(addr uint32) (*SoraBasicBlock, error) {
+	bb := bbmanager.Get(addr)
+	if bb == nil || bb.Address != addr {
+		return nil, fmt.Errorf("no bb at 0x%08x", addr)
+	}
+	if bb.BranchAddress != 0 {
+		return nil, fmt.Errorf("bb 0x%08x ends with branch at 0x%08x", addr, bb.BranchAddress)
+	}
+
+	next_addr := bb.LastAddress + 4
+	next_bb := bbmanager.Get(next_addr)
+	if next_bb == nil || next_bb.Address != next_addr {
+		return nil, fmt.Errorf("no adjacent bb after 0x%08x", addr)
+	}
+
+	if outs := bbmanager.refsFromBB[addr]; len(outs) > 1 || (len(outs) == 1 && outs[0] != next_addr) {
+		return nil, fmt.Errorf("bb 0x%08x has more than a fallthrough edge", addr)
+	}
+	if ins := bbmanager.refsToBB[next_addr]; len(ins) > 1 || (len(ins) == 1 && ins[0] != addr) {
+		return nil, fmt.Errorf("bb 0x%08x has other predecessors", next_addr)
+	}
+
+	bbmanager.RemoveReference(addr, next_addr)
+	bbmanager.moveRefsFrom(next_addr, addr, next_addr, addr)
+
+	bb.LastAddress = next_bb.LastAddress
+	bb.BranchAddress = next_bb.BranchAddress
+
+	bbmanager.basicBlocks.Remove(next_addr)
+	bbmanager.forgetBB(next_addr)
+	return bb, nil
+}
+
+type BBIssueKind string
+
+const (
+	BBIssueRange    BBIssueKind = "range"
+	BBIssueOverlap  BBIssueKind = "overlap"
+	BBIssueBranch   BBIssueKind = "branch"
+	BBIssueDangling BBIssueKind = "dangling_ref"
+	BBIssueIndex    BBIssueKind = "ref_index"
+)
+
+type BBIssue struct {
+	Kind    BBIssueKind
+	Address uint32
+	Message string
+}
+
+// Validate checks the block and reference invariants and lists what is broken.
+func (bbmanager *BasicBlockManager) Validate() []BBIssue {
+	var issues []BBIssue
+	report := func(kind BBIssueKind, addr uint32, format string, a ...any) {
+		issues = append(issues, BBIssue{
+			Kind:    kind,
+			Address: addr,
+			Message: fmt.Sprintf(format, a...),
+		})
+	}
+
+	var prev_bb *SoraBasicBlock
+	bbmanager.ForEach(func(bb *SoraBasicBlock) {
+		if bb.LastAddress < bb.Address {
+			report(BBIssueRange, bb.Address, "last address 0x%08x before start", bb.LastAddress)
+		}
+		if bb.BranchAddress != 0 && (bb.BranchAddress < bb.Address || bb.BranchAddress > bb.LastAddress) {
+			report(BBIssueBranch, bb.Address, "branch 0x%08x outside [0x%08x, 0x%08x]", bb.BranchAddress, bb.Address, bb.LastAddress)
+		}
+		if prev_bb != nil && prev_bb.LastAddress >= bb.Address {
+			report(BBIssueOverlap, bb.Address, "overlaps bb 0x%08x ending at 0x%08x", prev_bb.Address, prev_bb.LastAddress)
+		}
+		prev_bb = bb
+	})
+
+	exists := func(addr uint32) bool {
+		it := bbmanager.basicBlocks.Search(addr)
+		return !it.End()
+	}
+	indexed := func(addrs []uint32, addr uint32) bool {
+		for _, ex_addr := range addrs {
+			if ex_addr == addr {
+				return true
+			}
+		}
+		return false
+	}
+
+	for key := range bbmanager.refs {
+		if !exists(key.From) {
+			report(BBIssueDangling, key.From, "ref 0x%08x -> 0x%08x from missing bb", key.From, key.To)
+		}
+		if !exists(key.To) {
+			report(BBIssueDangling, key.To, "ref 0x%08x -> 0x%08x to missing bb", key.From, key.To)
+		}
+		if !indexed(bbmanager.refsFromBB[key.From], key.To) || !indexed(bbmanager.refsToBB[key.To], key.From) {
+			report(BBIssueIndex, key.From, "ref 0x%08x -> 0x%08x not indexed", key.From, key.To)
+		}
+	}
+	for from_addr, to_addrs := range bbmanager.refsFromBB {
+		for _, to_addr := range to_addrs {
+			if _, ok := bbmanager.refs[BBRefKey{From: from_addr, To: to_addr}]; !ok {
+				report(BBIssueIndex, from_addr, "index 0x%08x -> 0x%08x without ref", from_addr, to_addr)
+			}
+		}
+	}
+
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].Address != issues[j].Address {
+			return issues[i].Address < issues[j].Address
+		}
+		return issues[i].Message < issues[j].Message
+	})
+	return issues
+}
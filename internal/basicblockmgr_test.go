@@ -3,6 +3,7 @@ package internal
 import (
 	"testing"
 
+	"github.com/firodj/pspsora/models"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -42,6 +43,22 @@ func TestGet(t *testing.T) {
 	assert.Nil(t, bb)
 }
 
+func TestForEachIn(t *testing.T) {
+	bbmanager := NewBasicBlockManager(nil)
+	for _, addr := range []uint32{0x800000, 0x800010, 0x800020, 0x800030} {
+		bb := bbmanager.Create(addr)
+		bb.LastAddress = addr + 0xC
+	}
+
+	var got []uint32
+	bbmanager.ForEachIn(0x800018, 0x800020, func(bb *SoraBasicBlock) { got = append(got, bb.Address) })
+	assert.Equal(t, []uint32{0x800010, 0x800020}, got)
+
+	got = nil
+	bbmanager.ForEachIn(0x800040, 0x800050, func(bb *SoraBasicBlock) { got = append(got, bb.Address) })
+	assert.Empty(t, got)
+}
+
 func TestSplitAt(t *testing.T) {
 	bbmanager := NewBasicBlockManager(nil)
 
@@ -58,3 +75,109 @@ func TestSplitAt(t *testing.T) {
 	assert.Equal(t, uint32(0x800018), split.BranchAddress)
 	assert.Equal(t, uint32(0x80001C), split.LastAddress)
 }
+
+func TestCreateRangeOverlap(t *testing.T) {
+	bbmanager := NewBasicBlockManager(nil)
+
+	bb := bbmanager.Create(0x800010)
+	bb.LastAddress = 0x80001C
+
+	bb = bbmanager.CreateRange(0x800000, 0x80001C, 0x800018)
+	assert.Equal(t, uint32(0x800000), bb.Address)
+	assert.Equal(t, uint32(0x80000C), bb.LastAddress)
+	assert.Equal(t, uint32(0), bb.BranchAddress)
+	assert.NotNil(t, bbmanager.GetReference(0x800000, 0x800010))
+
+	split := bbmanager.CreateRange(0x800018, 0x80001C, 0)
+	assert.Equal(t, uint32(0x800018), split.Address)
+	assert.Equal(t, uint32(0x800014), bbmanager.Get(0x800010).LastAddress)
+
+	assert.Empty(t, bbmanager.Validate())
+}
+
+func TestMergeRemove(t *testing.T) {
+	bbmanager := NewBasicBlockManager(nil)
+
+	bb := bbmanager.Create(0x800008)
+	bb.LastAddress = 0x80001C
+	bb.BranchAddress = 0x800018
+	bbmanager.CreateReference(0x800008, 0x800040)
+
+	bbmanager.SplitAt(0x800010)
+
+	_, err := bbmanager.Merge(0x800010)
+	assert.Error(t, err)
+
+	merged, err := bbmanager.Merge(0x800008)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x80001C), merged.LastAddress)
+	assert.Equal(t, uint32(0x800018), merged.BranchAddress)
+	assert.Nil(t, bbmanager.GetReference(0x800008, 0x800010))
+	assert.Equal(t, uint32(0x800008), bbmanager.Get(0x800010).Address)
+
+	bb = bbmanager.Create(0x800040)
+	bb.LastAddress = 0x800044
+	assert.Empty(t, bbmanager.Validate())
+
+	assert.NoError(t, bbmanager.Remove(0x800040))
+	assert.Error(t, bbmanager.Remove(0x800040))
+	assert.Empty(t, bbmanager.RefsFrom(0x800008))
+	assert.Empty(t, bbmanager.Validate())
+}
+
+func TestValidate(t *testing.T) {
+	bbmanager := NewBasicBlockManager(nil)
+
+	bb := bbmanager.Create(0x800000)
+	bb.LastAddress = 0x800010
+	bb.BranchAddress = 0x800020
+
+	bb = bbmanager.Create(0x800020)
+	bb.LastAddress = 0x800024
+	bbmanager.CreateReference(0x800020, 0x800030)
+
+	issues := bbmanager.Validate()
+	assert.Len(t, issues, 2)
+	assert.Equal(t, BBIssueBranch, issues[0].Kind)
+	assert.Equal(t, BBIssueDangling, issues[1].Kind)
+}
+
+func TestClassifyEdge(t *testing.T) {
+	doc := newTestDocument()
+	bbmanager := doc.BBManager
+
+	info := opBranch
+	info.IsLikelyBranch = true
+	info.BranchTarget = 0x800100
+	putInstr(doc, 0x800008, "beql\ta0,zero,->$08800100", info)
+	putInstr(doc, 0x80000C, "nop", models.MipsOpcode{})
+	bb := bbmanager.CreateRange(0x800000, 0x80000C, 0x800008)
+
+	assert.Equal(t, RefBranch, bbmanager.ClassifyEdge(bb, 0x800100))
+	assert.Equal(t, RefLikelySkip, bbmanager.ClassifyEdge(bb, 0x800010))
+
+	info = opJAL
+	info.BranchTarget = 0x800200
+	putInstr(doc, 0x800018, "jal\t->$08800200", info)
+	putInstr(doc, 0x80001C, "nop", models.MipsOpcode{})
+	bb = bbmanager.CreateRange(0x800010, 0x80001C, 0x800018)
+
+	assert.Equal(t, RefCall, bbmanager.ClassifyEdge(bb, 0x800200))
+	assert.Equal(t, RefFallthrough, bbmanager.ClassifyEdge(bb, 0x800020))
+
+	putInstr(doc, 0x800020, "jr\tra", opJR)
+	putInstr(doc, 0x800024, "syscall\t0x2010", models.MipsOpcode{})
+	bb = bbmanager.CreateRange(0x800020, 0x800024, 0x800020)
+	assert.Equal(t, RefReturn, bbmanager.ClassifyEdge(bb, 0x800014))
+
+	ref := bbmanager.CreateReference(0x800010, 0x800200).SetKind(RefCall).Visit().Visit()
+	assert.True(t, ref.IsLinked)
+	assert.True(t, ref.IsVisited)
+	assert.Equal(t, int64(2), ref.VisitCount)
+	assert.Same(t, ref, bbmanager.Refs()[0])
+
+	ref = bbmanager.GetReference(0x800000, 0x800010)
+	assert.Nil(t, ref)
+	ref = bbmanager.CreateReference(0x800000, 0x800010).SetAdjacent(false)
+	assert.False(t, ref.IsAdjacent)
+}
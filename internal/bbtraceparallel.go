@@ -0,0 +1,548 @@
+package internal
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	windowRecords = 1 << 14 // records processed as a window
+	minAhead      = 16      // records a thread runs ahead at once, halved after a record needing ParsingBB
+	maxAhead      = 1 << 12 // and doubled otherwise
+)
+
+type chunkJob struct {
+	id      uint16
+	records []byte
+	result  chan *BBTraceChunk
+}
+
+// parseReaderParallel is parseReader with chunks read ahead and decoded on
+// workers goroutines, then processed by windows of about windowRecords
+// records.
+//
+// Within a window the threads run ahead on their own goroutines, each over
+// its records in order, as long as a record only continues the function on
+// top of its stack over known blocks and references. Running ahead reads
+// the managers only, the hits, BB additions and reference visits of a
+// record are kept and replayed in file order up to the first record some
+// thread could not run. That record goes through ParsingBB as in
+// parseReader, the threads having been put back to their state before it,
+// then the threads run ahead again. So the managers, the profile and the
+// events end up as with parseReader.
+func (bbtrace *BBTraceParser) parseReaderParallel(bin io.Reader, length int, workers int) (int, error) {
+	jobs := make(chan *chunkJob, workers*2)
+	order := make(chan *chunkJob, workers*4)
+	done := make(chan struct{})
+
+	var read_err error
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		defer close(order)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			id, records, err := readChunk(bin)
+			if err != nil {
+				read_err = err
+				return
+			}
+			job := &chunkJob{id: id, records: records, result: make(chan *BBTraceChunk, 1)}
+			select {
+			case order <- job:
+			case <-done:
+				return
+			}
+			jobs <- job
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job.result <- DecodeChunk(job.id, job.records)
+			}
+		}()
+	}
+
+	var err error
+	stop := false
+	var window []windowChunk
+	records := 0
+	limit := minAhead
+	for job := range order {
+		chunk := <-job.result
+		window = append(window, windowChunk{chunk: chunk, bytes: chunkHeaderSize + len(job.records)})
+		for k := range chunk.Items {
+			if chunk.Items[k].Kind == 0 {
+				records++
+			}
+		}
+		// a window ends where a checkpoint is written, never part way through a run ahead
+		if records < windowRecords && (length <= 0 || records < length) && chunk.Err == nil &&
+			!bbtrace.checkpointDue(RefTs(records)) {
+			continue
+		}
+		length, stop, err = bbtrace.processWindow(window, length, workers, &limit)
+		window, records = nil, 0
+		if err != nil || stop {
+			break
+		}
+	}
+	if err == nil && !stop && len(window) > 0 {
+		length, stop, err = bbtrace.processWindow(window, length, workers, &limit)
+	}
+
+	close(done)
+	for range order {
+	}
+	wg.Wait()
+
+	if err != nil || stop {
+		return length, err
+	}
+	if read_err != io.EOF {
+		return length, read_err
+	}
+	bbtrace.doc.logf("INFO:\tstop by EOF\n")
+	return length, nil
+}
+
+// windowChunk is a decoded chunk of a window and its size in the stream.
+type windowChunk struct {
+	chunk *BBTraceChunk
+	bytes int
+}
+
+// windowItem is an item of a window, nts is the Nts of a BB record.
+type windowItem struct {
+	*BBTraceItem
+	id  uint16
+	nts RefTs
+}
+
+type aheadOpKind int
+
+const (
+	aheadHit aheadOpKind = iota
+	aheadAddBB
+	aheadVisit
+)
+
+// aheadOp is a change made by a record run ahead.
+type aheadOp struct {
+	kind     aheadOpKind
+	addr     uint32
+	fun      *SoraFunction
+	ref      *SoraBBRef
+	ref_kind SoraBBRefKind
+	ev       *TraceEvent
+}
+
+// aheadRecord is a record run ahead: the state of its thread before it, put
+// back when the record is not replayed, and its changes.
+type aheadRecord struct {
+	pc      uint32
+	last_bb uint32
+	top     uint32
+	ops     []aheadOp
+}
+
+// traceWindow is a run of chunks processed together.
+type traceWindow struct {
+	bbtrace  *BBTraceParser
+	workers  int
+	chunks   []windowChunk
+	items    []windowItem
+	end      int              // items from end on are past length, never run ahead
+	byThread map[uint16][]int // item indexes of each thread, in order
+	ahead    []*aheadRecord   // by item index, the records run ahead
+	limit    int              // records a thread runs ahead at once
+	replayed int
+}
+
+func (bbtrace *BBTraceParser) processWindow(chunks []windowChunk, length int, workers int, limit *int) (int, bool, error) {
+	w := &traceWindow{
+		bbtrace:  bbtrace,
+		workers:  workers,
+		chunks:   chunks,
+		end:      -1,
+		byThread: make(map[uint16][]int),
+		limit:    *limit,
+	}
+
+	nts := bbtrace.Nts
+	records := 0
+	for _, wc := range chunks {
+		for k := range wc.chunk.Items {
+			item := &wc.chunk.Items[k]
+			idx := len(w.items)
+			w.items = append(w.items, windowItem{BBTraceItem: item, id: wc.chunk.ID, nts: nts})
+			w.byThread[wc.chunk.ID] = append(w.byThread[wc.chunk.ID], idx)
+			if item.Kind != 0 {
+				continue
+			}
+			nts++
+			records++
+			if length > 0 && records == length && w.end < 0 {
+				w.end = idx + 1
+			}
+		}
+	}
+	if w.end < 0 {
+		w.end = len(w.items)
+	}
+	w.ahead = make([]*aheadRecord, len(w.items))
+
+	length, stop, err := w.process(length)
+	*limit = w.limit
+	bbtrace.replayed += w.replayed
+	return length, stop, err
+}
+
+// process runs the chunks as processChunk and afterChunk do, replaying the
+// records run ahead.
+func (w *traceWindow) process(length int) (int, bool, error) {
+	bbtrace := w.bbtrace
+	next := 0 // the records before next are run ahead, or skipped
+	i := 0
+
+	for _, wc := range w.chunks {
+		chunk := wc.chunk
+		currentThread := bbtrace.beginChunk(chunk)
+		stop := false
+
+		for k := range chunk.Items {
+			item := &chunk.Items[k]
+			if item.Kind == 0 && i >= next {
+				next = w.runAhead(i)
+			}
+			if rec := w.ahead[i]; rec != nil {
+				bbtrace.replay(rec)
+				bbtrace.Nts++
+				w.replayed++
+			} else if err := bbtrace.processItem(chunk, currentThread, item); err != nil {
+				return length, true, err
+			}
+			i++
+			if item.Kind != 0 {
+				continue
+			}
+			if length, stop = countDown(length); stop {
+				break
+			}
+		}
+
+		var err error
+		length, stop, err = bbtrace.endChunk(chunk, currentThread, length, stop)
+		if err != nil || stop {
+			return length, stop, err
+		}
+		if err := bbtrace.afterChunk(wc.bytes); err != nil {
+			return length, true, err
+		}
+	}
+	return length, false, nil
+}
+
+// aheadRun is a thread running ahead over its items.
+type aheadRun struct {
+	thread  *BBTraceThreadState
+	indexes []int
+	stop    int  // the first record not run
+	early   bool // stopped by a record needing ParsingBB
+}
+
+// runAhead runs the threads ahead from the record at i, it returns the
+// index of the first record one of them could not run, the records before
+// it are replayed. The record at i is run first, i is returned when it can
+// not be.
+func (w *traceWindow) runAhead(i int) int {
+	bbtrace := w.bbtrace
+	first := &w.items[i]
+	thread := bbtrace.Threads[first.id]
+	if i >= w.end || thread == nil || !thread.Executing {
+		return i
+	}
+	rec := w.runRecord(thread, first)
+	if rec == nil {
+		return i
+	}
+	w.ahead[i] = rec
+
+	next := w.end
+	var runs []*aheadRun
+	for id, indexes := range w.byThread {
+		from := i
+		if id == first.id {
+			from = i + 1
+		}
+		indexes = indexes[sort.SearchInts(indexes, from):]
+		if len(indexes) == 0 {
+			continue
+		}
+
+		t := bbtrace.Threads[id]
+		if t == nil {
+			// created by its chunk, it is parsed from its first record
+			if stop := w.nextRecord(indexes); stop < next {
+				next = stop
+			}
+			continue
+		}
+		if !t.Executing {
+			// skipped, nothing to run ahead
+			continue
+		}
+		runs = append(runs, &aheadRun{thread: t, indexes: indexes})
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, w.workers)
+	for _, run := range runs {
+		wg.Add(1)
+		go func(run *aheadRun) {
+			defer wg.Done()
+			sem <- struct{}{}
+			run.stop, run.early = w.runThread(run.thread, run.indexes)
+			<-sem
+		}(run)
+	}
+	wg.Wait()
+
+	early := false
+	for _, run := range runs {
+		if run.stop < next {
+			next = run.stop
+			early = run.early
+		} else if run.stop == next && run.early {
+			early = true
+		}
+	}
+
+	// the records from next on are dropped, their threads go back to before them
+	for _, run := range runs {
+		restored := false
+		for _, idx := range run.indexes {
+			rec := w.ahead[idx]
+			if idx < next || rec == nil {
+				continue
+			}
+			if !restored {
+				run.thread.PC = rec.pc
+				run.thread.LastBB = rec.last_bb
+				run.thread.Stack.Top().address = rec.top
+				restored = true
+			}
+			w.ahead[idx] = nil
+		}
+	}
+
+	if early {
+		w.limit /= 2
+		if w.limit < minAhead {
+			w.limit = minAhead
+		}
+	} else if w.limit < maxAhead {
+		w.limit *= 2
+	}
+	return next
+}
+
+// runThread runs thread ahead over its items at indexes, up to w.limit
+// records. It returns the index of the first record not run, early is set
+// when it needs ParsingBB or follows a change of the thread.
+func (w *traceWindow) runThread(thread *BBTraceThreadState, indexes []int) (int, bool) {
+	n := 0
+	for k, idx := range indexes {
+		if idx >= w.end {
+			return w.end, false
+		}
+		item := &w.items[idx]
+		if item.Kind != 0 {
+			// starts, names and ends change the thread, what follows is parsed
+			return w.nextRecord(indexes[k+1:]), true
+		}
+		if n == w.limit {
+			return idx, false
+		}
+		rec := w.runRecord(thread, item)
+		if rec == nil {
+			return idx, true
+		}
+		w.ahead[idx] = rec
+		n++
+	}
+	return w.end, false
+}
+
+// nextRecord returns the first BB record among indexes, w.end when none.
+func (w *traceWindow) nextRecord(indexes []int) int {
+	for _, idx := range indexes {
+		if idx >= w.end {
+			break
+		}
+		if w.items[idx].Kind == 0 {
+			return idx
+		}
+	}
+	return w.end
+}
+
+// runRecord runs a record of thread as ParsingBB does when it continues the
+// function on top of the stack over known blocks, branches and references.
+// It reads the managers only, their changes are kept in the record and the
+// thread moves on. It returns nil, leaving the thread as is, when the
+// record needs ParsingBB.
+func (w *traceWindow) runRecord(thread *BBTraceThreadState, item *windowItem) *aheadRecord {
+	bbtrace := w.bbtrace
+	bbmanager := bbtrace.doc.BBManager
+	instrmgr := bbtrace.doc.InstrManager
+
+	if item.LastPC == 0 || thread.Stack.Len() == 0 {
+		return nil
+	}
+	theBB := bbmanager.Get(item.PC)
+	if theBB == nil || theBB.Address != item.PC {
+		return nil
+	}
+
+	top := thread.Stack.Top()
+	rec := &aheadRecord{pc: thread.PC, last_bb: thread.LastBB, top: top.address}
+	last_bb, top_addr := thread.LastBB, top.address
+
+	hit := func(addr uint32) {
+		op := aheadOp{kind: aheadHit, addr: addr}
+		if bbtrace.OnEvent != nil {
+			op.ev = bbtrace.event(TraceBB, item.nts, thread, last_bb, addr, nil)
+		}
+		rec.ops = append(rec.ops, op)
+		last_bb = addr
+	}
+	setAddress := func(addr uint32) {
+		if top.Fun != nil && !top.Fun.HasBB(addr) {
+			rec.ops = append(rec.ops, aheadOp{kind: aheadAddBB, addr: addr, fun: top.Fun})
+		}
+		top_addr = addr
+	}
+	visit := func(fromBB *SoraBasicBlock, to_addr uint32) bool {
+		ref := bbmanager.GetReference(fromBB.Address, to_addr)
+		if ref == nil {
+			return false
+		}
+		rec.ops = append(rec.ops, aheadOp{kind: aheadVisit, ref: ref, ref_kind: bbmanager.ClassifyEdge(fromBB, to_addr)})
+		return true
+	}
+
+	// as OnMergingPastToLast
+	past_addr := top_addr
+	var merged []uint32
+	for n := 0; true; n++ {
+		pastBB := bbmanager.Get(past_addr)
+		if pastBB == nil {
+			return nil
+		}
+		for _, addr := range merged {
+			if addr == pastBB.Address {
+				return nil
+			}
+		}
+		merged = append(merged, pastBB.Address)
+
+		if n > 0 {
+			hit(pastBB.Address)
+			setAddress(pastBB.Address)
+		} else if top_addr != pastBB.Address {
+			return nil
+		}
+
+		next_addr := pastBB.LastAddress + 4
+
+		if pastBB.BranchAddress != 0 {
+			pastBrInstr := instrmgr.Get(pastBB.BranchAddress)
+			if pastBrInstr == nil {
+				return nil
+			}
+			if pastBrInstr.Info.IsLikelyBranch && pastBB.BranchAddress == item.LastPC {
+				break
+			}
+			if pastBB.LastAddress == item.LastPC {
+				break
+			}
+			if pastBrInstr.Info.IsConditional {
+				if pastBrInstr.Info.IsBranchToRegister {
+					return nil
+				}
+			} else if pastBrInstr.Info.IsBranchToRegister {
+				break
+			} else if pastBrInstr.Info.BranchTarget != 0 {
+				next_addr = pastBrInstr.Info.BranchTarget
+			} else {
+				return nil
+			}
+		}
+		if !visit(pastBB, next_addr) {
+			return nil
+		}
+		past_addr = next_addr
+	}
+
+	hit(theBB.Address)
+
+	lastBB := bbmanager.Get(item.LastPC)
+	if lastBB == nil {
+		return nil
+	}
+	brInstr := instrmgr.Get(lastBB.BranchAddress)
+	if brInstr == nil || !visit(lastBB, theBB.Address) {
+		return nil
+	}
+
+	// calls, returns and jumps out of the function change the stack
+	switch brInstr.Mnemonic {
+	case "jal", "jalr":
+		return nil
+	case "jr":
+		if len(brInstr.Args) == 0 || brInstr.Args[0].Reg == "ra" {
+			return nil
+		}
+	}
+	if bbtrace.doc.FunManager.jumpLeaves(top.Fun, brInstr, theBB.Address) {
+		return nil
+	}
+	setAddress(theBB.Address)
+
+	thread.PC = item.PC
+	thread.LastBB = last_bb
+	top.address = top_addr
+	return rec
+}
+
+// replay applies the changes of a record run ahead.
+func (bbtrace *BBTraceParser) replay(rec *aheadRecord) {
+	for _, op := range rec.ops {
+		switch op.kind {
+		case aheadHit:
+			bbtrace.Profile.HitBB(op.addr)
+			if op.ev != nil {
+				bbtrace.OnEvent(op.ev)
+			}
+		case aheadAddBB:
+			op.fun.AddBB(op.addr)
+		case aheadVisit:
+			op.ref.SetKind(op.ref_kind).Visit()
+		}
+	}
+}
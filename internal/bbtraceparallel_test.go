@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseTestTrace(t *testing.T, filename string, workers int, length int) (*SoraDocument, []TraceEvent, error) {
+	doc := newTestDocument()
+	putCaller(doc, "main", 0x8804000, 0x8805000)
+	putCaller(doc, "sub", 0x8805000, 0x8806000)
+	putLeafFunction(doc, "leaf", 0x8806000)
+	putSpin(doc, "spin", 0x880a000)
+
+	var events []TraceEvent
+	doc.Parser.Workers = workers
+	doc.Parser.EnableCallHistory = true
+	doc.Parser.OnEvent = func(ev *TraceEvent) { events = append(events, *ev) }
+	doc.Parser.SetTraceFiles([]string{filename})
+	err := doc.Parser.Parse(length)
+	return doc, events, err
+}
+
+func TestParseDecodeAhead(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "trace.rec")
+
+	var chunks []testTraceChunk
+	for n := 0; n < 20; n++ {
+		chunks = append(chunks,
+			traceChunk(1,
+				traceRecord(0x8804000, 0),
+				traceRecord(0x8805000, 0x8804004),
+				traceRecord(0x8806000, 0x8805004),
+			),
+			traceChunk(2, traceRecord(0x8806000, 0)),
+			traceChunk(1,
+				traceRecord(0x8805008, 0x8806004),
+				traceRecord(0x8804008, 0x880500C),
+			),
+		)
+	}
+	writeTestTrace(t, filename, chunks...)
+
+	seq_doc, seq_events, err := parseTestTrace(t, filename, 0, 0)
+	assert.NoError(t, err)
+	par_doc, par_events, err := parseTestTrace(t, filename, 4, 0)
+	assert.NoError(t, err)
+
+	assert.NotEmpty(t, seq_events)
+	assert.Equal(t, seq_events, par_events)
+	assert.Equal(t, seq_doc.Parser.Nts, par_doc.Parser.Nts)
+	assert.Equal(t, seq_doc.Parser.Profile.BBCounts, par_doc.Parser.Profile.BBCounts)
+	assert.Equal(t, len(seq_doc.Parser.Mismatches), len(par_doc.Parser.Mismatches))
+	assert.Equal(t, seq_doc.BBManager.Refs(), par_doc.BBManager.Refs())
+
+	// stopping by length part way through a chunk
+	seq_doc, seq_events, err = parseTestTrace(t, filename, 0, 50)
+	assert.NoError(t, err)
+	par_doc, par_events, err = parseTestTrace(t, filename, 4, 50)
+	assert.NoError(t, err)
+	assert.Equal(t, seq_events, par_events)
+	assert.Equal(t, RefTs(51), par_doc.Parser.Nts)
+
+	// a broken chunk after valid ones
+	data := encodeTestTrace(chunks[:4]...)
+	data = append(data, 0xde, 0xad)
+	assert.NoError(t, os.WriteFile(filename, data, 0644))
+	_, seq_events, seq_err := parseTestTrace(t, filename, 0, 0)
+	_, par_events, par_err := parseTestTrace(t, filename, 4, 0)
+	assert.Error(t, seq_err)
+	assert.Equal(t, seq_err, par_err)
+	assert.Equal(t, seq_events, par_events)
+}
+
+// putSpin puts a function looping over two blocks, calling leaf when
+// leaving the loop and going back to the start:
+//
+//	0x00: bne ->0x20
+//	0x08: jal leaf
+//	0x10: bne ->0x00
+//	0x18: jr ra
+//	0x20: b ->0x00
+func putSpin(doc *SoraDocument, name string, addr uint32) {
+	putBranch(doc, addr, addr+0x20)
+	info := opJAL
+	info.BranchTarget = 0x8806000
+	putInstr(doc, addr+0x08, "jal\t->$leaf", info)
+	putInstr(doc, addr+0x0c, "nop", models.MipsOpcode{})
+	putBranch(doc, addr+0x10, addr)
+	putInstr(doc, addr+0x18, "jr\tra", opJR)
+	putInstr(doc, addr+0x1c, "nop", models.MipsOpcode{})
+	jump := opBranch
+	jump.IsConditional = false
+	jump.BranchTarget = addr
+	putInstr(doc, addr+0x20, "b\t->$", jump)
+	putInstr(doc, addr+0x24, "nop", models.MipsOpcode{})
+	putFunction(doc, name, addr, 0x28)
+}
+
+// spinRecords are the records of n rounds of spin at 0x880a000, each
+// looping inner times before calling leaf.
+func spinRecords(n, inner int) [][]uint32 {
+	var records [][]uint32
+	for r := 0; r < n; r++ {
+		for k := 0; k < inner; k++ {
+			records = append(records,
+				traceRecord(0x880a020, 0x880a004),
+				traceRecord(0x880a000, 0x880a024),
+			)
+		}
+		records = append(records,
+			traceRecord(0x8806000, 0x880a00c),
+			traceRecord(0x880a010, 0x8806004),
+			traceRecord(0x880a000, 0x880a014),
+		)
+	}
+	return records
+}
+
+func TestParseThreadsParallel(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "trace.rec")
+
+	var chunks []testTraceChunk
+	for id := uint16(1); id <= 3; id++ {
+		chunks = append(chunks, traceChunk(id, traceStart(0x880a000), traceName(fmt.Sprintf("worker%d", id)),
+			traceRecord(0x880a000, 0)))
+	}
+	chunks = append(chunks, traceChunk(4, traceStart(0x880a000), traceName("idle0"), traceRecord(0x880a000, 0)))
+	for n := 0; n < 40; n++ {
+		for id := uint16(1); id <= 4; id++ {
+			chunks = append(chunks, traceChunk(id, spinRecords(2, int(id)*5+n%3)...))
+		}
+		if n == 20 {
+			// a thread showing up part way, and one renamed
+			chunks = append(chunks,
+				traceChunk(5, traceStart(0x880a000), traceRecord(0x880a000, 0)),
+				traceChunk(2, traceStart(0x880a000), traceName("renamed")),
+			)
+		}
+		if n > 20 {
+			chunks = append(chunks, traceChunk(5, spinRecords(1, 3)...))
+		}
+	}
+	// thread 3 ends by calling into sub
+	chunks = append(chunks, traceChunk(3,
+		traceRecord(0x8805000, 0x880a024),
+		traceRecord(0x8806000, 0x8805004),
+		traceEnd(0x8806000),
+	))
+	writeTestTrace(t, filename, chunks...)
+
+	type threadState struct {
+		PC, LastBB uint32
+		Stack      []uint32
+	}
+	state := func(doc *SoraDocument) (funs []string, threads map[uint16]threadState) {
+		doc.FunManager.ForEach(func(fun *SoraFunction) {
+			funs = append(funs, fmt.Sprintf("%s %x", fun.Name, fun.BBAddresses))
+		})
+		threads = make(map[uint16]threadState)
+		for id, thread := range doc.Parser.Threads {
+			ts := threadState{PC: thread.PC, LastBB: thread.LastBB}
+			for i := 0; i < thread.Stack.Len(); i++ {
+				ts.Stack = append(ts.Stack, thread.Stack.At(i).Address())
+			}
+			threads[id] = ts
+		}
+		return funs, threads
+	}
+
+	for _, length := range []int{0, 1000, 2345} {
+		seq_doc, seq_events, err := parseTestTrace(t, filename, 0, length)
+		assert.NoError(t, err)
+		seq_funs, seq_threads := state(seq_doc)
+
+		for _, workers := range []int{2, 3, 8} {
+			par_doc, par_events, err := parseTestTrace(t, filename, workers, length)
+			assert.NoError(t, err)
+			par_funs, par_threads := state(par_doc)
+
+			assert.Greater(t, par_doc.Parser.replayed, int(par_doc.Parser.Nts)/2)
+			assert.Equal(t, seq_events, par_events)
+			assert.Equal(t, seq_doc.Parser.Nts, par_doc.Parser.Nts)
+			assert.Equal(t, seq_doc.Parser.Profile.BBCounts, par_doc.Parser.Profile.BBCounts)
+			assert.Equal(t, seq_doc.Parser.Profile.BBSources, par_doc.Parser.Profile.BBSources)
+			assert.Equal(t, seq_doc.BBManager.Refs(), par_doc.BBManager.Refs())
+			assert.Equal(t, seq_doc.Parser.Mismatches, par_doc.Parser.Mismatches)
+			assert.Equal(t, seq_doc.Parser.Timeline.Slices, par_doc.Parser.Timeline.Slices)
+			assert.Equal(t, seq_funs, par_funs)
+			assert.Equal(t, seq_threads, par_threads)
+		}
+	}
+}
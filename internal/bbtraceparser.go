@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/davecgh/go-spew/spew"
 )
@@ -22,8 +21,13 @@ type RefTs int
 type BBTraceStackItem struct {
 	address uint32
 	RA      uint32
+	SP      int // RegSP before entering Fun
 	Fun     *SoraFunction
 	NodeID  FunGraphNodeID
+
+	// entered by a callback delivered over the frame below, whose RA is
+	// kept, it returns into the kernel rather than to a caller
+	Callback bool
 }
 
 func NewStackItem(bb_init *SoraBasicBlock) *BBTraceStackItem {
@@ -52,7 +56,10 @@ type BBTraceThreadState struct {
 	FunGraph    *FunGraph
 	CallHistory *CallHistory
 
-	Name string
+	Name    string
+	StartPC uint32 // from KIND_START
+	EndPC   uint32 // from KIND_END
+	LastBB  uint32
 }
 
 type BBTraceParam struct {
@@ -65,26 +72,129 @@ type BBTraceParam struct {
 
 type BBTraceYield func(param BBTraceParam)
 
+// BBTraceSource is one recording, thread IDs are only meaningful within it.
+type BBTraceSource struct {
+	Index    int
+	Filename string
+	Threads  map[uint16]*BBTraceThreadState
+	StartNts RefTs
+	EndNts   RefTs
+}
+
 type BBTraceParser struct {
 	doc       *SoraDocument
-	filename  string
+	Sources   []*BBTraceSource
+	Current   *BBTraceSource
 	Nts       RefTs
 	Fts       RefTs
 	CurrentID uint16
 	Threads   map[uint16]*BBTraceThreadState
+	Profile   *TraceProfile
+	Timeline  *ThreadTimeline
+
+	// Mismatches are returns and entries that broke the call stack
+	Mismatches        []*RAMismatch
+	exceptionHandlers map[uint32]bool
+
+	entryIndex map[uint32][]FunctionEntry
+
+	EnableFunGraph    bool
+	EnableCallHistory bool
+
+	// Workers, when above 1, decode chunks and run the threads ahead
+	// concurrently, see parseReaderParallel. The result is the sequential one.
+	Workers  int
+	replayed int // records run ahead and replayed
+
+	// CheckpointEvery records a checkpoint is written into CheckpointDir
+	CheckpointEvery RefTs
+	CheckpointDir   string
+	lastCheckpoint  RefTs
+	offset          int64 // of the next chunk in the current source
+
+	// OnEvent, when set, receives every BB hit, function enter and leave
+	// and thread event in trace order
+	OnEvent func(ev *TraceEvent)
 }
 
-func NewBBTraceParser(doc *SoraDocument, filename string) *BBTraceParser {
+func NewBBTraceParser(doc *SoraDocument, filenames ...string) *BBTraceParser {
 	bbtrace := &BBTraceParser{
 		doc:       doc,
-		filename:  filename,
 		CurrentID: 0,
 		Nts:       0,
 		Fts:       0,
+		Profile:   NewTraceProfile(doc),
 	}
+	bbtrace.resetTimeline()
+	bbtrace.SetTraceFiles(filenames)
 	return bbtrace
 }
 
+// SetTraceFiles replaces the recordings parsed, in order, by Parse.
+func (bbtrace *BBTraceParser) SetTraceFiles(filenames []string) {
+	bbtrace.Sources = nil
+	for _, filename := range filenames {
+		bbtrace.AddTraceFile(filename)
+	}
+}
+
+func (bbtrace *BBTraceParser) AddTraceFile(filename string) *BBTraceSource {
+	src := &BBTraceSource{
+		Index:    len(bbtrace.Sources),
+		Filename: filename,
+	}
+	bbtrace.Sources = append(bbtrace.Sources, src)
+	return src
+}
+
+func (bbtrace *BBTraceParser) resetTimeline() {
+	bbtrace.Timeline = NewThreadTimeline()
+	bbtrace.Timeline.OnEvent = func(ev *ThreadEvent) {
+		if bbtrace.OnEvent != nil {
+			bbtrace.OnEvent(&TraceEvent{
+				Kind:       TraceEventKind(ev.Kind),
+				Nts:        ev.Nts,
+				Source:     ev.Source,
+				ThreadID:   ev.ID,
+				ThreadName: ev.Name,
+				Address:    ev.PC,
+			})
+		}
+	}
+}
+
+func (bbtrace *BBTraceParser) emit(kind TraceEventKind, thread *BBTraceThreadState, addr uint32, fun *SoraFunction) {
+	bbtrace.OnEvent(bbtrace.event(kind, bbtrace.Nts, thread, thread.LastBB, addr, fun))
+}
+
+// event makes the event of thread at nts, prev is the BB hit before a TraceBB.
+func (bbtrace *BBTraceParser) event(kind TraceEventKind, nts RefTs, thread *BBTraceThreadState, prev uint32, addr uint32, fun *SoraFunction) *TraceEvent {
+	ev := &TraceEvent{
+		Kind:       kind,
+		Nts:        nts,
+		Source:     bbtrace.sourceIndex(),
+		ThreadID:   thread.ID,
+		ThreadName: thread.Name,
+		Address:    addr,
+	}
+	if kind == TraceBB {
+		ev.Prev = prev
+		fun = bbtrace.doc.FunManager.FindByAddress(addr)
+	}
+	if fun != nil {
+		ev.Function = fun.Name
+	}
+	return ev
+}
+
+func (bbtrace *BBTraceParser) hitBB(thread *BBTraceThreadState, bb_addr uint32) {
+	bbtrace.Profile.HitBB(bb_addr)
+	if bbtrace.OnEvent != nil {
+		bbtrace.emit(TraceBB, thread, bb_addr, nil)
+	}
+	thread.LastBB = bb_addr
+}
+
 func FindFirstNull(b []byte) int {
 	l := 0
 	x := l
@@ -119,190 +229,392 @@ func FindFirstNull(b []byte) int {
 }
 
 func (bbtrace *BBTraceParser) EndParsing() {
+	bbtrace.Timeline.SwitchOut(bbtrace.Nts)
+
 	for _, thread := range bbtrace.Threads {
 		if thread.CallHistory != nil {
 			thread.CallHistory.StopAll(thread.Stack.Len(), bbtrace.Nts)
+			bbtrace.Profile.AddCallHistory(thread.CallHistory)
 		}
 	}
 }
 
+// Parse reads every trace file in order, BBs, refs, functions and counts
+// accumulate over them. A positive length stops after that many records in total.
 func (bbtrace *BBTraceParser) Parse(length int) error {
-	bin, err := os.Open(bbtrace.filename)
+	bbtrace.Threads = nil
+	bbtrace.Profile = NewTraceProfile(bbtrace.doc)
+	bbtrace.doc.BBManager.ResetVisits()
+	bbtrace.resetTimeline()
+	bbtrace.Mismatches = nil
+	bbtrace.entryIndex = nil
+	bbtrace.Nts = 1
+	bbtrace.Fts = 1
+
+	for _, src := range bbtrace.Sources {
+		src.Threads = nil
+	}
+
+	bbtrace.lastCheckpoint = 0
+
+	return bbtrace.parseSources(0, 0, length)
+}
+
+// parseSources parses from offset of source first on to the last source.
+func (bbtrace *BBTraceParser) parseSources(first int, offset int64, length int) error {
+	initial_length := length
+	for _, src := range bbtrace.Sources[first:] {
+		var err error
+		length, err = bbtrace.parseSource(src, offset, length)
+		if err != nil {
+			return err
+		}
+		offset = 0
+		if initial_length > 0 && length == 0 {
+			bbtrace.doc.logf("INFO:\tstop by length (%d)\n", initial_length)
+			break
+		}
+	}
+
+	return nil
+}
+
+// parseSource parses src from offset, a non zero offset continues the
+// current threads as restored from a checkpoint.
+func (bbtrace *BBTraceParser) parseSource(src *BBTraceSource, offset int64, length int) (int, error) {
+	bin, err := OpenTrace(src.Filename)
 	if err != nil {
-		return err
+		return length, err
 	}
 	defer bin.Close()
 
-	bbtrace.Threads = make(map[uint16]*BBTraceThreadState)
+	bbtrace.doc.logf("INFO:\tparsing #%d %s (%s)\n", src.Index, src.Filename, bin.Format)
+	bbtrace.Current = src
+	bbtrace.Profile.Source = src.Index
+	bbtrace.offset = offset
+	if offset > 0 {
+		// offsets are within the raw chunk stream, compressed or not
+		if _, err := io.CopyN(io.Discard, bin, offset); err != nil {
+			return length, unexpectedEOF(err)
+		}
+	} else {
+		bbtrace.Threads = make(map[uint16]*BBTraceThreadState)
+		bbtrace.CurrentID = 0
+		src.Threads = bbtrace.Threads
+		src.StartNts = bbtrace.Nts
+	}
 
-	ok := true
-	bbtrace.Nts = 1
-	bbtrace.Fts = 1
-	initial_length := length
-	cur_ID := uint16(0)
+	defer func() {
+		bbtrace.EndParsing()
+		src.EndNts = bbtrace.Nts
+	}()
+
+	if bbtrace.Workers > 1 {
+		return bbtrace.parseReaderParallel(bin, length, bbtrace.Workers)
+	}
+	return bbtrace.parseReader(bin, length)
+}
+
+// BBTraceItem is a decoded record of a chunk, Kind is 0 for a BB hit.
+type BBTraceItem struct {
+	Kind   uint16
+	Index  int // word index within the chunk
+	PC     uint32
+	LastPC uint32
+	Name   string
+}
 
+// BBTraceChunk is a decoded 'ID' chunk, Err is set when decoding stopped early.
+type BBTraceChunk struct {
+	ID    uint16
+	Size  int
+	Items []BBTraceItem
+	Err   error
+}
+
+const chunkHeaderSize = 10 // 'ID', id, 'SZ', size
+
+// readChunk reads the next raw chunk, io.EOF only when no chunk is left.
+func readChunk(bin io.Reader) (uint16, []byte, error) {
 	buf32 := make([]byte, 4)
 	buf16 := make([]byte, 2)
 
-	defer bbtrace.EndParsing()
+	_, err := io.ReadFull(bin, buf16)
+	if err != nil {
+		return 0, nil, err
+	}
 
-	for ok {
-		_, err := bin.Read(buf16)
-		if err != nil {
-			if err != io.EOF {
-				return err
-			}
-			fmt.Println("INFO:\tstop by EOF")
-			break
-		}
+	kind := uint16(binary.LittleEndian.Uint16(buf16))
+	if kind != KIND_ID {
+		return 0, nil, fmt.Errorf("ERROR:\tunmatched kind 'ID', found: 0x%x", kind)
+	}
 
-		kind := uint16(binary.LittleEndian.Uint16(buf16))
-		if kind != KIND_ID {
-			return fmt.Errorf("ERROR:\tunmatched kind 'ID', found: 0x%x", kind)
-		}
+	_, err = io.ReadFull(bin, buf16)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	cur_ID := uint16(binary.LittleEndian.Uint16(buf16))
 
-		_, err = bin.Read(buf16)
-		if err != nil {
-			return err
+	_, err = io.ReadFull(bin, buf16)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	kind = uint16(binary.LittleEndian.Uint16(buf16))
+
+	if kind != KIND_SZ {
+		return 0, nil, fmt.Errorf("ERROR:\tunmatched kind 'SZ', found: 0x%x", kind)
+	}
+
+	_, err = io.ReadFull(bin, buf32)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	size := int(binary.LittleEndian.Uint32(buf32))
+
+	records := make([]byte, size*4)
+	_, err = io.ReadFull(bin, records)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+
+	return cur_ID, records, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// DecodeChunk splits the raw records of a chunk into items, it keeps no
+// state so chunks may be decoded concurrently.
+func DecodeChunk(cur_ID uint16, records []byte) *BBTraceChunk {
+	size := len(records) / 4
+	chunk := &BBTraceChunk{ID: cur_ID, Size: size}
+	kind := KIND_SZ
+
+	word := func(i int) (uint32, bool) {
+		if i >= size {
+			chunk.Err = fmt.Errorf("[%d] truncated record at #(%d/%d)", cur_ID, i, size)
+			return 0, false
 		}
-		cur_ID = uint16(binary.LittleEndian.Uint16(buf16))
+		return binary.LittleEndian.Uint32(records[i*4:]), true
+	}
 
-		_, err = bin.Read(buf16)
-		if err != nil {
-			return err
+	for i := 0; i < size; i++ {
+		var ok bool
+		last_kind := kind
+		pc, _ := word(i)
+		item := BBTraceItem{Index: i}
+
+		if (pc & 0xFFFF0000) == 0 {
+			kind = uint16(pc & 0xFFFF)
+			item.Kind = kind
+
+			if kind == KIND_START || kind == KIND_END {
+				i++
+				if item.PC, ok = word(i); !ok {
+					return chunk
+				}
+			} else if kind == KIND_NAME {
+				if last_kind != KIND_START {
+					chunk.Err = fmt.Errorf("unknown name for what last_kind: 0x%04x", last_kind)
+					return chunk
+				}
+				j := i + 1 + 8
+				if j > size {
+					chunk.Err = fmt.Errorf("[%d] truncated name at #(%d/%d)", cur_ID, i, size)
+					return chunk
+				}
+				str := records[(i+1)*4 : j*4]
+				i = j - 1
+				item.Name = string(str[0:FindFirstNull(str)])
+			} else {
+				chunk.Err = fmt.Errorf("[%d] unknown kind: 0x%04x", cur_ID, kind)
+				return chunk
+			}
+
+			chunk.Items = append(chunk.Items, item)
+			continue
 		}
-		kind = uint16(binary.LittleEndian.Uint16(buf16))
 
-		if kind != KIND_SZ {
-			return fmt.Errorf("ERROR:\tunmatched kind 'SZ', found: 0x%x", kind)
+		i++
+		item.PC = pc
+		if item.LastPC, ok = word(i); !ok {
+			return chunk
 		}
+		chunk.Items = append(chunk.Items, item)
+	}
 
-		_, err = bin.Read(buf32)
+	return chunk
+}
+
+func (bbtrace *BBTraceParser) parseReader(bin io.Reader, length int) (int, error) {
+	for {
+		cur_ID, records, err := readChunk(bin)
 		if err != nil {
-			return err
+			if err != io.EOF {
+				return length, err
+			}
+			bbtrace.doc.logf("INFO:\tstop by EOF\n")
+			break
 		}
-		size := int(binary.LittleEndian.Uint32(buf32))
 
-		records := make([]byte, size*4)
-		_, err = bin.Read(records)
-		if err != nil {
-			return err
+		var stop bool
+		length, stop, err = bbtrace.processChunk(DecodeChunk(cur_ID, records), length)
+		if err != nil || stop {
+			return length, err
+		}
+		if err := bbtrace.afterChunk(chunkHeaderSize + len(records)); err != nil {
+			return length, err
 		}
+	}
 
-		fmt.Printf("INFO:\t[%d] read record size=%d\n", cur_ID, size)
-		currentThread := bbtrace.SetCurrentThread(cur_ID)
+	return length, nil
+}
 
-		if currentThread.CallHistory != nil {
-			currentThread.CallHistory.AddMarker(bbtrace.Nts, currentThread.Name)
-			currentThread.CallHistory.Fts = bbtrace.Fts
-		}
-
-		for i := 0; i < size; i++ {
-			last_kind := kind
-
-			last_pc := uint32(0)
-			pc := binary.LittleEndian.Uint32(records[i*4:])
-
-			if (pc & 0xFFFF0000) == 0 {
-				kind = uint16(pc & 0xFFFF)
-
-				if kind == KIND_START {
-					i++
-					pc = binary.LittleEndian.Uint32(records[i*4:])
-
-					past_pc := bbtrace.SetCurrentThreadPC(pc)
-					fmt.Printf("INFO:\t[%d] #(%d/%d) KIND_START pc=0x%08x last_pc=0x%08x\n", cur_ID, i-1, size, pc, past_pc)
-				} else if kind == KIND_NAME {
-					i++
-					j := i + 8
-					str := records[i*4 : j*4]
-					i = j - 1
-					name := string(str[0:FindFirstNull(str)])
-					fmt.Printf("INFO:\t[%d] #(%d/%d) KIND_NAME name=%s\n", cur_ID, i-8, size, name)
-					if last_kind == KIND_START {
-						currentThread.Name = name
-
-						if currentThread.CallHistory != nil {
-							currentThread.CallHistory.AddMarker(bbtrace.Nts, currentThread.Name)
-						}
-					} else {
-						err := fmt.Errorf("unknown name for what last_kind: 0x%04x", last_kind)
-						return err
-					}
-
-					switch name {
-					case "idle0", "idle1", "SceIoAsync":
-						currentThread.Executing = false
-					}
-				} else if kind == KIND_END {
-					i++
-					end_pc := binary.LittleEndian.Uint32(records[i*4:])
-					fmt.Printf("INFO:\t[%d] #(%d/%d) KIND_END end_pc=0x%08x\n", cur_ID, i-1, size, end_pc)
-				} else {
-					err := fmt.Errorf("[%d] unknown kind: 0x%04x", cur_ID, kind)
-					return err
-				}
+// processChunk runs the items of a chunk in order, stop is set once length
+// records were parsed.
+func (bbtrace *BBTraceParser) processChunk(chunk *BBTraceChunk, length int) (int, bool, error) {
+	currentThread := bbtrace.beginChunk(chunk)
+	stop := false
 
-				continue
-			}
+	for k := range chunk.Items {
+		item := &chunk.Items[k]
+		if err := bbtrace.processItem(chunk, currentThread, item); err != nil {
+			return length, true, err
+		}
+		if item.Kind != 0 {
+			continue
+		}
+		if length, stop = countDown(length); stop {
+			break
+		}
+	}
 
-			i++
-			last_pc = binary.LittleEndian.Uint32(records[i*4:])
+	return bbtrace.endChunk(chunk, currentThread, length, stop)
+}
 
-			if currentThread.Executing {
-				param := BBTraceParam{
-					ID:     bbtrace.CurrentID,
-					Kind:   0,
-					PC:     pc,
-					LastPC: last_pc,
-					Nts:    bbtrace.Nts,
-				}
+// beginChunk switches to the thread of chunk.
+func (bbtrace *BBTraceParser) beginChunk(chunk *BBTraceChunk) *BBTraceThreadState {
+	bbtrace.doc.logf("INFO:\t[%d] read record size=%d\n", chunk.ID, chunk.Size)
+	currentThread := bbtrace.SetCurrentThread(chunk.ID)
+	bbtrace.Timeline.SwitchIn(bbtrace.Nts, bbtrace.sourceIndex(), currentThread)
 
-				//fmt.Printf("DEBUG:\t[%d] #(%d/%d) %d {0x%08x, 0x%08x}\n", cur_ID, i-1, size, param.Nts, param.PC, param.LastPC)
+	if currentThread.CallHistory != nil {
+		currentThread.CallHistory.AddMarker(bbtrace.Nts, currentThread.Name)
+		currentThread.CallHistory.Fts = bbtrace.Fts
+	}
+	return currentThread
+}
 
-				err := bbtrace.ParsingBB(param)
-				if err != nil {
-					return err
-				}
-			} else {
-				fmt.Printf("DEBUG:\t[%d] #(%d/%d) skip thread %s (0x%08x, 0x%08x)\n", cur_ID, i-1, size, currentThread.Name,
-					pc, last_pc)
-			}
+// processItem runs a thread event or a BB record of chunk.
+func (bbtrace *BBTraceParser) processItem(chunk *BBTraceChunk, currentThread *BBTraceThreadState, item *BBTraceItem) error {
+	cur_ID := chunk.ID
+	size := chunk.Size
+	i := item.Index
+
+	if item.Kind == KIND_START {
+		past_pc := bbtrace.SetCurrentThreadPC(item.PC)
+		currentThread.StartPC = item.PC
+		bbtrace.Timeline.OnStart(bbtrace.Nts, bbtrace.sourceIndex(), currentThread, item.PC)
+		bbtrace.doc.logf("INFO:\t[%d] #(%d/%d) KIND_START pc=0x%08x last_pc=0x%08x\n", cur_ID, i, size, item.PC, past_pc)
+		return nil
+	} else if item.Kind == KIND_NAME {
+		bbtrace.doc.logf("INFO:\t[%d] #(%d/%d) KIND_NAME name=%s\n", cur_ID, i, size, item.Name)
+		currentThread.Name = item.Name
+		bbtrace.Timeline.OnName(bbtrace.Nts, bbtrace.sourceIndex(), currentThread)
 
-			bbtrace.Nts++
+		if currentThread.CallHistory != nil {
+			currentThread.CallHistory.AddMarker(bbtrace.Nts, currentThread.Name)
+		}
 
-			if length > 0 {
-				length -= 1
-				if length == 0 {
-					ok = false
-					fmt.Printf("INFO:\tstop by length (%d)\n", initial_length)
-					break
-				}
-			}
+		switch item.Name {
+		case "idle0", "idle1", "SceIoAsync":
+			currentThread.Executing = false
 		}
+		return nil
+	} else if item.Kind == KIND_END {
+		bbtrace.doc.logf("INFO:\t[%d] #(%d/%d) KIND_END end_pc=0x%08x\n", cur_ID, i, size, item.PC)
+		currentThread.EndPC = item.PC
+		bbtrace.Timeline.OnEnd(bbtrace.Nts, bbtrace.sourceIndex(), currentThread, item.PC)
+		return nil
+	}
 
-		if currentThread.CallHistory != nil {
-			currentThread.CallHistory.AddMarker(bbtrace.Nts, currentThread.Name)
-			bbtrace.Fts = currentThread.CallHistory.Fts
+	if currentThread.Executing {
+		param := BBTraceParam{
+			ID:     bbtrace.CurrentID,
+			Kind:   0,
+			PC:     item.PC,
+			LastPC: item.LastPC,
+			Nts:    bbtrace.Nts,
+		}
+
+		//fmt.Printf("DEBUG:\t[%d] #(%d/%d) %d {0x%08x, 0x%08x}\n", cur_ID, i, size, param.Nts, param.PC, param.LastPC)
+
+		err := bbtrace.ParsingBB(param)
+		if err != nil {
+			return err
 		}
+	} else {
+		bbtrace.doc.logf("DEBUG:\t[%d] #(%d/%d) skip thread %s (0x%08x, 0x%08x)\n", cur_ID, i, size, currentThread.Name,
+			item.PC, item.LastPC)
 	}
 
+	bbtrace.Nts++
 	return nil
 }
 
+// endChunk closes the chunk on its thread, the error of a chunk decoded
+// part way is returned unless length ran out before it.
+func (bbtrace *BBTraceParser) endChunk(chunk *BBTraceChunk, currentThread *BBTraceThreadState, length int, stop bool) (int, bool, error) {
+	if currentThread.CallHistory != nil {
+		currentThread.CallHistory.AddMarker(bbtrace.Nts, currentThread.Name)
+		bbtrace.Fts = currentThread.CallHistory.Fts
+	}
+
+	if !stop && chunk.Err != nil {
+		return length, true, chunk.Err
+	}
+	return length, stop, nil
+}
+
+// countDown takes a parsed record off length, stop is set when it runs out.
+// A length of 0 or less is no limit.
+func countDown(length int) (int, bool) {
+	if length <= 0 {
+		return length, false
+	}
+	length -= 1
+	return length, length == 0
+}
+
+func (bbtrace *BBTraceParser) sourceIndex() int {
+	if bbtrace.Current == nil {
+		return 0
+	}
+	return bbtrace.Current.Index
+}
+
 func (bbtrace *BBTraceParser) SetCurrentThread(id uint16) *BBTraceThreadState {
 	if bbtrace.CurrentID == 0 || bbtrace.CurrentID != id {
 		bbtrace.CurrentID = id
 		if _, ok := bbtrace.Threads[bbtrace.CurrentID]; !ok {
-			bbtrace.Threads[bbtrace.CurrentID] = &BBTraceThreadState{
-				ID:          bbtrace.CurrentID,
-				RegSP:       0,
-				PC:          0,
-				Executing:   true,
-				FunGraph:    nil, //NewFunGraph(),
-				CallHistory: nil, //NewCallHistory(),
-				Stack:       new(Queue[*BBTraceStackItem]),
+			thread := &BBTraceThreadState{
+				ID:        bbtrace.CurrentID,
+				RegSP:     0,
+				PC:        0,
+				Executing: true,
+				Stack:     new(Queue[*BBTraceStackItem]),
+			}
+			if bbtrace.EnableFunGraph {
+				thread.FunGraph = NewFunGraph()
 			}
+			if bbtrace.EnableCallHistory {
+				thread.CallHistory = NewCallHistory()
+			}
+			bbtrace.Threads[bbtrace.CurrentID] = thread
 		}
 	}
 	return bbtrace.Threads[bbtrace.CurrentID]
@@ -327,9 +639,18 @@ func (bbtrace *BBTraceParser) ParsingBB(param BBTraceParam) error {
 	if err != nil {
 		return err
 	}
+	currentThread := bbtrace.Threads[bbtrace.CurrentID]
 
 	if param.LastPC == 0 {
-		// Usually start thread doesn't have last_pc
+		bbtrace.hitBB(currentThread, theBB.Address)
+
+		// Usually start thread doesn't have last_pc, within a running
+		// stack nothing branched here so the kernel delivered a callback
+		if currentThread.Stack.Len() > 0 {
+			bbtrace.addMismatch(currentThread, MismatchCallback, theBB.Address, 0)
+			bbtrace.OnEnterCallback(theBB)
+			return nil
+		}
 		bbtrace.OnEnterFunc(theBB, 0)
 		return nil
 	}
@@ -338,18 +659,21 @@ func (bbtrace *BBTraceParser) ParsingBB(param BBTraceParam) error {
 	if err != nil {
 		return err
 	}
+	bbtrace.hitBB(currentThread, theBB.Address)
 
 	lastBB := bbtrace.doc.BBManager.Get(param.LastPC)
 	if lastBB == nil {
 		return fmt.Errorf("unable to get last BB 0x%08x at 0x%08x", param.LastPC, theBB.Address)
 	}
 
-	brInstr := bbtrace.doc.InstrManager.Get(lastBB.BranchAddress)
+	brInstr := bbtrace.doc.Disasm(lastBB.BranchAddress)
 	if brInstr == nil {
 		return fmt.Errorf("unable to get lat Instruction at 0x%08x", lastBB.BranchAddress)
 	}
 
-	bbtrace.doc.BBManager.CreateReference(lastBB.Address, theBB.Address)
+	bbtrace.doc.BBManager.CreateReference(lastBB.Address, theBB.Address).
+		SetKind(bbtrace.doc.BBManager.ClassifyEdge(lastBB, theBB.Address)).
+		Visit()
 
 	if brInstr.Mnemonic == "jal" || brInstr.Mnemonic == "jalr" {
 		ra := brInstr.Address + 4
@@ -360,7 +684,19 @@ func (bbtrace *BBTraceParser) ParsingBB(param BBTraceParam) error {
 	} else if brInstr.Mnemonic == "jr" && brInstr.Args[0].Reg == "ra" {
 		bbtrace.OnLeaveFunc(theBB)
 	} else {
-		bbtrace.OnContinueNext(theBB)
+		var topFunc *SoraFunction
+		if currentThread.Stack.Len() > 0 {
+			topFunc = currentThread.Stack.Top().Fun
+		}
+		switch bbtrace.doc.FunManager.ClassifyJump(topFunc, brInstr, theBB.Address) {
+		case ReasonTailCall, ReasonJumpEntry:
+			bbtrace.OnTailCall(theBB, brInstr)
+		case ReasonSharedEpilogue:
+			bbtrace.doc.FunManager.ReportBoundary(BoundaryKeep, ReasonSharedEpilogue, theBB.Address, brInstr.Address)
+			bbtrace.OnContinueNext(theBB)
+		default:
+			bbtrace.OnContinueNext(theBB)
+		}
 	}
 
 	return nil
@@ -384,36 +720,26 @@ func (bbtrace *BBTraceParser) EnsureBB(bb_addr uint32) (*SoraBasicBlock, error)
 			return nil, err
 		}
 		theBB = splitBB
-		fmt.Printf("INFO:\tsplit bb at 0x%08x from original 0x%08x\n", splitBB.Address, prevBB.Address)
+		bbtrace.Profile.OnSplitBB(prevBB, splitBB)
+		bbtrace.doc.logf("INFO:\tsplit bb at 0x%08x from original 0x%08x\n", splitBB.Address, prevBB.Address)
 	}
 
 	return theBB, nil
 }
 
 func (bbtrace *BBTraceParser) OnEachBB(state BBAnalState) {
-	newBB := bbtrace.doc.BBManager.Get(state.BBAddr)
-
+	newBB := bbtrace.doc.BBManager.CreateRange(state.BBAddr, state.LastAddr, state.BranchAddr)
 	if newBB == nil {
-		newBB = bbtrace.doc.BBManager.Create(state.BBAddr)
-		if newBB == nil {
-			fmt.Printf("ERROR:\tunable to create BB at: 0x%08x, either already exists?\n", state.BBAddr)
-			return
-		} else {
-			newBB.LastAddress = state.LastAddr
-			newBB.BranchAddress = state.BranchAddr
-		}
-	} else if newBB.Address != state.BBAddr {
-		fmt.Printf("ERROR:\tfix me to split bb during OnEachBB at: 0x%08x\n", state.BBAddr)
-		return
+		bbtrace.doc.logf("ERROR:\tunable to create BB at: 0x%08x\n", state.BBAddr)
 	}
 }
 
 func (bbtrace *BBTraceParser) Debug(theBB *SoraBasicBlock, mode string) {
 	return
 
-	fmt.Printf("DEBUG: [%s]\n", mode)
+	bbtrace.doc.logf("DEBUG: [%s]\n", mode)
 	for addr := theBB.Address; addr <= theBB.LastAddress; addr += 4 {
-		instr := bbtrace.doc.InstrManager.Get(addr)
+		instr := bbtrace.doc.Disasm(addr)
 		fmt.Print("\t")
 		if instr.Address == theBB.BranchAddress {
 			fmt.Print("* ")
@@ -424,45 +750,47 @@ func (bbtrace *BBTraceParser) Debug(theBB *SoraBasicBlock, mode string) {
 	}
 }
 
-func (bbtrace *BBTraceParser) OnEnterFunc(theBB *SoraBasicBlock, ra uint32) {
-	currentThread := bbtrace.Threads[bbtrace.CurrentID]
-	parent_ID := FunGraphNodeID(0)
-
-	if currentThread.Stack.Len() > 0 {
-		if ra == 0 {
-			fmt.Printf("WARNING:\tundefined ra when entering func\n")
-		}
-		currentThread.Stack.Top().RA = ra
-		parent_ID = currentThread.Stack.Top().NodeID
-
-		if currentThread.CallHistory != nil {
-			level := currentThread.Stack.Len()
-			currentThread.CallHistory.EndBlock(level, bbtrace.Nts)
-		}
-	}
-
+// EnsureFunc returns the function starting at theBB, splitting or creating it when needed.
+func (bbtrace *BBTraceParser) EnsureFunc(theBB *SoraBasicBlock, reason BoundaryReason, from uint32) *SoraFunction {
 	theFunc := bbtrace.doc.FunManager.Get(theBB.Address)
 	if theFunc == nil {
-		fn_start := bbtrace.doc.SymMap.GetFunctionStart(theBB.Address)
+		fn_start := bbtrace.doc.FunManager.FunctionStart(theBB.Address)
 		if fn_start != 0 {
-			theFunc, _ = bbtrace.doc.FunManager.SplitAt(theBB.Address)
+			// the BB starts the second half of the split
+			_, theFunc = bbtrace.doc.FunManager.SplitAt(theBB.Address, reason, from)
 
 			if theFunc == nil {
-				fmt.Printf("ERROR:\tsplit func 0x%08x\n", theBB.Address)
+				bbtrace.doc.logf("ERROR:\tsplit func 0x%08x\n", theBB.Address)
 			}
 		} else {
 			theFunc = bbtrace.doc.FunManager.CreateNewFunction(theBB.Address, theBB.Size())
 
 			if theFunc == nil {
-				fmt.Printf("ERROR:\tunable to create func from bb 0x%08x\n", theBB.Address)
+				bbtrace.doc.logf("ERROR:\tunable to create func from bb 0x%08x\n", theBB.Address)
 			}
 		}
 	}
+	return theFunc
+}
+
+func (bbtrace *BBTraceParser) pushFunc(theBB *SoraBasicBlock, theFunc *SoraFunction, parent_ID FunGraphNodeID, callback bool) {
+	currentThread := bbtrace.Threads[bbtrace.CurrentID]
 
 	theFunc.AddBB(theBB.Address)
 
+	ra := uint32(0)
+	if currentThread.Stack.Len() > 0 && !callback {
+		ra = currentThread.Stack.Top().RA
+	}
+
 	stack_item := NewStackItem(theBB)
 	stack_item.Fun = theFunc
+	stack_item.SP = currentThread.RegSP
+	stack_item.Callback = callback
+
+	if frame := bbtrace.doc.FunManager.GetStackFrame(theFunc); frame != nil {
+		currentThread.RegSP -= frame.Size
+	}
 
 	if currentThread.FunGraph != nil {
 		node := currentThread.FunGraph.AddNode(theBB.Address, parent_ID)
@@ -471,11 +799,56 @@ func (bbtrace *BBTraceParser) OnEnterFunc(theBB *SoraBasicBlock, ra uint32) {
 	}
 
 	currentThread.Stack.Push(stack_item)
+	if bbtrace.OnEvent != nil {
+		bbtrace.emit(TraceEnter, currentThread, theFunc.Address, theFunc)
+	}
 
 	if currentThread.CallHistory != nil {
 		level := currentThread.Stack.Len()
-		currentThread.CallHistory.AddBlock(level, bbtrace.Nts, theBB.Address, theFunc.Name)
+		if block := currentThread.CallHistory.AddBlock(level, bbtrace.Nts, theBB.Address, theFunc.Name); block != nil {
+			block.RA = ra
+		}
+	}
+}
+
+func (bbtrace *BBTraceParser) onPopped(thread *BBTraceThreadState, left *BBTraceStackItem) {
+	if bbtrace.OnEvent != nil && left.Fun != nil {
+		bbtrace.emit(TraceLeave, thread, left.Fun.Address, left.Fun)
 	}
+}
+
+func (bbtrace *BBTraceParser) OnEnterFunc(theBB *SoraBasicBlock, ra uint32) {
+	bbtrace.enterFunc(theBB, ra, false)
+}
+
+// OnEnterCallback pushes the callback delivered while the top of the stack
+// runs, the RA of the interrupted frame stays as it was.
+func (bbtrace *BBTraceParser) OnEnterCallback(theBB *SoraBasicBlock) {
+	bbtrace.enterFunc(theBB, 0, true)
+}
+
+func (bbtrace *BBTraceParser) enterFunc(theBB *SoraBasicBlock, ra uint32, callback bool) {
+	currentThread := bbtrace.Threads[bbtrace.CurrentID]
+	parent_ID := FunGraphNodeID(0)
+	lastBranch := uint32(0)
+
+	if currentThread.Stack.Len() > 0 {
+		if !callback {
+			currentThread.Stack.Top().RA = ra
+		}
+		parent_ID = currentThread.Stack.Top().NodeID
+		if ra != 0 {
+			lastBranch = ra - 8
+		}
+
+		if currentThread.CallHistory != nil {
+			level := currentThread.Stack.Len()
+			currentThread.CallHistory.EndBlock(level, bbtrace.Nts)
+		}
+	}
+
+	theFunc := bbtrace.EnsureFunc(theBB, ReasonCallEntry, lastBranch)
+	bbtrace.pushFunc(theBB, theFunc, parent_ID, callback)
 
 	//fmt.Printf("INFO:\tenter func bb 0x%08x ra=0x%08x", theBB.Address, ra)
 	//if theFunc != nil {
@@ -492,41 +865,96 @@ func (bbtrace *BBTraceParser) OnLeaveFunc(theBB *SoraBasicBlock) {
 		level := currentThread.Stack.Len()
 		currentThread.CallHistory.EndBlock(level, bbtrace.Nts)
 	}
-	_ = currentThread.Stack.Pop()
+	left := currentThread.Stack.Pop()
+	currentThread.RegSP = left.SP
+	bbtrace.onPopped(currentThread, left)
 
 	if currentThread.Stack.Len() > 0 {
 		expected_ra := currentThread.Stack.Top().RA
 
+		if left.Callback && expected_ra != theBB.Address {
+			// back into the kernel, the interrupted frame resumes later
+			mismatch := bbtrace.addMismatch(currentThread, MismatchCallbackReturn, theBB.Address, expected_ra)
+			if left.Fun != nil {
+				mismatch.Leaving = left.Fun.Name
+			}
+			bbtrace.Debug(theBB, "callback return")
+			return
+		}
+
 		if expected_ra != theBB.Address {
-			fmt.Printf("WARNING:\tunexpected ra 0x%08x, expecting 0x%08x\n--- callback? ---\n", theBB.Address, expected_ra)
+			kind, unwound := bbtrace.ClassifyReturn(currentThread, theBB.Address, expected_ra)
+			mismatch := bbtrace.addMismatch(currentThread, kind, theBB.Address, expected_ra)
+			mismatch.Unwound = unwound
+			if left.Fun != nil {
+				mismatch.Leaving = left.Fun.Name
+			}
 
-			bbtrace.OnEnterFunc(theBB, expected_ra)
-		} else {
-			past_bb := currentThread.Stack.Top().Address()
-			currentThread.Stack.Top().SetAddress(theBB)
-			//fmt.Printf("INFO:\tleave bb 0x%08x\n", past_top.Address())
+			switch kind {
+			case MismatchUnwind:
+				bbtrace.unwind(currentThread, unwound)
+			case MismatchCallback:
+				bbtrace.OnEnterCallback(theBB)
+				return
+			default:
+				// no frame to go back to, the caller keeps running from the
+				// target and no function is made of it
+				currentThread.Stack.Top().SetAddress(theBB)
+				bbtrace.Debug(theBB, "resync")
+				return
+			}
+		}
 
-			bbtrace.doc.BBManager.CreateReference(past_bb, theBB.Address).SetAdjacent(true)
+		past_bb := currentThread.Stack.Top().Address()
+		currentThread.Stack.Top().SetAddress(theBB)
+		//fmt.Printf("INFO:\tleave bb 0x%08x\n", past_top.Address())
 
-			if currentThread.CallHistory != nil {
-				level := currentThread.Stack.Len()
-				currentThread.CallHistory.EndBlock(level, bbtrace.Nts)
-			}
+		bbtrace.doc.BBManager.CreateReference(past_bb, theBB.Address).SetKind(RefFallthrough).Visit()
 
-			bbtrace.Debug(theBB, "leave")
+		if currentThread.CallHistory != nil {
+			level := currentThread.Stack.Len()
+			currentThread.CallHistory.EndBlock(level, bbtrace.Nts)
 		}
+
+		bbtrace.Debug(theBB, "leave")
 	} else {
 		myFunc := bbtrace.doc.FunManager.Get(theBB.Address)
-		fmt.Printf("INFO:\tend of stack, goto: 0x%08x", theBB.Address)
+		name := ""
 		if myFunc != nil {
-			fmt.Printf(" name: %s", myFunc.Name)
+			name = " name: " + myFunc.Name
 		}
-		fmt.Println()
+		bbtrace.doc.logf("INFO:\tend of stack, goto: 0x%08x%s\n", theBB.Address, name)
 
 		bbtrace.Debug(theBB, "end")
 	}
 }
 
+// OnTailCall replaces the top of the stack, the callee returns to our caller.
+func (bbtrace *BBTraceParser) OnTailCall(theBB *SoraBasicBlock, brInstr *SoraInstruction) {
+	currentThread := bbtrace.Threads[bbtrace.CurrentID]
+
+	if currentThread.CallHistory != nil {
+		level := currentThread.Stack.Len()
+		currentThread.CallHistory.EndBlock(level, bbtrace.Nts)
+	}
+	left := currentThread.Stack.Pop()
+	currentThread.RegSP = left.SP
+	bbtrace.onPopped(currentThread, left)
+
+	parent_ID := FunGraphNodeID(0)
+	if currentThread.FunGraph != nil {
+		parent_ID = currentThread.FunGraph.At(left.NodeID).ParentID
+	}
+
+	theFunc := bbtrace.EnsureFunc(theBB, ReasonJumpEntry, brInstr.Address)
+	if theFunc.Address == theBB.Address {
+		bbtrace.doc.FunManager.ReportBoundary(BoundaryKeep, ReasonTailCall, theBB.Address, brInstr.Address)
+	}
+	bbtrace.pushFunc(theBB, theFunc, parent_ID, left.Callback)
+
+	bbtrace.Debug(theBB, "tailcall")
+}
+
 func (bbtrace *BBTraceParser) OnContinueNext(theBB *SoraBasicBlock) {
 	currentThread := bbtrace.Threads[bbtrace.CurrentID]
 	currentThread.Stack.Top().SetAddress(theBB)
@@ -558,6 +986,7 @@ func (bbtrace *BBTraceParser) OnMergingPastToLast(last_pc uint32) error {
 		}
 
 		if n > 0 {
+			bbtrace.hitBB(currentThread, pastBB.Address)
 			currentThread.Stack.Top().SetAddress(pastBB)
 			bbtrace.Debug(pastBB, "merging")
 		} else {
@@ -569,7 +998,7 @@ func (bbtrace *BBTraceParser) OnMergingPastToLast(last_pc uint32) error {
 		next_addr := pastBB.LastAddress + 4
 
 		if pastBB.BranchAddress != 0 {
-			pastBrInstr := bbtrace.doc.InstrManager.Get(pastBB.BranchAddress)
+			pastBrInstr := bbtrace.doc.Disasm(pastBB.BranchAddress)
 
 			if pastBrInstr == nil {
 				return fmt.Errorf("no branch instr for past BB at 0x%08x", pastBB.BranchAddress)
@@ -588,7 +1017,7 @@ func (bbtrace *BBTraceParser) OnMergingPastToLast(last_pc uint32) error {
 			if pastBrInstr.Info.IsConditional {
 				next_addr = pastBB.LastAddress + 4
 				if pastBrInstr.Info.IsBranchToRegister {
-					fmt.Printf("WARNING:\tunimplemented conditional register branch for merging\n")
+					bbtrace.doc.logf("WARNING:\tunimplemented conditional register branch for merging\n")
 				}
 			} else {
 				if pastBrInstr.Info.IsBranchToRegister {
@@ -601,7 +1030,9 @@ func (bbtrace *BBTraceParser) OnMergingPastToLast(last_pc uint32) error {
 				}
 			}
 		}
-		bbtrace.doc.BBManager.CreateReference(pastBB.Address, next_addr).SetAdjacent(true)
+		bbtrace.doc.BBManager.CreateReference(pastBB.Address, next_addr).
+			SetKind(bbtrace.doc.BBManager.ClassifyEdge(pastBB, next_addr)).
+			Visit()
 		past_addr = next_addr
 	}
 
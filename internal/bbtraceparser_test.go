@@ -1,6 +1,10 @@
 package internal
 
 import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/davecgh/go-spew/spew"
@@ -35,3 +39,127 @@ func TestBytesToString(t *testing.T) {
 	spew.Dump(z)
 	assert.True(t, true)
 }
+
+// testTraceChunk is one 'ID' chunk, Words are the raw records.
+type testTraceChunk struct {
+	ID    uint16
+	Words []uint32
+}
+
+func traceRecord(pc, last_pc uint32) []uint32 { return []uint32{pc, last_pc} }
+func traceStart(pc uint32) []uint32           { return []uint32{uint32(KIND_START), pc} }
+func traceEnd(end_pc uint32) []uint32         { return []uint32{uint32(KIND_END), end_pc} }
+
+func traceName(name string) []uint32 {
+	str := make([]byte, 32)
+	copy(str, name)
+	words := []uint32{uint32(KIND_NAME)}
+	for i := 0; i < 8; i++ {
+		words = append(words, binary.LittleEndian.Uint32(str[i*4:]))
+	}
+	return words
+}
+
+func traceChunk(id uint16, records ...[]uint32) testTraceChunk {
+	chunk := testTraceChunk{ID: id}
+	for _, rec := range records {
+		chunk.Words = append(chunk.Words, rec...)
+	}
+	return chunk
+}
+
+func encodeTestTrace(chunks ...testTraceChunk) []byte {
+	var buf bytes.Buffer
+	for _, chunk := range chunks {
+		binary.Write(&buf, binary.LittleEndian, KIND_ID)
+		binary.Write(&buf, binary.LittleEndian, chunk.ID)
+		binary.Write(&buf, binary.LittleEndian, KIND_SZ)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(chunk.Words)))
+		binary.Write(&buf, binary.LittleEndian, chunk.Words)
+	}
+	return buf.Bytes()
+}
+
+func writeTestTrace(t *testing.T, path string, chunks ...testTraceChunk) {
+	assert.NoError(t, os.WriteFile(path, encodeTestTrace(chunks...), 0644))
+}
+
+func TestParseMultipleSources(t *testing.T) {
+	dir := t.TempDir()
+	doc := newTestDocument()
+	putLeafFunction(doc, "boot", 0x8804000)
+	putLeafFunction(doc, "battle", 0x8804100)
+
+	writeTestTrace(t, filepath.Join(dir, "boot.rec"), traceChunk(1, traceRecord(0x8804000, 0)))
+	writeTestTrace(t, filepath.Join(dir, "battle.rec"),
+		traceChunk(1, traceRecord(0x8804000, 0), traceRecord(0x8804100, 0)))
+
+	doc.Parser.SetTraceFiles([]string{filepath.Join(dir, "boot.rec"), filepath.Join(dir, "battle.rec")})
+	assert.NoError(t, doc.Parser.Parse(0))
+
+	prof := doc.Parser.Profile
+	assert.Equal(t, int64(2), prof.BBCounts[0x8804000])
+	assert.Equal(t, []int{0, 1}, prof.SourcesOfBB(0x8804000))
+	assert.Equal(t, []int{1}, prof.SourcesOfBB(0x8804100))
+	assert.Equal(t, []uint32{0x8804100}, prof.ReachedOnlyBy(1))
+
+	src := doc.Parser.Sources[1]
+	assert.Equal(t, RefTs(2), src.StartNts)
+	assert.Equal(t, RefTs(4), src.EndNts)
+	assert.Len(t, src.Threads, 1)
+	assert.NotSame(t, doc.Parser.Sources[0].Threads[1], src.Threads[1])
+}
+
+func TestParseLog(t *testing.T) {
+	dir := t.TempDir()
+	doc := newTestDocument()
+	putLeafFunction(doc, "main", 0x8804000)
+	writeTestTrace(t, filepath.Join(dir, "trace.rec"),
+		traceChunk(1, traceStart(0x8804000), traceRecord(0x8804000, 0)))
+
+	var log bytes.Buffer
+	doc.Log = &log
+	doc.Parser.SetTraceFiles([]string{filepath.Join(dir, "trace.rec")})
+	assert.NoError(t, doc.Parser.Parse(0))
+	assert.Contains(t, log.String(), "INFO:\t[1] #(0/4) KIND_START pc=0x08804000")
+	assert.Contains(t, log.String(), "INFO:\tstop by EOF\n")
+}
+
+func TestParseAgainResetsVisits(t *testing.T) {
+	dir := t.TempDir()
+	doc := newTestDocument()
+	putCaller(doc, "main", 0x8804000, 0x8805000)
+	putLeafFunction(doc, "leaf", 0x8805000)
+
+	writeTestTrace(t, filepath.Join(dir, "trace.rec"), traceChunk(1,
+		traceRecord(0x8804000, 0),
+		traceRecord(0x8805000, 0x8804004),
+		traceRecord(0x8804008, 0x8805004),
+	))
+	doc.Parser.SetTraceFiles([]string{filepath.Join(dir, "trace.rec")})
+
+	assert.NoError(t, doc.Parser.Parse(0))
+	ref := doc.BBManager.GetReference(0x8804000, 0x8805000)
+	if !assert.NotNil(t, ref) {
+		return
+	}
+	assert.Equal(t, int64(1), ref.VisitCount)
+
+	assert.NoError(t, doc.Parser.Parse(0))
+	assert.Equal(t, int64(1), doc.Parser.Profile.BBCounts[0x8805000])
+	assert.Equal(t, int64(1), ref.VisitCount)
+}
+
+func TestEnsureFuncSplitsInside(t *testing.T) {
+	doc := newTestDocument()
+	outer := putFunction(doc, "outer", 0x8804000, 0x20)
+
+	theBB := &SoraBasicBlock{Address: 0x8804010, LastAddress: 0x880401c}
+	theFunc := doc.Parser.EnsureFunc(theBB, ReasonCallEntry, 0x8804100)
+
+	if assert.NotNil(t, theFunc) {
+		assert.Equal(t, uint32(0x8804010), theFunc.Address)
+		assert.Equal(t, uint32(0x10), theFunc.Size)
+	}
+	assert.Equal(t, uint32(0x10), outer.Size)
+}
@@ -11,6 +11,7 @@ type BlockGraph struct {
 	Start, Stop  RefTs
 	Fts, FtsStop RefTs
 	Text         string
+	RA           uint32 // where the block returns to in its caller
 }
 
 func (b *BlockGraph) End(n RefTs) {
@@ -78,6 +79,36 @@ func (c *CallHistory) StackAt(level int) *StackGraph {
 	return c.stackGraphs[level]
 }
 
+// ActiveAt returns the block of level running at n, nil if none.
+func (s *StackGraph) ActiveAt(n RefTs) *BlockGraph {
+	floor, _ := s.blockGraphs.FloorCeil(n)
+	if floor.End() || floor.Value().Stop <= n {
+		return nil
+	}
+	return floor.Value()
+}
+
+// BlocksAt lists the running block of every level at n, from the outermost.
+func (c *CallHistory) BlocksAt(n RefTs) []*BlockGraph {
+	var blocks []*BlockGraph
+	for level := 1; level <= c.MaxLevel(); level++ {
+		b := c.stackGraphs[level].ActiveAt(n)
+		if b == nil {
+			break
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+func (c *CallHistory) ForEachBlock(f func(level int, b *BlockGraph)) {
+	for level := 1; level <= c.MaxLevel(); level++ {
+		for it := c.stackGraphs[level].blockGraphs.Min(); !it.End(); it = it.Next() {
+			f(level, it.Value())
+		}
+	}
+}
+
 func (c *CallHistory) MaxLevel() int {
 	return len(c.stackGraphs) - 1
 }
@@ -119,6 +150,9 @@ func (c *CallHistory) AddBlock(level int, n RefTs, addr uint32, text string) *Bl
 	}
 
 	block := stack_graph.Add(n, addr, text)
+	if block == nil {
+		return nil
+	}
 	block.Fts = c.Fts
 	c.Fts++
 	return block
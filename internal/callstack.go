@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+)
+
+type CallStackFrame struct {
+	Level    int
+	Address  uint32
+	Name     string
+	Function *SoraFunction
+	Entered  RefTs
+	RA       uint32
+}
+
+// FunctionEntry is one time a function was entered.
+type FunctionEntry struct {
+	Source     int
+	ThreadID   uint16
+	ThreadName string
+	Nts        RefTs
+	Level      int
+	RA         uint32
+}
+
+func (bbtrace *BBTraceParser) threadOf(src int, id uint16) (*BBTraceThreadState, error) {
+	if src < 0 || src >= len(bbtrace.Sources) {
+		return nil, fmt.Errorf("no trace source #%d", src)
+	}
+	thread, ok := bbtrace.Sources[src].Threads[id]
+	if !ok {
+		return nil, fmt.Errorf("no thread %d in trace source #%d", id, src)
+	}
+	if thread.CallHistory == nil {
+		return nil, fmt.Errorf("thread %d in trace source #%d has no call history", id, src)
+	}
+	return thread, nil
+}
+
+// CallStackAt rebuilds the call stack of a thread at n from its CallHistory,
+// the outermost frame first. It needs EnableCallHistory while parsing.
+func (bbtrace *BBTraceParser) CallStackAt(src int, id uint16, n RefTs) ([]CallStackFrame, error) {
+	thread, err := bbtrace.threadOf(src, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []CallStackFrame
+	for i, b := range thread.CallHistory.BlocksAt(n) {
+		frame := CallStackFrame{
+			Level:   i + 1,
+			Address: b.Address,
+			Name:    b.Text,
+			Entered: b.Start,
+			RA:      b.RA,
+		}
+		frame.Function = bbtrace.doc.FunManager.FindByAddress(b.Address)
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+func (bbtrace *BBTraceParser) buildEntryIndex() {
+	bbtrace.entryIndex = make(map[uint32][]FunctionEntry)
+	for _, src := range bbtrace.Sources {
+		for _, thread := range src.Threads {
+			if thread.CallHistory == nil {
+				continue
+			}
+			thread.CallHistory.ForEachBlock(func(level int, b *BlockGraph) {
+				bbtrace.entryIndex[b.Address] = append(bbtrace.entryIndex[b.Address], FunctionEntry{
+					Source:     src.Index,
+					ThreadID:   thread.ID,
+					ThreadName: thread.Name,
+					Nts:        b.Start,
+					Level:      level,
+					RA:         b.RA,
+				})
+			})
+		}
+	}
+
+	for _, entries := range bbtrace.entryIndex {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Nts < entries[j].Nts })
+	}
+}
+
+// FunctionEntries lists every time the function at fun_addr was entered, by Nts.
+func (bbtrace *BBTraceParser) FunctionEntries(fun_addr uint32) []FunctionEntry {
+	if bbtrace.entryIndex == nil {
+		bbtrace.buildEntryIndex()
+	}
+	return bbtrace.entryIndex[fun_addr]
+}
+
+func (bbtrace *BBTraceParser) DumpCallStackAt(src int, id uint16, n RefTs) {
+	frames, err := bbtrace.CallStackAt(src, id, n)
+	if err != nil {
+		bbtrace.doc.logf("ERROR:\t%s\n", err)
+		return
+	}
+	fmt.Printf("Call Stack #%d thread %d at %d\n", src, id, n)
+	for i := len(frames) - 1; i >= 0; i-- {
+		frame := frames[i]
+		fmt.Printf("\t#%d 0x%08x %s entered=%d ra=0x%08x\n", frame.Level, frame.Address, frame.Name, frame.Entered, frame.RA)
+	}
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallStackAt(t *testing.T) {
+	dir := t.TempDir()
+	doc := newTestDocument()
+	putCaller(doc, "main", 0x8804000, 0x8805000)
+	putCaller(doc, "sub", 0x8805000, 0x8806000)
+	putLeafFunction(doc, "leaf", 0x8806000)
+
+	writeTestTrace(t, filepath.Join(dir, "trace.rec"),
+		traceChunk(1,
+			traceRecord(0x8804000, 0),
+			traceRecord(0x8805000, 0x8804004),
+			traceRecord(0x8806000, 0x8805004),
+			traceRecord(0x8805008, 0x8806004),
+			traceRecord(0x8804008, 0x880500C),
+		),
+		traceChunk(2, traceRecord(0x8805000, 0)),
+	)
+
+	doc.Parser.EnableCallHistory = true
+	doc.Parser.SetTraceFiles([]string{filepath.Join(dir, "trace.rec")})
+	assert.NoError(t, doc.Parser.Parse(0))
+
+	frames, err := doc.Parser.CallStackAt(0, 1, 3)
+	assert.NoError(t, err)
+	assert.Len(t, frames, 3)
+	assert.Equal(t, "main", frames[0].Name)
+	assert.Equal(t, uint32(0x8804008), frames[1].RA)
+	assert.Equal(t, "leaf", frames[2].Function.Name)
+	assert.Equal(t, uint32(0x8805008), frames[2].RA)
+	assert.Equal(t, RefTs(3), frames[2].Entered)
+
+	frames, _ = doc.Parser.CallStackAt(0, 1, 4)
+	assert.Len(t, frames, 2)
+	frames, _ = doc.Parser.CallStackAt(0, 1, 5)
+	assert.Len(t, frames, 1)
+
+	_, err = doc.Parser.CallStackAt(0, 3, 1)
+	assert.Error(t, err)
+
+	entries := doc.Parser.FunctionEntries(0x8805000)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, RefTs(2), entries[0].Nts)
+	assert.Equal(t, 2, entries[0].Level)
+	assert.Equal(t, uint16(2), entries[1].ThreadID)
+	assert.Equal(t, RefTs(6), entries[1].Nts)
+	assert.Empty(t, doc.Parser.FunctionEntries(0x8807000))
+}
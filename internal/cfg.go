@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CFGBlock is a block of a function's control flow graph, Succs and Preds
+// are indices into FunctionCFG.Blocks.
+type CFGBlock struct {
+	Index         int
+	Address       uint32
+	LastAddress   uint32
+	BranchAddress uint32
+	Succs         []int
+	Preds         []int
+	Visits        int64
+	Exit          bool // returns or leaves the function
+}
+
+// FunctionCFG is the intra-procedural graph of one function, calls fall
+// through to their return site. Blocks are sorted by address and Blocks[0]
+// is the entry.
+type FunctionCFG struct {
+	Fun    *SoraFunction
+	Blocks []*CFGBlock
+
+	anal  *FunctionAnalyzer
+	index map[uint32]int
+
+	// filled by Dominators and PostDominators
+	Idom  []int
+	Ipdom []int
+	rpo   []int
+}
+
+func (cfg *FunctionCFG) BlockAt(addr uint32) *CFGBlock {
+	i := sort.Search(len(cfg.Blocks), func(i int) bool { return cfg.Blocks[i].LastAddress >= addr })
+	if i < len(cfg.Blocks) && cfg.Blocks[i].Address <= addr {
+		return cfg.Blocks[i]
+	}
+	return nil
+}
+
+func (cfg *FunctionCFG) inside(addr uint32) bool {
+	return addr >= cfg.Fun.Address && addr <= cfg.Fun.LastAddress()
+}
+
+func (cfg *FunctionCFG) addEdge(from *CFGBlock, to_addr uint32) {
+	to, ok := cfg.index[to_addr]
+	if !ok {
+		return
+	}
+	for _, succ := range from.Succs {
+		if succ == to {
+			return
+		}
+	}
+	from.Succs = append(from.Succs, to)
+	cfg.Blocks[to].Preds = append(cfg.Blocks[to].Preds, from.Index)
+}
+
+// BuildCFG splits fun at branches, branch targets and the blocks the trace
+// found, and links them by the branches and the trace refs.
+func (anal *FunctionAnalyzer) BuildCFG() *FunctionCFG {
+	doc := anal.doc
+	fun := anal.fun
+	cfg := &FunctionCFG{Fun: fun, anal: anal, index: make(map[uint32]int)}
+
+	leaders := map[uint32]bool{fun.Address: true}
+	ends := make(map[uint32]uint32) // last address -> branch address
+	doc.BBManager.ForEachIn(fun.Address, fun.LastAddress(), func(bb *SoraBasicBlock) {
+		if cfg.inside(bb.Address) {
+			leaders[bb.Address] = true
+		}
+		if cfg.inside(bb.LastAddress + 4) {
+			leaders[bb.LastAddress+4] = true
+		}
+	})
+
+	for addr := fun.Address; addr <= fun.LastAddress(); addr += 4 {
+		instr := doc.Disasm(addr)
+		if instr == nil || !instr.Info.IsBranch {
+			continue
+		}
+		last := addr
+		if instr.Info.HasDelaySlot {
+			last += 4
+		}
+		ends[last] = addr
+		if cfg.inside(last + 4) {
+			leaders[last+4] = true
+		}
+		if !instr.Info.IsBranchToRegister && !instr.Info.IsLinkedBranch && cfg.inside(instr.Info.BranchTarget) {
+			leaders[instr.Info.BranchTarget] = true
+		}
+		addr = last
+	}
+
+	var starts []uint32
+	for addr := range leaders {
+		starts = append(starts, addr)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	for i, start := range starts {
+		last := fun.LastAddress()
+		if i+1 < len(starts) {
+			last = starts[i+1] - 4
+		}
+		block := &CFGBlock{Index: len(cfg.Blocks), Address: start, LastAddress: last}
+		if branch, ok := ends[last]; ok {
+			block.BranchAddress = branch
+		}
+		if doc.Parser != nil && doc.Parser.Profile != nil {
+			block.Visits = doc.Parser.Profile.BBCounts[start]
+		}
+		cfg.index[start] = block.Index
+		cfg.Blocks = append(cfg.Blocks, block)
+	}
+
+	for _, block := range cfg.Blocks {
+		fallthrough_ok := true
+		if block.BranchAddress != 0 {
+			instr := doc.Disasm(block.BranchAddress)
+			info := instr.Info
+			switch {
+			case info.IsLinkedBranch:
+			case info.IsBranchToRegister:
+				fallthrough_ok = false
+				block.Exit = isReturnInstr(instr)
+			default:
+				if cfg.inside(info.BranchTarget) {
+					cfg.addEdge(block, info.BranchTarget)
+				} else {
+					block.Exit = true
+				}
+				fallthrough_ok = info.IsConditional
+			}
+		}
+		if fallthrough_ok {
+			if cfg.inside(block.LastAddress + 4) {
+				cfg.addEdge(block, block.LastAddress+4)
+			} else {
+				block.Exit = true
+			}
+		}
+	}
+
+	// indirect jumps and anything else the trace saw
+	doc.BBManager.ForEachIn(fun.Address, fun.LastAddress(), func(bb *SoraBasicBlock) {
+		if !cfg.inside(bb.Address) {
+			return
+		}
+		from := cfg.BlockAt(bb.LastAddress)
+		if from == nil {
+			return
+		}
+		for _, to_addr := range doc.BBManager.RefsFrom(bb.Address) {
+			ref := doc.BBManager.GetReference(bb.Address, to_addr)
+			if ref == nil || ref.Kind == RefCall || ref.Kind == RefReturn || ref.IsLinked {
+				continue
+			}
+			if cfg.inside(to_addr) {
+				cfg.addEdge(from, to_addr)
+			}
+		}
+	})
+
+	return cfg
+}
+
+// ReversePostorder lists the blocks reachable from the entry.
+func (cfg *FunctionCFG) ReversePostorder() []int {
+	if cfg.rpo != nil {
+		return cfg.rpo
+	}
+	visited := make([]bool, len(cfg.Blocks))
+	var post []int
+	var walk func(i int)
+	walk = func(i int) {
+		visited[i] = true
+		for _, succ := range cfg.Blocks[i].Succs {
+			if !visited[succ] {
+				walk(succ)
+			}
+		}
+		post = append(post, i)
+	}
+	if len(cfg.Blocks) > 0 {
+		walk(0)
+	}
+	for i, j := 0, len(post)-1; i < j; i, j = i+1, j-1 {
+		post[i], post[j] = post[j], post[i]
+	}
+	cfg.rpo = post
+	return post
+}
+
+// Dominators computes the immediate dominator of every block, -1 for the
+// entry and unreachable blocks.
+func (cfg *FunctionCFG) Dominators() []int {
+	if cfg.Idom != nil {
+		return cfg.Idom
+	}
+	cfg.Idom = iterativeIdom(len(cfg.Blocks), cfg.ReversePostorder(), func(i int) []int {
+		return cfg.Blocks[i].Preds
+	})
+	return cfg.Idom
+}
+
+// PostDominators computes the immediate post-dominator of every block, -1
+// when it is only the function's exit or the block never reaches an exit.
+func (cfg *FunctionCFG) PostDominators() []int {
+	if cfg.Ipdom != nil {
+		return cfg.Ipdom
+	}
+
+	// the virtual exit is len(Blocks), the successor of every exit block
+	exit := len(cfg.Blocks)
+	var exits []int
+	for _, block := range cfg.Blocks {
+		if block.Exit || len(block.Succs) == 0 {
+			exits = append(exits, block.Index)
+		}
+	}
+	succs := func(i int) []int {
+		if i == exit {
+			return nil
+		}
+		if cfg.Blocks[i].Exit || len(cfg.Blocks[i].Succs) == 0 {
+			return append(cfg.Blocks[i].Succs[:len(cfg.Blocks[i].Succs):len(cfg.Blocks[i].Succs)], exit)
+		}
+		return cfg.Blocks[i].Succs
+	}
+
+	visited := make([]bool, exit+1)
+	var post []int
+	var walk func(i int)
+	walk = func(i int) {
+		visited[i] = true
+		preds := exits
+		if i != exit {
+			preds = cfg.Blocks[i].Preds
+		}
+		for _, pred := range preds {
+			if !visited[pred] {
+				walk(pred)
+			}
+		}
+		post = append(post, i)
+	}
+	walk(exit)
+	for i, j := 0, len(post)-1; i < j; i, j = i+1, j-1 {
+		post[i], post[j] = post[j], post[i]
+	}
+
+	ipdom := iterativeIdom(exit+1, post, succs)
+	for i, p := range ipdom {
+		if p == exit {
+			ipdom[i] = -1
+		}
+	}
+	cfg.Ipdom = ipdom[:exit]
+	return cfg.Ipdom
+}
+
+// iterativeIdom is Cooper, Harvey and Kennedy's dominator algorithm over n
+// nodes, rpo starts at the root and preds gives the incoming edges.
+func iterativeIdom(n int, rpo []int, preds func(i int) []int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = -1
+	}
+	for k, i := range rpo {
+		order[i] = k
+	}
+
+	idom := make([]int, n)
+	for i := range idom {
+		idom[i] = -1
+	}
+	if len(rpo) == 0 {
+		return idom
+	}
+	idom[rpo[0]] = rpo[0]
+
+	intersect := func(a, b int) int {
+		for a != b {
+			for order[a] > order[b] {
+				a = idom[a]
+			}
+			for order[b] > order[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, i := range rpo[1:] {
+			new_idom := -1
+			for _, pred := range preds(i) {
+				if idom[pred] == -1 {
+					continue
+				}
+				if new_idom == -1 {
+					new_idom = pred
+				} else {
+					new_idom = intersect(pred, new_idom)
+				}
+			}
+			if idom[i] != new_idom {
+				idom[i] = new_idom
+				changed = true
+			}
+		}
+	}
+
+	idom[rpo[0]] = -1
+	return idom
+}
+
+// Dominates tells whether block a dominates block b.
+func (cfg *FunctionCFG) Dominates(a, b int) bool {
+	idom := cfg.Dominators()
+	for b != -1 {
+		if a == b {
+			return true
+		}
+		b = idom[b]
+	}
+	return false
+}
+
+func (cfg *FunctionCFG) Dump() {
+	idom := cfg.Dominators()
+	for _, block := range cfg.Blocks {
+		fmt.Printf("bb 0x%08x-0x%08x visits=%d", block.Address, block.LastAddress, block.Visits)
+		if idom[block.Index] >= 0 {
+			fmt.Printf(" idom=0x%08x", cfg.Blocks[idom[block.Index]].Address)
+		}
+		for _, succ := range block.Succs {
+			fmt.Printf(" ->0x%08x", cfg.Blocks[succ].Address)
+		}
+		if block.Exit {
+			fmt.Printf(" exit")
+		}
+		fmt.Println()
+	}
+}
@@ -0,0 +1,387 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+type CheckpointStackItem struct {
+	Address uint32 `yaml:"address"`
+	RA      uint32 `yaml:"ra"`
+	SP      int    `yaml:"sp"`
+	Fun     uint32 `yaml:"fun"`
+
+	Callback bool `yaml:"callback,omitempty"`
+}
+
+type CheckpointThread struct {
+	ID        uint16                `yaml:"id"`
+	PC        uint32                `yaml:"pc"`
+	RegSP     int                   `yaml:"reg_sp"`
+	Executing bool                  `yaml:"executing"`
+	Name      string                `yaml:"name"`
+	StartPC   uint32                `yaml:"start_pc"`
+	EndPC     uint32                `yaml:"end_pc"`
+	LastBB    uint32                `yaml:"last_bb"`
+	Stack     []CheckpointStackItem `yaml:"stack"`
+}
+
+type CheckpointSource struct {
+	Filename string             `yaml:"filename"`
+	StartNts RefTs              `yaml:"start_nts"`
+	EndNts   RefTs              `yaml:"end_nts"`
+	Threads  []CheckpointThread `yaml:"threads"`
+}
+
+// BBTraceCheckpoint is the parser state at a chunk boundary, Offset being
+// where the next chunk of trace Source starts. Call histories and function
+// graphs are not kept, on resume they restart from the restored stacks.
+// Every checkpoint holds all of the state, it is loaded on its own.
+type BBTraceCheckpoint struct {
+	Source    int    `yaml:"source"`
+	Offset    int64  `yaml:"offset"`
+	Nts       RefTs  `yaml:"nts"`
+	Fts       RefTs  `yaml:"fts"`
+	CurrentID uint16 `yaml:"current_id"`
+
+	Sources     []CheckpointSource `yaml:"sources"`
+	BasicBlocks []SoraBasicBlock   `yaml:"basic_blocks"`
+	Refs        []SoraBBRef        `yaml:"refs"`
+	Functions   []SoraFunction     `yaml:"functions"`
+	Boundaries  []FunctionBoundary `yaml:"boundaries"`
+
+	BBCounts   map[uint32]int64         `yaml:"bb_counts"`
+	BBSources  map[uint32]map[int]int64 `yaml:"bb_sources"`
+	Mismatches []*RAMismatch            `yaml:"mismatches"`
+
+	ThreadEvents []ThreadEvent  `yaml:"thread_events"`
+	ThreadSlices []*ThreadSlice `yaml:"thread_slices"`
+	OpenSlice    *ThreadSlice   `yaml:"open_slice,omitempty"`
+}
+
+func checkpointThread(thread *BBTraceThreadState) CheckpointThread {
+	ct := CheckpointThread{
+		ID:        thread.ID,
+		PC:        thread.PC,
+		RegSP:     thread.RegSP,
+		Executing: thread.Executing,
+		Name:      thread.Name,
+		StartPC:   thread.StartPC,
+		EndPC:     thread.EndPC,
+		LastBB:    thread.LastBB,
+	}
+	for i := 0; i < thread.Stack.Len(); i++ {
+		item := thread.Stack.At(i)
+		ci := CheckpointStackItem{Address: item.Address(), RA: item.RA, SP: item.SP, Callback: item.Callback}
+		if item.Fun != nil {
+			ci.Fun = item.Fun.Address
+		}
+		ct.Stack = append(ct.Stack, ci)
+	}
+	return ct
+}
+
+// Checkpoint snapshots the parser and the managers, it is only consistent
+// between chunks. Nothing of the parser is shared with the snapshot.
+func (bbtrace *BBTraceParser) Checkpoint() *BBTraceCheckpoint {
+	cp := &BBTraceCheckpoint{
+		Source:    bbtrace.sourceIndex(),
+		Offset:    bbtrace.offset,
+		Nts:       bbtrace.Nts,
+		Fts:       bbtrace.Fts,
+		CurrentID: bbtrace.CurrentID,
+		BBCounts:  make(map[uint32]int64, len(bbtrace.Profile.BBCounts)),
+		BBSources: make(map[uint32]map[int]int64, len(bbtrace.Profile.BBSources)),
+
+		ThreadEvents: append([]ThreadEvent(nil), bbtrace.Timeline.Events...),
+	}
+
+	for addr, count := range bbtrace.Profile.BBCounts {
+		cp.BBCounts[addr] = count
+	}
+	for addr, sources := range bbtrace.Profile.BBSources {
+		cp.BBSources[addr] = make(map[int]int64, len(sources))
+		for src, count := range sources {
+			cp.BBSources[addr][src] = count
+		}
+	}
+	for _, mismatch := range bbtrace.Mismatches {
+		state := *mismatch
+		state.Stack = append([]RAMismatchFrame(nil), mismatch.Stack...)
+		cp.Mismatches = append(cp.Mismatches, &state)
+	}
+	for _, slice := range bbtrace.Timeline.Slices {
+		state := *slice
+		cp.ThreadSlices = append(cp.ThreadSlices, &state)
+	}
+	if open := bbtrace.Timeline.open; open != nil {
+		state := *open
+		cp.OpenSlice = &state
+	}
+
+	for _, src := range bbtrace.Sources[:cp.Source+1] {
+		cs := CheckpointSource{Filename: src.Filename, StartNts: src.StartNts, EndNts: src.EndNts}
+		var ids []int
+		for id := range src.Threads {
+			ids = append(ids, int(id))
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			cs.Threads = append(cs.Threads, checkpointThread(src.Threads[uint16(id)]))
+		}
+		cp.Sources = append(cp.Sources, cs)
+	}
+
+	bbtrace.doc.BBManager.ForEach(func(bb *SoraBasicBlock) {
+		cp.BasicBlocks = append(cp.BasicBlocks, *bb)
+	})
+	for _, ref := range bbtrace.doc.BBManager.Refs() {
+		cp.Refs = append(cp.Refs, *ref)
+	}
+	bbtrace.doc.FunManager.ForEach(func(fun *SoraFunction) {
+		state := *fun
+		state.Frame = nil
+		state.BBAddresses = append([]uint32(nil), fun.BBAddresses...)
+		cp.Functions = append(cp.Functions, state)
+	})
+	for _, boundary := range bbtrace.doc.FunManager.Boundaries {
+		cp.Boundaries = append(cp.Boundaries, *boundary)
+	}
+
+	return cp
+}
+
+// SaveCheckpoint writes the checkpoint into filename.
+func (bbtrace *BBTraceParser) SaveCheckpoint(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := yaml.NewEncoder(file)
+	if err := enc.Encode(bbtrace.Checkpoint()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// LoadCheckpoint reads the checkpoint in filename.
+func LoadCheckpoint(filename string) (*BBTraceCheckpoint, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cp := &BBTraceCheckpoint{}
+	if err := yaml.NewDecoder(file).Decode(cp); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", filename, err)
+	}
+	return cp, nil
+}
+
+// ListCheckpoints returns the checkpoints written to dir, oldest first.
+func ListCheckpoints(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "checkpoint_*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// afterChunk advances the offset past a fully processed chunk and writes a
+// checkpoint every CheckpointEvery records.
+func (bbtrace *BBTraceParser) afterChunk(chunk_bytes int) error {
+	bbtrace.offset += int64(chunk_bytes)
+
+	if !bbtrace.checkpointDue(0) {
+		return nil
+	}
+	bbtrace.lastCheckpoint = bbtrace.Nts
+
+	filename := filepath.Join(bbtrace.CheckpointDir, fmt.Sprintf("checkpoint_%012d.yaml", bbtrace.Nts))
+	bbtrace.doc.logf("INFO:\tcheckpoint %s\n", filename)
+	return bbtrace.SaveCheckpoint(filename)
+}
+
+// checkpointDue tells whether a checkpoint is written after records more
+// records are parsed.
+func (bbtrace *BBTraceParser) checkpointDue(records RefTs) bool {
+	if bbtrace.CheckpointEvery <= 0 || bbtrace.CheckpointDir == "" {
+		return false
+	}
+	return bbtrace.Nts+records-bbtrace.lastCheckpoint >= bbtrace.CheckpointEvery
+}
+
+func (bbtrace *BBTraceParser) restoreThread(ct CheckpointThread) *BBTraceThreadState {
+	thread := &BBTraceThreadState{
+		ID:        ct.ID,
+		PC:        ct.PC,
+		RegSP:     ct.RegSP,
+		Executing: ct.Executing,
+		Stack:     new(Queue[*BBTraceStackItem]),
+		Name:      ct.Name,
+		StartPC:   ct.StartPC,
+		EndPC:     ct.EndPC,
+		LastBB:    ct.LastBB,
+	}
+	if bbtrace.EnableFunGraph {
+		thread.FunGraph = NewFunGraph()
+	}
+	if bbtrace.EnableCallHistory {
+		thread.CallHistory = NewCallHistory()
+		thread.CallHistory.Fts = bbtrace.Fts
+	}
+
+	parent_ID := FunGraphNodeID(0)
+	ra := uint32(0)
+	for _, ci := range ct.Stack {
+		item := &BBTraceStackItem{address: ci.Address, RA: ci.RA, SP: ci.SP, Callback: ci.Callback}
+		item.Fun = bbtrace.doc.FunManager.Get(ci.Fun)
+		if item.Fun == nil {
+			bbtrace.doc.logf("WARNING:\tcheckpoint stack of thread %d refers unknown func 0x%08x\n", ct.ID, ci.Fun)
+		}
+		if thread.FunGraph != nil {
+			node := thread.FunGraph.AddNode(ci.Fun, parent_ID)
+			node.Fun = item.Fun
+			item.NodeID = node.ID
+			parent_ID = node.ID
+		}
+		thread.Stack.Push(item)
+		if thread.CallHistory != nil && item.Fun != nil {
+			if block := thread.CallHistory.AddBlock(thread.Stack.Len(), bbtrace.Nts, ci.Fun, item.Fun.Name); block != nil {
+				block.RA = ra
+			}
+		}
+		ra = ci.RA
+	}
+	return thread
+}
+
+func (bbtrace *BBTraceParser) restore(cp *BBTraceCheckpoint) error {
+	if cp.Source >= len(bbtrace.Sources) {
+		return fmt.Errorf("checkpoint is in trace source #%d, only %d given", cp.Source, len(bbtrace.Sources))
+	}
+	for i, cs := range cp.Sources {
+		if filepath.Base(cs.Filename) != filepath.Base(bbtrace.Sources[i].Filename) {
+			bbtrace.doc.logf("WARNING:\tcheckpoint trace source #%d was %s, now %s\n", i, cs.Filename, bbtrace.Sources[i].Filename)
+		}
+	}
+
+	doc := bbtrace.doc
+	doc.BBManager = NewBasicBlockManager(doc)
+	for i := range cp.BasicBlocks {
+		bb := cp.BasicBlocks[i]
+		doc.BBManager.basicBlocks.Insert(bb.Address, &bb)
+	}
+	for i := range cp.Refs {
+		ref := cp.Refs[i]
+		*doc.BBManager.CreateReference(ref.From, ref.To) = ref
+	}
+	doc.FunManager.restore(cp.Functions, cp.Boundaries)
+
+	bbtrace.Nts = cp.Nts
+	bbtrace.Fts = cp.Fts
+	bbtrace.lastCheckpoint = cp.Nts
+	bbtrace.entryIndex = nil
+
+	bbtrace.Profile = NewTraceProfile(doc)
+	if cp.BBCounts != nil {
+		bbtrace.Profile.BBCounts = cp.BBCounts
+	}
+	if cp.BBSources != nil {
+		bbtrace.Profile.BBSources = cp.BBSources
+	}
+	bbtrace.Mismatches = cp.Mismatches
+
+	bbtrace.resetTimeline()
+	bbtrace.Timeline.Events = cp.ThreadEvents
+	bbtrace.Timeline.Slices = cp.ThreadSlices
+	bbtrace.Timeline.open = cp.OpenSlice
+
+	for _, src := range bbtrace.Sources {
+		src.Threads = nil
+	}
+	for i, cs := range cp.Sources {
+		src := bbtrace.Sources[i]
+		src.StartNts = cs.StartNts
+		src.EndNts = cs.EndNts
+		src.Threads = make(map[uint16]*BBTraceThreadState)
+		for _, ct := range cs.Threads {
+			src.Threads[ct.ID] = bbtrace.restoreThread(ct)
+		}
+	}
+
+	bbtrace.Current = bbtrace.Sources[cp.Source]
+	bbtrace.Threads = bbtrace.Current.Threads
+	bbtrace.CurrentID = cp.CurrentID
+	bbtrace.Profile.Source = cp.Source
+	return nil
+}
+
+// Resume restores the checkpoint in filename and parses on from there, length
+// counting records from the checkpoint.
+func (bbtrace *BBTraceParser) Resume(filename string, length int) error {
+	cp, err := LoadCheckpoint(filename)
+	if err != nil {
+		return err
+	}
+	if err := bbtrace.restore(cp); err != nil {
+		return err
+	}
+
+	bbtrace.doc.logf("INFO:\tresume #%d at offset %d nts=%d\n", cp.Source, cp.Offset, cp.Nts)
+	return bbtrace.parseSources(cp.Source, cp.Offset, length)
+}
+
+func (funmgr *FunctionManager) restore(funcs []SoraFunction, boundaries []FunctionBoundary) {
+	keep := make(map[uint32]bool)
+	for i := range funcs {
+		state := funcs[i]
+		keep[state.Address] = true
+
+		fun := funmgr.Get(state.Address)
+		if fun == nil {
+			fun = &state
+			funmgr.functions.Insert(fun.Address, fun)
+			funmgr.RegisterNameFunction(fun)
+			funmgr.doc.SymMap.AddFunction(fun.Name, fun.Address, fun.Size, -1)
+			continue
+		}
+
+		if fun.Name != state.Name {
+			funmgr.UnregisterNameFunction(fun)
+			fun.Name = state.Name
+			funmgr.RegisterNameFunction(fun)
+		}
+		fun.SetLastAddress(state.LastAddress())
+		fun.BBAddresses = state.BBAddresses
+		funmgr.doc.SymMap.SetFunctionSize(fun.Address, fun.Size)
+	}
+
+	var stale []*SoraFunction
+	funmgr.ForEach(func(fun *SoraFunction) {
+		if !keep[fun.Address] {
+			stale = append(stale, fun)
+		}
+	})
+	for _, fun := range stale {
+		funmgr.removeFunction(fun)
+	}
+
+	funmgr.journal = nil
+	funmgr.Boundaries = nil
+	funmgr.boundarySeen = make(map[boundaryKey]*FunctionBoundary)
+	for i := range boundaries {
+		boundary := boundaries[i]
+		key := boundaryKey{boundary.Action, boundary.Reason, boundary.Address, boundary.From}
+		funmgr.boundarySeen[key] = &boundary
+		funmgr.Boundaries = append(funmgr.Boundaries, &boundary)
+	}
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+
+	var chunks []testTraceChunk
+	for n := 0; n < 10; n++ {
+		chunks = append(chunks,
+			traceChunk(1,
+				traceRecord(0x8804000, 0),
+				traceRecord(0x8805000, 0x8804004),
+			),
+			traceChunk(2, traceRecord(0x8806000, 0)),
+			traceChunk(1,
+				traceRecord(0x8806000, 0x8805004),
+				traceRecord(0x8805008, 0x8806004),
+				traceRecord(0x8804008, 0x880500C),
+			),
+		)
+	}
+	traces := []string{filepath.Join(dir, "first.rec"), filepath.Join(dir, "second.rec")}
+	writeTestTrace(t, traces[0], chunks[:15]...)
+	writeTestTrace(t, traces[1], chunks[15:]...)
+
+	newDoc := func() (*SoraDocument, *[]TraceEvent) {
+		doc := newTestDocument()
+		putCaller(doc, "main", 0x8804000, 0x8805000)
+		putCaller(doc, "sub", 0x8805000, 0x8806000)
+		putLeafFunction(doc, "leaf", 0x8806000)
+
+		events := new([]TraceEvent)
+		doc.Parser.OnEvent = func(ev *TraceEvent) { *events = append(*events, *ev) }
+		doc.Parser.SetTraceFiles(traces)
+		return doc, events
+	}
+
+	full, full_events := newDoc()
+	full.Parser.CheckpointEvery = 10
+	full.Parser.CheckpointDir = dir
+	assert.NoError(t, full.Parser.Parse(0))
+
+	checkpoints, err := ListCheckpoints(dir)
+	assert.NoError(t, err)
+	assert.True(t, len(checkpoints) > 3)
+
+	// every checkpoint holds the logs from the start
+	data, err := os.ReadFile(checkpoints[2])
+	assert.NoError(t, err)
+	var saved BBTraceCheckpoint
+	assert.NoError(t, yaml.Unmarshal(data, &saved))
+	assert.Equal(t, RefTs(1), saved.ThreadEvents[0].Nts)
+
+	// the snapshot shares nothing with the parser
+	cp := full.Parser.Checkpoint()
+	cp.BBCounts[0x8804000] = -1
+	cp.ThreadEvents[0].Nts = 0
+	assert.NotEqual(t, int64(-1), full.Parser.Profile.BBCounts[0x8804000])
+	assert.NotZero(t, full.Parser.Timeline.Events[0].Nts)
+
+	for _, filename := range []string{checkpoints[1], checkpoints[len(checkpoints)-2]} {
+		cp, err := LoadCheckpoint(filename)
+		assert.NoError(t, err)
+
+		resumed, resumed_events := newDoc()
+		assert.NoError(t, resumed.Parser.Resume(filename, 0))
+
+		var tail []TraceEvent
+		for _, ev := range *full_events {
+			if ev.Nts >= cp.Nts && ev.Kind != TraceSwitchIn && ev.Kind != TraceSwitchOut {
+				tail = append(tail, ev)
+			}
+		}
+		var got []TraceEvent
+		for _, ev := range *resumed_events {
+			if ev.Kind != TraceSwitchIn && ev.Kind != TraceSwitchOut {
+				got = append(got, ev)
+			}
+		}
+
+		assert.Equal(t, tail, got, filename)
+		assert.Equal(t, full.Parser.Nts, resumed.Parser.Nts)
+		assert.Equal(t, full.Parser.Profile.BBCounts, resumed.Parser.Profile.BBCounts)
+		assert.Equal(t, full.Parser.Profile.BBSources, resumed.Parser.Profile.BBSources)
+		assert.Equal(t, full.BBManager.Refs(), resumed.BBManager.Refs())
+		assert.Equal(t, len(full.Parser.Mismatches), len(resumed.Parser.Mismatches))
+		assert.Equal(t, full.Parser.Timeline.Slices, resumed.Parser.Timeline.Slices)
+	}
+
+	// a new document has none of the instructions decoded yet
+	disasmFrom(t, full)
+	for _, filename := range checkpoints {
+		resumed, _ := newDoc()
+		resumed.InstrManager = NewInstructionManager(resumed)
+		assert.NoError(t, resumed.Parser.Resume(filename, 0), filename)
+		assert.Equal(t, full.Parser.Profile.BBCounts, resumed.Parser.Profile.BBCounts, filename)
+	}
+
+	// the last one still resumes once the earlier ones are gone
+	for _, filename := range checkpoints[:len(checkpoints)-1] {
+		assert.NoError(t, os.Remove(filename))
+	}
+	resumed, _ := newDoc()
+	assert.NoError(t, resumed.Parser.Resume(checkpoints[len(checkpoints)-1], 0))
+	assert.Equal(t, full.Parser.Profile.BBCounts, resumed.Parser.Profile.BBCounts)
+	assert.Equal(t, full.Parser.Timeline.Slices, resumed.Parser.Timeline.Slices)
+}
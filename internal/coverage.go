@@ -0,0 +1,346 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// AddrRange is [Start, End), End being exclusive.
+type AddrRange struct {
+	Start uint32
+	End   uint32
+}
+
+func (r AddrRange) Size() uint32 {
+	return r.End - r.Start
+}
+
+// CoverageSet is a sorted list of disjoint address ranges executed by a trace.
+type CoverageSet struct {
+	ranges []AddrRange
+}
+
+func (cov *CoverageSet) Ranges() []AddrRange {
+	return cov.ranges
+}
+
+func (cov *CoverageSet) Add(start, end uint32) {
+	if end <= start {
+		return
+	}
+	i := sort.Search(len(cov.ranges), func(i int) bool { return cov.ranges[i].End >= start })
+	j := i
+	for j < len(cov.ranges) && cov.ranges[j].Start <= end {
+		if cov.ranges[j].Start < start {
+			start = cov.ranges[j].Start
+		}
+		if cov.ranges[j].End > end {
+			end = cov.ranges[j].End
+		}
+		j++
+	}
+
+	merged := append([]AddrRange{}, cov.ranges[:i]...)
+	merged = append(merged, AddrRange{start, end})
+	cov.ranges = append(merged, cov.ranges[j:]...)
+}
+
+func (cov *CoverageSet) Merge(other *CoverageSet) {
+	for _, r := range other.ranges {
+		cov.Add(r.Start, r.End)
+	}
+}
+
+func (cov *CoverageSet) Contains(addr uint32) bool {
+	i := sort.Search(len(cov.ranges), func(i int) bool { return cov.ranges[i].End > addr })
+	return i < len(cov.ranges) && cov.ranges[i].Start <= addr
+}
+
+// Intersect returns how many bytes of [start, end) are covered.
+func (cov *CoverageSet) Intersect(start, end uint32) uint32 {
+	total := uint32(0)
+	i := sort.Search(len(cov.ranges), func(i int) bool { return cov.ranges[i].End > start })
+	for ; i < len(cov.ranges) && cov.ranges[i].Start < end; i++ {
+		lo, hi := cov.ranges[i].Start, cov.ranges[i].End
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		total += hi - lo
+	}
+	return total
+}
+
+// Coverage collects the blocks the parsed trace executed.
+func (doc *SoraDocument) Coverage() *CoverageSet {
+	cov := &CoverageSet{}
+	for bb_addr, count := range doc.Parser.Profile.BBCounts {
+		if count == 0 {
+			continue
+		}
+		if bb := doc.BBManager.Get(bb_addr); bb != nil {
+			cov.Add(bb.Address, bb.LastAddress+4)
+		}
+	}
+	return cov
+}
+
+type CoverageModule struct {
+	Name    string
+	Address uint32
+	Size    uint32
+}
+
+// CoverageModules lists the loaded modules, or the main module text when none are known.
+func (doc *SoraDocument) CoverageModules() []CoverageModule {
+	var modules []CoverageModule
+	for _, modl := range doc.yaml.LoadedModules {
+		modules = append(modules, CoverageModule{modl.Name, modl.Address, modl.Size})
+	}
+	if len(modules) == 0 && doc.yaml.Module.TextEnd > doc.yaml.Module.TextStart {
+		modules = append(modules, CoverageModule{
+			Name:    doc.yaml.Module.NM.Name,
+			Address: doc.yaml.Module.TextStart,
+			Size:    doc.yaml.Module.TextEnd - doc.yaml.Module.TextStart,
+		})
+	}
+	return modules
+}
+
+type FunctionCoverage struct {
+	Fun           *SoraFunction
+	Module        string
+	Instructions  int
+	Covered       int
+	Blocks        int
+	CoveredBlocks int
+}
+
+func (fc *FunctionCoverage) Percent() float64 {
+	if fc.Instructions == 0 {
+		return 0
+	}
+	return float64(fc.Covered) * 100 / float64(fc.Instructions)
+}
+
+type ModuleCoverage struct {
+	CoverageModule
+	Instructions  int
+	Covered       int
+	Blocks        int
+	CoveredBlocks int
+}
+
+func (mc *ModuleCoverage) Percent() float64 {
+	if mc.Instructions == 0 {
+		return 0
+	}
+	return float64(mc.Covered) * 100 / float64(mc.Instructions)
+}
+
+type CoverageReport struct {
+	Functions []*FunctionCoverage
+	Modules   []*ModuleCoverage
+}
+
+// CoverageReport compares the statically known functions with cov.
+func (doc *SoraDocument) CoverageReport(cov *CoverageSet) *CoverageReport {
+	report := &CoverageReport{}
+	for _, modl := range doc.CoverageModules() {
+		report.Modules = append(report.Modules, &ModuleCoverage{CoverageModule: modl})
+	}
+
+	doc.FunManager.ForEach(func(fun *SoraFunction) {
+		fc := &FunctionCoverage{
+			Fun:          fun,
+			Instructions: int(fun.Size / 4),
+			Covered:      int(cov.Intersect(fun.Address, fun.Address+fun.Size) / 4),
+		}
+
+		doc.ProcessBB(fun.Address, fun.LastAddress(), func(state BBAnalState) {
+			fc.Blocks++
+			if cov.Contains(state.BBAddr) {
+				fc.CoveredBlocks++
+			}
+		})
+
+		for _, mc := range report.Modules {
+			if fun.Address >= mc.Address && fun.Address < mc.Address+mc.Size {
+				fc.Module = mc.Name
+				mc.Instructions += fc.Instructions
+				mc.Covered += fc.Covered
+				mc.Blocks += fc.Blocks
+				mc.CoveredBlocks += fc.CoveredBlocks
+				break
+			}
+		}
+		report.Functions = append(report.Functions, fc)
+	})
+
+	return report
+}
+
+func (report *CoverageReport) Dump() {
+	for _, mc := range report.Modules {
+		fmt.Printf("module %s 0x%08x %d/%d instrs (%.1f%%) %d/%d bbs\n", mc.Name, mc.Address,
+			mc.Covered, mc.Instructions, mc.Percent(), mc.CoveredBlocks, mc.Blocks)
+	}
+	for _, fc := range report.Functions {
+		fmt.Printf("%s 0x%08x %d/%d instrs (%.1f%%) %d/%d bbs\n", fc.Fun.Name, fc.Fun.Address,
+			fc.Covered, fc.Instructions, fc.Percent(), fc.CoveredBlocks, fc.Blocks)
+	}
+}
+
+// WriteDrcov exports cov as a drcov version 2 log, ranges outside modules are dropped.
+func (cov *CoverageSet) WriteDrcov(w io.Writer, modules []CoverageModule) error {
+	type drcovBB struct {
+		Start uint32
+		Size  uint16
+		ModID uint16
+	}
+	var bbs []drcovBB
+
+	for _, r := range cov.ranges {
+		for id, modl := range modules {
+			lo, hi := r.Start, r.End
+			if lo < modl.Address {
+				lo = modl.Address
+			}
+			if hi > modl.Address+modl.Size {
+				hi = modl.Address + modl.Size
+			}
+			for ; lo < hi; lo += 0xFFFC {
+				size := hi - lo
+				if size > 0xFFFC {
+					size = 0xFFFC
+				}
+				bbs = append(bbs, drcovBB{lo - modl.Address, uint16(size), uint16(id)})
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "DRCOV VERSION: 2\n")
+	fmt.Fprintf(w, "DRCOV FLAVOR: pspsora\n")
+	fmt.Fprintf(w, "Module Table: version 2, count %d\n", len(modules))
+	fmt.Fprintf(w, "Columns: id, base, end, entry, checksum, timestamp, path\n")
+	for id, modl := range modules {
+		fmt.Fprintf(w, "%3d, 0x%08x, 0x%08x, 0x%08x, 0x00000000, 0x00000000, %s\n",
+			id, modl.Address, modl.Address+modl.Size, 0, modl.Name)
+	}
+	fmt.Fprintf(w, "BB Table: %d bbs\n", len(bbs))
+	return binary.Write(w, binary.LittleEndian, bbs)
+}
+
+// ReadDrcov loads a drcov version 2 log written by WriteDrcov.
+func ReadDrcov(r io.Reader) (*CoverageSet, []CoverageModule, error) {
+	rd := bufio.NewReader(r)
+	var modules []CoverageModule
+	count := 0
+
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "Module Table:") {
+			if _, err := fmt.Sscanf(line, "Module Table: version 2, count %d", &count); err != nil {
+				return nil, nil, fmt.Errorf("drcov module table: %w", err)
+			}
+		} else if strings.HasPrefix(line, "BB Table:") {
+			var nbbs int
+			if _, err := fmt.Sscanf(line, "BB Table: %d bbs", &nbbs); err != nil {
+				return nil, nil, fmt.Errorf("drcov bb table: %w", err)
+			}
+
+			cov := &CoverageSet{}
+			buf := make([]byte, 8)
+			for i := 0; i < nbbs; i++ {
+				if _, err := io.ReadFull(rd, buf); err != nil {
+					return nil, nil, err
+				}
+				start := binary.LittleEndian.Uint32(buf)
+				size := binary.LittleEndian.Uint16(buf[4:])
+				id := int(binary.LittleEndian.Uint16(buf[6:]))
+				if id >= len(modules) {
+					return nil, nil, fmt.Errorf("drcov bb #%d unknown module %d", i, id)
+				}
+				base := modules[id].Address
+				cov.Add(base+start, base+start+uint32(size))
+			}
+			return cov, modules, nil
+		} else if len(modules) < count && !strings.HasPrefix(line, "Columns:") {
+			fields := strings.SplitN(line, ",", 7)
+			if len(fields) != 7 {
+				return nil, nil, fmt.Errorf("drcov module line: %s", line)
+			}
+			var base, end uint32
+			fmt.Sscanf(strings.TrimSpace(fields[1]), "0x%x", &base)
+			fmt.Sscanf(strings.TrimSpace(fields[2]), "0x%x", &end)
+			modules = append(modules, CoverageModule{
+				Name:    strings.TrimSpace(fields[6]),
+				Address: base,
+				Size:    end - base,
+			})
+		}
+	}
+}
+
+// WriteLcov exports an lcov tracefile using instruction addresses as line numbers.
+func (report *CoverageReport) WriteLcov(w io.Writer, cov *CoverageSet, testName string) error {
+	byModule := make(map[string][]*FunctionCoverage)
+	var names []string
+	for _, fc := range report.Functions {
+		if _, ok := byModule[fc.Module]; !ok {
+			names = append(names, fc.Module)
+		}
+		byModule[fc.Module] = append(byModule[fc.Module], fc)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, key := range names {
+		name := key
+		if name == "" {
+			name = "unknown"
+		}
+		fmt.Fprintf(bw, "TN:%s\nSF:%s\n", testName, name)
+
+		funcs := byModule[key]
+
+		hit := 0
+		for _, fc := range funcs {
+			fmt.Fprintf(bw, "FN:%d,%s\n", fc.Fun.Address, fc.Fun.Name)
+		}
+		for _, fc := range funcs {
+			fnda := 0
+			if cov.Contains(fc.Fun.Address) {
+				fnda = 1
+				hit++
+			}
+			fmt.Fprintf(bw, "FNDA:%d,%s\n", fnda, fc.Fun.Name)
+		}
+		fmt.Fprintf(bw, "FNF:%d\nFNH:%d\n", len(funcs), hit)
+
+		lines, covered := 0, 0
+		for _, fc := range funcs {
+			for addr := fc.Fun.Address; addr <= fc.Fun.LastAddress(); addr += 4 {
+				da := 0
+				if cov.Contains(addr) {
+					da = 1
+					covered++
+				}
+				lines++
+				fmt.Fprintf(bw, "DA:%d,%d\n", addr, da)
+			}
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", lines, covered)
+	}
+	return bw.Flush()
+}
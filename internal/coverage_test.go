@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoverageSet(t *testing.T) {
+	cov := &CoverageSet{}
+	cov.Add(0x100, 0x110)
+	cov.Add(0x120, 0x130)
+	cov.Add(0x108, 0x118)
+	assert.Equal(t, []AddrRange{{0x100, 0x118}, {0x120, 0x130}}, cov.Ranges())
+
+	other := &CoverageSet{}
+	other.Add(0x118, 0x120)
+	other.Add(0x200, 0x204)
+	cov.Merge(other)
+	assert.Equal(t, []AddrRange{{0x100, 0x130}, {0x200, 0x204}}, cov.Ranges())
+
+	assert.True(t, cov.Contains(0x12C))
+	assert.False(t, cov.Contains(0x130))
+	assert.Equal(t, uint32(0x14), cov.Intersect(0x120, 0x204))
+}
+
+func TestDrcovRoundTrip(t *testing.T) {
+	cov := &CoverageSet{}
+	cov.Add(0x8804000, 0x8804020)
+	cov.Add(0x8900000, 0x8900010)
+	modules := []CoverageModule{{"main", 0x8804000, 0x1000}, {"lib", 0x8900000, 0x100}}
+
+	var buf bytes.Buffer
+	assert.NoError(t, cov.WriteDrcov(&buf, modules))
+
+	loaded, loadedModules, err := ReadDrcov(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, modules, loadedModules)
+	assert.Equal(t, cov.Ranges(), loaded.Ranges())
+}
+
+func TestCoverageReport(t *testing.T) {
+	doc := newTestDocument()
+	doc.yaml.LoadedModules = []PSPLoadedModule{
+		{Name: "game", Address: 0x8804000, Size: 0x1000},
+		{Name: "lib", Address: 0x8806000, Size: 0x100},
+	}
+	putCaller(doc, "main", 0x8804000, 0x8806000)
+	putLeafFunction(doc, "leaf", 0x8806000)
+	putInstr(doc, 0x8807000, "nop", models.MipsOpcode{})
+	putFunction(doc, "bad", 0x8807000, 8)
+
+	saved := memoryIsValidAddress
+	memoryIsValidAddress = func(address uint32) bool { return address != 0x8807004 }
+	defer func() { memoryIsValidAddress = saved }()
+
+	cov := &CoverageSet{}
+	cov.Add(0x8804000, 0x8804008)
+	report := doc.CoverageReport(cov)
+
+	if assert.Len(t, report.Functions, 3) {
+		main := report.Functions[0]
+		assert.Equal(t, "game", main.Module)
+		assert.Equal(t, 4, main.Instructions)
+		assert.Equal(t, 2, main.Covered)
+		assert.Equal(t, 2, main.Blocks)
+		assert.Equal(t, 1, main.CoveredBlocks)
+		assert.Equal(t, 50.0, main.Percent())
+
+		assert.Equal(t, "lib", report.Functions[1].Module)
+		assert.Equal(t, 0.0, report.Functions[1].Percent())
+		assert.Equal(t, "", report.Functions[2].Module)
+		assert.Equal(t, 1, report.Functions[2].Blocks)
+	}
+	if assert.Len(t, report.Modules, 2) {
+		assert.Equal(t, 4, report.Modules[0].Instructions)
+		assert.Equal(t, 50.0, report.Modules[0].Percent())
+		assert.Equal(t, 2, report.Modules[1].Instructions)
+		assert.Equal(t, 0, report.Modules[1].CoveredBlocks)
+		assert.Equal(t, 0.0, report.Modules[1].Percent())
+	}
+
+	var lcov bytes.Buffer
+	assert.NoError(t, report.WriteLcov(&lcov, cov, "run"))
+	assert.Equal(t, "TN:run\nSF:game\n"+
+		"FN:142622720,main\nFNDA:1,main\nFNF:1\nFNH:1\n"+
+		"DA:142622720,1\nDA:142622724,1\nDA:142622728,0\nDA:142622732,0\n"+
+		"LF:4\nLH:2\nend_of_record\n"+
+		"TN:run\nSF:lib\n"+
+		"FN:142630912,leaf\nFNDA:0,leaf\nFNF:1\nFNH:0\n"+
+		"DA:142630912,0\nDA:142630916,0\n"+
+		"LF:2\nLH:0\nend_of_record\n"+
+		"TN:run\nSF:unknown\n"+
+		"FN:142635008,bad\nFNDA:0,bad\nFNF:1\nFNH:0\n"+
+		"DA:142635008,0\nDA:142635012,0\n"+
+		"LF:2\nLH:0\nend_of_record\n", lcov.String())
+}
@@ -0,0 +1,415 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/firodj/pspsora/binarysearchtree"
+)
+
+type DataKind string
+
+const (
+	DataASCII    DataKind = "ascii"
+	DataUTF8     DataKind = "utf8"
+	DataShiftJIS DataKind = "sjis"
+	DataPointers DataKind = "ptrs" // table of code addresses
+	DataFloat    DataKind = "float"
+)
+
+// SoraData is a typed item found in the memory dump. Text is the string,
+// the float or the count of pointers, Shift-JIS strings are kept escaped.
+type SoraData struct {
+	Address uint32   `yaml:"address"`
+	Size    uint32   `yaml:"size"`
+	Kind    DataKind `yaml:"kind"`
+	Name    string   `yaml:"name"`
+	Text    string   `yaml:"text"`
+}
+
+func (data *SoraData) LastAddress() uint32 {
+	return data.Address + data.Size - 1
+}
+
+var dataPrefixes = map[DataKind]string{
+	DataASCII:    "str",
+	DataUTF8:     "str",
+	DataShiftJIS: "sjis",
+	DataPointers: "ptrs",
+	DataFloat:    "flt",
+}
+
+type DataManager struct {
+	doc *SoraDocument
+
+	items binarysearchtree.AVLTree[uint32, *SoraData]
+	names map[string]*SoraData
+	// data addressed by the instruction at the key
+	refs map[uint32]dataRef
+}
+
+func NewDataManager(doc *SoraDocument) *DataManager {
+	return &DataManager{
+		doc:   doc,
+		names: make(map[string]*SoraData),
+		refs:  make(map[uint32]dataRef),
+	}
+}
+
+// Create adds an item named after its kind and address, nil when it
+// overlaps one already there.
+func (datamgr *DataManager) Create(addr, size uint32, kind DataKind, text string) *SoraData {
+	if datamgr.Find(addr) != nil || datamgr.Find(addr+size-1) != nil {
+		return nil
+	}
+	if _, c := datamgr.items.FloorCeil(addr); !c.End() && c.Value().Address <= addr+size-1 {
+		return nil
+	}
+
+	data := &SoraData{
+		Address: addr,
+		Size:    size,
+		Kind:    kind,
+		Name:    fmt.Sprintf("%s_%08x", dataPrefixes[kind], addr),
+		Text:    text,
+	}
+	datamgr.items.Insert(addr, data)
+	datamgr.names[data.Name] = data
+
+	if symmap := datamgr.doc.SymMap; symmap != nil {
+		symmap.AddLabel(data.Name, addr)
+	}
+	return data
+}
+
+func (datamgr *DataManager) Get(addr uint32) *SoraData {
+	it := datamgr.items.Search(addr)
+	if it.End() {
+		return nil
+	}
+	return it.Value()
+}
+
+// Find returns the item holding addr.
+func (datamgr *DataManager) Find(addr uint32) *SoraData {
+	f, _ := datamgr.items.FloorCeil(addr)
+	if f.End() || f.Value().LastAddress() < addr {
+		return nil
+	}
+	return f.Value()
+}
+
+func (datamgr *DataManager) GetByName(name string) *SoraData {
+	return datamgr.names[name]
+}
+
+func (datamgr *DataManager) ForEach(cb func(data *SoraData)) {
+	datamgr.items.InOrderTraverse(cb)
+}
+
+func (datamgr *DataManager) Dump() {
+	datamgr.ForEach(func(data *SoraData) {
+		fmt.Printf("0x%08x %-5s %-14s %5d %s\n", data.Address, data.Kind, data.Name, data.Size, data.Text)
+	})
+}
+
+// minStringLen is the shortest string the scan keeps, in bytes, and
+// minPointers the shortest pointer table.
+const (
+	minStringLen = 4
+	maxStringLen = 4096
+	minPointers  = 3
+)
+
+func isPrintableASCII(b byte) bool {
+	return (b >= 0x20 && b < 0x7f) || b == '\t' || b == '\n' || b == '\r'
+}
+
+// classifyString tells the encoding of the NUL terminated bytes, ok is
+// false when they do not look like text.
+func classifyString(text []byte) (kind DataKind, ok bool) {
+	if len(text) < minStringLen {
+		return "", false
+	}
+	ascii := true
+	for _, b := range text {
+		if !isPrintableASCII(b) {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return DataASCII, true
+	}
+
+	if utf8.Valid(text) {
+		printable := true
+		for _, r := range string(text) {
+			if !unicode.IsPrint(r) && r != '\t' && r != '\n' && r != '\r' {
+				printable = false
+				break
+			}
+		}
+		if printable {
+			return DataUTF8, true
+		}
+	}
+
+	if isShiftJIS(text) {
+		return DataShiftJIS, true
+	}
+	return "", false
+}
+
+// isShiftJIS checks the lead and trail byte ranges, with at least one
+// double byte character.
+func isShiftJIS(text []byte) bool {
+	double := 0
+	for i := 0; i < len(text); i++ {
+		b := text[i]
+		switch {
+		case isPrintableASCII(b), b >= 0xa1 && b <= 0xdf:
+		case (b >= 0x81 && b <= 0x9f) || (b >= 0xe0 && b <= 0xfc):
+			if i+1 >= len(text) {
+				return false
+			}
+			trail := text[i+1]
+			if trail < 0x40 || trail == 0x7f || trail > 0xfc {
+				return false
+			}
+			double++
+			i++
+		default:
+			return false
+		}
+	}
+	return double > 0
+}
+
+// codeRanges lists the functions sorted, the scan leaves them out.
+func (doc *SoraDocument) codeRanges() [][2]uint32 {
+	var ranges [][2]uint32
+	doc.FunManager.ForEach(func(fun *SoraFunction) {
+		ranges = append(ranges, [2]uint32{fun.Address, fun.LastAddress()})
+	})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	return ranges
+}
+
+func (doc *SoraDocument) isCodePointer(addr uint32) bool {
+	return addr&3 == 0 && addr != 0 && doc.FunManager.FindByAddress(addr) != nil
+}
+
+// scanPointers looks for pointer tables in [lo, hi).
+func (doc *SoraDocument) scanPointers(lo, hi uint32) {
+	for addr := (lo + 3) &^ 3; addr+4 <= hi; {
+		n := uint32(0)
+		for addr+n*4+4 <= hi && doc.isCodePointer(doc.readWord(addr+n*4)) {
+			n++
+		}
+		if n >= minPointers {
+			doc.DataManager.Create(addr, n*4, DataPointers, strconv.Itoa(int(n)))
+			addr += n * 4
+		} else {
+			addr += 4
+		}
+	}
+}
+
+func (doc *SoraDocument) readWord(addr uint32) uint32 {
+	word, _ := doc.Memory.Read32(addr)
+	return word
+}
+
+// scanPointed marks the addresses the words of [lo, hi) point to.
+func (doc *SoraDocument) scanPointed(lo, hi uint32, referenced map[uint32]bool) {
+	for addr := (lo + 3) &^ 3; addr+4 <= hi; addr += 4 {
+		if word := doc.readWord(addr); word != 0 && doc.Memory.Contains(word, 1) {
+			referenced[word] = true
+		}
+	}
+}
+
+// scanStrings looks for NUL terminated strings in [lo, hi). A string must
+// be word aligned or referenced, from code or from a pointer, any run of
+// printable bytes would do otherwise.
+func (doc *SoraDocument) scanStrings(lo, hi uint32, referenced map[uint32]bool) {
+	mem, err := doc.Memory.Read(lo, int(hi-lo))
+	if err != nil {
+		doc.logf("WARNING:\t%s\n", err)
+		return
+	}
+	off := func(addr uint32) uint32 { return addr - lo }
+
+	for addr := lo; addr < hi; {
+		if mem[off(addr)] == 0 || doc.DataManager.Find(addr) != nil {
+			addr++
+			continue
+		}
+		end := addr
+		for end < hi && end-addr < maxStringLen && mem[off(end)] != 0 && doc.DataManager.Find(end) == nil {
+			end++
+		}
+		if end < hi && mem[off(end)] == 0 && (addr&3 == 0 || referenced[addr]) {
+			text := mem[off(addr):off(end)]
+			if kind, ok := classifyString(text); ok {
+				str := string(text)
+				if kind == DataShiftJIS {
+					str = strconv.Quote(str)
+				}
+				doc.DataManager.Create(addr, end-addr+1, kind, str)
+			}
+		}
+		addr = end + 1
+	}
+}
+
+// DiscoverData scans the memory dump outside the functions for strings and
+// pointer tables, then labels the instructions addressing them.
+func (doc *SoraDocument) DiscoverData() {
+	var ranges [][2]uint32
+	lo := doc.Memory.Start()
+	hi := doc.Memory.End()
+	for _, code := range doc.codeRanges() {
+		if code[1] < lo || code[0] >= hi {
+			continue
+		}
+		if code[0] > lo {
+			ranges = append(ranges, [2]uint32{lo, code[0]})
+		}
+		if code[1]+1 > lo {
+			lo = code[1] + 1
+		}
+	}
+	if lo < hi {
+		ranges = append(ranges, [2]uint32{lo, hi})
+	}
+
+	var refs []dataRef
+	doc.FunManager.ForEach(func(fun *SoraFunction) {
+		refs = append(refs, doc.collectDataRefs(fun)...)
+	})
+	referenced := make(map[uint32]bool)
+	for _, ref := range refs {
+		referenced[ref.target] = true
+	}
+
+	for _, r := range ranges {
+		doc.scanPointers(r[0], r[1])
+		doc.scanPointed(r[0], r[1], referenced)
+	}
+	for _, r := range ranges {
+		doc.scanStrings(r[0], r[1], referenced)
+	}
+	doc.labelDataRefs(refs)
+
+	count := 0
+	doc.DataManager.ForEach(func(data *SoraData) { count++ })
+	doc.logf("INFO:\tdiscovered %d data items\n", count)
+}
+
+// dataLabel names addr by the item holding it, with the offset into it.
+func (datamgr *DataManager) dataLabel(addr uint32) string {
+	data := datamgr.Find(addr)
+	if data == nil {
+		return ""
+	}
+	if addr == data.Address {
+		return data.Name
+	}
+	return fmt.Sprintf("%s+0x%x", data.Name, addr-data.Address)
+}
+
+// labelArgs sets the label of the arguments of the instruction at addr
+// addressing a data item, the immediate computing it or the memory access.
+func (datamgr *DataManager) labelArgs(addr uint32, arguments []*SoraArgument) {
+	ref, ok := datamgr.refs[addr]
+	if !ok || len(arguments) == 0 {
+		return
+	}
+	if !ref.mem {
+		if data := datamgr.Get(ref.target); data != nil {
+			if arg := arguments[len(arguments)-1]; arg.Type == ArgImm {
+				arg.Label = data.Name
+			}
+		}
+		return
+	}
+	if label := datamgr.dataLabel(ref.target); label != "" {
+		for _, arg := range arguments {
+			if arg.Type == ArgMem {
+				arg.Label = label
+			}
+		}
+	}
+}
+
+// dataRef is a constant address computed by the instruction at addr,
+// accessed when mem.
+type dataRef struct {
+	addr   uint32
+	op     string
+	target uint32
+	mem    bool
+}
+
+// collectDataRefs lists the constant propagated addresses the instructions
+// of fun access or compute.
+func (doc *SoraDocument) collectDataRefs(fun *SoraFunction) []dataRef {
+	vsa := NewValueSetAnalysis(doc)
+	fv := vsa.analyzeFunction(fun)
+
+	var refs []dataRef
+	for addr := fun.Address; addr <= fun.LastAddress(); addr += 4 {
+		instr := doc.Disasm(addr)
+		st, ok := fv.before[addr]
+		if instr == nil || !ok || instr.Op == "" {
+			continue
+		}
+
+		if access := instr.Access; access != nil {
+			base := st.get(access.Base)
+			if base.Kind == ValueConst && len(base.Values) == 1 {
+				refs = append(refs, dataRef{addr: addr, op: instr.Op, target: base.Values[0] + uint32(access.Offset), mem: true})
+			}
+			continue
+		}
+
+		switch instr.Op {
+		case "addiu", "ori":
+		default:
+			continue
+		}
+		after := st.clone()
+		vsa.transfer(after, instr)
+		val := after.get(instr.Operands[0].Reg)
+		if val.Kind == ValueConst && len(val.Values) == 1 {
+			refs = append(refs, dataRef{addr: addr, op: instr.Op, target: val.Values[0]})
+		}
+	}
+	return refs
+}
+
+// labelDataRefs keeps the references for the labels of the arguments and
+// labels the instructions already disassembled. Floats loaded from a
+// constant address become items themselves.
+func (doc *SoraDocument) labelDataRefs(refs []dataRef) {
+	vsa := NewValueSetAnalysis(doc)
+	for _, ref := range refs {
+		doc.DataManager.refs[ref.addr] = ref
+		if ref.mem && (ref.op == "lwc1" || ref.op == "lv.s") && doc.DataManager.Find(ref.target) == nil {
+			if word, ok := vsa.read32(ref.target); ok {
+				doc.DataManager.Create(ref.target, 4, DataFloat, strconv.FormatFloat(float64(math.Float32frombits(word)), 'g', -1, 32))
+			}
+		}
+	}
+	for _, ref := range refs {
+		if instr := doc.InstrManager.Get(ref.addr); instr != nil {
+			instr.Mnemonic, instr.Args = doc.InstructionArgs(instr)
+		}
+	}
+}
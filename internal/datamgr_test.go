@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverData(t *testing.T) {
+	doc := newEmuDocument()
+	putCode(doc, 0x8800000, models.MipsOpcode{},
+		0x3c040880, // lui a0, 0x880
+		0x24840200, // addiu a0, a0, 0x200
+		0x3c010880, // lui at, 0x880
+		0xc4200300, // lwc1 f0, 0x300(at)
+		0x8c280284, // lw t0, 0x284(at)
+	)
+	putCode(doc, 0x8800014, opJR, 0x03e00008, 0)
+	putFunction(doc, "main", 0x8800000, 0x1c)
+	putLeaf(doc, "f2", 0x8800040)
+	putLeaf(doc, "f3", 0x8800050)
+
+	copy(doc.Memory.data[0x200:], "Hello, world\x00")
+	copy(doc.Memory.data[0x220:], "héllo wörld\x00")
+	copy(doc.Memory.data[0x240:], "\x82\xa0\x82\xa2\x00")
+	putWords(doc, 0x8800280, 0x8800040, 0x8800050, 0x8800000)
+	putWords(doc, 0x8800300, 0x3fc00000)
+	// unaligned text is only kept when something points to it
+	copy(doc.Memory.data[0x2c1:], "junk text\x00")
+	copy(doc.Memory.data[0x2d1:], "pointed\x00")
+	putWords(doc, 0x88002f0, 0x88002d1)
+
+	doc.DiscoverData()
+
+	var items []SoraData
+	doc.DataManager.ForEach(func(data *SoraData) { items = append(items, *data) })
+	assert.Equal(t, []SoraData{
+		{Address: 0x8800200, Size: 13, Kind: DataASCII, Name: "str_08800200", Text: "Hello, world"},
+		{Address: 0x8800220, Size: 14, Kind: DataUTF8, Name: "str_08800220", Text: "héllo wörld"},
+		{Address: 0x8800240, Size: 5, Kind: DataShiftJIS, Name: "sjis_08800240", Text: `"\x82\xa0\x82\xa2"`},
+		{Address: 0x8800280, Size: 12, Kind: DataPointers, Name: "ptrs_08800280", Text: "3"},
+		{Address: 0x88002d1, Size: 8, Kind: DataASCII, Name: "str_088002d1", Text: "pointed"},
+		{Address: 0x8800300, Size: 4, Kind: DataFloat, Name: "flt_08800300", Text: "1.5"},
+	}, items)
+
+	instr := doc.Disasm(0x8800004)
+	assert.Equal(t, "str_08800200", instr.Args[2].Label)
+	assert.Equal(t, "a0 = &str_08800200", doc.PseudoStatement(instr))
+	assert.Equal(t, "flt_08800300", doc.Disasm(0x880000C).Args[1].Label)
+	assert.Equal(t, "ptrs_08800280+0x4", doc.Disasm(0x8800010).Args[1].Label)
+
+	// decoded again, as after a patch, the labels come back
+	disasmFrom(t, doc)
+	doc.InstrManager = NewInstructionManager(doc)
+	assert.Equal(t, "str_08800200", doc.Disasm(0x8800004).Args[2].Label)
+	assert.Equal(t, "flt_08800300", doc.Disasm(0x880000C).Args[1].Label)
+	assert.NotPanics(t, func() { doc.DataManager.labelArgs(0x8800004, nil) })
+
+	assert.Same(t, doc.DataManager.Get(0x88002d1), doc.DataManager.GetByName("str_088002d1"))
+	assert.Equal(t, "str_088002d1", *doc.SymMap.GetLabelName(0x88002d1))
+	addr, ok := doc.SymMap.GetLabelValue("flt_08800300")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0x8800300), addr)
+}
+
+func TestDiscoverDataNestedFunctions(t *testing.T) {
+	doc := newEmuDocument()
+	copy(doc.Memory.data[0x420:], "inside code\x00")
+	copy(doc.Memory.data[0x460:], "past the code\x00")
+	putCode(doc, 0x8800400, opJR, 0x03e00008, 0)
+	for addr := uint32(0x8800408); addr < 0x8800448; addr += 4 {
+		putWord(doc, addr, doc.readWord(addr), models.MipsOpcode{})
+	}
+	putFunction(doc, "outer", 0x8800400, 0x40)
+	putFunction(doc, "inner", 0x8800408, 0x8)
+	putFunction(doc, "overlap", 0x8800438, 0x10)
+
+	doc.DiscoverData()
+
+	var items []SoraData
+	doc.DataManager.ForEach(func(data *SoraData) { items = append(items, *data) })
+	assert.Equal(t, []SoraData{
+		{Address: 0x8800460, Size: 14, Kind: DataASCII, Name: "str_08800460", Text: "past the code"},
+	}, items)
+}
@@ -0,0 +1,440 @@
+package internal
+
+// DecodedInstruction is an instruction decoded from its encoding. Op is the
+// canonical mnemonic, aliases like li and move are not applied. Reads and
+// Writes leave out the zero register, VFPU vectors and matrices are listed
+// by their single registers.
+type DecodedInstruction struct {
+	Op       string
+	Operands []Operand
+	Reads    []Register
+	Writes   []Register
+	Access   *MemoryAccess
+}
+
+// MemoryAccess is the memory a load or store touches, Size bytes at Base +
+// Offset.
+type MemoryAccess struct {
+	Base   Register
+	Offset int32
+	Size   int
+	Store  bool
+}
+
+func (dec *DecodedInstruction) read(regs ...Register) {
+	for _, reg := range regs {
+		if reg != RegZero {
+			dec.Reads = append(dec.Reads, reg)
+		}
+	}
+}
+
+func (dec *DecodedInstruction) write(regs ...Register) {
+	for _, reg := range regs {
+		if reg != RegZero {
+			dec.Writes = append(dec.Writes, reg)
+		}
+	}
+}
+
+type mipsFields struct {
+	word uint32
+	addr uint32
+}
+
+func (f mipsFields) op() uint32    { return f.word >> 26 }
+func (f mipsFields) rs() Register  { return GPR(int(f.word>>21) & 31) }
+func (f mipsFields) rt() Register  { return GPR(int(f.word>>16) & 31) }
+func (f mipsFields) rd() Register  { return GPR(int(f.word>>11) & 31) }
+func (f mipsFields) sa() uint32    { return (f.word >> 6) & 31 }
+func (f mipsFields) funct() uint32 { return f.word & 63 }
+func (f mipsFields) imm() int32    { return int32(int16(f.word)) }
+func (f mipsFields) uimm() uint32  { return f.word & 0xffff }
+
+func (f mipsFields) branchTarget() uint32 {
+	return f.addr + 4 + uint32(f.imm()<<2)
+}
+
+func (f mipsFields) jumpTarget() uint32 {
+	return (f.addr+4)&0xf0000000 | (f.word&0x3ffffff)<<2
+}
+
+var specialOps = map[uint32]string{
+	0x00: "sll", 0x02: "srl", 0x03: "sra", 0x04: "sllv", 0x06: "srlv", 0x07: "srav",
+	0x08: "jr", 0x09: "jalr", 0x0a: "movz", 0x0b: "movn",
+	0x0c: "syscall", 0x0d: "break", 0x0f: "sync",
+	0x10: "mfhi", 0x11: "mthi", 0x12: "mflo", 0x13: "mtlo",
+	0x16: "clz", 0x17: "clo",
+	0x18: "mult", 0x19: "multu", 0x1a: "div", 0x1b: "divu", 0x1c: "madd", 0x1d: "maddu",
+	0x20: "add", 0x21: "addu", 0x22: "sub", 0x23: "subu",
+	0x24: "and", 0x25: "or", 0x26: "xor", 0x27: "nor",
+	0x2a: "slt", 0x2b: "sltu", 0x2c: "max", 0x2d: "min",
+	0x2e: "msub", 0x2f: "msubu",
+}
+
+var regimmOps = map[uint32]string{
+	0x00: "bltz", 0x01: "bgez", 0x02: "bltzl", 0x03: "bgezl",
+	0x10: "bltzal", 0x11: "bgezal", 0x12: "bltzall", 0x13: "bgezall",
+}
+
+var immOps = map[uint32]string{
+	0x08: "addi", 0x09: "addiu", 0x0a: "slti", 0x0b: "sltiu",
+	0x0c: "andi", 0x0d: "ori", 0x0e: "xori",
+}
+
+var branchOps = map[uint32]string{
+	0x04: "beq", 0x05: "bne", 0x06: "blez", 0x07: "bgtz",
+	0x14: "beql", 0x15: "bnel", 0x16: "blezl", 0x17: "bgtzl",
+}
+
+var memOps = map[uint32]string{
+	0x20: "lb", 0x21: "lh", 0x22: "lwl", 0x23: "lw", 0x24: "lbu", 0x25: "lhu", 0x26: "lwr",
+	0x28: "sb", 0x29: "sh", 0x2a: "swl", 0x2b: "sw", 0x2e: "swr",
+	0x30: "ll", 0x38: "sc",
+}
+
+var bshflOps = map[uint32]string{
+	0x02: "wsbh", 0x03: "wsbw", 0x10: "seb", 0x14: "bitrev", 0x18: "seh",
+}
+
+var memSizes = map[uint32]int{
+	0x20: 1, 0x21: 2, 0x22: 4, 0x23: 4, 0x24: 1, 0x25: 2, 0x26: 4,
+	0x28: 1, 0x29: 2, 0x2a: 4, 0x2b: 4, 0x2e: 4,
+	0x30: 4, 0x38: 4, 0x31: 4, 0x39: 4,
+}
+
+var bc1Ops = []string{"bc1f", "bc1t", "bc1fl", "bc1tl"}
+
+// fpuOps are the COP1 single format ops by funct, c.cond.s being 0x30 up.
+var fpuOps = map[uint32]string{
+	0x00: "add.s", 0x01: "sub.s", 0x02: "mul.s", 0x03: "div.s",
+	0x04: "sqrt.s", 0x05: "abs.s", 0x06: "mov.s", 0x07: "neg.s",
+	0x0c: "round.w.s", 0x0d: "trunc.w.s", 0x0e: "ceil.w.s", 0x0f: "floor.w.s",
+	0x24: "cvt.w.s",
+}
+
+var fpuConds = []string{
+	"f", "un", "eq", "ueq", "olt", "ult", "ole", "ule",
+	"sf", "ngle", "seq", "ngl", "lt", "nge", "le", "ngt",
+}
+
+// DecodeInstruction decodes the Allegrex instruction word at addr, nil when
+// the encoding is not known.
+func DecodeInstruction(addr, word uint32) *DecodedInstruction {
+	f := mipsFields{word, addr}
+	dec := &DecodedInstruction{}
+
+	switch op := f.op(); op {
+	case 0x00:
+		return decodeSpecial(f, dec)
+
+	case 0x01:
+		name, ok := regimmOps[uint32(f.rt().Num)]
+		if !ok {
+			return nil
+		}
+		dec.Op = name
+		dec.Operands = []Operand{RegOperand(f.rs()), TargetOperand(f.branchTarget())}
+		dec.read(f.rs())
+		if name[len(name)-2:] == "al" || name[len(name)-3:] == "all" {
+			dec.write(RegRA)
+		}
+
+	case 0x02, 0x03:
+		dec.Op = "j"
+		if op == 0x03 {
+			dec.Op = "jal"
+			dec.write(RegRA)
+		}
+		dec.Operands = []Operand{TargetOperand(f.jumpTarget())}
+
+	case 0x04, 0x05, 0x14, 0x15:
+		dec.Op = branchOps[op]
+		dec.Operands = []Operand{RegOperand(f.rs()), RegOperand(f.rt()), TargetOperand(f.branchTarget())}
+		dec.read(f.rs(), f.rt())
+
+	case 0x06, 0x07, 0x16, 0x17:
+		dec.Op = branchOps[op]
+		dec.Operands = []Operand{RegOperand(f.rs()), TargetOperand(f.branchTarget())}
+		dec.read(f.rs())
+
+	case 0x08, 0x09, 0x0a, 0x0b:
+		dec.Op = immOps[op]
+		dec.Operands = []Operand{RegOperand(f.rt()), RegOperand(f.rs()), ImmOperand(f.imm())}
+		dec.read(f.rs())
+		dec.write(f.rt())
+
+	case 0x0c, 0x0d, 0x0e:
+		dec.Op = immOps[op]
+		dec.Operands = []Operand{RegOperand(f.rt()), RegOperand(f.rs()), UImmOperand(f.uimm())}
+		dec.read(f.rs())
+		dec.write(f.rt())
+
+	case 0x0f:
+		dec.Op = "lui"
+		dec.Operands = []Operand{RegOperand(f.rt()), UImmOperand(f.uimm())}
+		dec.write(f.rt())
+
+	case 0x10:
+		return decodeCop0(f, dec)
+
+	case 0x11:
+		return decodeCop1(f, dec)
+
+	case 0x1f:
+		return decodeSpecial3(f, dec)
+
+	case 0x12, 0x18, 0x19, 0x1b, 0x32, 0x34, 0x35, 0x36, 0x37, 0x3a, 0x3c, 0x3d, 0x3e:
+		return decodeVfpu(f, dec)
+
+	case 0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x30:
+		dec.Op = memOps[op]
+		dec.Operands = []Operand{RegOperand(f.rt()), MemOperand(f.rs(), f.imm())}
+		dec.read(f.rs())
+		if op == 0x22 || op == 0x26 {
+			// lwl and lwr merge into rt
+			dec.read(f.rt())
+		}
+		dec.write(f.rt())
+		dec.Access = &MemoryAccess{Base: f.rs(), Offset: f.imm(), Size: memSizes[op]}
+
+	case 0x28, 0x29, 0x2a, 0x2b, 0x2e:
+		dec.Op = memOps[op]
+		dec.Operands = []Operand{RegOperand(f.rt()), MemOperand(f.rs(), f.imm())}
+		dec.read(f.rt(), f.rs())
+		dec.Access = &MemoryAccess{Base: f.rs(), Offset: f.imm(), Size: memSizes[op], Store: true}
+
+	case 0x38:
+		dec.Op = "sc"
+		dec.Operands = []Operand{RegOperand(f.rt()), MemOperand(f.rs(), f.imm())}
+		dec.read(f.rt(), f.rs())
+		dec.write(f.rt())
+		dec.Access = &MemoryAccess{Base: f.rs(), Offset: f.imm(), Size: 4, Store: true}
+
+	case 0x2f:
+		dec.Op = "cache"
+		dec.Operands = []Operand{UImmOperand(uint32(f.rt().Num)), MemOperand(f.rs(), f.imm())}
+		dec.read(f.rs())
+
+	case 0x31, 0x39:
+		ft := Register{RegFPR, f.rt().Num}
+		dec.Operands = []Operand{RegOperand(ft), MemOperand(f.rs(), f.imm())}
+		dec.read(f.rs())
+		dec.Access = &MemoryAccess{Base: f.rs(), Offset: f.imm(), Size: 4, Store: op == 0x39}
+		if op == 0x31 {
+			dec.Op = "lwc1"
+			dec.write(ft)
+		} else {
+			dec.Op = "swc1"
+			dec.read(ft)
+		}
+
+	default:
+		return nil
+	}
+	return dec
+}
+
+func decodeSpecial(f mipsFields, dec *DecodedInstruction) *DecodedInstruction {
+	funct := f.funct()
+	name, ok := specialOps[funct]
+	if !ok {
+		return nil
+	}
+	dec.Op = name
+	rs, rt, rd := f.rs(), f.rt(), f.rd()
+
+	switch funct {
+	case 0x00, 0x02, 0x03:
+		if funct == 0x02 && rs.Num == 1 {
+			dec.Op = "rotr"
+		}
+		dec.Operands = []Operand{RegOperand(rd), RegOperand(rt), UImmOperand(f.sa())}
+		dec.read(rt)
+		dec.write(rd)
+	case 0x04, 0x06, 0x07:
+		if funct == 0x06 && f.sa() == 1 {
+			dec.Op = "rotrv"
+		}
+		dec.Operands = []Operand{RegOperand(rd), RegOperand(rt), RegOperand(rs)}
+		dec.read(rt, rs)
+		dec.write(rd)
+	case 0x08:
+		dec.Operands = []Operand{RegOperand(rs)}
+		dec.read(rs)
+	case 0x09:
+		dec.Operands = []Operand{RegOperand(rd), RegOperand(rs)}
+		dec.read(rs)
+		dec.write(rd)
+	case 0x0a, 0x0b:
+		dec.Operands = []Operand{RegOperand(rd), RegOperand(rs), RegOperand(rt)}
+		// the destination is kept when the condition fails
+		dec.read(rs, rt, rd)
+		dec.write(rd)
+	case 0x0c, 0x0d:
+		dec.Operands = []Operand{UImmOperand((f.word >> 6) & 0xfffff)}
+	case 0x0f:
+	case 0x10, 0x12:
+		src := RegHI
+		if funct == 0x12 {
+			src = RegLO
+		}
+		dec.Operands = []Operand{RegOperand(rd)}
+		dec.read(src)
+		dec.write(rd)
+	case 0x11, 0x13:
+		dst := RegHI
+		if funct == 0x13 {
+			dst = RegLO
+		}
+		dec.Operands = []Operand{RegOperand(rs)}
+		dec.read(rs)
+		dec.write(dst)
+	case 0x16, 0x17:
+		dec.Operands = []Operand{RegOperand(rd), RegOperand(rs)}
+		dec.read(rs)
+		dec.write(rd)
+	case 0x18, 0x19, 0x1a, 0x1b:
+		dec.Operands = []Operand{RegOperand(rs), RegOperand(rt)}
+		dec.read(rs, rt)
+		dec.write(RegHI, RegLO)
+	case 0x1c, 0x1d, 0x2e, 0x2f:
+		dec.Operands = []Operand{RegOperand(rs), RegOperand(rt)}
+		dec.read(rs, rt, RegHI, RegLO)
+		dec.write(RegHI, RegLO)
+	default:
+		dec.Operands = []Operand{RegOperand(rd), RegOperand(rs), RegOperand(rt)}
+		dec.read(rs, rt)
+		dec.write(rd)
+	}
+	return dec
+}
+
+func decodeCop0(f mipsFields, dec *DecodedInstruction) *DecodedInstruction {
+	rt := f.rt()
+	c0 := Register{RegCOP0, f.rd().Num}
+	switch f.rs().Num {
+	case 0x00:
+		dec.Op = "mfc0"
+		dec.Operands = []Operand{RegOperand(rt), RegOperand(c0)}
+		dec.read(c0)
+		dec.write(rt)
+	case 0x04:
+		dec.Op = "mtc0"
+		dec.Operands = []Operand{RegOperand(rt), RegOperand(c0)}
+		dec.read(rt)
+		dec.write(c0)
+	case 0x10:
+		if f.funct() != 0x18 {
+			return nil
+		}
+		dec.Op = "eret"
+	default:
+		return nil
+	}
+	return dec
+}
+
+func decodeCop1(f mipsFields, dec *DecodedInstruction) *DecodedInstruction {
+	rt := f.rt()
+	fs := Register{RegFPR, f.rd().Num}
+	fcr := Register{RegFCR, f.rd().Num}
+	switch f.rs().Num {
+	case 0x00:
+		dec.Op = "mfc1"
+		dec.Operands = []Operand{RegOperand(rt), RegOperand(fs)}
+		dec.read(fs)
+		dec.write(rt)
+	case 0x02:
+		dec.Op = "cfc1"
+		dec.Operands = []Operand{RegOperand(rt), RegOperand(fcr)}
+		dec.read(fcr)
+		dec.write(rt)
+	case 0x04:
+		dec.Op = "mtc1"
+		dec.Operands = []Operand{RegOperand(rt), RegOperand(fs)}
+		dec.read(rt)
+		dec.write(fs)
+	case 0x06:
+		dec.Op = "ctc1"
+		dec.Operands = []Operand{RegOperand(rt), RegOperand(fcr)}
+		dec.read(rt)
+		dec.write(fcr)
+	case 0x08:
+		dec.Op = bc1Ops[rt.Num&3]
+		dec.Operands = []Operand{TargetOperand(f.branchTarget())}
+		dec.read(RegFCSR)
+	case 0x10:
+		return decodeFpu(f, dec)
+	case 0x14:
+		if f.funct() != 0x20 {
+			return nil
+		}
+		dec.Op = "cvt.s.w"
+		fd := Register{RegFPR, int(f.sa())}
+		dec.Operands = []Operand{RegOperand(fd), RegOperand(fs)}
+		dec.read(fs)
+		dec.write(fd)
+	default:
+		return nil
+	}
+	return dec
+}
+
+// decodeFpu decodes the single format arithmetic, fd = fs op ft.
+func decodeFpu(f mipsFields, dec *DecodedInstruction) *DecodedInstruction {
+	fd := Register{RegFPR, int(f.sa())}
+	fs := Register{RegFPR, f.rd().Num}
+	ft := Register{RegFPR, f.rt().Num}
+	funct := f.funct()
+	if funct >= 0x30 {
+		dec.Op = "c." + fpuConds[funct&15] + ".s"
+		dec.Operands = []Operand{RegOperand(fs), RegOperand(ft)}
+		dec.read(fs, ft)
+		dec.write(RegFCSR)
+		return dec
+	}
+
+	name, ok := fpuOps[funct]
+	if !ok {
+		return nil
+	}
+	dec.Op = name
+	if funct < 0x04 {
+		dec.Operands = []Operand{RegOperand(fd), RegOperand(fs), RegOperand(ft)}
+		dec.read(fs, ft)
+	} else {
+		dec.Operands = []Operand{RegOperand(fd), RegOperand(fs)}
+		dec.read(fs)
+	}
+	dec.write(fd)
+	return dec
+}
+
+func decodeSpecial3(f mipsFields, dec *DecodedInstruction) *DecodedInstruction {
+	rs, rt, rd := f.rs(), f.rt(), f.rd()
+	switch f.funct() {
+	case 0x00:
+		dec.Op = "ext"
+		dec.Operands = []Operand{RegOperand(rt), RegOperand(rs), UImmOperand(f.sa()), UImmOperand(uint32(rd.Num) + 1)}
+		dec.read(rs)
+		dec.write(rt)
+	case 0x04:
+		dec.Op = "ins"
+		dec.Operands = []Operand{RegOperand(rt), RegOperand(rs), UImmOperand(f.sa()), UImmOperand(uint32(rd.Num) - f.sa() + 1)}
+		dec.read(rs, rt)
+		dec.write(rt)
+	case 0x20:
+		name, ok := bshflOps[f.sa()]
+		if !ok {
+			return nil
+		}
+		dec.Op = name
+		dec.Operands = []Operand{RegOperand(rd), RegOperand(rt)}
+		dec.read(rt)
+		dec.write(rd)
+	default:
+		return nil
+	}
+	return dec
+}
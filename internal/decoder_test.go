@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeInstruction(t *testing.T) {
+	dec := DecodeInstruction(0x8804000, 0x27bdffe0)
+	assert.Equal(t, "addiu", dec.Op)
+	assert.Equal(t, []Operand{RegOperand(RegSP), RegOperand(RegSP), ImmOperand(-0x20)}, dec.Operands)
+	assert.Equal(t, []Register{RegSP}, dec.Reads)
+	assert.Equal(t, []Register{RegSP}, dec.Writes)
+
+	dec = DecodeInstruction(0x8804000, 0x8fbf0014)
+	assert.Equal(t, "lw", dec.Op)
+	assert.Equal(t, []Operand{RegOperand(RegRA), MemOperand(RegSP, 0x14)}, dec.Operands)
+	assert.Equal(t, "0x14(sp)", dec.Operands[1].String())
+
+	dec = DecodeInstruction(0x8804000, 0xafb00010)
+	assert.Equal(t, "sw", dec.Op)
+	assert.Equal(t, []Register{GPR(16), RegSP}, dec.Reads)
+	assert.Empty(t, dec.Writes)
+
+	dec = DecodeInstruction(0x8804000, 0x03e00008)
+	assert.Equal(t, "jr", dec.Op)
+	assert.Equal(t, []Register{RegRA}, dec.Reads)
+
+	dec = DecodeInstruction(0x8804000, 0x0e201040)
+	assert.Equal(t, "jal", dec.Op)
+	assert.Equal(t, []Operand{TargetOperand(0x8804100)}, dec.Operands)
+	assert.Equal(t, []Register{RegRA}, dec.Writes)
+
+	dec = DecodeInstruction(0x8804000, 0x10800003)
+	assert.Equal(t, "beq", dec.Op)
+	assert.Equal(t, TargetOperand(0x8804010), dec.Operands[2])
+	assert.Equal(t, []Register{GPR(4)}, dec.Reads)
+
+	dec = DecodeInstruction(0x8804000, 0x00850018)
+	assert.Equal(t, "mult", dec.Op)
+	assert.Equal(t, []Register{RegHI, RegLO}, dec.Writes)
+
+	dec = DecodeInstruction(0x8804000, 0x7c823900)
+	assert.Equal(t, "ext", dec.Op)
+	assert.Equal(t, []Operand{RegOperand(GPR(2)), RegOperand(GPR(4)), UImmOperand(4), UImmOperand(8)}, dec.Operands)
+
+	dec = DecodeInstruction(0x8804000, 0x44026000)
+	assert.Equal(t, "mfc1", dec.Op)
+	assert.Equal(t, []Register{{RegFPR, 12}}, dec.Reads)
+	assert.Equal(t, []Register{GPR(2)}, dec.Writes)
+
+	dec = DecodeInstruction(0x8804000, 0)
+	assert.Equal(t, "sll", dec.Op)
+	assert.Empty(t, dec.Reads)
+	assert.Empty(t, dec.Writes)
+
+	assert.Nil(t, DecodeInstruction(0x8804000, 0xfc000000))
+}
+
+func TestLookupRegister(t *testing.T) {
+	for _, reg := range []Register{RegZero, RegSP, RegRA, RegHI, {RegFPR, 12}, {RegFCR, 31}, {RegCOP0, 12}, {RegVFPU, 0x25}} {
+		found, ok := LookupRegister(reg.Name())
+		assert.True(t, ok, reg.Name())
+		assert.Equal(t, reg, found)
+	}
+	_, ok := LookupRegister("10")
+	assert.False(t, ok)
+
+	arg := NewSoraArgument("10", nil)
+	assert.Equal(t, ArgImm, arg.Type)
+	assert.Equal(t, 10, arg.ValOfs)
+}
+
+func TestInstructionArgs(t *testing.T) {
+	doc := newTestDocument()
+	decode := func(addr, word uint32, dizz string) *SoraInstruction {
+		instr := doc.InstrManager.Create(addr, &models.MipsOpcode{Address: addr, Encoded: word, Dizz: dizz})
+		assert.True(t, instr.Decode())
+		instr.Mnemonic, instr.Args = doc.InstructionArgs(instr)
+		return instr
+	}
+
+	instr := decode(0x8804000, 0x24020005, "li\tv0,0x5")
+	assert.Equal(t, "li", instr.Mnemonic)
+	assert.Equal(t, []*SoraArgument{{Type: ArgReg, Reg: "v0"}, {Type: ArgImm, ValOfs: 5}}, instr.Args)
+
+	instr = decode(0x8804004, 0x02002021, "move\ta0,s0")
+	assert.Equal(t, []*SoraArgument{{Type: ArgReg, Reg: "a0"}, {Type: ArgReg, Reg: "s0"}}, instr.Args)
+
+	instr = decode(0x8804008, 0x03e00008, "jr\t->ra")
+	assert.True(t, instr.Args[0].IsCodeLocation)
+	assert.True(t, isReturnInstr(instr))
+
+	instr = decode(0x880400C, 0, "nop")
+	assert.Empty(t, instr.Args)
+
+	instr = decode(0x8804010, 0x8fbf0014, "")
+	assert.Equal(t, "lw", instr.Mnemonic)
+	assert.Equal(t, &SoraArgument{Type: ArgMem, Reg: "sp", ValOfs: 0x14}, instr.Args[1])
+	assert.True(t, instr.WritesReg(RegRA))
+	assert.True(t, instr.ReadsReg(RegSP))
+}
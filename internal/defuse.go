@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefEntry stands for the value a register has when the function is
+// entered, no instruction has the address 0.
+const DefEntry uint32 = 0
+
+// DefUse links the registers each instruction reads to the instructions that
+// may have written them, by reaching definitions over the CFG. VFPU vectors
+// are tracked by their single registers.
+type DefUse struct {
+	CFG *FunctionCFG
+
+	Uses map[uint32]map[Register][]uint32 // use address -> reg -> defs
+	Defs map[uint32]map[Register][]uint32 // def address -> reg -> uses
+}
+
+// callerSaved are the registers a call may change besides ra.
+var callerSaved = []Register{
+	GPR(1), GPR(2), GPR(3), GPR(4), GPR(5), GPR(6), GPR(7),
+	GPR(8), GPR(9), GPR(10), GPR(11), GPR(12), GPR(13), GPR(14), GPR(15),
+	GPR(24), GPR(25), RegHI, RegLO,
+}
+
+// callArgs are the registers a call is taken to read.
+var callArgs = []Register{GPR(4), GPR(5), GPR(6), GPR(7)}
+
+// reachingDefs maps a register to the sorted addresses defining it, a
+// register missing has only DefEntry.
+type reachingDefs map[Register][]uint32
+
+func (defs reachingDefs) get(reg Register) []uint32 {
+	if addrs, ok := defs[reg]; ok {
+		return addrs
+	}
+	return []uint32{DefEntry}
+}
+
+func (defs reachingDefs) equal(other reachingDefs) bool {
+	if len(defs) != len(other) {
+		return false
+	}
+	for reg, addrs := range defs {
+		other_addrs, ok := other[reg]
+		if !ok || len(addrs) != len(other_addrs) {
+			return false
+		}
+		for i := range addrs {
+			if addrs[i] != other_addrs[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func mergeDefs(sets []reachingDefs) reachingDefs {
+	merged := make(reachingDefs)
+	seen := make(map[Register]map[uint32]bool)
+	for _, defs := range sets {
+		for reg := range defs {
+			if seen[reg] == nil {
+				seen[reg] = make(map[uint32]bool)
+			}
+		}
+	}
+	for reg, addrs := range seen {
+		for _, defs := range sets {
+			for _, addr := range defs.get(reg) {
+				addrs[addr] = true
+			}
+		}
+		for addr := range addrs {
+			merged[reg] = append(merged[reg], addr)
+		}
+		sort.Slice(merged[reg], func(i, j int) bool { return merged[reg][i] < merged[reg][j] })
+	}
+	return merged
+}
+
+// defUseStep is what one instruction reads and then writes.
+type defUseStep struct {
+	addr   uint32
+	reads  []Register
+	writes []Register
+}
+
+// blockSteps lists the steps of a block. Calls read their arguments and
+// clobber the caller-saved registers after their delay slot.
+func (cfg *FunctionCFG) blockSteps(block *CFGBlock) []defUseStep {
+	doc := cfg.doc()
+	var steps []defUseStep
+	var clobber *defUseStep
+	for addr := block.Address; addr <= block.LastAddress; addr += 4 {
+		instr := doc.Disasm(addr)
+		if instr == nil {
+			continue
+		}
+		step := defUseStep{addr: addr, reads: instr.Reads, writes: instr.Writes}
+		if instr.Info.IsLinkedBranch {
+			step.reads = append(append([]Register{}, step.reads...), callArgs...)
+			call := defUseStep{addr: addr, writes: callerSaved}
+			if instr.Info.HasDelaySlot && addr < block.LastAddress {
+				steps = append(steps, step)
+				clobber = &call
+				continue
+			}
+			step.writes = append(append([]Register{}, step.writes...), callerSaved...)
+		}
+		steps = append(steps, step)
+		if clobber != nil {
+			steps = append(steps, *clobber)
+			clobber = nil
+		}
+	}
+	return steps
+}
+
+func applySteps(defs reachingDefs, steps []defUseStep, use func(addr uint32, reg Register, defs []uint32)) reachingDefs {
+	out := make(reachingDefs, len(defs))
+	for reg, addrs := range defs {
+		out[reg] = addrs
+	}
+	for _, step := range steps {
+		if use != nil {
+			for _, reg := range step.reads {
+				use(step.addr, reg, out.get(reg))
+			}
+		}
+		for _, reg := range step.writes {
+			out[reg] = []uint32{step.addr}
+		}
+	}
+	return out
+}
+
+// DefUse computes the def-use chains of the function from the decoded
+// instructions, those not decoded are taken to touch no register.
+func (cfg *FunctionCFG) DefUse() *DefUse {
+	du := &DefUse{
+		CFG:  cfg,
+		Uses: make(map[uint32]map[Register][]uint32),
+		Defs: make(map[uint32]map[Register][]uint32),
+	}
+
+	order := cfg.ReversePostorder()
+	in_order := make(map[int]bool)
+	for _, b := range order {
+		in_order[b] = true
+	}
+	for b := range cfg.Blocks {
+		if !in_order[b] {
+			order = append(order, b)
+		}
+	}
+
+	steps := make([][]defUseStep, len(cfg.Blocks))
+	for _, b := range order {
+		steps[b] = cfg.blockSteps(cfg.Blocks[b])
+	}
+
+	ins := make([]reachingDefs, len(cfg.Blocks))
+	outs := make([]reachingDefs, len(cfg.Blocks))
+	for changed := true; changed; {
+		changed = false
+		for _, b := range order {
+			var sets []reachingDefs
+			for _, pred := range cfg.Blocks[b].Preds {
+				if outs[pred] != nil {
+					sets = append(sets, outs[pred])
+				}
+			}
+			if b == 0 || len(sets) == 0 {
+				sets = append(sets, reachingDefs{})
+			}
+			ins[b] = mergeDefs(sets)
+			out := applySteps(ins[b], steps[b], nil)
+			if outs[b] == nil || !out.equal(outs[b]) {
+				outs[b] = out
+				changed = true
+			}
+		}
+	}
+
+	for _, b := range order {
+		applySteps(ins[b], steps[b], func(addr uint32, reg Register, defs []uint32) {
+			if du.Uses[addr] == nil {
+				du.Uses[addr] = make(map[Register][]uint32)
+			}
+			du.Uses[addr][reg] = defs
+			for _, def := range defs {
+				if du.Defs[def] == nil {
+					du.Defs[def] = make(map[Register][]uint32)
+				}
+				du.Defs[def][reg] = append(du.Defs[def][reg], addr)
+			}
+		})
+	}
+	for _, regs := range du.Defs {
+		for reg, uses := range regs {
+			sort.Slice(uses, func(i, j int) bool { return uses[i] < uses[j] })
+			uniq := uses[:0]
+			for i, use := range uses {
+				if i == 0 || use != uses[i-1] {
+					uniq = append(uniq, use)
+				}
+			}
+			regs[reg] = uniq
+		}
+	}
+	return du
+}
+
+// Reaching lists the definitions of reg the instruction at addr may read.
+func (du *DefUse) Reaching(addr uint32, reg Register) []uint32 {
+	return du.Uses[addr][reg]
+}
+
+// UsesOf lists the instructions that may read reg as defined at addr.
+func (du *DefUse) UsesOf(addr uint32, reg Register) []uint32 {
+	return du.Defs[addr][reg]
+}
+
+func (du *DefUse) Dump() {
+	var addrs []uint32
+	for addr := range du.Uses {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	for _, addr := range addrs {
+		fmt.Printf("0x%08x", addr)
+		var regs []Register
+		for reg := range du.Uses[addr] {
+			regs = append(regs, reg)
+		}
+		sort.Slice(regs, func(i, j int) bool { return regs[i].Name() < regs[j].Name() })
+		for _, reg := range regs {
+			defs := du.Uses[addr][reg]
+			fmt.Printf(" %s<-", reg.Name())
+			for i, def := range defs {
+				if i > 0 {
+					fmt.Printf(",")
+				}
+				if def == DefEntry {
+					fmt.Printf("entry")
+				} else {
+					fmt.Printf("0x%08x", def)
+				}
+			}
+		}
+		fmt.Println()
+	}
+}
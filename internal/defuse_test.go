@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefUseJoin(t *testing.T) {
+	doc := newTestDocument()
+	info := opBranch
+	info.BranchTarget = 0x8808010
+	putWord(doc, 0x8808000, 0x10800003, info)
+	putWord(doc, 0x8808004, 0x00000000, models.MipsOpcode{})
+	putWord(doc, 0x8808008, 0x24020001, models.MipsOpcode{})
+	putWord(doc, 0x880800C, 0x24030002, models.MipsOpcode{})
+	putWord(doc, 0x8808010, 0x00431021, models.MipsOpcode{})
+	putWord(doc, 0x8808014, 0x03e00008, opJR)
+	putWord(doc, 0x8808018, 0x00000000, models.MipsOpcode{})
+	fun := putFunction(doc, "join", 0x8808000, 0x1c)
+
+	du := NewFunctionAnalyzer(doc, fun).BuildCFG().DefUse()
+	assert.Equal(t, []uint32{DefEntry}, du.Reaching(0x8808000, GPR(4)))
+	assert.Equal(t, []uint32{DefEntry, 0x8808008}, du.Reaching(0x8808010, GPR(2)))
+	assert.Equal(t, []uint32{DefEntry, 0x880800C}, du.Reaching(0x8808010, GPR(3)))
+	assert.Equal(t, []uint32{0x8808010}, du.UsesOf(0x8808008, GPR(2)))
+	assert.Equal(t, []uint32{DefEntry}, du.Reaching(0x8808014, RegRA))
+}
+
+func TestDefUseVfpu(t *testing.T) {
+	doc := newTestDocument()
+	putWord(doc, 0x8808000, 0xd8810010, models.MipsOpcode{}) // lv.q C010, 0x10(a0)
+	putWord(doc, 0x8808004, 0x60028180, models.MipsOpcode{}) // vadd.q C000, C010, C020
+	putWord(doc, 0x8808008, 0x64828180, models.MipsOpcode{}) // vdot.q S000, C010, C020
+	putWord(doc, 0x880800C, 0x03e00008, opJR)
+	putWord(doc, 0x8808010, 0x00000000, models.MipsOpcode{})
+	fun := putFunction(doc, "vec", 0x8808000, 0x14)
+
+	du := NewFunctionAnalyzer(doc, fun).BuildCFG().DefUse()
+	s011, _ := LookupRegister("S011")
+	s020, _ := LookupRegister("S020")
+	assert.Equal(t, []uint32{0x8808000}, du.Reaching(0x8808004, s011))
+	assert.Equal(t, []uint32{DefEntry}, du.Reaching(0x8808004, s020))
+	assert.Equal(t, []uint32{0x8808004, 0x8808008}, du.UsesOf(0x8808000, s011))
+}
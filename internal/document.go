@@ -2,6 +2,7 @@ package internal
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -31,10 +32,11 @@ type PSPModule struct {
 }
 
 type SoraFunction struct {
-	Name        string   `yaml:"name"`
-	Address     uint32   `yaml:"address"`
-	Size        uint32   `yaml:"size"`
-	BBAddresses []uint32 `yaml:"bb_addresses"`
+	Name        string          `yaml:"name"`
+	Address     uint32          `yaml:"address"`
+	Size        uint32          `yaml:"size"`
+	BBAddresses []uint32        `yaml:"bb_addresses"`
+	Frame       *SoraStackFrame `yaml:"frame,omitempty"`
 }
 
 func (fun *SoraFunction) LastAddress() uint32 {
@@ -43,14 +45,23 @@ func (fun *SoraFunction) LastAddress() uint32 {
 
 func (fun *SoraFunction) SetLastAddress(last_addr uint32) {
 	fun.Size = last_addr - fun.Address + 4
+	// the frame was derived from the old boundary
+	fun.Frame = nil
 }
 
-func (fun *SoraFunction) AddBB(bb_addr uint32) {
+func (fun *SoraFunction) HasBB(bb_addr uint32) bool {
 	for _, ex_bb := range fun.BBAddresses {
 		if ex_bb == bb_addr {
-			return
+			return true
 		}
 	}
+	return false
+}
+
+func (fun *SoraFunction) AddBB(bb_addr uint32) {
+	if fun.HasBB(bb_addr) {
+		return
+	}
 
 	fun.BBAddresses = append(fun.BBAddresses, bb_addr)
 }
@@ -97,9 +108,12 @@ type SoraDocument struct {
 	BBManager    *BasicBlockManager
 	FunManager   *FunctionManager
 	InstrManager *InstructionManager
+	DataManager  *DataManager
+	PatchManager *PatchManager
 
 	// MemoryDump
-	buf unsafe.Pointer
+	buf    unsafe.Pointer
+	Memory *Memory
 
 	// UseDef Analyzer
 
@@ -110,6 +124,17 @@ type SoraDocument struct {
 	mapNameToFunc map[string][]int
 
 	EntryAddr uint32
+
+	// Log receives the INFO, WARNING and ERROR lines, os.Stdout when nil
+	Log io.Writer
+}
+
+func (doc *SoraDocument) logf(format string, a ...any) {
+	w := io.Writer(os.Stdout)
+	if doc != nil && doc.Log != nil {
+		w = doc.Log
+	}
+	fmt.Fprintf(w, format, a...)
 }
 
 func (doc *SoraDocument) LoadYaml(filename string) error {
@@ -133,14 +158,29 @@ func (doc *SoraDocument) LoadMemory(filename string) error {
 		return err
 	}
 	doc.buf = bridge.GlobalSetMemoryBase(data, doc.yaml.Memory.Start)
+	doc.Memory = NewMemory(data, doc.yaml.Memory.Start)
+	if doc.buf != nil {
+		doc.Memory.bridge = unsafe.Slice((*byte)(doc.buf), len(data))
+	}
 
 	return nil
 }
 
-func NewSoraDocument(path string, load_analyzed bool) (*SoraDocument, error) {
+// NewSoraDocument loads the dump at path, traces are the recordings to
+// parse relative to path, SoraBBTrace.rec when none given.
+func NewSoraDocument(path string, load_analyzed bool, traces ...string) (*SoraDocument, error) {
 	main_yaml := filepath.Join(path, "Sora.yaml")
 	main_data := filepath.Join(path, "SoraMemory.bin")
-	bb_data := filepath.Join(path, "SoraBBTrace.rec")
+	bb_data := []string{filepath.Join(path, "SoraBBTrace.rec")}
+	if len(traces) > 0 {
+		bb_data = nil
+		for _, trace := range traces {
+			if !filepath.IsAbs(trace) {
+				trace = filepath.Join(path, trace)
+			}
+			bb_data = append(bb_data, trace)
+		}
+	}
 
 	doc := &SoraDocument{
 		SymMap:        CreateSymbolMap(),
@@ -149,10 +189,12 @@ func NewSoraDocument(path string, load_analyzed bool) (*SoraDocument, error) {
 	}
 	bridge.GlobalSetSymbolMap(doc.SymMap.ptr)
 	bridge.GlobalSetGetFuncNameFunc(doc.GetHLEFuncName)
-	doc.Parser = NewBBTraceParser(doc, bb_data)
+	doc.Parser = NewBBTraceParser(doc, bb_data...)
 	doc.BBManager = NewBasicBlockManager(doc)
 	doc.FunManager = NewFunctionManager(doc)
 	doc.InstrManager = NewInstructionManager(doc)
+	doc.DataManager = NewDataManager(doc)
+	doc.PatchManager = NewPatchManager(doc)
 
 	err := doc.LoadYaml(main_yaml)
 	if err != nil {
@@ -199,18 +241,24 @@ func (doc *SoraDocument) Delete() {
 	doc.SymMap.Delete()
 }
 
+// memoryIsValidAddress and mipsAnalystGetOpcodeInfo are replaced in tests,
+// where the bridge has no memory.
+var (
+	memoryIsValidAddress     = bridge.MemoryIsValidAddress
+	mipsAnalystGetOpcodeInfo = bridge.MIPSAnalystGetOpcodeInfo
+)
+
 func (doc *SoraDocument) Disasm(address uint32) *SoraInstruction {
-	if !bridge.MemoryIsValidAddress(address) {
+	if !memoryIsValidAddress(address) {
 		return nil
 	}
 	instr := doc.InstrManager.Get(address)
 	if instr != nil {
 		return instr
 	}
-	instr = doc.InstrManager.Create(address, bridge.MIPSAnalystGetOpcodeInfo(address))
-	mnemonic, args := doc.ParseDizz(instr.Info.Dizz)
-	instr.Mnemonic = mnemonic
-	instr.Args = args
+	instr = doc.InstrManager.Create(address, mipsAnalystGetOpcodeInfo(address))
+	instr.Decode()
+	instr.Mnemonic, instr.Args = doc.InstructionArgs(instr)
 	return instr
 }
 
@@ -232,7 +280,7 @@ type SoraArgument struct {
 }
 
 func NewSoraArgument(opr string, labellookup func(uint32) *string) (arg *SoraArgument) {
-	if len(opr) == 2 {
+	if _, ok := LookupRegister(opr); ok {
 		return &SoraArgument{
 			Type: ArgReg,
 			Reg:  opr,
@@ -278,21 +326,82 @@ func NewSoraArgument(opr string, labellookup func(uint32) *string) (arg *SoraArg
 	return
 }
 
+func splitDizz(dizz string) (mnemonic string, params []string) {
+	fields := strings.Split(dizz, "\t")
+	mnemonic = fields[0]
+	for _, field := range fields[1:] {
+		params = append(params, strings.Split(field, ",")...)
+	}
+	return
+}
+
 func (doc *SoraDocument) ParseDizz(dizz string) (mnemonic string, arguments []*SoraArgument) {
-	params := strings.Split(dizz, "\t")
-	mnemonic = params[0]
-
-	for _, param := range params[1:] {
-		argz := strings.Split(param, ",")
-		for _, a := range argz {
-			var arg *SoraArgument = NewSoraArgument(a, doc.SymMap.GetLabelName)
-			arguments = append(arguments, arg)
-		}
+	mnemonic, params := splitDizz(dizz)
+	for _, a := range params {
+		var arg *SoraArgument = NewSoraArgument(a, doc.SymMap.GetLabelName)
+		arguments = append(arguments, arg)
 	}
 
 	return
 }
 
+// InstructionArgs gives the disassembler's mnemonic with the arguments
+// taken from the decoded operands. Aliases like li and move leave out zero
+// register operands, the text is only parsed when the two can't be matched.
+// Arguments addressing a data item get its label.
+func (doc *SoraDocument) InstructionArgs(instr *SoraInstruction) (string, []*SoraArgument) {
+	mnemonic, arguments := doc.instructionArgs(instr)
+	if doc.DataManager != nil {
+		doc.DataManager.labelArgs(instr.Address, arguments)
+	}
+	return mnemonic, arguments
+}
+
+func (doc *SoraDocument) instructionArgs(instr *SoraInstruction) (string, []*SoraArgument) {
+	if instr.Op == "" {
+		return doc.ParseDizz(instr.Info.Dizz)
+	}
+
+	operands := instr.Operands
+	mnemonic, params := splitDizz(instr.Info.Dizz)
+	if instr.Info.Dizz == "" {
+		mnemonic = instr.Op
+		params = nil
+		for _, opr := range operands {
+			params = append(params, opr.String())
+		}
+	}
+
+	if len(params) != len(operands) {
+		operands = nil
+		for _, opr := range instr.Operands {
+			if opr.Kind != OperandReg || opr.Reg != RegZero {
+				operands = append(operands, opr)
+			}
+		}
+		if len(params) == 0 {
+			operands = nil
+		}
+	}
+	if len(params) != len(operands) {
+		return doc.ParseDizz(instr.Info.Dizz)
+	}
+
+	var lookup func(uint32) *string
+	if doc.SymMap != nil {
+		lookup = doc.SymMap.GetLabelName
+	}
+	var arguments []*SoraArgument
+	for i, opr := range operands {
+		arg := opr.Argument(lookup)
+		if strings.HasPrefix(params[i], "->") {
+			arg.IsCodeLocation = true
+		}
+		arguments = append(arguments, arg)
+	}
+	return mnemonic, arguments
+}
+
 func (doc *SoraDocument) ProcessBB(start_addr uint32, last_addr uint32, cb BBYieldFunc) int {
 	var bbas BBAnalState
 	bbas.Init()
@@ -302,14 +411,22 @@ func (doc *SoraDocument) ProcessBB(start_addr uint32, last_addr uint32, cb BBYie
 		bbas.SetBB(addr)
 
 		instr := doc.Disasm(addr)
+		if instr == nil {
+			doc.logf("WARNING:\tno instruction at 0x%08x\n", addr)
+			bbas.Yield(addr-4, cb)
+			return bbas.Count
+		}
 
 		bbas.Append(instr)
 
 		if instr.Info.IsBranch {
+			if bbas.BranchAddr != 0 {
+				doc.logf("WARNING:\tSetBranch already set\n")
+			}
 			bbas.SetBranch(addr)
 
 			if !instr.Info.HasDelaySlot {
-				fmt.Printf("WARNING:\tunhandled branch without delay shot\n")
+				doc.logf("WARNING:\tunhandled branch without delay shot\n")
 				bbas.Yield(addr, cb)
 
 				if last_addr == 0 && instr.Info.IsConditional {
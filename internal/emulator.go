@@ -0,0 +1,578 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// EmuReturnAddress is put in ra so the emulated function returns to it.
+const EmuReturnAddress uint32 = 0xfffffff0
+
+type EmuStop string
+
+const (
+	EmuReturned  EmuStop = "return"
+	EmuStepLimit EmuStop = "limit"
+	EmuFault     EmuStop = "fault"   // bad memory access
+	EmuUnknown   EmuStop = "unknown" // instruction not decoded or not integer
+	EmuBreak     EmuStop = "break"
+)
+
+// EmuRegs is the integer register state.
+type EmuRegs struct {
+	GPR [32]uint32
+	HI  uint32
+	LO  uint32
+	PC  uint32
+}
+
+// Set assigns a register by name, like "a0" or "hi".
+func (regs *EmuRegs) Set(name string, val uint32) error {
+	reg, ok := LookupRegister(name)
+	if !ok {
+		return fmt.Errorf("unknown register %s", name)
+	}
+	return regs.SetReg(reg, val)
+}
+
+func (regs *EmuRegs) SetReg(reg Register, val uint32) error {
+	switch {
+	case reg.Class == RegGPR:
+		if reg.Num != 0 {
+			regs.GPR[reg.Num] = val
+		}
+	case reg == RegHI:
+		regs.HI = val
+	case reg == RegLO:
+		regs.LO = val
+	default:
+		return fmt.Errorf("register %s is not emulated", reg.Name())
+	}
+	return nil
+}
+
+func (regs *EmuRegs) Reg(reg Register) uint32 {
+	switch {
+	case reg.Class == RegGPR:
+		return regs.GPR[reg.Num]
+	case reg == RegHI:
+		return regs.HI
+	case reg == RegLO:
+		return regs.LO
+	}
+	return 0
+}
+
+// EmuMemory is a copy-on-write view of the document memory, writes go to
+// an overlay and the memory is left as it is.
+type EmuMemory struct {
+	mem   *Memory
+	dirty map[uint32]byte
+}
+
+func NewEmuMemory(mem *Memory) *EmuMemory {
+	return &EmuMemory{mem: mem, dirty: make(map[uint32]byte)}
+}
+
+func (emumem *EmuMemory) Valid(addr uint32, size int) bool {
+	return emumem.mem.Contains(addr, size)
+}
+
+func (emumem *EmuMemory) read(addr uint32, size int) ([]byte, error) {
+	data, err := emumem.mem.Read(addr, size)
+	if err != nil {
+		return nil, err
+	}
+	for i := range data {
+		if b, ok := emumem.dirty[addr+uint32(i)]; ok {
+			data[i] = b
+		}
+	}
+	return data, nil
+}
+
+func (emumem *EmuMemory) write(addr uint32, data []byte) error {
+	if !emumem.Valid(addr, len(data)) {
+		return fmt.Errorf("write of %d bytes at 0x%08x outside memory", len(data), addr)
+	}
+	for i, b := range data {
+		emumem.dirty[addr+uint32(i)] = b
+	}
+	return nil
+}
+
+func (emumem *EmuMemory) Read8(addr uint32) (uint8, error) {
+	data, err := emumem.read(addr, 1)
+	if err != nil {
+		return 0, err
+	}
+	return data[0], nil
+}
+
+func (emumem *EmuMemory) Read16(addr uint32) (uint16, error) {
+	data, err := emumem.read(addr, 2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(data), nil
+}
+
+func (emumem *EmuMemory) Read32(addr uint32) (uint32, error) {
+	data, err := emumem.read(addr, 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(data), nil
+}
+
+func (emumem *EmuMemory) Write8(addr uint32, val uint8) error {
+	return emumem.write(addr, []byte{val})
+}
+
+func (emumem *EmuMemory) Write16(addr uint32, val uint16) error {
+	return emumem.write(addr, binary.LittleEndian.AppendUint16(nil, val))
+}
+
+func (emumem *EmuMemory) Write32(addr uint32, val uint32) error {
+	return emumem.write(addr, binary.LittleEndian.AppendUint32(nil, val))
+}
+
+// Changes lists the written runs whose bytes differ from the memory.
+func (emumem *EmuMemory) Changes() []MemoryChange {
+	var addrs []uint32
+	for addr, b := range emumem.dirty {
+		if old, _ := emumem.mem.Read8(addr); old != b {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	var changes []MemoryChange
+	for i, addr := range addrs {
+		if i == 0 || addr != addrs[i-1]+1 {
+			changes = append(changes, MemoryChange{Address: addr})
+		}
+		change := &changes[len(changes)-1]
+		old, _ := emumem.mem.Read8(addr)
+		change.Old = append(change.Old, old)
+		change.New = append(change.New, emumem.dirty[addr])
+	}
+	return changes
+}
+
+// EmuHLEFunc stands in for an HLE function, arguments and result are in
+// the registers.
+type EmuHLEFunc func(emu *Emulator, hlefun *PSPHLEFunction)
+
+// Emulator interprets the integer Allegrex instructions of the dump, to run
+// small routines in isolation. Calls are followed, syscalls are stubbed.
+type Emulator struct {
+	doc  *SoraDocument
+	Mem  *EmuMemory
+	Regs EmuRegs
+
+	MaxSteps int
+	HLE      map[string]EmuHLEFunc // by "Module::Func"
+
+	nullify bool // the likely branch was not taken
+}
+
+// EmuResult is where and why the emulation stopped.
+type EmuResult struct {
+	Stop    EmuStop
+	Regs    EmuRegs
+	Steps   int
+	Changes []MemoryChange
+	Err     error
+}
+
+func NewEmulator(doc *SoraDocument) *Emulator {
+	return &Emulator{
+		doc:      doc,
+		Mem:      NewEmuMemory(doc.Memory),
+		MaxSteps: 100000,
+		HLE:      make(map[string]EmuHLEFunc),
+	}
+}
+
+// Call runs fun from its entry with regs until it returns. ra is set so it
+// returns to EmuReturnAddress, sp defaults to the top of the memory.
+func (emu *Emulator) Call(fun *SoraFunction, regs EmuRegs) *EmuResult {
+	emu.Regs = regs
+	emu.Regs.GPR[0] = 0
+	emu.Regs.GPR[RegRA.Num] = EmuReturnAddress
+	if emu.Regs.GPR[RegSP.Num] == 0 {
+		emu.Regs.GPR[RegSP.Num] = (emu.doc.Memory.End() - 0x10) &^ 0xf
+	}
+	emu.Regs.PC = fun.Address
+	return emu.Run()
+}
+
+// Run executes from Regs.PC until the return address, a fault or MaxSteps.
+func (emu *Emulator) Run() *EmuResult {
+	res := &EmuResult{}
+	pc, npc := emu.Regs.PC, emu.Regs.PC+4
+	for {
+		if pc == EmuReturnAddress {
+			res.Stop = EmuReturned
+			break
+		}
+		if res.Steps >= emu.MaxSteps {
+			res.Stop = EmuStepLimit
+			break
+		}
+
+		word, err := emu.Mem.Read32(pc)
+		if err != nil {
+			res.Stop, res.Err = EmuFault, err
+			break
+		}
+		dec := DecodeInstruction(pc, word)
+		if dec == nil {
+			res.Stop, res.Err = EmuUnknown, fmt.Errorf("unknown instruction 0x%08x at 0x%08x", word, pc)
+			break
+		}
+
+		emu.Regs.PC = pc
+		next, stop, err := emu.step(dec, npc)
+		res.Steps++
+		if stop != "" {
+			res.Stop, res.Err = stop, err
+			break
+		}
+		if emu.nullify {
+			emu.nullify = false
+			pc, npc = npc+4, npc+8
+			continue
+		}
+		pc, npc = npc, next
+	}
+	emu.Regs.PC = pc
+	res.Regs = emu.Regs
+	res.Changes = emu.Mem.Changes()
+	return res
+}
+
+func isLikelyOp(op string) bool {
+	switch op {
+	case "beql", "bnel", "blezl", "bgtzl", "bltzl", "bgezl", "bltzall", "bgezall":
+		return true
+	}
+	return false
+}
+
+func (emu *Emulator) reg(opr Operand) uint32 {
+	return emu.Regs.Reg(opr.Reg)
+}
+
+func (emu *Emulator) set(opr Operand, val uint32) {
+	emu.Regs.SetReg(opr.Reg, val)
+}
+
+func (emu *Emulator) addr(opr Operand) uint32 {
+	return emu.Regs.Reg(opr.Reg) + uint32(opr.Imm)
+}
+
+// step executes dec, next is the address after the delay slot at npc.
+func (emu *Emulator) step(dec *DecodedInstruction, npc uint32) (next uint32, stop EmuStop, err error) {
+	next = npc + 4
+	oprs := dec.Operands
+	regs := &emu.Regs
+
+	branch := func(taken bool, target Operand) {
+		if taken {
+			next = target.UImm
+		} else if isLikelyOp(dec.Op) {
+			emu.nullify = true
+		}
+	}
+	link := func() {
+		regs.GPR[RegRA.Num] = npc + 4
+	}
+
+	switch dec.Op {
+	case "nop", "sync", "cache":
+
+	case "sll":
+		emu.set(oprs[0], emu.reg(oprs[1])<<oprs[2].UImm)
+	case "srl":
+		emu.set(oprs[0], emu.reg(oprs[1])>>oprs[2].UImm)
+	case "sra":
+		emu.set(oprs[0], uint32(int32(emu.reg(oprs[1]))>>oprs[2].UImm))
+	case "rotr":
+		emu.set(oprs[0], bits.RotateLeft32(emu.reg(oprs[1]), -int(oprs[2].UImm)))
+	case "sllv":
+		emu.set(oprs[0], emu.reg(oprs[1])<<(emu.reg(oprs[2])&31))
+	case "srlv":
+		emu.set(oprs[0], emu.reg(oprs[1])>>(emu.reg(oprs[2])&31))
+	case "srav":
+		emu.set(oprs[0], uint32(int32(emu.reg(oprs[1]))>>(emu.reg(oprs[2])&31)))
+	case "rotrv":
+		emu.set(oprs[0], bits.RotateLeft32(emu.reg(oprs[1]), -int(emu.reg(oprs[2])&31)))
+
+	case "jr":
+		next = emu.reg(oprs[0])
+	case "jalr":
+		next = emu.reg(oprs[1])
+		emu.set(oprs[0], npc+4)
+	case "j":
+		next = oprs[0].UImm
+	case "jal":
+		next = oprs[0].UImm
+		link()
+
+	case "movz":
+		if emu.reg(oprs[2]) == 0 {
+			emu.set(oprs[0], emu.reg(oprs[1]))
+		}
+	case "movn":
+		if emu.reg(oprs[2]) != 0 {
+			emu.set(oprs[0], emu.reg(oprs[1]))
+		}
+
+	case "syscall":
+		emu.syscall(oprs[0].UImm)
+	case "break":
+		return next, EmuBreak, nil
+
+	case "mfhi":
+		emu.set(oprs[0], regs.HI)
+	case "mflo":
+		emu.set(oprs[0], regs.LO)
+	case "mthi":
+		regs.HI = emu.reg(oprs[0])
+	case "mtlo":
+		regs.LO = emu.reg(oprs[0])
+
+	case "clz":
+		emu.set(oprs[0], uint32(bits.LeadingZeros32(emu.reg(oprs[1]))))
+	case "clo":
+		emu.set(oprs[0], uint32(bits.LeadingZeros32(^emu.reg(oprs[1]))))
+
+	case "mult", "multu", "madd", "maddu", "msub", "msubu":
+		var prod uint64
+		rs, rt := emu.reg(oprs[0]), emu.reg(oprs[1])
+		if dec.Op[len(dec.Op)-1] == 'u' {
+			prod = uint64(rs) * uint64(rt)
+		} else {
+			prod = uint64(int64(int32(rs)) * int64(int32(rt)))
+		}
+		acc := uint64(regs.HI)<<32 | uint64(regs.LO)
+		switch dec.Op[:2] {
+		case "ma":
+			prod = acc + prod
+		case "ms":
+			prod = acc - prod
+		}
+		regs.HI, regs.LO = uint32(prod>>32), uint32(prod)
+
+	case "div":
+		rs, rt := int32(emu.reg(oprs[0])), int32(emu.reg(oprs[1]))
+		if rt != 0 && !(rs == -0x80000000 && rt == -1) {
+			regs.LO, regs.HI = uint32(rs/rt), uint32(rs%rt)
+		}
+	case "divu":
+		rs, rt := emu.reg(oprs[0]), emu.reg(oprs[1])
+		if rt != 0 {
+			regs.LO, regs.HI = rs/rt, rs%rt
+		}
+
+	case "add", "addu":
+		emu.set(oprs[0], emu.reg(oprs[1])+emu.reg(oprs[2]))
+	case "sub", "subu":
+		emu.set(oprs[0], emu.reg(oprs[1])-emu.reg(oprs[2]))
+	case "and":
+		emu.set(oprs[0], emu.reg(oprs[1])&emu.reg(oprs[2]))
+	case "or":
+		emu.set(oprs[0], emu.reg(oprs[1])|emu.reg(oprs[2]))
+	case "xor":
+		emu.set(oprs[0], emu.reg(oprs[1])^emu.reg(oprs[2]))
+	case "nor":
+		emu.set(oprs[0], ^(emu.reg(oprs[1]) | emu.reg(oprs[2])))
+	case "slt":
+		emu.set(oprs[0], boolWord(int32(emu.reg(oprs[1])) < int32(emu.reg(oprs[2]))))
+	case "sltu":
+		emu.set(oprs[0], boolWord(emu.reg(oprs[1]) < emu.reg(oprs[2])))
+	case "max":
+		a, b := int32(emu.reg(oprs[1])), int32(emu.reg(oprs[2]))
+		if b > a {
+			a = b
+		}
+		emu.set(oprs[0], uint32(a))
+	case "min":
+		a, b := int32(emu.reg(oprs[1])), int32(emu.reg(oprs[2]))
+		if b < a {
+			a = b
+		}
+		emu.set(oprs[0], uint32(a))
+
+	case "bltz", "bltzl", "bltzal", "bltzall":
+		if len(dec.Op) > 5 && dec.Op[4:6] == "al" {
+			link()
+		}
+		branch(int32(emu.reg(oprs[0])) < 0, oprs[1])
+	case "bgez", "bgezl", "bgezal", "bgezall":
+		if len(dec.Op) > 5 && dec.Op[4:6] == "al" {
+			link()
+		}
+		branch(int32(emu.reg(oprs[0])) >= 0, oprs[1])
+	case "beq", "beql":
+		branch(emu.reg(oprs[0]) == emu.reg(oprs[1]), oprs[2])
+	case "bne", "bnel":
+		branch(emu.reg(oprs[0]) != emu.reg(oprs[1]), oprs[2])
+	case "blez", "blezl":
+		branch(int32(emu.reg(oprs[0])) <= 0, oprs[1])
+	case "bgtz", "bgtzl":
+		branch(int32(emu.reg(oprs[0])) > 0, oprs[1])
+
+	case "addi", "addiu":
+		emu.set(oprs[0], emu.reg(oprs[1])+uint32(oprs[2].Imm))
+	case "slti":
+		emu.set(oprs[0], boolWord(int32(emu.reg(oprs[1])) < oprs[2].Imm))
+	case "sltiu":
+		emu.set(oprs[0], boolWord(emu.reg(oprs[1]) < uint32(oprs[2].Imm)))
+	case "andi":
+		emu.set(oprs[0], emu.reg(oprs[1])&oprs[2].UImm)
+	case "ori":
+		emu.set(oprs[0], emu.reg(oprs[1])|oprs[2].UImm)
+	case "xori":
+		emu.set(oprs[0], emu.reg(oprs[1])^oprs[2].UImm)
+	case "lui":
+		emu.set(oprs[0], oprs[1].UImm<<16)
+
+	case "lb", "lbu", "lh", "lhu", "lw", "ll", "lwl", "lwr":
+		err = emu.load(dec.Op, oprs[0], emu.addr(oprs[1]))
+	case "sb", "sh", "sw", "swl", "swr":
+		err = emu.store(dec.Op, oprs[0], emu.addr(oprs[1]))
+	case "sc":
+		if err = emu.store("sw", oprs[0], emu.addr(oprs[1])); err == nil {
+			emu.set(oprs[0], 1)
+		}
+
+	case "ext":
+		pos, size := oprs[2].UImm, oprs[3].UImm
+		emu.set(oprs[0], (emu.reg(oprs[1])>>pos)&uint32(1<<size-1))
+	case "ins":
+		pos, size := oprs[2].UImm, oprs[3].UImm
+		mask := uint32(1<<size-1) << pos
+		emu.set(oprs[0], emu.reg(oprs[0])&^mask|(emu.reg(oprs[1])<<pos)&mask)
+	case "wsbh":
+		val := emu.reg(oprs[1])
+		emu.set(oprs[0], (val&0x00ff00ff)<<8|(val&0xff00ff00)>>8)
+	case "wsbw":
+		emu.set(oprs[0], bits.ReverseBytes32(emu.reg(oprs[1])))
+	case "seb":
+		emu.set(oprs[0], uint32(int32(int8(emu.reg(oprs[1])))))
+	case "seh":
+		emu.set(oprs[0], uint32(int32(int16(emu.reg(oprs[1])))))
+	case "bitrev":
+		emu.set(oprs[0], bits.Reverse32(emu.reg(oprs[1])))
+
+	default:
+		return next, EmuUnknown, fmt.Errorf("%s at 0x%08x is not emulated", dec.Op, regs.PC)
+	}
+	if err != nil {
+		return next, EmuFault, err
+	}
+	return next, "", nil
+}
+
+func boolWord(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (emu *Emulator) load(op string, rt Operand, addr uint32) error {
+	var val uint32
+	switch op {
+	case "lb", "lbu":
+		b, err := emu.Mem.Read8(addr)
+		if err != nil {
+			return err
+		}
+		val = uint32(b)
+		if op == "lb" {
+			val = uint32(int32(int8(b)))
+		}
+	case "lh", "lhu":
+		h, err := emu.Mem.Read16(addr)
+		if err != nil {
+			return err
+		}
+		val = uint32(h)
+		if op == "lh" {
+			val = uint32(int32(int16(h)))
+		}
+	case "lw", "ll":
+		w, err := emu.Mem.Read32(addr)
+		if err != nil {
+			return err
+		}
+		val = w
+	case "lwl", "lwr":
+		w, err := emu.Mem.Read32(addr &^ 3)
+		if err != nil {
+			return err
+		}
+		shift := (addr & 3) * 8
+		if op == "lwl" {
+			val = emu.reg(rt)&(0x00ffffff>>shift) | w<<(24-shift)
+		} else {
+			val = emu.reg(rt)&(0xffffff00<<(24-shift)) | w>>shift
+		}
+	}
+	emu.set(rt, val)
+	return nil
+}
+
+func (emu *Emulator) store(op string, rt Operand, addr uint32) error {
+	val := emu.reg(rt)
+	switch op {
+	case "sb":
+		return emu.Mem.Write8(addr, uint8(val))
+	case "sh":
+		return emu.Mem.Write16(addr, uint16(val))
+	case "sw":
+		return emu.Mem.Write32(addr, val)
+	}
+
+	w, err := emu.Mem.Read32(addr &^ 3)
+	if err != nil {
+		return err
+	}
+	shift := (addr & 3) * 8
+	if op == "swl" {
+		w = w&(0xffffff00<<shift) | val>>(24-shift)
+	} else {
+		w = w&(0x00ffffff>>(24-shift)) | val<<shift
+	}
+	return emu.Mem.Write32(addr&^3, w)
+}
+
+// hleIndex splits a syscall code into the HLE module and function index.
+func hleIndex(code uint32) (modl_idx int, fun_idx int) {
+	return int(code>>12) & 0xff, int(code & 0xfff)
+}
+
+// syscall runs the stub of the HLE function, unknown functions and those
+// without a stub return 0.
+func (emu *Emulator) syscall(code uint32) {
+	modl_idx, fun_idx := hleIndex(code)
+	name := emu.doc.GetHLEFuncName(modl_idx, fun_idx)
+	var hlefun *PSPHLEFunction
+	if modl_idx < len(emu.doc.yaml.HLEModules) && fun_idx < len(emu.doc.yaml.HLEModules[modl_idx].Funcs) {
+		hlefun = &emu.doc.yaml.HLEModules[modl_idx].Funcs[fun_idx]
+	}
+
+	if stub, ok := emu.HLE[name]; ok {
+		stub(emu, hlefun)
+		return
+	}
+	if hlefun == nil || (hlefun.RetMask != "" && hlefun.RetMask != "v") {
+		emu.Regs.GPR[2] = 0
+	}
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmulatorChecksum(t *testing.T) {
+	doc := newEmuDocument()
+	putWords(doc, 0x8800000,
+		0x00001021, // move v0, zero
+		0x18a00006, // blez a1, 0x8800020
+		0x00000000,
+		0x90880000, // lbu t0, 0(a0)
+		0x24a5ffff, // addiu a1, a1, -1
+		0x00481021, // addu v0, v0, t0
+		0x1ca0fffc, // bgtz a1, 0x880000c
+		0x24840001, // addiu a0, a0, 1
+		0xacc20000, // sw v0, 0(a2)
+		0x03e00008, // jr ra
+		0x00000000,
+	)
+	copy(doc.Memory.data[0x100:], []byte{1, 2, 3, 4})
+	fun := putFunction(doc, "checksum", 0x8800000, 0x2c)
+
+	var regs EmuRegs
+	assert.NoError(t, regs.Set("a0", 0x8800100))
+	assert.NoError(t, regs.Set("a1", 4))
+	assert.NoError(t, regs.Set("a2", 0x8800200))
+
+	res := NewEmulator(doc).Call(fun, regs)
+	assert.NoError(t, res.Err)
+	assert.Equal(t, EmuReturned, res.Stop)
+	assert.Equal(t, 26, res.Steps)
+	assert.Equal(t, uint32(10), res.Regs.GPR[2])
+	assert.Equal(t, uint32(0x8800104), res.Regs.GPR[4])
+	assert.Equal(t, []MemoryChange{{Address: 0x8800200, Old: []byte{0}, New: []byte{10}}}, res.Changes)
+	assert.Equal(t, byte(0), doc.Memory.data[0x200])
+}
+
+func TestEmulatorSyscallAndLimit(t *testing.T) {
+	doc := newEmuDocument()
+	doc.yaml.HLEModules = []PSPHLEModule{{Name: "Kernel", Funcs: []PSPHLEFunction{
+		{Name: "sceKernelDelayThread", RetMask: "x"},
+		{Name: "sceKernelGetSystemTimeLow", RetMask: "x"},
+	}}}
+	putWords(doc, 0x8800000,
+		0x0000000c, // syscall Kernel::sceKernelDelayThread
+		0x0000004c, // syscall Kernel::sceKernelGetSystemTimeLow
+		0x03e00008, // jr ra
+		0x00000000,
+		0x1000ffff, // b 0x8800010
+		0x00000000,
+	)
+	fun := putFunction(doc, "gettime", 0x8800000, 0x10)
+
+	emu := NewEmulator(doc)
+	emu.HLE["Kernel::sceKernelGetSystemTimeLow"] = func(emu *Emulator, hlefun *PSPHLEFunction) {
+		emu.Regs.GPR[2] = 1234
+	}
+	var regs EmuRegs
+	regs.GPR[2] = 99
+	res := emu.Call(fun, regs)
+	assert.Equal(t, EmuReturned, res.Stop)
+	assert.Equal(t, uint32(1234), res.Regs.GPR[2])
+
+	emu.MaxSteps = 10
+	res = emu.Call(putFunction(doc, "spin", 0x8800010, 0x8), EmuRegs{})
+	assert.Equal(t, EmuStepLimit, res.Stop)
+	assert.Equal(t, 10, res.Steps)
+}
+
+func TestEmulatorLikelyBranch(t *testing.T) {
+	doc := newEmuDocument()
+	putWords(doc, 0x8800000,
+		0x50800002, // beql a0, zero, 0x880000c
+		0x24020001, // li v0, 1
+		0x24030002, // li v1, 2
+		0x03e00008, // jr ra
+		0x00000000,
+	)
+	fun := putFunction(doc, "likely", 0x8800000, 0x14)
+
+	var regs EmuRegs
+	regs.GPR[4] = 1
+	res := NewEmulator(doc).Call(fun, regs)
+	assert.Equal(t, EmuReturned, res.Stop)
+	assert.Equal(t, uint32(0), res.Regs.GPR[2])
+	assert.Equal(t, uint32(2), res.Regs.GPR[3])
+
+	regs.GPR[4] = 0
+	res = NewEmulator(doc).Call(fun, regs)
+	assert.Equal(t, uint32(1), res.Regs.GPR[2])
+	assert.Equal(t, uint32(0), res.Regs.GPR[3])
+}
@@ -38,7 +38,7 @@ func (anal *FunctionAnalyzer) Process() {
 
 		if _, ok := bb_visits[cur_addr]; !ok {
 			if bbfun := anal.doc.FunManager.Get(cur_addr); bbfun == nil {
-				fmt.Printf("WARNING:\tunknown bb and not a func: 0x08%x\n", cur_addr)
+				anal.doc.logf("WARNING:\tunknown bb and not a func: 0x08%x\n", cur_addr)
 			}
 			continue
 		}
@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+type BoundaryAction string
+
+const (
+	BoundarySplit BoundaryAction = "split"
+	BoundaryMerge BoundaryAction = "merge"
+	BoundaryKeep  BoundaryAction = "keep"
+)
+
+type BoundaryReason string
+
+const (
+	ReasonNone           BoundaryReason = ""
+	ReasonCallEntry      BoundaryReason = "call_entry"      // call lands in the middle of a function
+	ReasonJumpEntry      BoundaryReason = "jump_entry"      // jump lands in the middle of a function
+	ReasonTailCall       BoundaryReason = "tail_call"       // jump to another function entry
+	ReasonSharedEpilogue BoundaryReason = "shared_epilogue" // jump to another function's epilogue
+	ReasonNoReturn       BoundaryReason = "noreturn_call"   // code after a call that never returns
+)
+
+type FunctionBoundary struct {
+	Action  BoundaryAction
+	Reason  BoundaryReason
+	Address uint32 // boundary address
+	From    uint32 // instruction causing it
+	Fun     string
+	Other   string
+}
+
+// known HLE functions that never give control back, by exact name
+var noReturnNames = map[string]bool{
+	"sceKernelExitGame":             true,
+	"sceKernelExitThread":           true,
+	"sceKernelExitDeleteThread":     true,
+	"sceKernelSelfStopUnloadModule": true,
+	"sceKernelStopUnloadSelfModule": true,
+}
+
+type boundaryKey struct {
+	Action  BoundaryAction
+	Reason  BoundaryReason
+	Address uint32
+	From    uint32
+}
+
+// ReportBoundary records why a boundary was split, merged or kept, once per site.
+func (funmgr *FunctionManager) ReportBoundary(action BoundaryAction, reason BoundaryReason, addr, from uint32) *FunctionBoundary {
+	key := boundaryKey{action, reason, addr, from}
+	if boundary, ok := funmgr.boundarySeen[key]; ok {
+		return boundary
+	}
+
+	boundary := &FunctionBoundary{
+		Action:  action,
+		Reason:  reason,
+		Address: addr,
+		From:    from,
+	}
+	funmgr.boundarySeen[key] = boundary
+	if fun := funmgr.FindByAddress(from); fun != nil {
+		boundary.Fun = fun.Name
+	}
+	if fun := funmgr.FindByAddress(addr); fun != nil {
+		boundary.Other = fun.Name
+	}
+	funmgr.Boundaries = append(funmgr.Boundaries, boundary)
+	return boundary
+}
+
+// FindByAddress returns the function containing addr.
+func (funmgr *FunctionManager) FindByAddress(addr uint32) *SoraFunction {
+	f, _ := funmgr.functions.FloorCeil(addr)
+	if f.End() {
+		return nil
+	}
+	fun := f.Value()
+	if addr > fun.LastAddress() {
+		return nil
+	}
+	return fun
+}
+
+// IsNoReturn tells whether a call into fun is known to never return.
+// Import stubs are told by the HLE function of their syscall, named ones
+// (zz_ prefixed in the symbol map) by their name.
+func (funmgr *FunctionManager) IsNoReturn(fun *SoraFunction) bool {
+	if noReturnNames[strings.TrimPrefix(fun.Name, "zz_")] {
+		return true
+	}
+	if funmgr.doc == nil || funmgr.doc.InstrManager == nil {
+		return false
+	}
+	if hle_name, ok := funmgr.StubHLEName(fun); ok {
+		_, fun_name, _ := strings.Cut(hle_name, "::")
+		return noReturnNames[fun_name]
+	}
+	return funmgr.GetStackFrame(fun).NoReturn()
+}
+
+// StubHLEName returns the "Module::Func" called by fun when it is an import
+// stub, a `jr ra` with the syscall in its delay slot.
+func (funmgr *FunctionManager) StubHLEName(fun *SoraFunction) (string, bool) {
+	if fun.Size != 8 {
+		return "", false
+	}
+	instr := funmgr.doc.Disasm(fun.Address + 4)
+	if instr == nil || instr.Op != "syscall" || len(instr.Operands) == 0 {
+		return "", false
+	}
+	return funmgr.doc.GetHLEFuncName(hleIndex(instr.Operands[0].UImm)), true
+}
+
+// IsSharedEpilogue tells whether the code at addr only restores the frame and returns.
+func (funmgr *FunctionManager) IsSharedEpilogue(addr uint32) bool {
+	for n := 0; n < 24; n++ {
+		instr := funmgr.doc.Disasm(addr)
+		if instr == nil {
+			return false
+		}
+		if isReturnInstr(instr) {
+			return true
+		}
+		if instr.Info.IsBranch {
+			return false
+		}
+
+		switch instr.Mnemonic {
+		case "nop":
+		case "lw", "lv.q", "lwc1":
+			if len(instr.Args) < 2 || instr.Args[1].Reg != "sp" {
+				return false
+			}
+		case "addiu":
+			if len(instr.Args) < 2 || instr.Args[0].Reg != "sp" || instr.Args[1].Reg != "sp" {
+				return false
+			}
+		case "move", "addu", "or", "li":
+			if len(instr.Args) < 1 || (instr.Args[0].Reg != "v0" && instr.Args[0].Reg != "v1") {
+				return false
+			}
+		default:
+			return false
+		}
+		addr += 4
+	}
+	return false
+}
+
+// ClassifyJump decides how a non linked transfer from fun to target affects
+// function boundaries.
+func (funmgr *FunctionManager) ClassifyJump(fun *SoraFunction, brInstr *SoraInstruction, target uint32) BoundaryReason {
+	if !funmgr.jumpLeaves(fun, brInstr, target) {
+		return ReasonNone
+	}
+	if other := funmgr.Get(target); other != nil {
+		return ReasonTailCall
+	}
+	if funmgr.IsSharedEpilogue(target) {
+		return ReasonSharedEpilogue
+	}
+	return ReasonJumpEntry
+}
+
+// jumpLeaves tells whether a non linked transfer from fun to target goes
+// into another function, reading the functions only.
+func (funmgr *FunctionManager) jumpLeaves(fun *SoraFunction, brInstr *SoraInstruction, target uint32) bool {
+	if fun == nil || (target >= fun.Address && target <= fun.LastAddress()) {
+		return false
+	}
+	if brInstr.Info.IsLinkedBranch || isReturnInstr(brInstr) {
+		return false
+	}
+	if funmgr.Get(target) != nil {
+		return true
+	}
+	other := funmgr.FindByAddress(target)
+	return other != nil && other != fun
+}
+
+// DetectBoundaries statically looks for tail calls, shared epilogues and
+// code following non returning calls, correcting the boundaries on the way.
+// The functions split off are scanned too.
+func (funmgr *FunctionManager) DetectBoundaries() []*FunctionBoundary {
+	start := len(funmgr.Boundaries)
+
+	var work Queue[*SoraFunction]
+	funmgr.ForEach(func(fun *SoraFunction) {
+		work.Push(fun)
+	})
+
+	for work.Len() > 0 {
+		for _, split_func := range funmgr.detectFunctionBoundaries(work.Pop()) {
+			work.Push(split_func)
+		}
+	}
+
+	return funmgr.Boundaries[start:]
+}
+
+// detectFunctionBoundaries corrects the boundaries of fun, it returns the
+// functions split off it.
+func (funmgr *FunctionManager) detectFunctionBoundaries(fun *SoraFunction) []*SoraFunction {
+	var splits []*SoraFunction
+	split := func(addr uint32, reason BoundaryReason, from uint32) {
+		if _, split_func := funmgr.SplitAt(addr, reason, from); split_func != nil {
+			splits = append(splits, split_func)
+		}
+	}
+	reach := fun.Address
+
+	for addr := fun.Address; addr <= fun.LastAddress(); addr += 4 {
+		instr := funmgr.doc.Disasm(addr)
+		if instr == nil {
+			return splits
+		}
+		if !instr.Info.IsBranch || instr.Info.IsBranchToRegister {
+			continue
+		}
+		target := instr.Info.BranchTarget
+
+		if instr.Info.IsLinkedBranch {
+			callee := funmgr.Get(target)
+			next := addr + 8
+			if callee == nil || !funmgr.IsNoReturn(callee) || next > fun.LastAddress() || reach > addr+4 {
+				continue
+			}
+			// nothing before the call branches past it, the rest is another function
+			split(next, ReasonNoReturn, addr)
+			return splits
+		}
+
+		if target > reach && target <= fun.LastAddress() {
+			reach = target
+		}
+
+		switch funmgr.ClassifyJump(fun, instr, target) {
+		case ReasonTailCall:
+			funmgr.ReportBoundary(BoundaryKeep, ReasonTailCall, target, addr)
+		case ReasonSharedEpilogue:
+			funmgr.ReportBoundary(BoundaryKeep, ReasonSharedEpilogue, target, addr)
+		case ReasonJumpEntry:
+			split(target, ReasonJumpEntry, addr)
+		}
+	}
+	return splits
+}
+
+func (funmgr *FunctionManager) DumpBoundaries() {
+	for _, boundary := range funmgr.Boundaries {
+		fmt.Printf("%s\t%s\t0x%08x from 0x%08x %s -> %s\n", boundary.Action, boundary.Reason,
+			boundary.Address, boundary.From, boundary.Fun, boundary.Other)
+	}
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyJump(t *testing.T) {
+	doc := newTestDocument()
+	funA := putFunction(doc, "funA", 0x8804000, 0x20)
+	putFunction(doc, "funB", 0x8804020, 0x20)
+
+	// funB epilogue
+	putInstr(doc, 0x8804030, "lw\tra,0x4(sp)", models.MipsOpcode{})
+	putInstr(doc, 0x8804034, "jr\tra", opJR)
+	putInstr(doc, 0x8804038, "addiu\tsp,sp,0x10", models.MipsOpcode{})
+	putInstr(doc, 0x880403C, "nop", models.MipsOpcode{})
+
+	jmp := putInstr(doc, 0x8804010, "j\t->$08804020", models.MipsOpcode{IsBranch: true, HasDelaySlot: true})
+
+	assert.Equal(t, ReasonNone, doc.FunManager.ClassifyJump(funA, jmp, 0x8804008))
+	assert.Equal(t, ReasonTailCall, doc.FunManager.ClassifyJump(funA, jmp, 0x8804020))
+	assert.Equal(t, ReasonSharedEpilogue, doc.FunManager.ClassifyJump(funA, jmp, 0x8804030))
+	assert.True(t, doc.FunManager.IsSharedEpilogue(0x8804030))
+	assert.False(t, doc.FunManager.IsSharedEpilogue(0x8804038))
+}
+
+func TestReportBoundaryOnce(t *testing.T) {
+	doc := newTestDocument()
+	putFunction(doc, "funA", 0x8804000, 0x20)
+	putFunction(doc, "funB", 0x8804020, 0x20)
+
+	b1 := doc.FunManager.ReportBoundary(BoundaryKeep, ReasonTailCall, 0x8804020, 0x8804010)
+	b2 := doc.FunManager.ReportBoundary(BoundaryKeep, ReasonTailCall, 0x8804020, 0x8804010)
+
+	assert.Same(t, b1, b2)
+	assert.Len(t, doc.FunManager.Boundaries, 1)
+	assert.Equal(t, "funA", b1.Fun)
+	assert.Equal(t, "funB", b1.Other)
+}
+
+func TestIsNoReturn(t *testing.T) {
+	doc := newTestDocument()
+	exit := putFunction(doc, "sceKernelExitGame", 0x8900000, 0x8)
+	assert.True(t, doc.FunManager.IsNoReturn(exit))
+	stub := putFunction(doc, "zz_sceKernelExitThread", 0x8900020, 0x8)
+	assert.True(t, doc.FunManager.IsNoReturn(stub))
+
+	menu := putFunction(doc, "exitMenu", 0x8900030, 0x8)
+	putInstr(doc, 0x8900030, "jr\tra", opJR)
+	putInstr(doc, 0x8900034, "nop", models.MipsOpcode{})
+	assert.False(t, doc.FunManager.IsNoReturn(menu))
+
+	loop := putFunction(doc, "loop", 0x8900010, 0x8)
+	putInstr(doc, 0x8900010, "j\t->$08900010", models.MipsOpcode{IsBranch: true, HasDelaySlot: true, BranchTarget: 0x8900010})
+	putInstr(doc, 0x8900014, "nop", models.MipsOpcode{})
+	assert.True(t, doc.FunManager.IsNoReturn(loop))
+
+	// nothing is known of code that does not decode
+	broken := putFunction(doc, "broken", 0x8900040, 0x8)
+	putWord(doc, 0x8900040, 0xfc000000, models.MipsOpcode{})
+	putWord(doc, 0x8900044, 0, models.MipsOpcode{})
+	assert.False(t, doc.FunManager.IsNoReturn(broken))
+	assert.True(t, broken.Frame.Incomplete)
+	empty := putFunction(doc, "empty", 0x8900050, 0)
+	assert.False(t, doc.FunManager.IsNoReturn(empty))
+}
+
+func TestIsNoReturnEndingInCall(t *testing.T) {
+	doc := newTestDocument()
+	exit := putFunction(doc, "sceKernelExitGame", 0x8900100, 0x8)
+	other := putLeafFunction(doc, "other", 0x8900110)
+
+	putCall := func(addr uint32, callee *SoraFunction) *SoraFunction {
+		putInstr(doc, addr, "addiu\tsp,sp,-0x10", models.MipsOpcode{})
+		info := opJAL
+		info.BranchTarget = callee.Address
+		putInstr(doc, addr+4, "jal\t->$"+callee.Name, info)
+		putInstr(doc, addr+8, "nop", models.MipsOpcode{})
+		return putFunction(doc, fmt.Sprintf("fun_%08x", addr), addr, 0xc)
+	}
+
+	// partly known, its return site is past the end
+	partial := putCall(0x8900000, other)
+	assert.False(t, doc.FunManager.IsNoReturn(partial))
+	assert.True(t, partial.Frame.Incomplete)
+	assert.Contains(t, partial.Frame.Issues, "runs past the end at 0x08900004")
+
+	quit := putCall(0x8900020, exit)
+	assert.True(t, doc.FunManager.IsNoReturn(quit))
+	assert.False(t, quit.Frame.Incomplete)
+
+	// a function calling itself last is not known either
+	self := putFunction(doc, "self", 0x8900040, 0x8)
+	info := opJAL
+	info.BranchTarget = 0x8900040
+	putInstr(doc, 0x8900040, "jal\t->$self", info)
+	putInstr(doc, 0x8900044, "nop", models.MipsOpcode{})
+	assert.False(t, doc.FunManager.IsNoReturn(self))
+}
+
+func TestIsNoReturnStub(t *testing.T) {
+	doc := newTestDocument()
+	doc.yaml.HLEModules = []PSPHLEModule{{Name: "LoadExecForUser", Funcs: []PSPHLEFunction{
+		{Name: "sceKernelLoadExec"},
+		{Name: "sceKernelExitGame"},
+	}}}
+	putSyscallStub := func(addr, code uint32) *SoraFunction {
+		putInstr(doc, addr, "jr\tra", opJR)
+		instr := putInstr(doc, addr+4, "syscall", models.MipsOpcode{Encoded: code<<6 | 0xc})
+		instr.Decode()
+		return putFunction(doc, fmt.Sprintf("z_un_%08x", addr), addr, 8)
+	}
+
+	exit := putSyscallStub(0x8900000, 0x0001)
+	name, ok := doc.FunManager.StubHLEName(exit)
+	assert.True(t, ok)
+	assert.Equal(t, "LoadExecForUser::sceKernelExitGame", name)
+	assert.True(t, doc.FunManager.IsNoReturn(exit))
+
+	load := putSyscallStub(0x8900010, 0x0000)
+	assert.False(t, doc.FunManager.IsNoReturn(load))
+}
+
+func TestDetectBoundariesSplitOff(t *testing.T) {
+	doc := newTestDocument()
+	putLeafFunction(doc, "sceKernelExitGame", 0x8900100)
+	putLeafFunction(doc, "sceKernelExitThread", 0x8900110)
+
+	// the code after the first no-return call makes a second one
+	for i, callee := range []uint32{0x8900100, 0x8900110} {
+		info := opJAL
+		info.BranchTarget = callee
+		putInstr(doc, 0x8900200+uint32(i*8), "jal\t->$exit", info)
+		putInstr(doc, 0x8900204+uint32(i*8), "nop", models.MipsOpcode{})
+	}
+	putInstr(doc, 0x8900210, "jr\tra", opJR)
+	putInstr(doc, 0x8900214, "nop", models.MipsOpcode{})
+	game := putFunction(doc, "game", 0x8900200, 0x18)
+
+	found := doc.FunManager.DetectBoundaries()
+	assert.Len(t, found, 2)
+	assert.Equal(t, uint32(0x8), game.Size)
+	assert.Equal(t, uint32(0x8), doc.FunManager.Get(0x8900208).Size)
+	assert.Equal(t, uint32(0x8), doc.FunManager.Get(0x8900210).Size)
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"fmt"
+)
+
+type FunctionOp string
+
+const (
+	FunOpSplit  FunctionOp = "split"
+	FunOpMerge  FunctionOp = "merge"
+	FunOpDelete FunctionOp = "delete"
+	FunOpResize FunctionOp = "resize"
+)
+
+type functionSnapshot struct {
+	fun   *SoraFunction
+	state SoraFunction
+}
+
+// FunctionJournalEntry keeps what an operation touched so it can be undone.
+type FunctionJournalEntry struct {
+	Op      FunctionOp
+	Address uint32
+
+	before     []functionSnapshot
+	created    []*SoraFunction
+	boundaries []*FunctionBoundary
+}
+
+func (funmgr *FunctionManager) beginJournal(op FunctionOp, addr uint32, funcs ...*SoraFunction) *FunctionJournalEntry {
+	entry := &FunctionJournalEntry{
+		Op:      op,
+		Address: addr,
+	}
+	for _, fun := range funcs {
+		state := *fun
+		state.BBAddresses = append([]uint32(nil), fun.BBAddresses...)
+		entry.before = append(entry.before, functionSnapshot{fun: fun, state: state})
+	}
+	funmgr.journal = append(funmgr.journal, entry)
+	return entry
+}
+
+func (funmgr *FunctionManager) dropJournal(entry *FunctionJournalEntry) {
+	if n := len(funmgr.journal); n > 0 && funmgr.journal[n-1] == entry {
+		funmgr.journal = funmgr.journal[:n-1]
+	}
+}
+
+// journalBoundary reports a boundary found by the operation of entry, it is
+// dropped again when the operation is undone.
+func (funmgr *FunctionManager) journalBoundary(entry *FunctionJournalEntry, action BoundaryAction, reason BoundaryReason, addr, from uint32) {
+	n := len(funmgr.Boundaries)
+	boundary := funmgr.ReportBoundary(action, reason, addr, from)
+	if entry != nil && len(funmgr.Boundaries) > n {
+		entry.boundaries = append(entry.boundaries, boundary)
+	}
+}
+
+func (funmgr *FunctionManager) dropBoundary(boundary *FunctionBoundary) {
+	delete(funmgr.boundarySeen, boundaryKey{boundary.Action, boundary.Reason, boundary.Address, boundary.From})
+	for i, other := range funmgr.Boundaries {
+		if other == boundary {
+			funmgr.Boundaries = append(funmgr.Boundaries[:i], funmgr.Boundaries[i+1:]...)
+			break
+		}
+	}
+}
+
+// Journal lists the user edits that can be undone, the splits found while
+// parsing are not part of it.
+func (funmgr *FunctionManager) Journal() []*FunctionJournalEntry {
+	return funmgr.journal
+}
+
+// removeFunction drops fun from the tree, the name index and the symbol map,
+// where it is only hidden so an undo finds it back as it was.
+func (funmgr *FunctionManager) removeFunction(fun *SoraFunction) {
+	funmgr.functions.Remove(fun.Address)
+	funmgr.UnregisterNameFunction(fun)
+	funmgr.doc.SymMap.RemoveFunction(fun.Address)
+}
+
+// Split starts a new function at addr inside the function holding it.
+func (funmgr *FunctionManager) Split(addr uint32) (*SoraFunction, error) {
+	fun := funmgr.FindByAddress(addr)
+	if fun == nil {
+		return nil, fmt.Errorf("no function at 0x%08x", addr)
+	}
+	if fun.Address == addr || addr%4 != 0 {
+		return nil, fmt.Errorf("invalid split 0x%08x of %s", addr, fun.Name)
+	}
+
+	entry := funmgr.beginJournal(FunOpSplit, addr, fun)
+	_, split_func := funmgr.splitAt(entry, addr, ReasonNone, addr)
+	if split_func == nil {
+		funmgr.dropJournal(entry)
+		return nil, fmt.Errorf("unable to split %s at 0x%08x", fun.Name, addr)
+	}
+	return split_func, nil
+}
+
+// Resize changes the size of the function at addr without overlapping the next one.
+func (funmgr *FunctionManager) Resize(addr uint32, size uint32) error {
+	fun := funmgr.Get(addr)
+	if fun == nil {
+		return fmt.Errorf("no function at 0x%08x", addr)
+	}
+	if size == 0 || size%4 != 0 {
+		return fmt.Errorf("invalid size 0x%x for function 0x%08x", size, addr)
+	}
+
+	_, c := funmgr.functions.FloorCeil(addr + 1)
+	if !c.End() && addr+size > c.Value().Address {
+		return fmt.Errorf("resize 0x%08x overlaps %s at 0x%08x", addr, c.Value().Name, c.Value().Address)
+	}
+
+	funmgr.beginJournal(FunOpResize, addr, fun)
+
+	fun.SetLastAddress(addr + size - 4)
+	bb_addrs := fun.BBAddresses
+	fun.BBAddresses = nil
+	for _, bb_addr := range bb_addrs {
+		if bb_addr <= fun.LastAddress() {
+			fun.AddBB(bb_addr)
+		}
+	}
+
+	funmgr.doc.SymMap.SetFunctionSize(fun.Address, fun.Size)
+	return nil
+}
+
+// Delete removes the function at addr, its blocks become orphans.
+func (funmgr *FunctionManager) Delete(addr uint32) error {
+	fun := funmgr.Get(addr)
+	if fun == nil {
+		return fmt.Errorf("no function at 0x%08x", addr)
+	}
+
+	funmgr.beginJournal(FunOpDelete, addr, fun)
+	funmgr.removeFunction(fun)
+	return nil
+}
+
+// Merge appends the function at next_addr into the adjacent function at addr.
+func (funmgr *FunctionManager) Merge(addr, next_addr uint32) (*SoraFunction, error) {
+	fun := funmgr.Get(addr)
+	if fun == nil {
+		return nil, fmt.Errorf("no function at 0x%08x", addr)
+	}
+	next := funmgr.Get(next_addr)
+	if next == nil {
+		return nil, fmt.Errorf("no function at 0x%08x", next_addr)
+	}
+	if fun.LastAddress()+4 != next.Address {
+		return nil, fmt.Errorf("%s (0x%08x) is not adjacent to %s (0x%08x)", fun.Name, fun.Address, next.Name, next.Address)
+	}
+
+	entry := funmgr.beginJournal(FunOpMerge, addr, fun, next)
+
+	funmgr.removeFunction(next)
+	fun.SetLastAddress(next.LastAddress())
+	for _, bb_addr := range next.BBAddresses {
+		fun.AddBB(bb_addr)
+	}
+
+	funmgr.doc.SymMap.SetFunctionSize(fun.Address, fun.Size)
+	funmgr.journalBoundary(entry, BoundaryMerge, ReasonNone, next_addr, addr)
+	return fun, nil
+}
+
+// Undo reverts the last journaled operation. It fails, keeping the entry,
+// when functions made since then sit where it would put functions back.
+func (funmgr *FunctionManager) Undo() (*FunctionJournalEntry, error) {
+	n := len(funmgr.journal)
+	if n == 0 {
+		return nil, fmt.Errorf("nothing to undo")
+	}
+	entry := funmgr.journal[n-1]
+	if err := funmgr.checkUndo(entry); err != nil {
+		return nil, err
+	}
+	funmgr.journal = funmgr.journal[:n-1]
+
+	for _, fun := range entry.created {
+		if funmgr.Get(fun.Address) == fun {
+			funmgr.removeFunction(fun)
+		}
+	}
+
+	for i := len(entry.before) - 1; i >= 0; i-- {
+		snap := entry.before[i]
+		*snap.fun = snap.state
+
+		if funmgr.Get(snap.fun.Address) != snap.fun {
+			funmgr.functions.Insert(snap.fun.Address, snap.fun)
+			funmgr.RegisterNameFunction(snap.fun)
+			// back with its module index, the symbol map only hid it
+			funmgr.doc.SymMap.RestoreFunction(snap.fun.Address)
+		}
+		funmgr.doc.SymMap.SetFunctionSize(snap.fun.Address, snap.fun.Size)
+	}
+
+	for _, boundary := range entry.boundaries {
+		funmgr.dropBoundary(boundary)
+	}
+
+	return entry, nil
+}
+
+// checkUndo tells whether the functions of entry can be put back: every
+// range they had is only held by them, or by the functions entry created.
+func (funmgr *FunctionManager) checkUndo(entry *FunctionJournalEntry) error {
+	owned := make(map[*SoraFunction]bool)
+	for _, snap := range entry.before {
+		owned[snap.fun] = true
+	}
+	for _, fun := range entry.created {
+		owned[fun] = true
+	}
+
+	for _, snap := range entry.before {
+		lo := snap.state.Address
+		hi := snap.state.LastAddress()
+		if hi < lo {
+			hi = lo
+		}
+
+		it, c := funmgr.functions.FloorCeil(lo)
+		if it.End() {
+			it = c
+		}
+		for ; !it.End() && it.Key() <= hi; it = it.Next() {
+			other := it.Value()
+			if owned[other] || (other.Address != lo && other.LastAddress() < lo) {
+				continue
+			}
+			return fmt.Errorf("unable to undo %s of 0x%08x: %s at 0x%08x took its place",
+				entry.Op, entry.Address, other.Name, other.Address)
+		}
+	}
+	return nil
+}
+
+// Revert undoes operations until only keep entries are left in the journal.
+func (funmgr *FunctionManager) Revert(keep int) error {
+	for len(funmgr.journal) > keep {
+		if _, err := funmgr.Undo(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFunctionMergeUndo(t *testing.T) {
+	doc := newTestDocument()
+	funA := putFunction(doc, "funA", 0x8804000, 0x20)
+	funA.AddBB(0x8804000)
+	funB := putFunction(doc, "funB", 0x8804020, 0x10)
+	funB.AddBB(0x8804020)
+	funB.AddBB(0x8804028)
+
+	_, err := doc.FunManager.Merge(0x8804000, 0x8804030)
+	assert.Error(t, err)
+
+	merged, err := doc.FunManager.Merge(0x8804000, 0x8804020)
+	assert.NoError(t, err)
+	assert.Same(t, funA, merged)
+	assert.Equal(t, uint32(0x30), funA.Size)
+	assert.Equal(t, []uint32{0x8804000, 0x8804020, 0x8804028}, funA.BBAddresses)
+	assert.Nil(t, doc.FunManager.Get(0x8804020))
+	assert.Empty(t, doc.FunManager.GetByName("funB"))
+	assert.Len(t, doc.FunManager.Boundaries, 1)
+	assert.Zero(t, doc.SymMap.GetFunctionSize(0x8804020))
+
+	entry, err := doc.FunManager.Undo()
+	assert.NoError(t, err)
+	assert.Equal(t, FunOpMerge, entry.Op)
+	assert.Equal(t, uint32(0x20), funA.Size)
+	assert.Equal(t, []uint32{0x8804000}, funA.BBAddresses)
+	assert.Same(t, funB, doc.FunManager.Get(0x8804020))
+	assert.Equal(t, []*SoraFunction{funB}, doc.FunManager.GetByName("funB"))
+	assert.Empty(t, doc.FunManager.Boundaries)
+	assert.False(t, doc.SymMap.removed[0x8804020])
+
+	_, err = doc.FunManager.Undo()
+	assert.Error(t, err)
+}
+
+func TestFunctionResizeDelete(t *testing.T) {
+	doc := newTestDocument()
+	funA := putFunction(doc, "funA", 0x8804000, 0x20)
+	funA.AddBB(0x8804000)
+	funA.AddBB(0x8804010)
+	putFunction(doc, "funB", 0x8804020, 0x10)
+
+	assert.Error(t, doc.FunManager.Resize(0x8804000, 0x24))
+	assert.NoError(t, doc.FunManager.Resize(0x8804000, 0x10))
+	assert.Equal(t, []uint32{0x8804000}, funA.BBAddresses)
+
+	assert.NoError(t, doc.FunManager.Delete(0x8804020))
+	assert.Nil(t, doc.FunManager.FindByAddress(0x8804024))
+	assert.Len(t, doc.FunManager.Journal(), 2)
+
+	assert.NoError(t, doc.FunManager.Revert(0))
+	assert.Equal(t, uint32(0x20), funA.Size)
+	assert.Len(t, funA.BBAddresses, 2)
+	assert.NotNil(t, doc.FunManager.Get(0x8804020))
+}
+
+func TestFunctionSplitUndo(t *testing.T) {
+	doc := newTestDocument()
+	funA := putFunction(doc, "funA", 0x8804000, 0x20)
+	funA.AddBB(0x8804000)
+	funA.AddBB(0x8804010)
+
+	_, err := doc.FunManager.Split(0x8804000)
+	assert.Error(t, err)
+	split, err := doc.FunManager.Split(0x8804010)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x10), split.Size)
+	assert.Equal(t, []uint32{0x8804010}, split.BBAddresses)
+	assert.Len(t, doc.FunManager.Boundaries, 1)
+
+	_, err = doc.FunManager.Undo()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x20), funA.Size)
+	assert.Nil(t, doc.FunManager.Get(0x8804010))
+	assert.Empty(t, doc.FunManager.Boundaries)
+
+	// splits found while parsing are not journaled
+	doc.FunManager.SplitAt(0x8804010, ReasonCallEntry, 0x8804100)
+	assert.NotNil(t, doc.FunManager.Get(0x8804010))
+	assert.Empty(t, doc.FunManager.Journal())
+}
+
+func TestFunctionUndoTaken(t *testing.T) {
+	doc := newTestDocument()
+	putFunction(doc, "main", 0x8804000, 0x10)
+	funB := putFunction(doc, "funB", 0x8804010, 0x10)
+
+	assert.NoError(t, doc.FunManager.Delete(0x8804000))
+	again := doc.FunManager.CreateNewFunction(0x8804000, 8)
+	assert.NotNil(t, again)
+
+	_, err := doc.FunManager.Undo()
+	assert.Error(t, err)
+	assert.Len(t, doc.FunManager.Journal(), 1)
+	var funcs []string
+	doc.FunManager.ForEach(func(fun *SoraFunction) { funcs = append(funcs, fun.Name) })
+	assert.Equal(t, []string{"z_un_08804000", "funB"}, funcs)
+	assert.Empty(t, doc.FunManager.GetByName("main"))
+
+	// a function made inside the range a merge gives back
+	assert.NoError(t, doc.FunManager.Delete(0x8804000))
+	_, err = doc.FunManager.Merge(0x8804010, 0x8804020)
+	assert.Error(t, err)
+	putFunction(doc, "funC", 0x8804020, 0x10)
+	_, err = doc.FunManager.Merge(0x8804010, 0x8804020)
+	assert.NoError(t, err)
+	_, split := doc.FunManager.SplitAt(0x8804028, ReasonJumpEntry, 0x8804010)
+	assert.NotNil(t, split)
+	_, err = doc.FunManager.Undo()
+	assert.Error(t, err)
+	assert.Equal(t, uint32(0x18), funB.Size)
+
+	// once it is gone the merge is undone
+	doc.FunManager.removeFunction(split)
+	funB.SetLastAddress(0x880402c)
+	_, err = doc.FunManager.Undo()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x10), funB.Size)
+	assert.NotNil(t, doc.FunManager.Get(0x8804020))
+}
@@ -10,12 +10,18 @@ type FunctionManager struct {
 	doc           *SoraDocument
 	functions     binarysearchtree.AVLTree[uint32, *SoraFunction]
 	mapNameToFunc map[string][]uint32
+
+	Boundaries   []*FunctionBoundary
+	boundarySeen map[boundaryKey]*FunctionBoundary
+
+	journal []*FunctionJournalEntry
 }
 
 func NewFunctionManager(doc *SoraDocument) *FunctionManager {
 	return &FunctionManager{
 		doc:           doc,
 		mapNameToFunc: make(map[string][]uint32),
+		boundarySeen:  make(map[boundaryKey]*FunctionBoundary),
 	}
 }
 
@@ -39,6 +45,32 @@ func (funmgr *FunctionManager) RegisterNameFunction(fun *SoraFunction) {
 	funmgr.mapNameToFunc[fun.Name] = append(funmgr.mapNameToFunc[fun.Name], fun.Address)
 }
 
+func (funmgr *FunctionManager) UnregisterNameFunction(fun *SoraFunction) {
+	addrs := funmgr.mapNameToFunc[fun.Name]
+	for i, ex_addr := range addrs {
+		if ex_addr == fun.Address {
+			addrs = append(addrs[:i], addrs[i+1:]...)
+			break
+		}
+	}
+
+	if len(addrs) == 0 {
+		delete(funmgr.mapNameToFunc, fun.Name)
+	} else {
+		funmgr.mapNameToFunc[fun.Name] = addrs
+	}
+}
+
+func (funmgr *FunctionManager) GetByName(name string) []*SoraFunction {
+	var result []*SoraFunction
+	for _, addr := range funmgr.mapNameToFunc[name] {
+		if fun := funmgr.Get(addr); fun != nil {
+			result = append(result, fun)
+		}
+	}
+	return result
+}
+
 func (funmgr *FunctionManager) CreateNewFunction(addr uint32, size uint32) *SoraFunction {
 	fun := funmgr.Get(addr)
 	if fun != nil {
@@ -77,18 +109,84 @@ func (funmgr *FunctionManager) Get(addr uint32) *SoraFunction {
 	return it.Value()
 }
 
-func (mgr *FunctionManager) SplitAt(split_addr uint32) (prev_func, split_func *SoraFunction) {
-	fmt.Printf("DEBUG:\tsplit func at 0x%08x\n", split_addr)
-	fn_start := mgr.doc.SymMap.GetFunctionStart(split_addr)
+// GetStackFrame returns the frame of fun, analyzing it on first use.
+func (funmgr *FunctionManager) GetStackFrame(fun *SoraFunction) *SoraStackFrame {
+	if fun.Frame == nil {
+		NewFunctionAnalyzer(funmgr.doc, fun).AnalyzeStackFrame()
+	}
+	return fun.Frame
+}
+
+func (funmgr *FunctionManager) ForEach(cb func(fun *SoraFunction)) {
+	funmgr.functions.InOrderTraverse(cb)
+}
+
+// UnbalancedFunctions lists functions that leave the stack unbalanced on some path.
+func (funmgr *FunctionManager) UnbalancedFunctions() []*SoraFunction {
+	var result []*SoraFunction
+	funmgr.ForEach(func(fun *SoraFunction) {
+		if !funmgr.GetStackFrame(fun).Balanced {
+			result = append(result, fun)
+		}
+	})
+	return result
+}
+
+func (funmgr *FunctionManager) DumpStackFrames() {
+	funmgr.ForEach(func(fun *SoraFunction) {
+		frame := funmgr.GetStackFrame(fun)
+		fmt.Printf("%s 0x%08x frame=%d ra=%v", fun.Name, fun.Address, frame.Size, frame.SpillRA)
+		if frame.SpillRA {
+			fmt.Printf("@%d", frame.RAOffset)
+		}
+		for _, saved := range frame.SavedRegs {
+			fmt.Printf(" %s@%d", saved.Reg, saved.Offset)
+		}
+		if !frame.Balanced {
+			fmt.Print(" UNBALANCED")
+		}
+		fmt.Println()
+		for _, issue := range frame.Issues {
+			fmt.Printf("\t%s\n", issue)
+		}
+	})
+}
+
+// FunctionStart is the start of the function holding addr, from the symbol
+// map or else from the functions known here, 0 when there is none.
+func (funmgr *FunctionManager) FunctionStart(addr uint32) uint32 {
+	if fn_start := funmgr.doc.SymMap.GetFunctionStart(addr); fn_start != 0 {
+		return fn_start
+	}
+	if fun := funmgr.FindByAddress(addr); fun != nil {
+		return fun.Address
+	}
+	return 0
+}
+
+// SplitAt ends the function holding split_addr before it, prev_func being
+// that function and split_func the new one starting at split_addr. Splits
+// found while parsing are not journaled, see Split for the user edit.
+func (mgr *FunctionManager) SplitAt(split_addr uint32, reason BoundaryReason, from uint32) (prev_func, split_func *SoraFunction) {
+	return mgr.splitAt(nil, split_addr, reason, from)
+}
+
+func (mgr *FunctionManager) splitAt(entry *FunctionJournalEntry, split_addr uint32, reason BoundaryReason, from uint32) (prev_func, split_func *SoraFunction) {
+	mgr.doc.logf("DEBUG:\tsplit func at 0x%08x\n", split_addr)
+	fn_start := mgr.FunctionStart(split_addr)
 	funcStart := mgr.Get(split_addr)
 
 	if fn_start == 0 {
 		if funcStart == nil {
-			fmt.Printf("TODO:\tunimplemented create func when split at 0x%08x\n", split_addr)
+			mgr.doc.logf("TODO:\tunimplemented create func when split at 0x%08x\n", split_addr)
 		}
 		return
 	}
 	funcStart = mgr.Get(fn_start)
+	if funcStart == nil {
+		mgr.doc.logf("ERROR:\tno func for symbol 0x%08x when split at 0x%08x\n", fn_start, split_addr)
+		return
+	}
 	prev_func = funcStart
 
 	last_addr := funcStart.LastAddress()
@@ -101,10 +199,25 @@ func (mgr *FunctionManager) SplitAt(split_addr uint32) (prev_func, split_func *S
 
 	if split_func == nil {
 		funcStart.SetLastAddress(last_addr)
-		fmt.Printf("ERROR:\tunable to create splitted func at 0x%08x\n", split_addr)
+		mgr.doc.logf("ERROR:\tunable to create splitted func at 0x%08x\n", split_addr)
 		return
 	}
+	if entry != nil {
+		entry.created = append(entry.created, split_func)
+	}
+
+	// blocks past the split now belong to the new function
+	bb_addrs := funcStart.BBAddresses
+	funcStart.BBAddresses = nil
+	for _, bb_addr := range bb_addrs {
+		if bb_addr >= split_addr {
+			split_func.AddBB(bb_addr)
+		} else {
+			funcStart.AddBB(bb_addr)
+		}
+	}
 
 	mgr.doc.SymMap.SetFunctionSize(funcStart.Address, funcStart.Size)
+	mgr.journalBoundary(entry, BoundarySplit, reason, split_addr, from)
 	return
 }
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+)
+
+func init() {
+	// instructions come from putInstr, not from the bridge memory
+	memoryIsValidAddress = func(address uint32) bool { return true }
+}
+
+// disasmFrom makes Disasm decode the instructions put in doc so far, as
+// the bridge would from its memory, until the test ends.
+func disasmFrom(t *testing.T, doc *SoraDocument) {
+	infos := make(map[uint32]models.MipsOpcode)
+	doc.InstrManager.instructions.InOrderTraverse(func(instr *SoraInstruction) {
+		infos[instr.Address] = instr.Info
+	})
+	saved := mipsAnalystGetOpcodeInfo
+	mipsAnalystGetOpcodeInfo = func(address uint32) *models.MipsOpcode {
+		info, ok := infos[address]
+		if !ok {
+			info.Address = address
+		}
+		return &info
+	}
+	t.Cleanup(func() { mipsAnalystGetOpcodeInfo = saved })
+}
+
+func newTestDocument() *SoraDocument {
+	doc := &SoraDocument{
+		SymMap:        CreateSymbolMap(),
+		mapAddrToFunc: make(map[uint32]int),
+		mapNameToFunc: make(map[string][]int),
+	}
+	doc.Parser = NewBBTraceParser(doc)
+	doc.BBManager = NewBasicBlockManager(doc)
+	doc.FunManager = NewFunctionManager(doc)
+	doc.InstrManager = NewInstructionManager(doc)
+	doc.DataManager = NewDataManager(doc)
+	doc.PatchManager = NewPatchManager(doc)
+	return doc
+}
+
+// putInstr stores a pre-decoded instruction so tests run without the bridge.
+func putInstr(doc *SoraDocument, addr uint32, dizz string, info models.MipsOpcode) *SoraInstruction {
+	info.Address = addr
+	info.Dizz = dizz
+	instr := doc.InstrManager.Create(addr, &info)
+
+	params := strings.Split(dizz, "\t")
+	instr.Mnemonic = params[0]
+	for _, param := range params[1:] {
+		for _, a := range strings.Split(param, ",") {
+			instr.Args = append(instr.Args, NewSoraArgument(a, nil))
+		}
+	}
+	return instr
+}
+
+var (
+	opJR     = models.MipsOpcode{IsBranch: true, IsBranchToRegister: true, HasDelaySlot: true}
+	opJAL    = models.MipsOpcode{IsBranch: true, IsLinkedBranch: true, HasDelaySlot: true}
+	opBranch = models.MipsOpcode{IsBranch: true, IsConditional: true, HasDelaySlot: true}
+)
+
+func putFunction(doc *SoraDocument, name string, addr, size uint32) *SoraFunction {
+	fun := &SoraFunction{Name: name, Address: addr, Size: size}
+	doc.FunManager.functions.Insert(addr, fun)
+	doc.FunManager.RegisterNameFunction(fun)
+	return fun
+}
+
+// putLeafFunction puts a function made of a single `jr ra` block.
+func putLeafFunction(doc *SoraDocument, name string, addr uint32) *SoraFunction {
+	putInstr(doc, addr, "jr\tra", opJR)
+	putInstr(doc, addr+4, "nop", models.MipsOpcode{})
+	return putFunction(doc, name, addr, 8)
+}
+
+// putCaller puts a function calling target then returning.
+func putCaller(doc *SoraDocument, name string, addr, target uint32) {
+	info := opJAL
+	info.BranchTarget = target
+	putInstr(doc, addr, "jal\t->$"+name, info)
+	putInstr(doc, addr+4, "nop", models.MipsOpcode{})
+	putInstr(doc, addr+8, "jr\tra", opJR)
+	putInstr(doc, addr+12, "nop", models.MipsOpcode{})
+	putFunction(doc, name, addr, 16)
+}
+
+func putBranch(doc *SoraDocument, addr, target uint32) {
+	info := opBranch
+	info.BranchTarget = target
+	putInstr(doc, addr, "bne\tv0,zero,->$", info)
+	putInstr(doc, addr+4, "nop", models.MipsOpcode{})
+}
+
+func newEmuDocument() *SoraDocument {
+	doc := newTestDocument()
+	doc.Memory = NewMemory(make([]byte, 0x1000), 0x8800000)
+	return doc
+}
+
+func putWords(doc *SoraDocument, addr uint32, words ...uint32) {
+	for i, word := range words {
+		binary.LittleEndian.PutUint32(doc.Memory.data[addr-doc.Memory.start+uint32(i*4):], word)
+	}
+}
+
+// putWord stores an instruction decoded from its encoding.
+func putWord(doc *SoraDocument, addr, word uint32, info models.MipsOpcode) *SoraInstruction {
+	info.Encoded = word
+	instr := putInstr(doc, addr, "", info)
+	instr.Decode()
+	instr.Mnemonic, instr.Args = doc.InstructionArgs(instr)
+	return instr
+}
+
+// putCode writes words to the dump and decodes them, info applies to the
+// first one.
+func putCode(doc *SoraDocument, addr uint32, info models.MipsOpcode, words ...uint32) {
+	putWords(doc, addr, words...)
+	for i, word := range words {
+		if i > 0 {
+			info = models.MipsOpcode{}
+		}
+		putWord(doc, addr+uint32(i*4), word, info)
+	}
+}
+
+func putLeaf(doc *SoraDocument, name string, addr uint32) {
+	putCode(doc, addr, opJR, 0x03e00008, 0)
+	putFunction(doc, name, addr, 8)
+}
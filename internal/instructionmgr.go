@@ -10,6 +10,46 @@ type SoraInstruction struct {
 	Address  uint32
 	Mnemonic string
 	Args     []*SoraArgument
+
+	// decoded from Info.Encoded by Decode, Op is empty when it was not
+	Op       string
+	Operands []Operand
+	Reads    []Register
+	Writes   []Register
+	Access   *MemoryAccess
+}
+
+// Decode fills the typed operands and the registers read and written from
+// the encoding.
+func (instr *SoraInstruction) Decode() bool {
+	dec := DecodeInstruction(instr.Address, instr.Info.Encoded)
+	if dec == nil {
+		return false
+	}
+	instr.Op = dec.Op
+	instr.Operands = dec.Operands
+	instr.Reads = dec.Reads
+	instr.Writes = dec.Writes
+	instr.Access = dec.Access
+	return true
+}
+
+func (instr *SoraInstruction) ReadsReg(reg Register) bool {
+	for _, r := range instr.Reads {
+		if r == reg {
+			return true
+		}
+	}
+	return false
+}
+
+func (instr *SoraInstruction) WritesReg(reg Register) bool {
+	for _, r := range instr.Writes {
+		if r == reg {
+			return true
+		}
+	}
+	return false
 }
 
 type InstructionManager struct {
@@ -36,6 +76,14 @@ func (mgr *InstructionManager) Create(addr uint32, info *models.MipsOpcode) *Sor
 	return instr
 }
 
+// Forget drops the instructions of size bytes at addr, they are decoded
+// again on the next Disasm.
+func (mgr *InstructionManager) Forget(addr uint32, size int) {
+	for a := addr &^ 3; a < addr+uint32(size); a += 4 {
+		mgr.instructions.Remove(a)
+	}
+}
+
 func (mgr *InstructionManager) Get(addr uint32) *SoraInstruction {
 	it := mgr.instructions.Search(addr)
 	if it.End() {
@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// NaturalLoop is the union of the natural loops of the back edges into Header.
+type NaturalLoop struct {
+	Header    uint32     `yaml:"header"`
+	Body      []uint32   `yaml:"body"`
+	Latches   []uint32   `yaml:"latches"` // sources of the back edges
+	Exits     []BBRefKey `yaml:"exits"`
+	Depth     int        `yaml:"depth"`
+	Visits    int64      `yaml:"visits"`    // header executions
+	Backedges int64      `yaml:"backedges"` // traced back edge traversals
+
+	Parent   *NaturalLoop   `yaml:"-"`
+	Children []*NaturalLoop `yaml:"-"`
+
+	blocks map[int]bool
+}
+
+func (loop *NaturalLoop) Contains(addr uint32) bool {
+	i := sort.Search(len(loop.Body), func(i int) bool { return loop.Body[i] >= addr })
+	return i < len(loop.Body) && loop.Body[i] == addr
+}
+
+// Entries is how many times the loop was entered from outside, by the trace.
+func (loop *NaturalLoop) Entries() int64 {
+	return loop.Visits - loop.Backedges
+}
+
+// LoopForest holds the loops of one function, outermost first.
+type LoopForest struct {
+	CFG   *FunctionCFG
+	Loops []*NaturalLoop
+	// Irreducible lists retreating edges that are not back edges, their
+	// targets don't dominate their sources
+	Irreducible []BBRefKey
+}
+
+// FindLoops finds the natural loops of cfg and how they nest.
+func (cfg *FunctionCFG) FindLoops() *LoopForest {
+	forest := &LoopForest{CFG: cfg}
+	rpo := cfg.ReversePostorder()
+	order := make(map[int]int)
+	for n, i := range rpo {
+		order[i] = n
+	}
+
+	by_header := make(map[int]*NaturalLoop)
+	var headers []int
+
+	for _, i := range rpo {
+		block := cfg.Blocks[i]
+		for _, succ := range block.Succs {
+			if order[succ] > order[i] {
+				continue
+			}
+			if !cfg.Dominates(succ, i) {
+				forest.Irreducible = append(forest.Irreducible, BBRefKey{block.Address, cfg.Blocks[succ].Address})
+				continue
+			}
+
+			loop, ok := by_header[succ]
+			if !ok {
+				loop = &NaturalLoop{
+					Header: cfg.Blocks[succ].Address,
+					Visits: cfg.Blocks[succ].Visits,
+					blocks: map[int]bool{succ: true},
+				}
+				by_header[succ] = loop
+				headers = append(headers, succ)
+			}
+			loop.Latches = append(loop.Latches, block.Address)
+			if ref := cfg.backedgeRef(block, cfg.Blocks[succ]); ref != nil {
+				loop.Backedges += ref.VisitCount
+			}
+
+			// walk backwards from the latch up to the header
+			work := []int{i}
+			for len(work) > 0 {
+				n := work[len(work)-1]
+				work = work[:len(work)-1]
+				if loop.blocks[n] {
+					continue
+				}
+				loop.blocks[n] = true
+				work = append(work, cfg.Blocks[n].Preds...)
+			}
+		}
+	}
+
+	for _, h := range headers {
+		loop := by_header[h]
+		for n := range loop.blocks {
+			loop.Body = append(loop.Body, cfg.Blocks[n].Address)
+			for _, succ := range cfg.Blocks[n].Succs {
+				if !loop.blocks[succ] {
+					loop.Exits = append(loop.Exits, BBRefKey{cfg.Blocks[n].Address, cfg.Blocks[succ].Address})
+				}
+			}
+		}
+		sort.Slice(loop.Body, func(i, j int) bool { return loop.Body[i] < loop.Body[j] })
+		sort.Slice(loop.Exits, func(i, j int) bool {
+			if loop.Exits[i].From != loop.Exits[j].From {
+				return loop.Exits[i].From < loop.Exits[j].From
+			}
+			return loop.Exits[i].To < loop.Exits[j].To
+		})
+		forest.Loops = append(forest.Loops, loop)
+	}
+
+	// the parent is the smallest other loop holding the header
+	for _, loop := range forest.Loops {
+		for _, other := range forest.Loops {
+			if other == loop || !other.Contains(loop.Header) || len(other.Body) <= len(loop.Body) {
+				continue
+			}
+			if loop.Parent == nil || len(other.Body) < len(loop.Parent.Body) {
+				loop.Parent = other
+			}
+		}
+	}
+	for _, loop := range forest.Loops {
+		if loop.Parent != nil {
+			loop.Parent.Children = append(loop.Parent.Children, loop)
+		}
+		for p := loop; p != nil; p = p.Parent {
+			loop.Depth++
+		}
+	}
+
+	sort.SliceStable(forest.Loops, func(i, j int) bool {
+		if forest.Loops[i].Depth != forest.Loops[j].Depth {
+			return forest.Loops[i].Depth < forest.Loops[j].Depth
+		}
+		return forest.Loops[i].Header < forest.Loops[j].Header
+	})
+	return forest
+}
+
+// backedgeRef finds the trace ref of the edge from -> to, refs start at
+// the trace's own blocks which may begin before from.
+func (cfg *FunctionCFG) backedgeRef(from, to *CFGBlock) *SoraBBRef {
+	bbmanager := cfg.doc().BBManager
+	if bb := bbmanager.Get(from.LastAddress); bb != nil {
+		return bbmanager.GetReference(bb.Address, to.Address)
+	}
+	return nil
+}
+
+func (cfg *FunctionCFG) doc() *SoraDocument {
+	return cfg.anal.doc
+}
+
+// LoopOf returns the innermost loop holding addr.
+func (forest *LoopForest) LoopOf(addr uint32) *NaturalLoop {
+	var result *NaturalLoop
+	for _, loop := range forest.Loops {
+		if loop.Contains(addr) && (result == nil || loop.Depth > result.Depth) {
+			result = loop
+		}
+	}
+	return result
+}
+
+// LoopDepth is 0 outside any loop.
+func (forest *LoopForest) LoopDepth(addr uint32) int {
+	if loop := forest.LoopOf(addr); loop != nil {
+		return loop.Depth
+	}
+	return 0
+}
+
+func (forest *LoopForest) Dump() {
+	for _, loop := range forest.Loops {
+		fmt.Printf("%sloop 0x%08x depth=%d blocks=%d visits=%d entries=%d\n", strings.Repeat("  ", loop.Depth-1),
+			loop.Header, loop.Depth, len(loop.Body), loop.Visits, loop.Entries())
+	}
+	for _, edge := range forest.Irreducible {
+		fmt.Printf("irreducible 0x%08x -> 0x%08x\n", edge.From, edge.To)
+	}
+}
+
+// HotLoop is a loop with the function it belongs to.
+type HotLoop struct {
+	Fun  *SoraFunction
+	Loop *NaturalLoop
+}
+
+// HotLoops finds the loops of every function, by header executions.
+func (doc *SoraDocument) HotLoops() []HotLoop {
+	var result []HotLoop
+	doc.FunManager.ForEach(func(fun *SoraFunction) {
+		forest := NewFunctionAnalyzer(doc, fun).BuildCFG().FindLoops()
+		for _, loop := range forest.Loops {
+			result = append(result, HotLoop{fun, loop})
+		}
+	})
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Loop.Visits > result[j].Loop.Visits
+	})
+	return result
+}
+
+func (doc *SoraDocument) DumpHotLoops(n int) {
+	for i, hot := range doc.HotLoops() {
+		if i >= n || hot.Loop.Visits == 0 {
+			break
+		}
+		fmt.Printf("%-32s loop 0x%08x depth=%d blocks=%d visits=%d entries=%d\n", hot.Fun.Name,
+			hot.Loop.Header, hot.Loop.Depth, len(hot.Loop.Body), hot.Loop.Visits, hot.Loop.Entries())
+	}
+}
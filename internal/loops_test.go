@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNestedLoops(t *testing.T) {
+	doc := newTestDocument()
+	putInstr(doc, 0x8808000, "addiu\tsp,sp,-0x10", models.MipsOpcode{})
+	putInstr(doc, 0x8808004, "li\ts0,0x0", models.MipsOpcode{})
+	putInstr(doc, 0x8808008, "addiu\ts1,s1,0x1", models.MipsOpcode{})
+	putBranch(doc, 0x880800C, 0x8808008)
+	putBranch(doc, 0x8808014, 0x8808004)
+	putInstr(doc, 0x880801C, "jr\tra", opJR)
+	putInstr(doc, 0x8808020, "nop", models.MipsOpcode{})
+	fun := putFunction(doc, "nested", 0x8808000, 0x24)
+
+	doc.Parser.Profile.BBCounts[0x8808004] = 3
+	doc.Parser.Profile.BBCounts[0x8808008] = 30
+
+	cfg := NewFunctionAnalyzer(doc, fun).BuildCFG()
+	assert.Len(t, cfg.Blocks, 5)
+	assert.Equal(t, uint32(0x8808010), cfg.BlockAt(0x880800C).LastAddress)
+	assert.True(t, cfg.BlockAt(0x880801C).Exit)
+
+	idom := cfg.Dominators()
+	assert.Equal(t, -1, idom[0])
+	assert.Equal(t, uint32(0x8808008), cfg.Blocks[idom[cfg.BlockAt(0x8808014).Index]].Address)
+	assert.True(t, cfg.Dominates(1, 3))
+	assert.False(t, cfg.Dominates(2, 1))
+
+	forest := cfg.FindLoops()
+	assert.Empty(t, forest.Irreducible)
+	if assert.Len(t, forest.Loops, 2) {
+		outer, inner := forest.Loops[0], forest.Loops[1]
+		assert.Equal(t, uint32(0x8808004), outer.Header)
+		assert.Equal(t, []uint32{0x8808004, 0x8808008, 0x8808014}, outer.Body)
+		assert.Equal(t, []BBRefKey{{0x8808014, 0x880801C}}, outer.Exits)
+		assert.Equal(t, 1, outer.Depth)
+
+		assert.Equal(t, uint32(0x8808008), inner.Header)
+		assert.Equal(t, []uint32{0x8808008}, inner.Body)
+		assert.Equal(t, []uint32{0x8808008}, inner.Latches)
+		assert.Equal(t, 2, inner.Depth)
+		assert.Equal(t, outer, inner.Parent)
+		assert.Equal(t, []*NaturalLoop{inner}, outer.Children)
+	}
+	assert.Equal(t, 2, forest.LoopDepth(0x8808008))
+	assert.Equal(t, 0, forest.LoopDepth(0x880801C))
+
+	hot := doc.HotLoops()
+	if assert.Len(t, hot, 2) {
+		assert.Equal(t, uint32(0x8808008), hot[0].Loop.Header)
+		assert.Equal(t, int64(30), hot[0].Loop.Visits)
+		assert.Equal(t, fun, hot[0].Fun)
+	}
+}
+
+func TestIrreducibleLoop(t *testing.T) {
+	doc := newTestDocument()
+	putBranch(doc, 0x8808000, 0x8808010)
+	putInstr(doc, 0x8808008, "nop", models.MipsOpcode{})
+	putInstr(doc, 0x880800C, "nop", models.MipsOpcode{})
+	putBranch(doc, 0x8808010, 0x8808008)
+	putInstr(doc, 0x8808018, "jr\tra", opJR)
+	putInstr(doc, 0x880801C, "nop", models.MipsOpcode{})
+	fun := putFunction(doc, "irreducible", 0x8808000, 0x20)
+
+	forest := NewFunctionAnalyzer(doc, fun).BuildCFG().FindLoops()
+	assert.Empty(t, forest.Loops)
+	assert.Len(t, forest.Irreducible, 1)
+}
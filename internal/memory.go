@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// MemorySegment is a region of the PSP address space, addresses are
+// compared with the cached and kernel mirror bits masked off.
+type MemorySegment struct {
+	Name  string
+	Start uint32
+	End   uint32 // exclusive
+}
+
+// memoryMirrorMask drops the cached and kernel mirror bits of an address.
+const memoryMirrorMask = 0x3fffffff
+
+var memorySegments = []MemorySegment{
+	{"scratchpad", 0x00010000, 0x00014000},
+	{"vram", 0x04000000, 0x04800000},
+	{"kernel", 0x08000000, 0x08800000},
+	{"user", 0x08800000, 0x0a000000},
+}
+
+// MemoryChange is a run of bytes written over the dump.
+type MemoryChange struct {
+	Address uint32
+	Old     []byte
+	New     []byte
+}
+
+// Memory is the memory dump, read little-endian with bounds checks. Patches
+// go to an overlay and the dump is kept as loaded. The copy of the bridge,
+// when set, gets the patches too so its disassembly follows them.
+type Memory struct {
+	data    []byte
+	start   uint32
+	overlay map[uint32]byte
+	bridge  []byte
+}
+
+func NewMemory(data []byte, start uint32) *Memory {
+	return &Memory{data: data, start: start, overlay: make(map[uint32]byte)}
+}
+
+func (mem *Memory) Start() uint32 {
+	return mem.start
+}
+
+// End is the address after the dump.
+func (mem *Memory) End() uint32 {
+	return mem.start + uint32(len(mem.data))
+}
+
+// Contains tells whether the dump holds size bytes at addr, mirrors
+// included. The other methods take mirrored addresses too.
+func (mem *Memory) Contains(addr uint32, size int) bool {
+	addr &= memoryMirrorMask
+	return mem != nil && addr >= mem.start && uint64(addr-mem.start)+uint64(size) <= uint64(len(mem.data))
+}
+
+// Segment finds the segment of addr, nil when it is not mapped.
+func (mem *Memory) Segment(addr uint32) *MemorySegment {
+	addr &= memoryMirrorMask
+	for i := range memorySegments {
+		if seg := &memorySegments[i]; addr >= seg.Start && addr < seg.End {
+			return seg
+		}
+	}
+	return nil
+}
+
+// IsValidAddress follows bridge.MemoryIsValidAddress, the address is mapped
+// and the dump holds it.
+func (mem *Memory) IsValidAddress(addr uint32) bool {
+	return mem.Segment(addr) != nil && mem.Contains(addr, 1)
+}
+
+// Read copies size bytes at addr, patches applied.
+func (mem *Memory) Read(addr uint32, size int) ([]byte, error) {
+	addr &= memoryMirrorMask
+	data, err := mem.ReadOriginal(addr, size)
+	if err != nil {
+		return nil, err
+	}
+	if len(mem.overlay) > 0 {
+		for i := range data {
+			if b, ok := mem.overlay[addr+uint32(i)]; ok {
+				data[i] = b
+			}
+		}
+	}
+	return data, nil
+}
+
+// ReadOriginal copies size bytes at addr as in the dump.
+func (mem *Memory) ReadOriginal(addr uint32, size int) ([]byte, error) {
+	addr &= memoryMirrorMask
+	if !mem.Contains(addr, size) {
+		return nil, fmt.Errorf("read of %d bytes at 0x%08x outside memory", size, addr)
+	}
+	data := make([]byte, size)
+	copy(data, mem.data[addr-mem.start:])
+	return data, nil
+}
+
+func (mem *Memory) Read8(addr uint32) (uint8, error) {
+	data, err := mem.Read(addr, 1)
+	if err != nil {
+		return 0, err
+	}
+	return data[0], nil
+}
+
+func (mem *Memory) Read16(addr uint32) (uint16, error) {
+	data, err := mem.Read(addr, 2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(data), nil
+}
+
+func (mem *Memory) Read32(addr uint32) (uint32, error) {
+	data, err := mem.Read(addr, 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(data), nil
+}
+
+func (mem *Memory) ReadFloat(addr uint32) (float32, error) {
+	word, err := mem.Read32(addr)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float32frombits(word), nil
+}
+
+// ReadCString reads up to the NUL, at most max bytes.
+func (mem *Memory) ReadCString(addr uint32, max int) (string, error) {
+	var str []byte
+	for len(str) < max {
+		b, err := mem.Read8(addr + uint32(len(str)))
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(str), nil
+		}
+		str = append(str, b)
+	}
+	return "", fmt.Errorf("string at 0x%08x longer than %d bytes", addr, max)
+}
+
+// Patch writes data at addr into the overlay.
+func (mem *Memory) Patch(addr uint32, data []byte) error {
+	addr &= memoryMirrorMask
+	if !mem.Contains(addr, len(data)) {
+		return fmt.Errorf("patch of %d bytes at 0x%08x outside memory", len(data), addr)
+	}
+	for i, b := range data {
+		mem.overlay[addr+uint32(i)] = b
+	}
+	if mem.bridge != nil {
+		copy(mem.bridge[addr-mem.start:], data)
+	}
+	return nil
+}
+
+func (mem *Memory) Patch32(addr uint32, val uint32) error {
+	return mem.Patch(addr, binary.LittleEndian.AppendUint32(nil, val))
+}
+
+// Revert drops the patches of size bytes at addr.
+func (mem *Memory) Revert(addr uint32, size int) {
+	addr &= memoryMirrorMask
+	for i := 0; i < size; i++ {
+		delete(mem.overlay, addr+uint32(i))
+	}
+	if mem.bridge != nil && mem.Contains(addr, size) {
+		copy(mem.bridge[addr-mem.start:], mem.data[addr-mem.start:addr-mem.start+uint32(size)])
+	}
+}
+
+// Changes lists the patched runs whose bytes differ from the dump.
+func (mem *Memory) Changes() []MemoryChange {
+	var addrs []uint32
+	for addr, b := range mem.overlay {
+		if mem.data[addr-mem.start] != b {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	var changes []MemoryChange
+	for i, addr := range addrs {
+		if i == 0 || addr != addrs[i-1]+1 {
+			changes = append(changes, MemoryChange{Address: addr})
+		}
+		change := &changes[len(changes)-1]
+		change.Old = append(change.Old, mem.data[addr-mem.start])
+		change.New = append(change.New, mem.overlay[addr])
+	}
+	return changes
+}
+
+// Bytes is a copy of the dump with the patches applied.
+func (mem *Memory) Bytes() []byte {
+	data := append([]byte{}, mem.data...)
+	for addr, b := range mem.overlay {
+		data[addr-mem.start] = b
+	}
+	return data
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryReads(t *testing.T) {
+	data := []byte{0x78, 0x56, 0x34, 0x12, 0x00, 0x00, 0xc0, 0x3f, 'h', 'i', 0, 'x'}
+	mem := NewMemory(data, 0x8800000)
+
+	b, err := mem.Read8(0x8800000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x78), b)
+	h, err := mem.Read16(0x8800002)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0x1234), h)
+	w, err := mem.Read32(0x8800000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x12345678), w)
+	f, err := mem.ReadFloat(0x8800004)
+	assert.NoError(t, err)
+	assert.Equal(t, float32(1.5), f)
+	s, err := mem.ReadCString(0x8800008, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", s)
+
+	w, err = mem.Read32(0x48800000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x12345678), w)
+	b, err = mem.Read8(0x88800001)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x56), b)
+	assert.True(t, mem.Contains(0x48800000, 12))
+	assert.False(t, mem.Contains(0x48800000, 13))
+
+	_, err = mem.Read32(0x880000a)
+	assert.Error(t, err)
+	_, err = mem.Read8(0x87fffff)
+	assert.Error(t, err)
+	_, err = mem.ReadCString(0x880000b, 16)
+	assert.Error(t, err)
+	_, err = mem.ReadCString(0x8800008, 1)
+	assert.Error(t, err)
+}
+
+func TestMemorySegments(t *testing.T) {
+	mem := NewMemory(make([]byte, 0x100), 0x8800000)
+	assert.Equal(t, "user", mem.Segment(0x8800000).Name)
+	assert.Equal(t, "user", mem.Segment(0x48800000).Name)
+	assert.Equal(t, "kernel", mem.Segment(0x88000000).Name)
+	assert.Equal(t, "vram", mem.Segment(0x04000000).Name)
+	assert.Equal(t, "scratchpad", mem.Segment(0x00010000).Name)
+	assert.Nil(t, mem.Segment(0x00000000))
+
+	assert.True(t, mem.IsValidAddress(0x88000ff))
+	assert.True(t, mem.IsValidAddress(0x488000ff))
+	assert.False(t, mem.IsValidAddress(0x8800100))
+	assert.False(t, mem.IsValidAddress(0x04000000))
+}
+
+func TestMemoryPatch(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	mem := NewMemory(data, 0x8800000)
+
+	assert.NoError(t, mem.Patch32(0x8800000, 0x0403ff01))
+	assert.NoError(t, mem.Patch(0x8800006, []byte{9}))
+	assert.Error(t, mem.Patch(0x8800007, []byte{1, 2}))
+	assert.NoError(t, mem.Patch(0x48800007, []byte{8}))
+
+	w, _ := mem.Read32(0x8800000)
+	assert.Equal(t, uint32(0x0403ff01), w)
+	orig, _ := mem.ReadOriginal(0x8800000, 4)
+	assert.Equal(t, []byte{1, 2, 3, 4}, orig)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, data)
+
+	assert.Equal(t, []MemoryChange{
+		{Address: 0x8800001, Old: []byte{2}, New: []byte{0xff}},
+		{Address: 0x8800006, Old: []byte{7}, New: []byte{9}},
+	}, mem.Changes())
+	assert.Equal(t, []byte{1, 0xff, 3, 4, 5, 6, 9, 8}, mem.Bytes())
+
+	mem.Revert(0x8800000, 4)
+	assert.Equal(t, []MemoryChange{{Address: 0x8800006, Old: []byte{7}, New: []byte{9}}}, mem.Changes())
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type RegClass string
+
+const (
+	RegGPR  RegClass = "gpr"
+	RegFPR  RegClass = "fpr"
+	RegVFPU RegClass = "vfpu"
+	RegCOP0 RegClass = "cop0"
+	RegHILO RegClass = "hilo" // 0 is hi, 1 is lo
+	RegFCR  RegClass = "fcr"  // FPU control, 31 holds the condition
+)
+
+var gprNames = []string{
+	"zero", "at", "v0", "v1", "a0", "a1", "a2", "a3",
+	"t0", "t1", "t2", "t3", "t4", "t5", "t6", "t7",
+	"s0", "s1", "s2", "s3", "s4", "s5", "s6", "s7",
+	"t8", "t9", "k0", "k1", "gp", "sp", "fp", "ra",
+}
+
+var cop0Names = map[int]string{
+	8:  "BadVAddr",
+	9:  "Count",
+	11: "Compare",
+	12: "Status",
+	13: "Cause",
+	14: "EPC",
+	15: "PRId",
+	16: "Config",
+}
+
+// Register is a typed register, comparable so it can key maps.
+type Register struct {
+	Class RegClass
+	Num   int
+}
+
+func GPR(num int) Register {
+	return Register{RegGPR, num}
+}
+
+var (
+	RegZero = GPR(0)
+	RegSP   = GPR(29)
+	RegRA   = GPR(31)
+	RegHI   = Register{RegHILO, 0}
+	RegLO   = Register{RegHILO, 1}
+	RegFCSR = Register{RegFCR, 31}
+)
+
+func (reg Register) Name() string {
+	switch reg.Class {
+	case RegGPR:
+		if reg.Num >= 0 && reg.Num < len(gprNames) {
+			return gprNames[reg.Num]
+		}
+	case RegFPR:
+		return fmt.Sprintf("f%d", reg.Num)
+	case RegVFPU:
+		return vfpuRegName(reg.Num)
+	case RegCOP0:
+		if name, ok := cop0Names[reg.Num]; ok {
+			return name
+		}
+		return fmt.Sprintf("c0r%d", reg.Num)
+	case RegHILO:
+		if reg.Num == 0 {
+			return "hi"
+		}
+		return "lo"
+	case RegFCR:
+		return fmt.Sprintf("fcr%d", reg.Num)
+	case RegVFPUC:
+		if reg.Num >= 0 && reg.Num < len(vfpuCtrlNames) {
+			return vfpuCtrlNames[reg.Num]
+		}
+	}
+	return fmt.Sprintf("%s%d", reg.Class, reg.Num)
+}
+
+func (reg Register) String() string {
+	return reg.Name()
+}
+
+// vfpuRegName names a single VFPU register the way the disassembler does,
+// S<matrix><column><row>.
+func vfpuRegName(num int) string {
+	return fmt.Sprintf("S%d%d%d", (num>>2)&7, num&3, (num>>5)&3)
+}
+
+// LookupRegister parses a register name of any class.
+func LookupRegister(name string) (Register, bool) {
+	for i, gpr := range gprNames {
+		if name == gpr {
+			return GPR(i), true
+		}
+	}
+	switch name {
+	case "hi":
+		return RegHI, true
+	case "lo":
+		return RegLO, true
+	case "s8":
+		return GPR(30), true
+	}
+	for i, ctrl := range vfpuCtrlNames {
+		if name == ctrl {
+			return Register{RegVFPUC, i}, true
+		}
+	}
+	for num, cop0 := range cop0Names {
+		if name == cop0 {
+			return Register{RegCOP0, num}, true
+		}
+	}
+
+	parse := func(prefix string, class RegClass, max int) (Register, bool) {
+		if !strings.HasPrefix(name, prefix) {
+			return Register{}, false
+		}
+		num, err := strconv.Atoi(name[len(prefix):])
+		if err != nil || num < 0 || num >= max {
+			return Register{}, false
+		}
+		return Register{class, num}, true
+	}
+	if reg, ok := parse("fcr", RegFCR, 32); ok {
+		return reg, true
+	}
+	if reg, ok := parse("f", RegFPR, 32); ok {
+		return reg, true
+	}
+	if reg, ok := parse("c0r", RegCOP0, 32); ok {
+		return reg, true
+	}
+	if len(name) == 4 && name[0] == 'S' {
+		mtx, col, row := name[1]-'0', name[2]-'0', name[3]-'0'
+		if mtx < 8 && col < 4 && row < 4 {
+			return Register{RegVFPU, int(mtx)<<2 | int(col) | int(row)<<5}, true
+		}
+	}
+	return Register{}, false
+}
+
+type OperandKind string
+
+const (
+	OperandReg    OperandKind = "reg"
+	OperandImm    OperandKind = "imm"  // signed
+	OperandUImm   OperandKind = "uimm" // unsigned, also shift amounts and bit fields
+	OperandMem    OperandKind = "mem"  // Reg + Imm
+	OperandTarget OperandKind = "target"
+)
+
+// Operand is an instruction operand decoded from its encoding. VFPU
+// registers have the vector Size, or the side of the matrix when Matrix.
+type Operand struct {
+	Kind   OperandKind
+	Reg    Register
+	Imm    int32
+	UImm   uint32
+	Size   int
+	Matrix bool
+}
+
+func RegOperand(reg Register) Operand {
+	return Operand{Kind: OperandReg, Reg: reg}
+}
+
+func ImmOperand(imm int32) Operand {
+	return Operand{Kind: OperandImm, Imm: imm}
+}
+
+func UImmOperand(imm uint32) Operand {
+	return Operand{Kind: OperandUImm, UImm: imm}
+}
+
+func MemOperand(base Register, offset int32) Operand {
+	return Operand{Kind: OperandMem, Reg: base, Imm: offset}
+}
+
+func TargetOperand(addr uint32) Operand {
+	return Operand{Kind: OperandTarget, UImm: addr}
+}
+
+// RegName names a register operand, VFPU ones by their shape.
+func (opr Operand) RegName() string {
+	switch {
+	case opr.Reg.Class != RegVFPU || opr.Size <= 1:
+		return opr.Reg.Name()
+	case opr.Matrix:
+		return MatrixName(opr.Reg.Num, opr.Size)
+	}
+	return VectorName(opr.Reg.Num, opr.Size)
+}
+
+func (opr Operand) String() string {
+	switch opr.Kind {
+	case OperandReg:
+		return opr.RegName()
+	case OperandImm:
+		if opr.Imm < 0 {
+			return fmt.Sprintf("-0x%x", -int64(opr.Imm))
+		}
+		return fmt.Sprintf("0x%x", opr.Imm)
+	case OperandUImm:
+		return fmt.Sprintf("0x%x", opr.UImm)
+	case OperandMem:
+		if opr.Imm < 0 {
+			return fmt.Sprintf("-0x%x(%s)", -int64(opr.Imm), opr.Reg.Name())
+		}
+		return fmt.Sprintf("0x%x(%s)", opr.Imm, opr.Reg.Name())
+	case OperandTarget:
+		return fmt.Sprintf("->$%08x", opr.UImm)
+	}
+	return ""
+}
+
+// Argument converts the operand for the code still using SoraArgument.
+func (opr Operand) Argument(labellookup func(uint32) *string) *SoraArgument {
+	switch opr.Kind {
+	case OperandReg:
+		return &SoraArgument{Type: ArgReg, Reg: opr.RegName()}
+	case OperandImm:
+		return &SoraArgument{Type: ArgImm, ValOfs: int(opr.Imm)}
+	case OperandUImm:
+		return &SoraArgument{Type: ArgImm, ValOfs: int(opr.UImm)}
+	case OperandMem:
+		return &SoraArgument{Type: ArgMem, Reg: opr.Reg.Name(), ValOfs: int(opr.Imm)}
+	case OperandTarget:
+		arg := &SoraArgument{Type: ArgImm, ValOfs: int(opr.UImm), IsCodeLocation: true}
+		if labellookup != nil {
+			if label := labellookup(opr.UImm); label != nil {
+				arg.Label = *label
+			}
+		}
+		return arg
+	}
+	return &SoraArgument{}
+}
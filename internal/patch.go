@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/firodj/pspsora/binarysearchtree"
+	"gopkg.in/yaml.v3"
+)
+
+type PatchKind string
+
+const (
+	PatchInstr PatchKind = "instr"
+	PatchData  PatchKind = "data"
+)
+
+// SoraPatch is an edit of the memory, Original are the bytes of the dump it
+// replaces.
+type SoraPatch struct {
+	Address  uint32    `yaml:"address"`
+	Kind     PatchKind `yaml:"kind"`
+	Comment  string    `yaml:"comment,omitempty"`
+	Original []byte    `yaml:"original,flow"`
+	Bytes    []byte    `yaml:"bytes,flow"`
+}
+
+func (patch *SoraPatch) LastAddress() uint32 {
+	return patch.Address + uint32(len(patch.Bytes)) - 1
+}
+
+// PatchManager keeps the patches by address, each one applied to the
+// memory overlay. Patches may not overlap.
+type PatchManager struct {
+	doc *SoraDocument
+
+	patches binarysearchtree.AVLTree[uint32, *SoraPatch]
+}
+
+func NewPatchManager(doc *SoraDocument) *PatchManager {
+	return &PatchManager{doc: doc}
+}
+
+// Conflict returns the patch overlapping size bytes at addr.
+func (patchmgr *PatchManager) Conflict(addr uint32, size int) *SoraPatch {
+	if f, _ := patchmgr.patches.FloorCeil(addr); !f.End() && f.Value().LastAddress() >= addr {
+		return f.Value()
+	}
+	if _, c := patchmgr.patches.FloorCeil(addr); !c.End() && c.Value().Address <= addr+uint32(size)-1 {
+		return c.Value()
+	}
+	return nil
+}
+
+// Create records and applies the edit of data at addr, kept at the
+// unmirrored address.
+func (patchmgr *PatchManager) Create(addr uint32, kind PatchKind, data []byte, comment string) (*SoraPatch, error) {
+	addr &= memoryMirrorMask
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty patch at 0x%08x", addr)
+	}
+	if other := patchmgr.Conflict(addr, len(data)); other != nil {
+		return nil, fmt.Errorf("patch at 0x%08x conflicts with patch at 0x%08x", addr, other.Address)
+	}
+	original, err := patchmgr.doc.Memory.ReadOriginal(addr, len(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := patchmgr.doc.Memory.Patch(addr, data); err != nil {
+		return nil, err
+	}
+	patchmgr.forget(addr, len(data))
+
+	patch := &SoraPatch{
+		Address:  addr,
+		Kind:     kind,
+		Comment:  comment,
+		Original: original,
+		Bytes:    append([]byte{}, data...),
+	}
+	patchmgr.patches.Insert(addr, patch)
+	return patch, nil
+}
+
+// forget drops the instructions decoded from the bytes a patch changes.
+func (patchmgr *PatchManager) forget(addr uint32, size int) {
+	if patchmgr.doc.InstrManager != nil {
+		patchmgr.doc.InstrManager.Forget(addr, size)
+	}
+}
+
+// PatchInstr replaces the instruction at addr, the word must decode.
+func (patchmgr *PatchManager) PatchInstr(addr, word uint32, comment string) (*SoraPatch, error) {
+	if addr&3 != 0 {
+		return nil, fmt.Errorf("unaligned instruction patch at 0x%08x", addr)
+	}
+	dec := DecodeInstruction(addr, word)
+	if dec == nil {
+		return nil, fmt.Errorf("invalid instruction 0x%08x at 0x%08x", word, addr)
+	}
+	if comment == "" {
+		comment = dec.Op
+	}
+	return patchmgr.Create(addr, PatchInstr, binary.LittleEndian.AppendUint32(nil, word), comment)
+}
+
+// PatchAsm assembles text at addr into one instruction patch, commented
+// with the mnemonics when comment is empty.
+func (patchmgr *PatchManager) PatchAsm(addr uint32, text, comment string) (*SoraPatch, error) {
+	instrs, err := NewAssembler(patchmgr.doc).Assemble(addr, text)
+	if err != nil {
+		return nil, err
+	}
+	if len(instrs) == 0 {
+		return nil, fmt.Errorf("nothing to assemble at 0x%08x", addr)
+	}
+	var data []byte
+	var ops []string
+	for _, instr := range instrs {
+		data = binary.LittleEndian.AppendUint32(data, instr.Word)
+		ops = append(ops, instr.Op)
+	}
+	if comment == "" {
+		comment = strings.Join(ops, "; ")
+	}
+	return patchmgr.Create(addr, PatchInstr, data, comment)
+}
+
+func (patchmgr *PatchManager) PatchData(addr uint32, data []byte, comment string) (*SoraPatch, error) {
+	return patchmgr.Create(addr, PatchData, data, comment)
+}
+
+func (patchmgr *PatchManager) Get(addr uint32) *SoraPatch {
+	it := patchmgr.patches.Search(addr)
+	if it.End() {
+		return nil
+	}
+	return it.Value()
+}
+
+// Remove reverts the patch at addr to the original bytes.
+func (patchmgr *PatchManager) Remove(addr uint32) bool {
+	patch := patchmgr.Get(addr)
+	if patch == nil {
+		return false
+	}
+	patchmgr.doc.Memory.Revert(patch.Address, len(patch.Bytes))
+	patchmgr.forget(patch.Address, len(patch.Bytes))
+	patchmgr.patches.Remove(patch.Address)
+	return true
+}
+
+func (patchmgr *PatchManager) ForEach(cb func(patch *SoraPatch)) {
+	patchmgr.patches.InOrderTraverse(cb)
+}
+
+func (patchmgr *PatchManager) Dump() {
+	patchmgr.ForEach(func(patch *SoraPatch) {
+		fmt.Printf("0x%08x %-5s % x -> % x %s\n", patch.Address, patch.Kind, patch.Original, patch.Bytes, patch.Comment)
+	})
+}
+
+func (patchmgr *PatchManager) Save(filename string) error {
+	var patches []SoraPatch
+	patchmgr.ForEach(func(patch *SoraPatch) { patches = append(patches, *patch) })
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := yaml.NewEncoder(file)
+	defer enc.Close()
+	return enc.Encode(patches)
+}
+
+// Load applies the saved patches, all of them or none. A patch whose
+// original bytes no longer match the dump is refused.
+func (patchmgr *PatchManager) Load(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var patches []SoraPatch
+	if err := yaml.NewDecoder(file).Decode(&patches); err != nil {
+		return err
+	}
+	for _, patch := range patches {
+		original, err := patchmgr.doc.Memory.ReadOriginal(patch.Address, len(patch.Original))
+		if err != nil {
+			return err
+		}
+		if string(original) != string(patch.Original) {
+			return fmt.Errorf("patch at 0x%08x: original bytes differ from the dump", patch.Address)
+		}
+	}
+
+	var created []*SoraPatch
+	for _, patch := range patches {
+		applied, err := patchmgr.Create(patch.Address, patch.Kind, patch.Bytes, patch.Comment)
+		if err != nil {
+			for _, undo := range created {
+				patchmgr.Remove(undo.Address)
+			}
+			return err
+		}
+		created = append(created, applied)
+	}
+	return nil
+}
+
+// cwcheatBase is the address CWCheat offsets are relative to.
+const cwcheatBase = 0x08800000
+
+// ExportCWCheat writes the patches as one CWCheat code titled title, each
+// run as the widest aligned constant writes.
+func (patchmgr *PatchManager) ExportCWCheat(w io.Writer, title string) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "_C0 %s\n", title)
+
+	var err error
+	patchmgr.ForEach(func(patch *SoraPatch) {
+		if err != nil {
+			return
+		}
+		for i := 0; i < len(patch.Bytes); {
+			addr := patch.Address + uint32(i)
+			if addr < cwcheatBase || addr-cwcheatBase >= 0x10000000 {
+				err = fmt.Errorf("patch at 0x%08x outside CWCheat range", addr)
+				return
+			}
+			ofs := addr - cwcheatBase
+			rest := patch.Bytes[i:]
+			switch {
+			case addr&3 == 0 && len(rest) >= 4:
+				fmt.Fprintf(out, "_L 0x%08X 0x%08X\n", 0x20000000|ofs, binary.LittleEndian.Uint32(rest))
+				i += 4
+			case addr&1 == 0 && len(rest) >= 2:
+				fmt.Fprintf(out, "_L 0x%08X 0x%08X\n", 0x10000000|ofs, binary.LittleEndian.Uint16(rest))
+				i += 2
+			default:
+				fmt.Fprintf(out, "_L 0x%08X 0x%08X\n", ofs, rest[0])
+				i++
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// ExportImage writes the memory dump with the patches applied, as the
+// SoraMemory.bin it was loaded from.
+func (patchmgr *PatchManager) ExportImage(w io.Writer) error {
+	_, err := w.Write(patchmgr.doc.Memory.Bytes())
+	return err
+}
+
+// ExportIPS writes the patched bytes as an IPS patch of the dump, offsets
+// being relative to its start. IPS cannot reach past 16MiB.
+func (patchmgr *PatchManager) ExportIPS(w io.Writer) error {
+	mem := patchmgr.doc.Memory
+	out := bufio.NewWriter(w)
+	out.WriteString("PATCH")
+
+	for _, change := range mem.Changes() {
+		ofs := change.Address - mem.Start()
+		data := change.New
+		if ofs == 0x454f46 { // would read as "EOF"
+			ofs--
+			prev, _ := mem.Read8(mem.Start() + ofs)
+			data = append([]byte{prev}, data...)
+		}
+		for len(data) > 0 {
+			n := len(data)
+			if n > 0xffff {
+				n = 0xffff
+			}
+			if ofs >= 0x1000000 {
+				return fmt.Errorf("change at 0x%08x past the IPS 16MiB limit", mem.Start()+ofs)
+			}
+			out.Write([]byte{byte(ofs >> 16), byte(ofs >> 8), byte(ofs)})
+			out.Write([]byte{byte(n >> 8), byte(n)})
+			out.Write(data[:n])
+			ofs += uint32(n)
+			data = data[n:]
+		}
+	}
+
+	out.WriteString("EOF")
+	return out.Flush()
+}
+
+// bpsNumber appends the BPS variable length encoding of n.
+func bpsNumber(buf []byte, n uint64) []byte {
+	for {
+		x := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			return append(buf, 0x80|x)
+		}
+		buf = append(buf, x)
+		n--
+	}
+}
+
+// BPS actions
+const (
+	bpsSourceRead = 0
+	bpsTargetRead = 1
+)
+
+// ExportBPS writes the patched bytes as a BPS patch of the dump, without
+// the size limit of IPS.
+func (patchmgr *PatchManager) ExportBPS(w io.Writer) error {
+	mem := patchmgr.doc.Memory
+	size := uint64(len(mem.data))
+
+	buf := []byte("BPS1")
+	buf = bpsNumber(buf, size)
+	buf = bpsNumber(buf, size)
+	buf = bpsNumber(buf, 0)
+
+	ofs := uint32(0)
+	for _, change := range mem.Changes() {
+		at := change.Address - mem.Start()
+		if at > ofs {
+			buf = bpsNumber(buf, uint64(at-ofs-1)<<2|bpsSourceRead)
+		}
+		buf = bpsNumber(buf, uint64(len(change.New)-1)<<2|bpsTargetRead)
+		buf = append(buf, change.New...)
+		ofs = at + uint32(len(change.New))
+	}
+	if uint64(ofs) < size {
+		buf = bpsNumber(buf, (size-uint64(ofs)-1)<<2|bpsSourceRead)
+	}
+
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(mem.data))
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(mem.Bytes()))
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"path/filepath"
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// applyBPS applies the source and target read actions of a BPS patch.
+func applyBPS(t *testing.T, source, patch []byte) []byte {
+	assert.Equal(t, "BPS1", string(patch[:4]))
+	assert.Equal(t, crc32.ChecksumIEEE(patch[:len(patch)-4]), binary.LittleEndian.Uint32(patch[len(patch)-4:]))
+	pos := 4
+	number := func() uint64 {
+		n, shift := uint64(0), uint64(1)
+		for {
+			x := patch[pos]
+			pos++
+			n += uint64(x&0x7f) * shift
+			if x&0x80 != 0 {
+				return n
+			}
+			shift <<= 7
+			n += shift
+		}
+	}
+	assert.Equal(t, uint64(len(source)), number())
+	target := make([]byte, 0, number())
+	pos += int(number())
+
+	for pos < len(patch)-12 {
+		data := number()
+		n := int(data>>2) + 1
+		switch data & 3 {
+		case bpsSourceRead:
+			target = append(target, source[len(target):len(target)+n]...)
+		case bpsTargetRead:
+			target = append(target, patch[pos:pos+n]...)
+			pos += n
+		default:
+			t.Fatalf("unexpected action %d", data&3)
+		}
+	}
+	assert.Equal(t, crc32.ChecksumIEEE(target), binary.LittleEndian.Uint32(patch[len(patch)-8:]))
+	return target
+}
+
+func TestPatchConflicts(t *testing.T) {
+	doc := newEmuDocument()
+	putWords(doc, 0x8800000, 0x03e00008, 0)
+
+	patch, err := doc.PatchManager.PatchInstr(0x8800004, 0x24020001, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "addiu", patch.Comment)
+	assert.Equal(t, []byte{0, 0, 0, 0}, patch.Original)
+
+	_, err = doc.PatchManager.PatchInstr(0x8800004, 0x00000000, "")
+	assert.ErrorContains(t, err, "conflicts")
+	_, err = doc.PatchManager.PatchData(0x8800002, []byte{1, 2, 3}, "")
+	assert.ErrorContains(t, err, "conflicts")
+	_, err = doc.PatchManager.PatchData(0x48800004, []byte{1}, "")
+	assert.ErrorContains(t, err, "conflicts")
+	_, err = doc.PatchManager.PatchInstr(0x8800002, 0, "")
+	assert.Error(t, err)
+	_, err = doc.PatchManager.PatchInstr(0x8800008, 0xfc000000, "")
+	assert.ErrorContains(t, err, "invalid instruction")
+	_, err = doc.PatchManager.PatchData(0x8800fff, []byte{1, 2}, "")
+	assert.Error(t, err)
+
+	word, _ := doc.Memory.Read32(0x8800004)
+	assert.Equal(t, uint32(0x24020001), word)
+	assert.Equal(t, byte(0), doc.Memory.data[4])
+
+	assert.True(t, doc.PatchManager.Remove(0x8800004))
+	assert.False(t, doc.PatchManager.Remove(0x8800004))
+	word, _ = doc.Memory.Read32(0x8800004)
+	assert.Equal(t, uint32(0), word)
+}
+
+func TestPatchRefreshesDisasm(t *testing.T) {
+	doc := newEmuDocument()
+	bridge := make([]byte, len(doc.Memory.data))
+	doc.Memory.bridge = bridge
+	putWord(doc, 0x8800004, 0, models.MipsOpcode{})
+
+	_, err := doc.PatchManager.PatchInstr(0x8800004, 0x24020001, "")
+	assert.NoError(t, err)
+	assert.Nil(t, doc.InstrManager.Get(0x8800004))
+	assert.Equal(t, []byte{1, 0, 2, 0x24}, bridge[4:8])
+
+	putWord(doc, 0x8800004, 0x24020001, models.MipsOpcode{})
+	assert.True(t, doc.PatchManager.Remove(0x8800004))
+	assert.Nil(t, doc.InstrManager.Get(0x8800004))
+	assert.Equal(t, []byte{0, 0, 0, 0}, bridge[4:8])
+}
+
+func TestPatchThenParse(t *testing.T) {
+	dir := t.TempDir()
+	newDoc := func() *SoraDocument {
+		doc := newEmuDocument()
+		putCaller(doc, "main", 0x8800100, 0x8800200)
+		putLeafFunction(doc, "leaf", 0x8800200)
+		return doc
+	}
+	disasmFrom(t, newDoc())
+
+	writeTestTrace(t, filepath.Join(dir, "trace.rec"), traceChunk(1,
+		traceRecord(0x8800100, 0),
+		traceRecord(0x8800200, 0x8800104),
+		traceRecord(0x8800108, 0x8800204),
+	))
+	doc := newDoc()
+	doc.Parser.SetTraceFiles([]string{filepath.Join(dir, "trace.rec")})
+	assert.NoError(t, doc.Parser.Parse(0))
+
+	_, err := doc.PatchManager.PatchInstr(0x8800100, 0x0e200080, "")
+	assert.NoError(t, err)
+	assert.NoError(t, doc.Parser.Parse(0))
+	assert.NotNil(t, doc.BBManager.GetReference(0x8800100, 0x8800200))
+}
+
+func TestPatchExport(t *testing.T) {
+	doc := newEmuDocument()
+	copy(doc.Memory.data[0x100:], "Hello\x00")
+	_, err := doc.PatchManager.PatchInstr(0x8800010, 0x24020001, "")
+	assert.NoError(t, err)
+	_, err = doc.PatchManager.PatchData(0x8800101, []byte("ola!"), "translate")
+	assert.NoError(t, err)
+
+	var cw bytes.Buffer
+	assert.NoError(t, doc.PatchManager.ExportCWCheat(&cw, "Patch"))
+	assert.Equal(t, "_C0 Patch\n"+
+		"_L 0x20000010 0x24020001\n"+
+		"_L 0x00000101 0x0000006F\n"+
+		"_L 0x10000102 0x0000616C\n"+
+		"_L 0x00000104 0x00000021\n", cw.String())
+
+	var image bytes.Buffer
+	assert.NoError(t, doc.PatchManager.ExportImage(&image))
+	assert.Equal(t, "Hola!\x00", string(image.Bytes()[0x100:0x106]))
+	assert.Equal(t, []byte{1, 0, 2, 0x24}, image.Bytes()[0x10:0x14])
+
+	var ips bytes.Buffer
+	assert.NoError(t, doc.PatchManager.ExportIPS(&ips))
+	assert.Equal(t, "PATCH"+
+		"\x00\x00\x10\x00\x01\x01"+
+		"\x00\x00\x12\x00\x02\x02\x24"+
+		"\x00\x01\x01\x00\x01o"+
+		"\x00\x01\x03\x00\x02a!"+
+		"EOF", ips.String())
+
+	var bps bytes.Buffer
+	assert.NoError(t, doc.PatchManager.ExportBPS(&bps))
+	assert.Equal(t, image.Bytes(), applyBPS(t, doc.Memory.data, bps.Bytes()))
+}
+
+func TestPatchSaveLoad(t *testing.T) {
+	doc := newEmuDocument()
+	_, err := doc.PatchManager.PatchInstr(0x8800010, 0x24020001, "")
+	assert.NoError(t, err)
+	_, err = doc.PatchManager.PatchData(0x8800100, []byte{1, 2, 3}, "table")
+	assert.NoError(t, err)
+
+	filename := filepath.Join(t.TempDir(), "patches.yaml")
+	assert.NoError(t, doc.PatchManager.Save(filename))
+
+	loaded := newEmuDocument()
+	assert.NoError(t, loaded.PatchManager.Load(filename))
+	assert.Equal(t, doc.Memory.Changes(), loaded.Memory.Changes())
+	assert.Equal(t, "table", loaded.PatchManager.Get(0x8800100).Comment)
+
+	changed := newEmuDocument()
+	changed.Memory.data[0x100] = 9
+	assert.ErrorContains(t, changed.PatchManager.Load(filename), "original bytes differ")
+	assert.Empty(t, changed.Memory.Changes())
+
+	conflicting := newEmuDocument()
+	_, err = conflicting.PatchManager.PatchData(0x8800102, []byte{7}, "")
+	assert.NoError(t, err)
+	assert.ErrorContains(t, conflicting.PatchManager.Load(filename), "conflicts")
+	assert.Nil(t, conflicting.PatchManager.Get(0x8800010))
+	assert.Len(t, conflicting.Memory.Changes(), 1)
+}
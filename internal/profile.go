@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+type BBProfile struct {
+	Address  uint32 `json:"address"`
+	Count    int64  `json:"count"`
+	Function string `json:"function,omitempty"`
+}
+
+type EdgeProfile struct {
+	From  uint32        `json:"from"`
+	To    uint32        `json:"to"`
+	Kind  SoraBBRefKind `json:"kind"`
+	Count int64         `json:"count"`
+}
+
+type FunctionProfile struct {
+	Address   uint32 `json:"address"`
+	Name      string `json:"name"`
+	Calls     int64  `json:"calls"`
+	Inclusive RefTs  `json:"inclusive"`
+	Exclusive RefTs  `json:"exclusive"`
+}
+
+// TraceProfile counts executions while parsing a BBTrace, times are Nts ticks.
+type TraceProfile struct {
+	doc       *SoraDocument
+	BBCounts  map[uint32]int64
+	Functions map[uint32]*FunctionProfile
+
+	// Source is the trace file index hits are attributed to
+	Source    int
+	BBSources map[uint32]map[int]int64
+}
+
+func NewTraceProfile(doc *SoraDocument) *TraceProfile {
+	return &TraceProfile{
+		doc:       doc,
+		BBCounts:  make(map[uint32]int64),
+		Functions: make(map[uint32]*FunctionProfile),
+		BBSources: make(map[uint32]map[int]int64),
+	}
+}
+
+func (prof *TraceProfile) HitBB(bb_addr uint32) {
+	prof.BBCounts[bb_addr]++
+
+	sources, ok := prof.BBSources[bb_addr]
+	if !ok {
+		sources = make(map[int]int64)
+		prof.BBSources[bb_addr] = sources
+	}
+	sources[prof.Source]++
+}
+
+// OnSplitBB carries the count over, every past run of prev_bb went through split_bb too.
+func (prof *TraceProfile) OnSplitBB(prev_bb, split_bb *SoraBasicBlock) {
+	if count, ok := prof.BBCounts[prev_bb.Address]; ok {
+		prof.BBCounts[split_bb.Address] += count
+	}
+	for src, count := range prof.BBSources[prev_bb.Address] {
+		if _, ok := prof.BBSources[split_bb.Address]; !ok {
+			prof.BBSources[split_bb.Address] = make(map[int]int64)
+		}
+		prof.BBSources[split_bb.Address][src] += count
+	}
+}
+
+func sortedSources(sources map[int]int64) []int {
+	result := make([]int, 0, len(sources))
+	for src := range sources {
+		result = append(result, src)
+	}
+	sort.Ints(result)
+	return result
+}
+
+// SourcesOfBB lists the trace files that executed bb_addr.
+func (prof *TraceProfile) SourcesOfBB(bb_addr uint32) []int {
+	return sortedSources(prof.BBSources[bb_addr])
+}
+
+// SourcesOfFunction lists the trace files that executed any block of fun.
+func (prof *TraceProfile) SourcesOfFunction(fun *SoraFunction) []int {
+	sources := make(map[int]int64)
+	for _, bb_addr := range fun.BBAddresses {
+		for src, count := range prof.BBSources[bb_addr] {
+			sources[src] += count
+		}
+	}
+	return sortedSources(sources)
+}
+
+// ReachedOnlyBy lists the blocks no other trace file executed.
+func (prof *TraceProfile) ReachedOnlyBy(src int) []uint32 {
+	var result []uint32
+	for bb_addr, sources := range prof.BBSources {
+		if _, ok := sources[src]; ok && len(sources) == 1 {
+			result = append(result, bb_addr)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+func (prof *TraceProfile) function(addr uint32) *FunctionProfile {
+	funprof, ok := prof.Functions[addr]
+	if !ok {
+		funprof = &FunctionProfile{Address: addr}
+		if fun := prof.doc.FunManager.Get(addr); fun != nil {
+			funprof.Name = fun.Name
+		} else {
+			funprof.Name = fmt.Sprintf("0x%08x", addr)
+		}
+		prof.Functions[addr] = funprof
+	}
+	return funprof
+}
+
+// AddCallHistory accumulates inclusive and exclusive time from the spans
+// of every stack level, a child is the block one level deeper inside the span.
+func (prof *TraceProfile) AddCallHistory(ch *CallHistory) {
+	for level := 1; level <= ch.MaxLevel(); level++ {
+		var children *StackGraph
+		if level < ch.MaxLevel() {
+			children = ch.stackGraphs[level+1]
+		}
+
+		for it := ch.stackGraphs[level].blockGraphs.Min(); !it.End(); it = it.Next() {
+			b := it.Value()
+			inclusive := b.Stop - b.Start
+			exclusive := inclusive
+
+			if children != nil {
+				_, c := children.blockGraphs.FloorCeil(b.Start)
+				for ; !c.End() && c.Key() < b.Stop; c = c.Next() {
+					exclusive -= c.Value().Stop - c.Value().Start
+				}
+			}
+
+			funprof := prof.function(b.Address)
+			funprof.Calls++
+			funprof.Inclusive += inclusive
+			funprof.Exclusive += exclusive
+		}
+	}
+}
+
+func (prof *TraceProfile) HotBBs() []BBProfile {
+	result := make([]BBProfile, 0, len(prof.BBCounts))
+	for addr, count := range prof.BBCounts {
+		bbprof := BBProfile{Address: addr, Count: count}
+		if fun := prof.doc.FunManager.FindByAddress(addr); fun != nil {
+			bbprof.Function = fun.Name
+		}
+		result = append(result, bbprof)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
+
+func (prof *TraceProfile) HotEdges() []EdgeProfile {
+	var result []EdgeProfile
+	for _, ref := range prof.doc.BBManager.Refs() {
+		if ref.VisitCount == 0 {
+			break
+		}
+		result = append(result, EdgeProfile{
+			From:  ref.From,
+			To:    ref.To,
+			Kind:  ref.Kind,
+			Count: ref.VisitCount,
+		})
+	}
+	return result
+}
+
+// HotSpots lists functions by exclusive time.
+func (prof *TraceProfile) HotSpots() []*FunctionProfile {
+	result := make([]*FunctionProfile, 0, len(prof.Functions))
+	for _, funprof := range prof.Functions {
+		result = append(result, funprof)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Exclusive != result[j].Exclusive {
+			return result[i].Exclusive > result[j].Exclusive
+		}
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
+
+func (prof *TraceProfile) DumpHotSpots(limit int) {
+	fmt.Printf("%-32s %10s %12s %12s\n", "function", "calls", "inclusive", "exclusive")
+	for i, funprof := range prof.HotSpots() {
+		if limit > 0 && i >= limit {
+			break
+		}
+		fmt.Printf("%-32s %10d %12d %12d\n", funprof.Name, funprof.Calls, funprof.Inclusive, funprof.Exclusive)
+	}
+
+	fmt.Printf("%-10s %12s %s\n", "bb", "count", "function")
+	for i, bbprof := range prof.HotBBs() {
+		if limit > 0 && i >= limit {
+			break
+		}
+		fmt.Printf("0x%08x %12d %s\n", bbprof.Address, bbprof.Count, bbprof.Function)
+	}
+}
+
+func (prof *TraceProfile) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"kind", "address", "to", "name", "count", "inclusive", "exclusive"})
+
+	for _, funprof := range prof.HotSpots() {
+		out.Write([]string{"function", fmt.Sprintf("0x%08x", funprof.Address), "", funprof.Name,
+			strconv.FormatInt(funprof.Calls, 10),
+			strconv.Itoa(int(funprof.Inclusive)), strconv.Itoa(int(funprof.Exclusive))})
+	}
+	for _, bbprof := range prof.HotBBs() {
+		out.Write([]string{"bb", fmt.Sprintf("0x%08x", bbprof.Address), "", bbprof.Function,
+			strconv.FormatInt(bbprof.Count, 10), "", ""})
+	}
+	for _, edge := range prof.HotEdges() {
+		out.Write([]string{"edge", fmt.Sprintf("0x%08x", edge.From), fmt.Sprintf("0x%08x", edge.To), string(edge.Kind),
+			strconv.FormatInt(edge.Count, 10), "", ""})
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+func (prof *TraceProfile) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Functions []*FunctionProfile `json:"functions"`
+		BBs       []BBProfile        `json:"bbs"`
+		Edges     []EdgeProfile      `json:"edges"`
+	}{
+		Functions: prof.HotSpots(),
+		BBs:       prof.HotBBs(),
+		Edges:     prof.HotEdges(),
+	})
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfileCallHistory(t *testing.T) {
+	doc := newTestDocument()
+	putFunction(doc, "main", 0x8804000, 0x100)
+	putFunction(doc, "sub", 0x8805000, 0x100)
+
+	ch := NewCallHistory()
+	ch.AddBlock(1, 10, 0x8804000, "main")
+	ch.EndBlock(1, 20)
+	ch.AddBlock(2, 20, 0x8805000, "sub")
+	ch.EndBlock(2, 50)
+	ch.EndBlock(1, 50)
+	ch.AddBlock(2, 60, 0x8805000, "sub")
+	ch.EndBlock(2, 70)
+	ch.EndBlock(1, 100)
+
+	prof := NewTraceProfile(doc)
+	prof.AddCallHistory(ch)
+
+	hot := prof.HotSpots()
+	assert.Len(t, hot, 2)
+	assert.Equal(t, "main", hot[0].Name)
+	assert.Equal(t, RefTs(90), hot[0].Inclusive)
+	assert.Equal(t, RefTs(50), hot[0].Exclusive)
+	assert.Equal(t, "sub", hot[1].Name)
+	assert.Equal(t, int64(2), hot[1].Calls)
+	assert.Equal(t, RefTs(40), hot[1].Exclusive)
+}
+
+func TestProfileBBCounts(t *testing.T) {
+	doc := newTestDocument()
+	putFunction(doc, "main", 0x8804000, 0x100)
+
+	prof := NewTraceProfile(doc)
+	prof.HitBB(0x8804000)
+	prof.HitBB(0x8804010)
+	prof.HitBB(0x8804010)
+	prof.OnSplitBB(&SoraBasicBlock{Address: 0x8804010}, &SoraBasicBlock{Address: 0x8804018})
+
+	hot := prof.HotBBs()
+	assert.Equal(t, uint32(0x8804010), hot[0].Address)
+	assert.Equal(t, int64(2), hot[1].Count)
+	assert.Equal(t, "main", hot[0].Function)
+
+	var buf bytes.Buffer
+	assert.NoError(t, prof.WriteCSV(&buf))
+	assert.Contains(t, buf.String(), "bb,0x08804018,,main,2,,")
+
+	buf.Reset()
+	assert.NoError(t, prof.WriteJSON(&buf))
+	assert.Contains(t, buf.String(), `"count": 2`)
+}
@@ -0,0 +1,549 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Str renders the argument as a pseudo-code operand.
+func (arg *SoraArgument) Str() string {
+	switch arg.Type {
+	case ArgReg:
+		return arg.Reg
+	case ArgMem:
+		if arg.Label != "" {
+			return "&" + arg.Label
+		}
+		if arg.ValOfs == 0 {
+			return arg.Reg
+		}
+		if arg.ValOfs < 0 {
+			return fmt.Sprintf("%s - 0x%x", arg.Reg, -arg.ValOfs)
+		}
+		return fmt.Sprintf("%s + 0x%x", arg.Reg, arg.ValOfs)
+	}
+	if arg.Label != "" {
+		return arg.Label
+	}
+	if arg.ValOfs < 0 {
+		return fmt.Sprintf("-0x%x", -arg.ValOfs)
+	}
+	return fmt.Sprintf("0x%x", arg.ValOfs)
+}
+
+func (arg *SoraArgument) IsZero() bool {
+	return (arg.Type == ArgReg && arg.Reg == "zero") || (arg.Type == ArgImm && arg.ValOfs == 0)
+}
+
+// PseudoCond is a branch condition, Left Op Right.
+type PseudoCond struct {
+	Left  string
+	Op    string
+	Right string
+}
+
+var negatedOps = map[string]string{
+	"==": "!=", "!=": "==",
+	"<": ">=", ">=": "<",
+	">": "<=", "<=": ">",
+}
+
+func (cond PseudoCond) Not() PseudoCond {
+	if op, ok := negatedOps[cond.Op]; ok {
+		cond.Op = op
+	} else if cond.Op == "" {
+		if strings.HasPrefix(cond.Left, "!") {
+			cond.Left = cond.Left[1:]
+		} else {
+			cond.Left = "!" + cond.Left
+		}
+	}
+	return cond
+}
+
+func (cond PseudoCond) String() string {
+	if cond.Op == "" {
+		return cond.Left
+	}
+	return fmt.Sprintf("%s %s %s", cond.Left, cond.Op, cond.Right)
+}
+
+// Reads tells whether the condition uses reg.
+func (cond PseudoCond) Reads(reg string) bool {
+	return cond.Left == reg || cond.Right == reg || cond.Left == "(s32)"+reg
+}
+
+var condOps = map[string]string{
+	"beq": "==", "bne": "!=",
+	"blez": "<=", "bgtz": ">", "bltz": "<", "bgez": ">=",
+	"beqz": "==", "bnez": "!=",
+}
+
+// PseudoCondition is the condition on which instr branches, ok is false for
+// unconditional and unknown branches.
+func PseudoCondition(instr *SoraInstruction) (cond PseudoCond, ok bool) {
+	mnemonic := instr.Mnemonic
+	if instr.Info.IsLikelyBranch {
+		mnemonic = strings.TrimSuffix(mnemonic, "l")
+	}
+
+	switch mnemonic {
+	case "bc1t":
+		return PseudoCond{Left: "fpcond"}, true
+	case "bc1f":
+		return PseudoCond{Left: "!fpcond"}, true
+	case "bvt", "bvf":
+		if len(instr.Operands) < 2 {
+			return cond, false
+		}
+		cc := fmt.Sprintf("CC[%d]", instr.Operands[0].UImm)
+		if mnemonic == "bvf" {
+			cc = "!" + cc
+		}
+		return PseudoCond{Left: cc}, true
+	}
+
+	op, ok := condOps[mnemonic]
+	if !ok || len(instr.Args) < 2 {
+		return cond, false
+	}
+	switch mnemonic {
+	case "beq", "bne":
+		if len(instr.Args) < 3 {
+			return cond, false
+		}
+		return PseudoCond{instr.Args[0].Str(), op, instr.Args[1].Str()}, true
+	case "beqz", "bnez":
+		return PseudoCond{instr.Args[0].Str(), op, "0"}, true
+	}
+	return PseudoCond{"(s32)" + instr.Args[0].Str(), op, "0"}, true
+}
+
+type pseudoFunc func(doc *SoraDocument, instr *SoraInstruction) (string, bool)
+
+var pseudoTable = map[string]pseudoFunc{
+	"addiu": pseudoAssign,
+	"addu":  pseudoAssign,
+	"subu":  pseudoAssign,
+	"move":  pseudoAssign,
+	"and":   pseudoAssign,
+	"andi":  pseudoAssign,
+	"ori":   pseudoAssign,
+	"or":    pseudoAssign,
+	"nor":   pseudoAssign,
+	"xor":   pseudoAssign,
+	"xori":  pseudoAssign,
+	"sll":   pseudoAssign,
+	"sllv":  pseudoAssign,
+	"sltiu": pseudoAssign,
+	"slti":  pseudoAssign,
+	"sltu":  pseudoAssign,
+	"slt":   pseudoAssign,
+	"sra":   pseudoAssign,
+	"srav":  pseudoAssign,
+	"srl":   pseudoAssign,
+	"srlv":  pseudoAssign,
+	"li":    pseudoAssign,
+
+	"lui": pseudoLoadUpper,
+	"lw":  pseudoLoad,
+	"lh":  pseudoLoad,
+	"lhu": pseudoLoad,
+	"lb":  pseudoLoad,
+	"lbu": pseudoLoad,
+
+	"sw": pseudoStore,
+	"sh": pseudoStore,
+	"sb": pseudoStore,
+
+	"nop": pseudoNothing,
+
+	"jal":  pseudoCall,
+	"jalr": pseudoCall,
+
+	"syscall": pseudoSyscall,
+}
+
+type pseudoOp struct {
+	op          string
+	arg1_signed bool
+	arg2_signed bool
+}
+
+var assignOps = map[string]pseudoOp{
+	"addiu": {op: "+"},
+	"addu":  {op: "+"},
+	"li":    {op: "+"},
+	"subu":  {op: "-"},
+	"and":   {op: "&"},
+	"andi":  {op: "&"},
+	"ori":   {op: "|"},
+	"or":    {op: "|"},
+	"xor":   {op: "^"},
+	"xori":  {op: "^"},
+	"sll":   {op: "<<"},
+	"sllv":  {op: "<<"},
+	"sltiu": {op: "<"},
+	"sltu":  {op: "<"},
+	"slti":  {op: "<", arg1_signed: true},
+	"slt":   {op: "<", arg1_signed: true, arg2_signed: true},
+	"sra":   {op: ">>", arg1_signed: true},
+	"srav":  {op: ">>", arg1_signed: true},
+	"srl":   {op: ">>"},
+	"srlv":  {op: ">>"},
+}
+
+func pseudoNothing(doc *SoraDocument, instr *SoraInstruction) (string, bool) {
+	return "", true
+}
+
+func pseudoAssign(doc *SoraDocument, instr *SoraInstruction) (string, bool) {
+	if len(instr.Args) < 2 || len(instr.Args) > 3 {
+		return "", false
+	}
+	if instr.Mnemonic == "nor" {
+		if len(instr.Args) < 3 {
+			return "", false
+		}
+		return fmt.Sprintf("%s = ~(%s | %s)", instr.Args[0].Str(), instr.Args[1].Str(), instr.Args[2].Str()), true
+	}
+
+	op := assignOps[instr.Mnemonic]
+	if len(instr.Args) > 2 && op.op == "" {
+		return "", false
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s = ", instr.Args[0].Str())
+	if op.arg1_signed {
+		sb.WriteString("(s32)")
+	}
+	sb.WriteString(instr.Args[1].Str())
+	if len(instr.Args) > 2 && !instr.Args[2].IsZero() {
+		arg2 := instr.Args[2]
+		if arg2.Label != "" && !arg2.IsCodeLocation && (op.op == "+" || op.op == "|") {
+			// the low half of a data address
+			return fmt.Sprintf("%s = &%s", instr.Args[0].Str(), arg2.Label), true
+		}
+		if op.op == "+" && arg2.Type == ArgImm && arg2.ValOfs < 0 && arg2.Label == "" {
+			fmt.Fprintf(&sb, " - 0x%x", -arg2.ValOfs)
+			return sb.String(), true
+		}
+		sb.WriteString(" " + op.op + " ")
+		if op.arg2_signed {
+			sb.WriteString("(s32)")
+		}
+		if (op.op == "<<" || op.op == ">>") && arg2.Type == ArgImm {
+			fmt.Fprintf(&sb, "%d", arg2.ValOfs)
+		} else {
+			sb.WriteString(arg2.Str())
+		}
+	}
+	return sb.String(), true
+}
+
+func pseudoLoadUpper(doc *SoraDocument, instr *SoraInstruction) (string, bool) {
+	if len(instr.Args) < 2 {
+		return "", false
+	}
+	if instr.Args[1].Type == ArgImm {
+		return fmt.Sprintf("%s = 0x%x", instr.Args[0].Str(), uint32(instr.Args[1].ValOfs)<<16), true
+	}
+	return fmt.Sprintf("%s = %s << 16", instr.Args[0].Str(), instr.Args[1].Str()), true
+}
+
+var memTypes = map[string]string{
+	"w": "u32", "h": "s16", "hu": "u16", "b": "s8", "bu": "u8",
+}
+
+func pseudoLoad(doc *SoraDocument, instr *SoraInstruction) (string, bool) {
+	sz, ok := memTypes[instr.Mnemonic[1:]]
+	if !ok || len(instr.Args) < 2 {
+		return "", false
+	}
+	return fmt.Sprintf("%s = *(%s *)(%s)", instr.Args[0].Str(), sz, instr.Args[1].Str()), true
+}
+
+func pseudoStore(doc *SoraDocument, instr *SoraInstruction) (string, bool) {
+	sz, ok := memTypes[instr.Mnemonic[1:]]
+	if !ok || len(instr.Args) < 2 {
+		return "", false
+	}
+	return fmt.Sprintf("*(%s *)(%s) = %s", sz, instr.Args[1].Str(), instr.Args[0].Str()), true
+}
+
+func pseudoCall(doc *SoraDocument, instr *SoraInstruction) (string, bool) {
+	if len(instr.Args) == 0 {
+		return "", false
+	}
+	target := instr.Args[len(instr.Args)-1]
+	if target.Type == ArgReg {
+		return fmt.Sprintf("v0 = (*%s)(...)", target.Str()), true
+	}
+	return fmt.Sprintf("v0 = %s(...)", doc.pseudoTarget(target)), true
+}
+
+func pseudoSyscall(doc *SoraDocument, instr *SoraInstruction) (string, bool) {
+	if len(instr.Args) == 0 {
+		return "", false
+	}
+	name := instr.Args[0].Str()
+	hlefun := doc.hleFunction(name)
+	if hlefun == nil {
+		return name + "(...)", true
+	}
+
+	var args []string
+	for i := range hlefun.ArgMask {
+		args = append(args, fmt.Sprintf("a%d", i))
+	}
+	call := fmt.Sprintf("%s(%s)", hlefun.Name, strings.Join(args, ", "))
+	if hlefun.RetMask == "" || hlefun.RetMask == "v" {
+		return call, true
+	}
+	return "v0 = " + call, true
+}
+
+// pseudoTarget names a code location, by symbol when it has one.
+func (doc *SoraDocument) pseudoTarget(arg *SoraArgument) string {
+	if arg.Label != "" {
+		return arg.Label
+	}
+	if arg.Type == ArgImm {
+		if fun := doc.FunManager.Get(uint32(arg.ValOfs)); fun != nil {
+			return fun.Name
+		}
+		return fmt.Sprintf("fun_%08x", uint32(arg.ValOfs))
+	}
+	return arg.Str()
+}
+
+// hleFunction finds the HLE function named "Module::Func".
+func (doc *SoraDocument) hleFunction(name string) *PSPHLEFunction {
+	modl_name, fun_name, ok := strings.Cut(name, "::")
+	if !ok {
+		return nil
+	}
+	for m := range doc.yaml.HLEModules {
+		modl := &doc.yaml.HLEModules[m]
+		if modl.Name != modl_name {
+			continue
+		}
+		for f := range modl.Funcs {
+			if modl.Funcs[f].Name == fun_name {
+				return &modl.Funcs[f]
+			}
+		}
+	}
+	return nil
+}
+
+// PseudoStatement translates a non control-flow instruction, unknown
+// instructions are kept as a comment with their disassembly.
+func (doc *SoraDocument) PseudoStatement(instr *SoraInstruction) string {
+	if stmt, ok := pseudoFloat(instr); ok {
+		return stmt
+	}
+	if fn, ok := pseudoTable[instr.Mnemonic]; ok {
+		if stmt, ok := fn(doc, instr); ok {
+			return stmt
+		}
+	}
+	return "/* " + strings.ReplaceAll(instr.Info.Dizz, "\t", " ") + " */"
+}
+
+// pseudoWrites lists the registers instr assigns, by the decoded operands
+// when there are.
+func pseudoWrites(instr *SoraInstruction) []string {
+	if instr.Op != "" {
+		var names []string
+		for _, reg := range instr.Writes {
+			names = append(names, reg.Name())
+		}
+		return names
+	}
+	if len(instr.Args) == 0 || instr.Args[0].Type != ArgReg {
+		return nil
+	}
+	switch instr.Mnemonic {
+	case "sw", "sh", "sb", "nop", "syscall":
+		return nil
+	case "jal", "jalr":
+		return []string{"ra"}
+	}
+	if instr.Info.IsBranch {
+		return nil
+	}
+	return []string{instr.Args[0].Reg}
+}
+
+// floatPseudo are the FPU and VFPU statements by decoded op, VFPU ones
+// without the size suffix. The format takes the operands by index.
+var floatPseudo = map[string]struct {
+	n      int
+	format string
+}{
+	"add.s":     {3, "%[1]s = %[2]s + %[3]s"},
+	"sub.s":     {3, "%[1]s = %[2]s - %[3]s"},
+	"mul.s":     {3, "%[1]s = %[2]s * %[3]s"},
+	"div.s":     {3, "%[1]s = %[2]s / %[3]s"},
+	"sqrt.s":    {2, "%[1]s = sqrtf(%[2]s)"},
+	"abs.s":     {2, "%[1]s = fabsf(%[2]s)"},
+	"mov.s":     {2, "%[1]s = %[2]s"},
+	"neg.s":     {2, "%[1]s = -%[2]s"},
+	"round.w.s": {2, "%[1]s = (s32)roundf(%[2]s)"},
+	"trunc.w.s": {2, "%[1]s = (s32)%[2]s"},
+	"ceil.w.s":  {2, "%[1]s = (s32)ceilf(%[2]s)"},
+	"floor.w.s": {2, "%[1]s = (s32)floorf(%[2]s)"},
+	"cvt.w.s":   {2, "%[1]s = (s32)%[2]s"},
+	"cvt.s.w":   {2, "%[1]s = (float)(s32)%[2]s"},
+	"mfc1":      {2, "%[1]s = %[2]s"},
+	"mtc1":      {2, "%[2]s = %[1]s"},
+	"lwc1":      {2, "%[1]s = *(float *)(%[2]s)"},
+	"swc1":      {2, "*(float *)(%[2]s) = %[1]s"},
+	"c.eq.s":    {2, "fpcond = %[1]s == %[2]s"},
+	"c.olt.s":   {2, "fpcond = %[1]s < %[2]s"},
+	"c.lt.s":    {2, "fpcond = %[1]s < %[2]s"},
+	"c.ole.s":   {2, "fpcond = %[1]s <= %[2]s"},
+	"c.le.s":    {2, "fpcond = %[1]s <= %[2]s"},
+
+	"vadd":   {3, "%[1]s = %[2]s + %[3]s"},
+	"vsub":   {3, "%[1]s = %[2]s - %[3]s"},
+	"vmul":   {3, "%[1]s = %[2]s * %[3]s"},
+	"vdiv":   {3, "%[1]s = %[2]s / %[3]s"},
+	"vscl":   {3, "%[1]s = %[2]s * %[3]s"},
+	"vdot":   {3, "%[1]s = dot(%[2]s, %[3]s)"},
+	"vhdp":   {3, "%[1]s = hdot(%[2]s, %[3]s)"},
+	"vcrs":   {3, "%[1]s = cross_half(%[2]s, %[3]s)"},
+	"vcrsp":  {3, "%[1]s = cross(%[2]s, %[3]s)"},
+	"vdet":   {3, "%[1]s = det(%[2]s, %[3]s)"},
+	"vmin":   {3, "%[1]s = min(%[2]s, %[3]s)"},
+	"vmax":   {3, "%[1]s = max(%[2]s, %[3]s)"},
+	"vsge":   {3, "%[1]s = %[2]s >= %[3]s"},
+	"vslt":   {3, "%[1]s = %[2]s < %[3]s"},
+	"vmov":   {2, "%[1]s = %[2]s"},
+	"vneg":   {2, "%[1]s = -%[2]s"},
+	"vabs":   {2, "%[1]s = abs(%[2]s)"},
+	"vrcp":   {2, "%[1]s = 1 / %[2]s"},
+	"vzero":  {1, "%[1]s = 0"},
+	"vone":   {1, "%[1]s = 1"},
+	"vidt":   {1, "%[1]s = identity()"},
+	"vmmov":  {2, "%[1]s = %[2]s"},
+	"vmmul":  {3, "%[1]s = %[2]s * %[3]s"},
+	"vmscl":  {3, "%[1]s = %[2]s * %[3]s"},
+	"vtfm2":  {3, "%[1]s = %[2]s * %[3]s"},
+	"vtfm3":  {3, "%[1]s = %[2]s * %[3]s"},
+	"vtfm4":  {3, "%[1]s = %[2]s * %[3]s"},
+	"vhtfm2": {3, "%[1]s = %[2]s * %[3]s"},
+	"vhtfm3": {3, "%[1]s = %[2]s * %[3]s"},
+	"vhtfm4": {3, "%[1]s = %[2]s * %[3]s"},
+	"vmidt":  {1, "%[1]s = identity()"},
+	"vmzero": {1, "%[1]s = 0"},
+	"vmone":  {1, "%[1]s = 1"},
+	"lv":     {2, "%[1]s = *(float *)(%[2]s)"},
+	"sv":     {2, "*(float *)(%[2]s) = %[1]s"},
+	"mfv":    {2, "%[1]s = %[2]s"},
+	"mfvc":   {2, "%[1]s = %[2]s"},
+	"mtv":    {2, "%[2]s = %[1]s"},
+	"mtvc":   {2, "%[2]s = %[1]s"},
+	"viim":   {2, "%[1]s = %[2]s"},
+}
+
+// pseudoOperand renders a decoded operand the way Str renders arguments.
+func pseudoOperand(opr Operand) string {
+	switch opr.Kind {
+	case OperandReg:
+		return opr.RegName()
+	case OperandMem:
+		return opr.Argument(nil).Str()
+	case OperandImm:
+		return fmt.Sprintf("%d", opr.Imm)
+	case OperandUImm:
+		return fmt.Sprintf("%d", opr.UImm)
+	}
+	return opr.String()
+}
+
+// pseudoFloat translates FPU and VFPU instructions from their decoded
+// operands, other VFPU ops become a call named after them.
+func pseudoFloat(instr *SoraInstruction) (string, bool) {
+	op := instr.Op
+	vfpu := len(op) > 0 && (op[0] == 'v' || op == "lv.s" || op == "lv.q" || op == "sv.s" || op == "sv.q")
+	if !vfpu && floatPseudo[op].format == "" {
+		return "", false
+	}
+
+	base := op
+	if vfpu {
+		if i := strings.LastIndex(op, "."); i > 0 {
+			base = op[:i]
+		}
+	}
+	var oprs []any
+	for _, opr := range instr.Operands {
+		oprs = append(oprs, pseudoOperand(opr))
+	}
+
+	switch base {
+	case "vpfxs", "vpfxt", "vpfxd":
+		return fmt.Sprintf("/* %s %s */", base, VfpuPrefix(instr.Operands[0].UImm, base == "vpfxd")), true
+	case "vcmp":
+		cond := vcmpConds[instr.Operands[0].UImm&15]
+		return fmt.Sprintf("CC = cmp_%s(%s, %s)", cond, oprs[1], oprs[2]), true
+	case "vcst":
+		cst := "(undef)"
+		if index := instr.Operands[1].UImm; int(index) < len(vcstNames) {
+			cst = vcstNames[index]
+		}
+		return fmt.Sprintf("%s = %s", oprs[0], cst), true
+	case "vfim":
+		return fmt.Sprintf("%s = %g", oprs[0], halfToFloat(uint16(instr.Operands[1].Imm))), true
+	case "vcmovt", "vcmovf":
+		cc := fmt.Sprintf("CC[%d]", instr.Operands[2].UImm)
+		if base == "vcmovf" {
+			cc = "!" + cc
+		}
+		return fmt.Sprintf("%s = %s ? %s : %s", oprs[0], cc, oprs[1], oprs[0]), true
+	case "lv", "sv":
+		if op == "lv.q" || op == "sv.q" {
+			base = op[:2]
+			format := strings.ReplaceAll(floatPseudo[base].format, "float", "vec4")
+			return fmt.Sprintf(format, oprs...), true
+		}
+	}
+
+	if pseudo, ok := floatPseudo[base]; ok && len(oprs) >= pseudo.n {
+		return fmt.Sprintf(pseudo.format, oprs...), true
+	}
+	if !vfpu || len(instr.Writes) == 0 || len(oprs) == 0 || instr.Operands[0].Kind != OperandReg {
+		return "", false
+	}
+	args := make([]string, 0, len(oprs)-1)
+	for _, opr := range oprs[1:] {
+		args = append(args, opr.(string))
+	}
+	return fmt.Sprintf("%s = %s(%s)", oprs[0], base, strings.Join(args, ", ")), true
+}
+
+// halfToFloat converts the half precision immediate of vfim.
+func halfToFloat(half uint16) float32 {
+	sign := uint32(half>>15) << 31
+	exp := uint32(half>>10) & 0x1f
+	mant := uint32(half) & 0x3ff
+	switch {
+	case exp == 0x1f:
+		exp = 0xff
+	case exp == 0 && mant == 0:
+	case exp == 0:
+		exp = 127 - 14
+		for mant&0x400 == 0 {
+			mant <<= 1
+			exp--
+		}
+		mant &= 0x3ff
+	default:
+		exp += 127 - 15
+	}
+	return math.Float32frombits(sign | exp<<23 | mant<<13)
+}
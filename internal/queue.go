@@ -22,3 +22,8 @@ func (q *Queue[T]) Pop() T {
 func (q *Queue[T]) Top() T {
 	return q.elements[q.Len()-1]
 }
+
+// At returns the i-th element from the bottom.
+func (q *Queue[T]) At(i int) T {
+	return q.elements[i]
+}
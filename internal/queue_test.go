@@ -22,3 +22,13 @@ func TestAja(t *testing.T) {
 	assert.Equal(t, 0, q.Len())
 	assert.Equal(t, "a", x)
 }
+
+func TestQueueAt(t *testing.T) {
+	q := Queue[string]{}
+	q.Push("a")
+	q.Push("b")
+
+	assert.Equal(t, "a", q.At(0))
+	assert.Equal(t, "b", q.At(1))
+	assert.Equal(t, "b", q.Top())
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type RAMismatchKind string
+
+const (
+	MismatchCallback       RAMismatchKind = "callback"
+	MismatchCallbackReturn RAMismatchKind = "callback_return" // a callback frame going back to the kernel
+	MismatchUnwind         RAMismatchKind = "unwind"
+	MismatchException      RAMismatchKind = "exception"
+	MismatchCorruption     RAMismatchKind = "corruption"
+)
+
+var exceptionNames = []string{
+	"Exception",
+	"exception",
+}
+
+type RAMismatchFrame struct {
+	Function uint32 `yaml:"function"`
+	Name     string `yaml:"name"`
+	RA       uint32 `yaml:"ra"`
+}
+
+// RAMismatch is a control transfer that did not follow the traced call stack.
+type RAMismatch struct {
+	Kind       RAMismatchKind    `yaml:"kind"`
+	Source     int               `yaml:"source"`
+	ThreadID   uint16            `yaml:"thread_id"`
+	ThreadName string            `yaml:"thread_name"`
+	Nts        RefTs             `yaml:"nts"`
+	ExpectedRA uint32            `yaml:"expected_ra"`
+	Target     uint32            `yaml:"target"`
+	Leaving    string            `yaml:"leaving,omitempty"`
+	Unwound    int               `yaml:"unwound,omitempty"`
+	Stack      []RAMismatchFrame `yaml:"stack"`
+}
+
+// AddExceptionHandler marks addr as an exception handler entry, such as the
+// one given to sceKernelRegisterDefaultExceptionHandler.
+func (bbtrace *BBTraceParser) AddExceptionHandler(addr uint32) {
+	if bbtrace.exceptionHandlers == nil {
+		bbtrace.exceptionHandlers = make(map[uint32]bool)
+	}
+	bbtrace.exceptionHandlers[addr] = true
+}
+
+func (bbtrace *BBTraceParser) isExceptionHandler(addr uint32) bool {
+	if bbtrace.exceptionHandlers[addr] {
+		return true
+	}
+	if fun := bbtrace.doc.FunManager.Get(addr); fun != nil {
+		for _, name := range exceptionNames {
+			if strings.Contains(fun.Name, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (bbtrace *BBTraceParser) isFunctionEntry(addr uint32) bool {
+	if bbtrace.doc.FunManager.Get(addr) != nil {
+		return true
+	}
+	return bbtrace.doc.SymMap.GetFunctionStart(addr) == addr
+}
+
+// ClassifyReturn tells why a return landed on target instead of expected_ra,
+// for an unwind also how many frames of the stack are skipped.
+func (bbtrace *BBTraceParser) ClassifyReturn(thread *BBTraceThreadState, target, expected_ra uint32) (RAMismatchKind, int) {
+	for i := thread.Stack.Len() - 2; i >= 0; i-- {
+		if thread.Stack.At(i).RA == target {
+			return MismatchUnwind, thread.Stack.Len() - 1 - i
+		}
+	}
+	if bbtrace.isExceptionHandler(target) {
+		return MismatchException, 0
+	}
+	if bbtrace.isFunctionEntry(target) {
+		return MismatchCallback, 0
+	}
+	return MismatchCorruption, 0
+}
+
+func (bbtrace *BBTraceParser) addMismatch(thread *BBTraceThreadState, kind RAMismatchKind, target, expected_ra uint32) *RAMismatch {
+	mismatch := &RAMismatch{
+		Kind:       kind,
+		Source:     bbtrace.sourceIndex(),
+		ThreadID:   thread.ID,
+		ThreadName: thread.Name,
+		Nts:        bbtrace.Nts,
+		ExpectedRA: expected_ra,
+		Target:     target,
+	}
+	for i := 0; i < thread.Stack.Len(); i++ {
+		item := thread.Stack.At(i)
+		frame := RAMismatchFrame{Function: item.Address(), RA: item.RA}
+		if item.Fun != nil {
+			frame.Function = item.Fun.Address
+			frame.Name = item.Fun.Name
+		}
+		mismatch.Stack = append(mismatch.Stack, frame)
+	}
+	bbtrace.Mismatches = append(bbtrace.Mismatches, mismatch)
+
+	bbtrace.doc.logf("WARNING:\t[%d] %s at 0x%08x, expecting ra 0x%08x\n", thread.ID, kind, target, expected_ra)
+	return mismatch
+}
+
+// unwind pops n frames without returning through them.
+func (bbtrace *BBTraceParser) unwind(thread *BBTraceThreadState, n int) {
+	for ; n > 0; n-- {
+		if thread.CallHistory != nil {
+			thread.CallHistory.EndBlock(thread.Stack.Len(), bbtrace.Nts)
+		}
+		left := thread.Stack.Pop()
+		thread.RegSP = left.SP
+		bbtrace.onPopped(thread, left)
+	}
+}
+
+// FindMismatches lists the recorded mismatches accepted by filter, all of them for nil.
+func (bbtrace *BBTraceParser) FindMismatches(filter func(*RAMismatch) bool) []*RAMismatch {
+	var result []*RAMismatch
+	for _, mismatch := range bbtrace.Mismatches {
+		if filter == nil || filter(mismatch) {
+			result = append(result, mismatch)
+		}
+	}
+	return result
+}
+
+func (bbtrace *BBTraceParser) MismatchesOfKind(kind RAMismatchKind) []*RAMismatch {
+	return bbtrace.FindMismatches(func(mismatch *RAMismatch) bool {
+		return mismatch.Kind == kind
+	})
+}
+
+func (bbtrace *BBTraceParser) MismatchesOfThread(src int, id uint16) []*RAMismatch {
+	return bbtrace.FindMismatches(func(mismatch *RAMismatch) bool {
+		return mismatch.Source == src && mismatch.ThreadID == id
+	})
+}
+
+func (bbtrace *BBTraceParser) DumpMismatches() {
+	counts := make(map[RAMismatchKind]int)
+	for _, mismatch := range bbtrace.Mismatches {
+		counts[mismatch.Kind]++
+	}
+	var kinds []string
+	for kind := range counts {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Printf("%-12s %d\n", kind, counts[RAMismatchKind(kind)])
+	}
+
+	for _, mismatch := range bbtrace.Mismatches {
+		fmt.Printf("%s [%d:%d %s] nts=%d target=0x%08x expected=0x%08x", mismatch.Kind, mismatch.Source,
+			mismatch.ThreadID, mismatch.ThreadName, mismatch.Nts, mismatch.Target, mismatch.ExpectedRA)
+		if mismatch.Leaving != "" {
+			fmt.Printf(" leaving=%s", mismatch.Leaving)
+		}
+		fmt.Println()
+		for i := len(mismatch.Stack) - 1; i >= 0; i-- {
+			frame := mismatch.Stack[i]
+			fmt.Printf("\t0x%08x %s ra=0x%08x\n", frame.Function, frame.Name, frame.RA)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReturnMismatch(t *testing.T) {
+	dir := t.TempDir()
+	doc := newTestDocument()
+	putCaller(doc, "main", 0x8804000, 0x8805000)
+	putCaller(doc, "sub", 0x8805000, 0x8806000)
+	putLeafFunction(doc, "leaf", 0x8806000)
+	putLeafFunction(doc, "callback", 0x8807000)
+	putInstr(doc, 0x8807100, "jr\tra", opJR)
+	putInstr(doc, 0x8807104, "nop", models.MipsOpcode{})
+
+	writeTestTrace(t, filepath.Join(dir, "trace.rec"),
+		traceChunk(1, traceStart(0x8804000), traceName("user_main"),
+			traceRecord(0x8804000, 0),
+			traceRecord(0x8805000, 0x8804004),
+			traceRecord(0x8806000, 0x8805004),
+			// leaf returns straight into main
+			traceRecord(0x8804008, 0x8806004),
+			traceRecord(0x8807000, 0),
+			traceRecord(0x8807100, 0x8807004),
+		))
+
+	doc.Parser.SetTraceFiles([]string{filepath.Join(dir, "trace.rec")})
+	assert.NoError(t, doc.Parser.Parse(0))
+
+	mismatches := doc.Parser.Mismatches
+	assert.Len(t, mismatches, 3)
+
+	assert.Equal(t, MismatchUnwind, mismatches[0].Kind)
+	assert.Equal(t, uint32(0x8805008), mismatches[0].ExpectedRA)
+	assert.Equal(t, uint32(0x8804008), mismatches[0].Target)
+	assert.Equal(t, 1, mismatches[0].Unwound)
+	assert.Equal(t, "leaf", mismatches[0].Leaving)
+	assert.Len(t, mismatches[0].Stack, 2)
+	assert.Equal(t, "sub", mismatches[0].Stack[1].Name)
+
+	assert.Equal(t, MismatchCallback, mismatches[1].Kind)
+	assert.Equal(t, uint32(0x8807000), mismatches[1].Target)
+	assert.Equal(t, "user_main", mismatches[1].ThreadName)
+
+	// the callback returns into the kernel, main keeps its RA
+	assert.Equal(t, MismatchCallbackReturn, mismatches[2].Kind)
+	assert.Equal(t, uint32(0x8804008), mismatches[2].ExpectedRA)
+	assert.Equal(t, "callback", mismatches[2].Leaving)
+	assert.Len(t, doc.Parser.MismatchesOfKind(MismatchCallback), 1)
+	assert.Len(t, doc.Parser.MismatchesOfThread(0, 1), 3)
+	assert.Empty(t, doc.Parser.MismatchesOfThread(0, 2))
+
+	thread := doc.Parser.Threads[1]
+	assert.Equal(t, 1, thread.Stack.Len())
+	assert.Equal(t, uint32(0x8804008), thread.Stack.Top().RA)
+	doc.Parser.AddExceptionHandler(0x8808000)
+	kind, _ := doc.Parser.ClassifyReturn(thread, 0x8808000, 0x8804010)
+	assert.Equal(t, MismatchException, kind)
+	kind, _ = doc.Parser.ClassifyReturn(thread, 0x8806000, 0x8804010)
+	assert.Equal(t, MismatchCallback, kind)
+}
+
+func TestReturnCorruptionKeepsFunctions(t *testing.T) {
+	dir := t.TempDir()
+	doc := newTestDocument()
+	putCaller(doc, "main", 0x8804000, 0x8806000)
+	putLeafFunction(doc, "leaf", 0x8806000)
+	putFunction(doc, "big", 0x8805000, 0x100)
+	putInstr(doc, 0x8805040, "jr\tra", opJR)
+	putInstr(doc, 0x8805044, "nop", models.MipsOpcode{})
+
+	writeTestTrace(t, filepath.Join(dir, "trace.rec"),
+		traceChunk(1,
+			traceRecord(0x8804000, 0),
+			traceRecord(0x8806000, 0x8804004),
+			// leaf returns into the middle of big
+			traceRecord(0x8805040, 0x8806004),
+		))
+
+	bounds := func() (list []string) {
+		doc.FunManager.ForEach(func(fun *SoraFunction) {
+			list = append(list, fmt.Sprintf("%s 0x%08x %d", fun.Name, fun.Address, fun.Size))
+		})
+		return list
+	}
+	before := bounds()
+
+	doc.Parser.SetTraceFiles([]string{filepath.Join(dir, "trace.rec")})
+	assert.NoError(t, doc.Parser.Parse(0))
+
+	mismatches := doc.Parser.Mismatches
+	if assert.Len(t, mismatches, 1) {
+		assert.Equal(t, MismatchCorruption, mismatches[0].Kind)
+		assert.Equal(t, uint32(0x8804008), mismatches[0].ExpectedRA)
+	}
+
+	assert.Equal(t, before, bounds())
+
+	thread := doc.Parser.Threads[1]
+	assert.Equal(t, 1, thread.Stack.Len())
+	assert.Equal(t, uint32(0x8805040), thread.Stack.Top().Address())
+	assert.Equal(t, "main", thread.Stack.Top().Fun.Name)
+}
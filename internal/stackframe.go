@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+)
+
+// callee-saved registers by MIPS o32 convention
+var calleeSavedRegs = map[string]bool{
+	"s0": true, "s1": true, "s2": true, "s3": true,
+	"s4": true, "s5": true, "s6": true, "s7": true,
+	"fp": true, "gp": true, "ra": true,
+}
+
+type SoraSavedReg struct {
+	Reg     string `yaml:"reg"`
+	Offset  int    `yaml:"offset"`
+	Address uint32 `yaml:"address"`
+}
+
+type SoraStackFrame struct {
+	Size      int            `yaml:"size"`
+	SetupAddr uint32         `yaml:"setup_address"`
+	SavedRegs []SoraSavedReg `yaml:"saved_regs"`
+	Locals    []int          `yaml:"locals"`
+	Args      []int          `yaml:"args"` // incoming args, above the frame
+	SpillRA   bool           `yaml:"spill_ra"`
+	RAOffset  int            `yaml:"ra_offset"`
+	UseFP     bool           `yaml:"use_fp"`
+
+	Returns    []uint32 `yaml:"returns"`
+	Indirect   []uint32 `yaml:"indirect"`
+	Unbalanced []uint32 `yaml:"unbalanced"`
+	Balanced   bool     `yaml:"balanced"`
+	Incomplete bool     `yaml:"incomplete"` // the scan ran into bad code or past the end
+	Issues     []string `yaml:"issues,omitempty"`
+}
+
+func (frame *SoraStackFrame) SavedSlot(offset int) *SoraSavedReg {
+	for i := range frame.SavedRegs {
+		if frame.SavedRegs[i].Offset == offset {
+			return &frame.SavedRegs[i]
+		}
+	}
+	return nil
+}
+
+// NoReturn tells no path out of the function was found, all of its code
+// being scanned.
+func (frame *SoraStackFrame) NoReturn() bool {
+	return !frame.Incomplete && len(frame.Returns) == 0 && len(frame.Indirect) == 0
+}
+
+func (frame *SoraStackFrame) warn(format string, a ...any) {
+	frame.Issues = append(frame.Issues, fmt.Sprintf(format, a...))
+}
+
+func isStoreMnemonic(mnemonic string) bool {
+	switch mnemonic {
+	case "sb", "sh", "sw", "swl", "swr", "swc1", "sv.s", "sv.q", "svl.q", "svr.q":
+		return true
+	}
+	return false
+}
+
+func isReturnInstr(instr *SoraInstruction) bool {
+	return instr.Mnemonic == "jr" && len(instr.Args) > 0 && instr.Args[0].Reg == "ra"
+}
+
+// spAdjust returns how instr changes sp, ok is false when the write can not be tracked.
+func spAdjust(instr *SoraInstruction, delta int, fp_delta *int) (int, bool) {
+	if len(instr.Args) < 2 || instr.Args[0].Type != ArgReg {
+		return delta, true
+	}
+	dst := instr.Args[0].Reg
+	src := instr.Args[1].Reg
+
+	if dst == "fp" && src == "sp" {
+		switch instr.Mnemonic {
+		case "move":
+			*fp_delta = delta
+		case "addiu":
+			if len(instr.Args) > 2 {
+				*fp_delta = delta + instr.Args[2].ValOfs
+			}
+		case "addu", "or":
+			if len(instr.Args) > 2 && instr.Args[2].Reg == "zero" {
+				*fp_delta = delta
+			}
+		}
+		return delta, true
+	}
+
+	if dst != "sp" || isStoreMnemonic(instr.Mnemonic) || instr.Info.IsBranch {
+		return delta, true
+	}
+
+	switch instr.Mnemonic {
+	case "addiu":
+		if src == "sp" && len(instr.Args) > 2 && instr.Args[2].Type == ArgImm {
+			return delta + instr.Args[2].ValOfs, true
+		}
+		if src == "fp" && len(instr.Args) > 2 && instr.Args[2].Type == ArgImm {
+			return *fp_delta + instr.Args[2].ValOfs, true
+		}
+	case "move":
+		if src == "fp" {
+			return *fp_delta, true
+		}
+	case "addu", "or":
+		if src == "fp" && len(instr.Args) > 2 && instr.Args[2].Reg == "zero" {
+			return *fp_delta, true
+		}
+	}
+	return delta, false
+}
+
+// AnalyzeStackFrame describes the frame built by the prologue and checks
+// that every return path gives the stack back balanced.
+func (anal *FunctionAnalyzer) AnalyzeStackFrame() *SoraStackFrame {
+	frame := &SoraStackFrame{}
+	fun := anal.fun
+	// a call back into fun while it is scanned is not known to not return
+	fun.Frame = &SoraStackFrame{Incomplete: true}
+
+	anal.scanPrologue(frame)
+	anal.scanLocals(frame)
+	anal.checkBalance(frame)
+
+	fun.Frame = frame
+	return frame
+}
+
+func (anal *FunctionAnalyzer) scanPrologue(frame *SoraStackFrame) {
+	fun := anal.fun
+	stored := make(map[string]bool)
+	written := make(map[string]bool)
+
+	for addr := fun.Address; addr <= fun.LastAddress(); addr += 4 {
+		instr := anal.doc.Disasm(addr)
+		if instr == nil {
+			break
+		}
+
+		if frame.Size == 0 && instr.Mnemonic == "addiu" && len(instr.Args) > 2 &&
+			instr.Args[0].Reg == "sp" && instr.Args[1].Reg == "sp" && instr.Args[2].ValOfs < 0 {
+			frame.Size = -instr.Args[2].ValOfs
+			frame.SetupAddr = addr
+		} else if isStoreMnemonic(instr.Mnemonic) && len(instr.Args) > 1 &&
+			instr.Args[1].Type == ArgMem && instr.Args[1].Reg == "sp" {
+			reg := instr.Args[0].Reg
+			if calleeSavedRegs[reg] && !stored[reg] && !written[reg] {
+				stored[reg] = true
+				frame.SavedRegs = append(frame.SavedRegs, SoraSavedReg{
+					Reg:     reg,
+					Offset:  instr.Args[1].ValOfs,
+					Address: addr,
+				})
+				if reg == "ra" {
+					frame.SpillRA = true
+					frame.RAOffset = instr.Args[1].ValOfs
+				}
+			}
+		} else if len(instr.Args) > 0 && instr.Args[0].Type == ArgReg && !isStoreMnemonic(instr.Mnemonic) {
+			written[instr.Args[0].Reg] = true
+			if instr.Args[0].Reg == "fp" && len(instr.Args) > 1 && instr.Args[1].Reg == "sp" {
+				frame.UseFP = true
+			}
+		}
+
+		// the prologue ends at the first control transfer and its delay slot
+		if instr.Info.IsBranch {
+			if instr.Info.HasDelaySlot && addr+4 <= fun.LastAddress() {
+				continue
+			}
+			break
+		}
+		if addr > fun.Address {
+			if prev := anal.doc.Disasm(addr - 4); prev != nil && prev.Info.IsBranch {
+				break
+			}
+		}
+	}
+}
+
+func (anal *FunctionAnalyzer) scanLocals(frame *SoraStackFrame) {
+	fun := anal.fun
+	locals := make(map[int]bool)
+	args := make(map[int]bool)
+
+	for addr := fun.Address; addr <= fun.LastAddress(); addr += 4 {
+		instr := anal.doc.Disasm(addr)
+		if instr == nil {
+			continue
+		}
+		for _, arg := range instr.Args {
+			if arg.Type != ArgMem || arg.Reg != "sp" {
+				continue
+			}
+			if frame.SavedSlot(arg.ValOfs) != nil {
+				continue
+			}
+			if frame.Size > 0 && arg.ValOfs >= frame.Size {
+				args[arg.ValOfs-frame.Size] = true
+			} else {
+				locals[arg.ValOfs] = true
+			}
+		}
+	}
+
+	for ofs := range locals {
+		frame.Locals = append(frame.Locals, ofs)
+	}
+	for ofs := range args {
+		frame.Args = append(frame.Args, ofs)
+	}
+	sort.Ints(frame.Locals)
+	sort.Ints(frame.Args)
+}
+
+// callsNoReturn tells whether instr calls a function known to never return.
+func (anal *FunctionAnalyzer) callsNoReturn(instr *SoraInstruction) bool {
+	funmgr := anal.doc.FunManager
+	if funmgr == nil || instr.Info.IsBranchToRegister {
+		return false
+	}
+	callee := funmgr.Get(instr.Info.BranchTarget)
+	return callee != nil && funmgr.IsNoReturn(callee)
+}
+
+type spVisit struct {
+	addr  uint32
+	delta int
+	fp    int
+}
+
+func (anal *FunctionAnalyzer) checkBalance(frame *SoraStackFrame) {
+	fun := anal.fun
+	visited := make(map[uint32]int)
+	consistent := true
+	var queue Queue[spVisit]
+
+	inside := func(addr uint32) bool {
+		return addr >= fun.Address && addr <= fun.LastAddress()
+	}
+	push := func(addr uint32, delta, fp int) {
+		if prev, ok := visited[addr]; ok {
+			if prev != delta {
+				consistent = false
+				frame.warn("inconsistent sp at 0x%08x (%d vs %d)", addr, prev, delta)
+			}
+			return
+		}
+		visited[addr] = delta
+		queue.Push(spVisit{addr, delta, fp})
+	}
+	leave := func(addr uint32, delta int) {
+		frame.Returns = append(frame.Returns, addr)
+		if delta != 0 {
+			frame.Unbalanced = append(frame.Unbalanced, addr)
+			frame.warn("unbalanced return at 0x%08x (sp%+d)", addr, delta)
+		}
+	}
+
+	if fun.Size == 0 || fun.Size%4 != 0 {
+		frame.Incomplete = true
+		frame.warn("bad function size %d", fun.Size)
+	}
+	push(fun.Address, 0, 0)
+
+	for queue.Len() > 0 {
+		cur := queue.Pop()
+		instr := anal.doc.Disasm(cur.addr)
+		if instr == nil {
+			frame.Incomplete = true
+			frame.warn("no instruction at 0x%08x", cur.addr)
+			continue
+		}
+		if DecodeInstruction(cur.addr, instr.Info.Encoded) == nil {
+			frame.Incomplete = true
+			frame.warn("undecodable instruction at 0x%08x", cur.addr)
+			continue
+		}
+
+		delta, ok := spAdjust(instr, cur.delta, &cur.fp)
+		if !ok {
+			frame.warn("untracked sp write at 0x%08x", cur.addr)
+		}
+
+		if !instr.Info.IsBranch {
+			if inside(cur.addr + 4) {
+				push(cur.addr+4, delta, cur.fp)
+			} else {
+				frame.Incomplete = true
+				frame.warn("runs past the end at 0x%08x", cur.addr)
+			}
+			continue
+		}
+
+		next := cur.addr + 4
+		not_taken := delta
+		if instr.Info.HasDelaySlot {
+			if slot := anal.doc.Disasm(cur.addr + 4); slot != nil {
+				if delta, ok = spAdjust(slot, delta, &cur.fp); !ok {
+					frame.warn("untracked sp write at 0x%08x", cur.addr+4)
+				}
+			}
+			if !instr.Info.IsLikelyBranch {
+				not_taken = delta
+			}
+			next += 4
+		}
+
+		switch {
+		case isReturnInstr(instr):
+			leave(cur.addr, delta)
+		case instr.Info.IsLinkedBranch:
+			if inside(next) {
+				push(next, delta, cur.fp)
+			} else if !anal.callsNoReturn(instr) {
+				frame.Incomplete = true
+				frame.warn("runs past the end at 0x%08x", cur.addr)
+			}
+		case instr.Info.IsBranchToRegister:
+			// indirect jump, targets are unknown statically
+			frame.Indirect = append(frame.Indirect, cur.addr)
+		case inside(instr.Info.BranchTarget):
+			push(instr.Info.BranchTarget, delta, cur.fp)
+		default:
+			// tail jump out of the function gives the frame back too
+			leave(cur.addr, delta)
+		}
+
+		if instr.Info.IsConditional && !instr.Info.IsLinkedBranch && inside(next) {
+			push(next, not_taken, cur.fp)
+		}
+	}
+
+	sort.Slice(frame.Returns, func(i, j int) bool { return frame.Returns[i] < frame.Returns[j] })
+	frame.Balanced = consistent && len(frame.Unbalanced) == 0
+}
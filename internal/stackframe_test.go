@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzeStackFrame(t *testing.T) {
+	doc := newTestDocument()
+	putInstr(doc, 0x8804000, "addiu\tsp,sp,-0x20", models.MipsOpcode{})
+	putInstr(doc, 0x8804004, "sw\ts0,0x10(sp)", models.MipsOpcode{})
+	putInstr(doc, 0x8804008, "sw\tra,0x14(sp)", models.MipsOpcode{})
+	putInstr(doc, 0x880400C, "sw\ta0,0x18(sp)", models.MipsOpcode{})
+	info := opJAL
+	info.BranchTarget = 0x8805000
+	putInstr(doc, 0x8804010, "jal\t->$08805000", info)
+	putInstr(doc, 0x8804014, "lw\ta1,0x28(sp)", models.MipsOpcode{})
+	putInstr(doc, 0x8804018, "lw\tra,0x14(sp)", models.MipsOpcode{})
+	putInstr(doc, 0x880401C, "lw\ts0,0x10(sp)", models.MipsOpcode{})
+	putInstr(doc, 0x8804020, "jr\tra", opJR)
+	putInstr(doc, 0x8804024, "addiu\tsp,sp,0x20", models.MipsOpcode{})
+
+	fun := &SoraFunction{Address: 0x8804000, Size: 0x28}
+	frame := NewFunctionAnalyzer(doc, fun).AnalyzeStackFrame()
+
+	assert.Equal(t, 0x20, frame.Size)
+	assert.Equal(t, uint32(0x8804000), frame.SetupAddr)
+	assert.True(t, frame.SpillRA)
+	assert.Equal(t, 0x14, frame.RAOffset)
+	assert.Len(t, frame.SavedRegs, 2)
+	assert.Equal(t, "s0", frame.SavedRegs[0].Reg)
+	assert.Equal(t, []int{0x18}, frame.Locals)
+	assert.Equal(t, []int{0x8}, frame.Args)
+	assert.Equal(t, []uint32{0x8804020}, frame.Returns)
+	assert.True(t, frame.Balanced)
+	assert.Same(t, frame, fun.Frame)
+}
+
+func TestAnalyzeStackFrameUnbalanced(t *testing.T) {
+	doc := newTestDocument()
+	putInstr(doc, 0x8804000, "addiu\tsp,sp,-0x10", models.MipsOpcode{})
+	info := opBranch
+	info.BranchTarget = 0x8804010
+	putInstr(doc, 0x8804004, "beq\ta0,zero,->$08804010", info)
+	putInstr(doc, 0x8804008, "nop", models.MipsOpcode{})
+	putInstr(doc, 0x880400C, "addiu\tsp,sp,0x10", models.MipsOpcode{})
+	putInstr(doc, 0x8804010, "jr\tra", opJR)
+	putInstr(doc, 0x8804014, "nop", models.MipsOpcode{})
+
+	fun := &SoraFunction{Address: 0x8804000, Size: 0x18}
+	frame := NewFunctionAnalyzer(doc, fun).AnalyzeStackFrame()
+
+	assert.Equal(t, 0x10, frame.Size)
+	assert.False(t, frame.SpillRA)
+	assert.False(t, frame.Balanced)
+	assert.NotEmpty(t, frame.Issues)
+}
@@ -0,0 +1,530 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+type PseudoKind string
+
+const (
+	PseudoStmt     PseudoKind = "stmt"
+	PseudoLabel    PseudoKind = "label"
+	PseudoIf       PseudoKind = "if"
+	PseudoWhile    PseudoKind = "while"
+	PseudoDoWhile  PseudoKind = "do_while"
+	PseudoLoop     PseudoKind = "loop"
+	PseudoSwitch   PseudoKind = "switch"
+	PseudoGoto     PseudoKind = "goto"
+	PseudoBreak    PseudoKind = "break"
+	PseudoContinue PseudoKind = "continue"
+	PseudoReturn   PseudoKind = "return"
+)
+
+// PseudoNode is a statement of the structured pseudo-code. Text is the
+// statement, the condition of if and loops, the label of goto and label,
+// the operand of switch or the returned expression.
+type PseudoNode struct {
+	Kind    PseudoKind
+	Address uint32
+	Text    string
+	Then    []*PseudoNode // if body, loop body
+	Else    []*PseudoNode
+	Cases   []*PseudoCase
+}
+
+type PseudoCase struct {
+	Target uint32
+	Body   []*PseudoNode
+}
+
+func pseudoLabel(addr uint32) string {
+	return fmt.Sprintf("loc_%08x", addr)
+}
+
+// regionContext is a loop or switch being structured, reaching its header
+// continues and reaching its follow breaks.
+type regionContext struct {
+	kind   PseudoKind
+	loop   *NaturalLoop
+	header int
+	follow int
+	latch  int
+	cond   PseudoCond
+}
+
+type structurer struct {
+	doc     *SoraDocument
+	cfg     *FunctionCFG
+	loops   map[int]*NaturalLoop
+	emitted []bool
+	gotos   map[string]bool
+	stack   []*regionContext
+}
+
+// Structure recovers if/else, loops and switches from the function's CFG,
+// what can not be nested is left as goto.
+func (anal *FunctionAnalyzer) Structure() []*PseudoNode {
+	cfg := anal.BuildCFG()
+	st := &structurer{
+		doc:     anal.doc,
+		cfg:     cfg,
+		loops:   make(map[int]*NaturalLoop),
+		emitted: make([]bool, len(cfg.Blocks)),
+		gotos:   make(map[string]bool),
+	}
+	for _, loop := range cfg.FindLoops().Loops {
+		st.loops[cfg.index[loop.Header]] = loop
+	}
+
+	var nodes []*PseudoNode
+	if len(cfg.Blocks) > 0 {
+		nodes = st.seq(0, -1)
+	}
+	return pruneLabels(nodes, st.gotos)
+}
+
+func (st *structurer) gotoNode(b int) *PseudoNode {
+	label := pseudoLabel(st.cfg.Blocks[b].Address)
+	st.gotos[label] = true
+	return &PseudoNode{Kind: PseudoGoto, Text: label}
+}
+
+// jump is the statement that reaches b from inside the current regions,
+// nil when b is to be emitted in place.
+func (st *structurer) jump(b int) *PseudoNode {
+	crossed_loop := false
+	for k := len(st.stack) - 1; k >= 0; k-- {
+		ctx := st.stack[k]
+		if ctx.kind != PseudoSwitch && b == ctx.header {
+			if crossed_loop {
+				return st.gotoNode(b)
+			}
+			return &PseudoNode{Kind: PseudoContinue}
+		}
+		if b == ctx.follow {
+			if k == len(st.stack)-1 {
+				return &PseudoNode{Kind: PseudoBreak}
+			}
+			return st.gotoNode(b)
+		}
+		if ctx.kind != PseudoSwitch {
+			crossed_loop = true
+		}
+	}
+	if st.emitted[b] {
+		return st.gotoNode(b)
+	}
+	return nil
+}
+
+func (st *structurer) loopContext() *regionContext {
+	for k := len(st.stack) - 1; k >= 0; k-- {
+		if st.stack[k].kind != PseudoSwitch {
+			return st.stack[k]
+		}
+	}
+	return nil
+}
+
+// seq emits the blocks from b on until stop, the join of the region.
+func (st *structurer) seq(b, stop int) []*PseudoNode {
+	var out []*PseudoNode
+	for b != -1 && b != stop {
+		if node := st.jump(b); node != nil {
+			return append(out, node)
+		}
+		if loop, ok := st.loops[b]; ok {
+			var follow int
+			out, follow = st.loop(loop, out)
+			b = follow
+			continue
+		}
+		b = st.block(b, &out)
+	}
+	return out
+}
+
+func (st *structurer) stmt(addr uint32, out *[]*PseudoNode) {
+	instr := st.doc.Disasm(addr)
+	if instr == nil {
+		return
+	}
+	if text := st.doc.PseudoStatement(instr); text != "" {
+		*out = append(*out, &PseudoNode{Kind: PseudoStmt, Address: addr, Text: text})
+	}
+}
+
+// body emits the statements of b before its branch.
+func (st *structurer) body(b int, out *[]*PseudoNode) {
+	block := st.cfg.Blocks[b]
+	last := block.LastAddress
+	if block.BranchAddress != 0 {
+		last = block.BranchAddress - 4
+	}
+	for addr := block.Address; addr <= last && addr >= block.Address; addr += 4 {
+		st.stmt(addr, out)
+	}
+}
+
+func (st *structurer) delaySlot(b int) uint32 {
+	block := st.cfg.Blocks[b]
+	if block.BranchAddress+4 <= block.LastAddress {
+		return block.BranchAddress + 4
+	}
+	return 0
+}
+
+// condition emits what runs before the branch of b is decided and returns
+// the condition. The delay slot of a branch runs before the jump but after
+// the condition is read, so a delay slot overwriting the condition's
+// operand makes the condition a temporary.
+func (st *structurer) condition(b int, instr *SoraInstruction, out *[]*PseudoNode) PseudoCond {
+	cond, ok := PseudoCondition(instr)
+	if !ok {
+		cond = PseudoCond{Left: "/* " + strings.ReplaceAll(instr.Info.Dizz, "\t", " ") + " */"}
+	}
+	delay := st.delaySlot(b)
+	if delay == 0 || instr.Info.IsLikelyBranch {
+		return cond
+	}
+	if delay_instr := st.doc.Disasm(delay); delay_instr != nil {
+		for _, reg := range pseudoWrites(delay_instr) {
+			if cond.Reads(reg) {
+				*out = append(*out, &PseudoNode{Kind: PseudoStmt, Address: instr.Address, Text: "cond = " + cond.String()})
+				cond = PseudoCond{Left: "cond"}
+				break
+			}
+		}
+	}
+	st.stmt(delay, out)
+	return cond
+}
+
+// join is where the arms of b meet, -1 when they don't inside the
+// current loop.
+func (st *structurer) join(b int) int {
+	j := st.cfg.PostDominators()[b]
+	if ctx := st.loopContext(); ctx != nil && j != -1 {
+		if j == ctx.header || !ctx.loop.Contains(st.cfg.Blocks[j].Address) {
+			return -1
+		}
+	}
+	return j
+}
+
+func (st *structurer) arm(t, join int) []*PseudoNode {
+	if t == join {
+		return nil
+	}
+	return st.seq(t, join)
+}
+
+// block emits b and the regions it heads, returns the block to continue
+// with or -1.
+func (st *structurer) block(b int, out *[]*PseudoNode) int {
+	block := st.cfg.Blocks[b]
+	st.emitted[b] = true
+	*out = append(*out, &PseudoNode{Kind: PseudoLabel, Address: block.Address, Text: pseudoLabel(block.Address)})
+	st.body(b, out)
+
+	next := -1
+	if len(block.Succs) > 0 {
+		next = block.Succs[0]
+	}
+	if block.BranchAddress == 0 {
+		return next
+	}
+
+	instr := st.doc.Disasm(block.BranchAddress)
+	info := instr.Info
+	delay := st.delaySlot(b)
+	fall := -1
+	if i, ok := st.cfg.index[block.LastAddress+4]; ok {
+		fall = i
+	}
+
+	switch {
+	case info.IsLinkedBranch:
+		st.stmt(delay, out)
+		st.stmt(block.BranchAddress, out)
+		return fall
+
+	case info.IsBranchToRegister:
+		st.stmt(delay, out)
+		if isReturnInstr(instr) {
+			*out = append(*out, &PseudoNode{Kind: PseudoReturn, Address: block.BranchAddress, Text: "v0"})
+			return -1
+		}
+		switch len(block.Succs) {
+		case 0:
+			*out = append(*out, &PseudoNode{Kind: PseudoGoto, Address: block.BranchAddress, Text: "*" + instr.Args[0].Str()})
+			return -1
+		case 1:
+			return next
+		}
+		return st.switchRegion(b, instr, out)
+
+	case !info.IsConditional:
+		st.stmt(delay, out)
+		if t, ok := st.cfg.index[info.BranchTarget]; ok && st.cfg.inside(info.BranchTarget) {
+			return t
+		}
+		// a jump out of the function is a tail call
+		target := NewSoraArgument(fmt.Sprintf("0x%x", info.BranchTarget), st.doc.SymMap.GetLabelName)
+		*out = append(*out, &PseudoNode{Kind: PseudoReturn, Address: block.BranchAddress,
+			Text: st.doc.pseudoTarget(target) + "(...)"})
+		return -1
+	}
+
+	cond := st.condition(b, instr, out)
+	taken := -1
+	if t, ok := st.cfg.index[info.BranchTarget]; ok && st.cfg.inside(info.BranchTarget) {
+		taken = t
+	}
+
+	if ctx := st.loopContext(); ctx != nil && ctx.kind == PseudoDoWhile && ctx.latch == b {
+		ctx.cond = cond
+		if taken != ctx.header {
+			ctx.cond = cond.Not()
+		}
+		return -1
+	}
+
+	join := st.join(b)
+	node := &PseudoNode{Kind: PseudoIf, Address: block.BranchAddress, Text: cond.String()}
+	if info.IsLikelyBranch && delay != 0 {
+		st.stmt(delay, &node.Then)
+	}
+	if taken == -1 {
+		node.Then = append(node.Then, &PseudoNode{Kind: PseudoGoto, Text: fmt.Sprintf("0x%08x", info.BranchTarget)})
+	} else {
+		node.Then = append(node.Then, st.arm(taken, join)...)
+	}
+	node.Else = st.arm(fall, join)
+
+	if len(node.Then) == 0 {
+		node.Then, node.Else = node.Else, nil
+		node.Text = cond.Not().String()
+	}
+	if len(node.Then) > 0 {
+		*out = append(*out, node)
+	}
+	return join
+}
+
+func (st *structurer) switchRegion(b int, instr *SoraInstruction, out *[]*PseudoNode) int {
+	block := st.cfg.Blocks[b]
+	join := st.join(b)
+	ctx := &regionContext{kind: PseudoSwitch, header: -1, follow: join, latch: -1}
+	st.stack = append(st.stack, ctx)
+	defer func() { st.stack = st.stack[:len(st.stack)-1] }()
+
+	node := &PseudoNode{Kind: PseudoSwitch, Address: block.BranchAddress, Text: instr.Args[0].Str()}
+	succs := append([]int{}, block.Succs...)
+	sort.Ints(succs)
+	for _, s := range succs {
+		body := st.arm(s, join)
+		if !pseudoTerminates(body) {
+			body = append(body, &PseudoNode{Kind: PseudoBreak})
+		}
+		node.Cases = append(node.Cases, &PseudoCase{Target: st.cfg.Blocks[s].Address, Body: body})
+	}
+	*out = append(*out, node)
+	return join
+}
+
+// loopFollow is the block most exits of loop go to.
+func (st *structurer) loopFollow(loop *NaturalLoop) int {
+	counts := make(map[int]int)
+	follow := -1
+	for _, exit := range loop.Exits {
+		i := st.cfg.index[exit.To]
+		counts[i]++
+		if follow == -1 || counts[i] > counts[follow] || (counts[i] == counts[follow] && i < follow) {
+			follow = i
+		}
+	}
+	return follow
+}
+
+// loopKind picks do-while when the only latch tests the exit, while when
+// the header does nothing but test it, else an endless loop with breaks.
+func (st *structurer) loopKind(loop *NaturalLoop, ctx *regionContext) PseudoKind {
+	two_way := func(b int) *SoraInstruction {
+		block := st.cfg.Blocks[b]
+		if block.BranchAddress == 0 || len(block.Succs) != 2 {
+			return nil
+		}
+		instr := st.doc.Disasm(block.BranchAddress)
+		if !instr.Info.IsConditional || instr.Info.IsLinkedBranch || instr.Info.IsBranchToRegister {
+			return nil
+		}
+		if instr.Info.IsLikelyBranch && st.delaySlot(b) != 0 {
+			if stmt := st.doc.Disasm(st.delaySlot(b)); stmt != nil && st.doc.PseudoStatement(stmt) != "" {
+				return nil
+			}
+		}
+		for _, s := range block.Succs {
+			if s != ctx.follow && s != ctx.header && !loop.Contains(st.cfg.Blocks[s].Address) {
+				return nil
+			}
+		}
+		return instr
+	}
+
+	if len(loop.Latches) == 1 {
+		latch := st.cfg.index[loop.Latches[0]]
+		if instr := two_way(latch); instr != nil {
+			succs := st.cfg.Blocks[latch].Succs
+			if (succs[0] == ctx.header && succs[1] == ctx.follow) || (succs[1] == ctx.header && succs[0] == ctx.follow) {
+				ctx.latch = latch
+				return PseudoDoWhile
+			}
+		}
+	}
+
+	if instr := two_way(ctx.header); instr != nil {
+		var stmts []*PseudoNode
+		st.body(ctx.header, &stmts)
+		if delay := st.delaySlot(ctx.header); delay != 0 {
+			st.stmt(delay, &stmts)
+		}
+		succs := st.cfg.Blocks[ctx.header].Succs
+		if len(stmts) == 0 && (succs[0] == ctx.follow || succs[1] == ctx.follow) {
+			return PseudoWhile
+		}
+	}
+	return PseudoLoop
+}
+
+func (st *structurer) loop(loop *NaturalLoop, out []*PseudoNode) ([]*PseudoNode, int) {
+	h := st.cfg.index[loop.Header]
+	ctx := &regionContext{kind: PseudoLoop, loop: loop, header: h, follow: st.loopFollow(loop), latch: -1}
+	ctx.kind = st.loopKind(loop, ctx)
+	st.stack = append(st.stack, ctx)
+
+	node := &PseudoNode{Kind: ctx.kind, Address: loop.Header}
+	if ctx.kind == PseudoWhile {
+		block := st.cfg.Blocks[h]
+		st.emitted[h] = true
+		out = append(out, &PseudoNode{Kind: PseudoLabel, Address: block.Address, Text: pseudoLabel(block.Address)})
+
+		instr := st.doc.Disasm(block.BranchAddress)
+		cond, _ := PseudoCondition(instr)
+		inside := st.cfg.index[instr.Info.BranchTarget]
+		if inside == ctx.follow {
+			cond = cond.Not()
+			inside = block.Succs[0]
+			if inside == ctx.follow {
+				inside = block.Succs[1]
+			}
+		}
+		node.Text = cond.String()
+		node.Then = st.seq(inside, -1)
+	} else {
+		next := st.block(h, &node.Then)
+		node.Then = append(node.Then, st.seq(next, -1)...)
+		node.Text = ctx.cond.String()
+	}
+
+	if n := len(node.Then); n > 0 && node.Then[n-1].Kind == PseudoContinue {
+		node.Then = node.Then[:n-1]
+	}
+	st.stack = st.stack[:len(st.stack)-1]
+	return append(out, node), ctx.follow
+}
+
+func pseudoTerminates(nodes []*PseudoNode) bool {
+	if len(nodes) == 0 {
+		return false
+	}
+	switch nodes[len(nodes)-1].Kind {
+	case PseudoReturn, PseudoGoto, PseudoBreak, PseudoContinue:
+		return true
+	}
+	return false
+}
+
+// pruneLabels drops the labels no goto goes to.
+func pruneLabels(nodes []*PseudoNode, gotos map[string]bool) []*PseudoNode {
+	var result []*PseudoNode
+	for _, node := range nodes {
+		if node.Kind == PseudoLabel && !gotos[node.Text] {
+			continue
+		}
+		node.Then = pruneLabels(node.Then, gotos)
+		node.Else = pruneLabels(node.Else, gotos)
+		for _, c := range node.Cases {
+			c.Body = pruneLabels(c.Body, gotos)
+		}
+		result = append(result, node)
+	}
+	return result
+}
+
+func writePseudo(w io.Writer, nodes []*PseudoNode, depth int) {
+	indent := strings.Repeat("\t", depth)
+	for _, node := range nodes {
+		switch node.Kind {
+		case PseudoStmt:
+			fmt.Fprintf(w, "%s%s;\n", indent, node.Text)
+		case PseudoLabel:
+			fmt.Fprintf(w, "%s%s:\n", strings.Repeat("\t", depth-1), node.Text)
+		case PseudoIf:
+			fmt.Fprintf(w, "%sif (%s) {\n", indent, node.Text)
+			writePseudo(w, node.Then, depth+1)
+			for len(node.Else) == 1 && node.Else[0].Kind == PseudoIf {
+				node = node.Else[0]
+				fmt.Fprintf(w, "%s} else if (%s) {\n", indent, node.Text)
+				writePseudo(w, node.Then, depth+1)
+			}
+			if len(node.Else) > 0 {
+				fmt.Fprintf(w, "%s} else {\n", indent)
+				writePseudo(w, node.Else, depth+1)
+			}
+			fmt.Fprintf(w, "%s}\n", indent)
+		case PseudoWhile:
+			fmt.Fprintf(w, "%swhile (%s) {\n", indent, node.Text)
+			writePseudo(w, node.Then, depth+1)
+			fmt.Fprintf(w, "%s}\n", indent)
+		case PseudoDoWhile:
+			fmt.Fprintf(w, "%sdo {\n", indent)
+			writePseudo(w, node.Then, depth+1)
+			fmt.Fprintf(w, "%s} while (%s);\n", indent, node.Text)
+		case PseudoLoop:
+			fmt.Fprintf(w, "%sfor (;;) {\n", indent)
+			writePseudo(w, node.Then, depth+1)
+			fmt.Fprintf(w, "%s}\n", indent)
+		case PseudoSwitch:
+			fmt.Fprintf(w, "%sswitch (%s) {\n", indent, node.Text)
+			for _, c := range node.Cases {
+				fmt.Fprintf(w, "%scase 0x%08x:\n", indent, c.Target)
+				writePseudo(w, c.Body, depth+1)
+			}
+			fmt.Fprintf(w, "%s}\n", indent)
+		case PseudoGoto:
+			fmt.Fprintf(w, "%sgoto %s;\n", indent, node.Text)
+		case PseudoBreak:
+			fmt.Fprintf(w, "%sbreak;\n", indent)
+		case PseudoContinue:
+			fmt.Fprintf(w, "%scontinue;\n", indent)
+		case PseudoReturn:
+			fmt.Fprintf(w, "%sreturn %s;\n", indent, node.Text)
+		}
+	}
+}
+
+// WritePseudo writes the function as nested pseudo-C.
+func (anal *FunctionAnalyzer) WritePseudo(w io.Writer) {
+	fmt.Fprintf(w, "void %s() {\n", anal.fun.Name)
+	writePseudo(w, anal.Structure(), 1)
+	fmt.Fprintf(w, "}\n")
+}
+
+func (anal *FunctionAnalyzer) DumpPseudo() {
+	anal.WritePseudo(os.Stdout)
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var opJump = models.MipsOpcode{IsBranch: true, HasDelaySlot: true}
+
+func putJump(doc *SoraDocument, addr, target uint32, delay string) {
+	info := opJump
+	info.BranchTarget = target
+	putInstr(doc, addr, "j\t->$", info)
+	putInstr(doc, addr+4, delay, models.MipsOpcode{})
+}
+
+func pseudoOf(doc *SoraDocument, fun *SoraFunction) string {
+	var sb strings.Builder
+	NewFunctionAnalyzer(doc, fun).WritePseudo(&sb)
+	return sb.String()
+}
+
+func TestStructureIfElse(t *testing.T) {
+	doc := newTestDocument()
+	info := opBranch
+	info.BranchTarget = 0x8808014
+	putInstr(doc, 0x8808000, "beq\ta0,zero,->$", info)
+	putInstr(doc, 0x8808004, "nop", models.MipsOpcode{})
+	putInstr(doc, 0x8808008, "li\tv0,0x2", models.MipsOpcode{})
+	putJump(doc, 0x880800C, 0x8808018, "nop")
+	putInstr(doc, 0x8808014, "li\tv0,0x3", models.MipsOpcode{})
+	putInstr(doc, 0x8808018, "jr\tra", opJR)
+	putInstr(doc, 0x880801C, "nop", models.MipsOpcode{})
+	fun := putFunction(doc, "select", 0x8808000, 0x20)
+
+	assert.Equal(t, `void select() {
+	if (a0 == zero) {
+		v0 = 0x3;
+	} else {
+		v0 = 0x2;
+	}
+	return v0;
+}
+`, pseudoOf(doc, fun))
+}
+
+func TestStructureLikelyBranch(t *testing.T) {
+	doc := newTestDocument()
+	info := opBranch
+	info.IsLikelyBranch = true
+	info.BranchTarget = 0x8808010
+	putInstr(doc, 0x8808000, "beql\ta0,zero,->$", info)
+	putInstr(doc, 0x8808004, "li\tv0,0x1", models.MipsOpcode{})
+	putInstr(doc, 0x8808008, "li\tv0,0x2", models.MipsOpcode{})
+	putInstr(doc, 0x880800C, "nop", models.MipsOpcode{})
+	putInstr(doc, 0x8808010, "jr\tra", opJR)
+	putInstr(doc, 0x8808014, "nop", models.MipsOpcode{})
+	fun := putFunction(doc, "likely", 0x8808000, 0x18)
+
+	assert.Equal(t, `void likely() {
+	if (a0 == zero) {
+		v0 = 0x1;
+	} else {
+		v0 = 0x2;
+	}
+	return v0;
+}
+`, pseudoOf(doc, fun))
+}
+
+func TestStructureDelaySlotCondition(t *testing.T) {
+	doc := newTestDocument()
+	info := opBranch
+	info.BranchTarget = 0x8808010
+	putInstr(doc, 0x8808000, "bne\tv0,zero,->$", info)
+	putInstr(doc, 0x8808004, "li\tv0,0x5", models.MipsOpcode{})
+	putInstr(doc, 0x8808008, "sw\tzero,0x4(a0)", models.MipsOpcode{})
+	putInstr(doc, 0x880800C, "nop", models.MipsOpcode{})
+	putInstr(doc, 0x8808010, "jr\tra", opJR)
+	putInstr(doc, 0x8808014, "nop", models.MipsOpcode{})
+	fun := putFunction(doc, "delay", 0x8808000, 0x18)
+
+	assert.Equal(t, `void delay() {
+	cond = v0 != zero;
+	v0 = 0x5;
+	if (!cond) {
+		*(u32 *)(a0 + 0x4) = zero;
+	}
+	return v0;
+}
+`, pseudoOf(doc, fun))
+}
+
+func TestStructureLoops(t *testing.T) {
+	doc := newTestDocument()
+	putInstr(doc, 0x8808000, "addiu\tsp,sp,-0x10", models.MipsOpcode{})
+	putInstr(doc, 0x8808004, "li\ts0,0x0", models.MipsOpcode{})
+	putInstr(doc, 0x8808008, "addiu\ts1,s1,0x1", models.MipsOpcode{})
+	putBranch(doc, 0x880800C, 0x8808008)
+	putBranch(doc, 0x8808014, 0x8808004)
+	putInstr(doc, 0x880801C, "jr\tra", opJR)
+	putInstr(doc, 0x8808020, "nop", models.MipsOpcode{})
+	fun := putFunction(doc, "nested", 0x8808000, 0x24)
+
+	assert.Equal(t, `void nested() {
+	sp = sp - 0x10;
+	do {
+		s0 = 0x0;
+		do {
+			s1 = s1 + 0x1;
+		} while (v0 != zero);
+	} while (v0 != zero);
+	return v0;
+}
+`, pseudoOf(doc, fun))
+
+	doc = newTestDocument()
+	putInstr(doc, 0x8808000, "li\tv0,0x0", models.MipsOpcode{})
+	info := opBranch
+	info.BranchTarget = 0x8808018
+	putInstr(doc, 0x8808004, "beq\ta0,zero,->$", info)
+	putInstr(doc, 0x8808008, "nop", models.MipsOpcode{})
+	putInstr(doc, 0x880800C, "addiu\ta0,a0,-0x1", models.MipsOpcode{})
+	putJump(doc, 0x8808010, 0x8808004, "addiu\tv0,v0,0x1")
+	putInstr(doc, 0x8808018, "jr\tra", opJR)
+	putInstr(doc, 0x880801C, "nop", models.MipsOpcode{})
+	fun = putFunction(doc, "count", 0x8808000, 0x20)
+
+	assert.Equal(t, `void count() {
+	v0 = 0x0;
+	while (a0 != zero) {
+		a0 = a0 - 0x1;
+		v0 = v0 + 0x1;
+	}
+	return v0;
+}
+`, pseudoOf(doc, fun))
+}
+
+func TestStructureIrreducible(t *testing.T) {
+	doc := newTestDocument()
+	putBranch(doc, 0x8808000, 0x8808010)
+	putInstr(doc, 0x8808008, "addiu\ta0,a0,0x1", models.MipsOpcode{})
+	putInstr(doc, 0x880800C, "nop", models.MipsOpcode{})
+	putBranch(doc, 0x8808010, 0x8808008)
+	putInstr(doc, 0x8808018, "jr\tra", opJR)
+	putInstr(doc, 0x880801C, "nop", models.MipsOpcode{})
+	fun := putFunction(doc, "irreducible", 0x8808000, 0x20)
+
+	assert.Equal(t, `void irreducible() {
+	if (v0 == zero) {
+	loc_08808008:
+		a0 = a0 + 0x1;
+	}
+	if (v0 != zero) {
+		goto loc_08808008;
+	}
+	return v0;
+}
+`, pseudoOf(doc, fun))
+}
+
+func TestStructureSwitch(t *testing.T) {
+	doc := newTestDocument()
+	putInstr(doc, 0x8808000, "sll\tv0,a0,0x2", models.MipsOpcode{})
+	putInstr(doc, 0x8808004, "jr\tv0", opJR)
+	putInstr(doc, 0x8808008, "nop", models.MipsOpcode{})
+	putInstr(doc, 0x880800C, "li\tv0,0x1", models.MipsOpcode{})
+	putInstr(doc, 0x8808010, "jr\tra", opJR)
+	putInstr(doc, 0x8808014, "nop", models.MipsOpcode{})
+	putInstr(doc, 0x8808018, "li\tv0,0x2", models.MipsOpcode{})
+	putInstr(doc, 0x880801C, "jr\tra", opJR)
+	putInstr(doc, 0x8808020, "nop", models.MipsOpcode{})
+	fun := putFunction(doc, "dispatch", 0x8808000, 0x24)
+
+	doc.BBManager.CreateRange(0x8808000, 0x8808008, 0x8808004)
+	doc.BBManager.CreateReference(0x8808000, 0x8808018)
+	doc.BBManager.CreateReference(0x8808000, 0x880800C)
+
+	assert.Equal(t, `void dispatch() {
+	v0 = a0 << 2;
+	switch (v0) {
+	case 0x0880800c:
+		v0 = 0x1;
+		return v0;
+	case 0x08808018:
+		v0 = 0x2;
+		return v0;
+	}
+}
+`, pseudoOf(doc, fun))
+}
@@ -4,11 +4,20 @@ import "github.com/firodj/pspsora/bridge"
 
 type SymbolMap struct {
 	ptr bridge.CSymbolMap
+
+	// functions removed here, still known to the bridge
+	removed map[uint32]bool
+	// labels added here, the bridge only has the ones it loaded
+	labels     map[uint32]string
+	labelAddrs map[string]uint32
 }
 
 func CreateSymbolMap() *SymbolMap {
 	symmap := &SymbolMap{
-		ptr: bridge.NewSymbolMap(),
+		ptr:        bridge.NewSymbolMap(),
+		removed:    make(map[uint32]bool),
+		labels:     make(map[uint32]string),
+		labelAddrs: make(map[string]uint32),
 	}
 	return symmap
 }
@@ -18,18 +27,41 @@ func (symmap *SymbolMap) Delete() {
 }
 
 func (symmap *SymbolMap) GetFunctionSize(startAddress uint32) uint32 {
+	if symmap.removed[startAddress] {
+		return 0
+	}
 	return bridge.SymbolMap_GetFunctionSize(symmap.ptr, startAddress)
 }
 
+// GetFunctionStart skips the removed functions, addresses they covered
+// belong to the function before when it was grown over them.
 func (symmap *SymbolMap) GetFunctionStart(address uint32) uint32 {
-	return bridge.SymbolMap_GetFunctionStart(symmap.ptr, address)
+	start := bridge.SymbolMap_GetFunctionStart(symmap.ptr, address)
+	for start != 0 && symmap.removed[start] {
+		start = bridge.SymbolMap_GetFunctionStart(symmap.ptr, start-1)
+		if start != 0 && !symmap.removed[start] && start+symmap.GetFunctionSize(start) <= address {
+			return 0
+		}
+	}
+	return start
 }
 
 func (symmap *SymbolMap) GetLabelName(address uint32) *string {
+	if name, ok := symmap.labels[address]; ok {
+		return &name
+	}
 	return bridge.SymbolMap_GetLabelName(symmap.ptr, address)
 }
 
+// GetLabelValue finds the labels added here, the bridge has no lookup by
+// name.
+func (symmap *SymbolMap) GetLabelValue(name string) (uint32, bool) {
+	address, ok := symmap.labelAddrs[name]
+	return address, ok
+}
+
 func (symmap *SymbolMap) AddFunction(name string, address uint32, size uint32, moduleIndex int) {
+	delete(symmap.removed, address)
 	bridge.SymbolMap_AddFunction(symmap.ptr, name, address, size, moduleIndex)
 }
 
@@ -40,3 +72,30 @@ func (symmap *SymbolMap) AddModule(name string, address uint32, size uint32) {
 func (symmap *SymbolMap) SetFunctionSize(address uint32, size uint32) bool {
 	return bridge.SymbolMap_SetFunctionSize(symmap.ptr, address, size)
 }
+
+// RemoveFunction hides the function at address, the bridge has no removal.
+func (symmap *SymbolMap) RemoveFunction(address uint32) bool {
+	if symmap.removed[address] {
+		return false
+	}
+	symmap.removed[address] = true
+	return true
+}
+
+// RestoreFunction shows again the function hidden by RemoveFunction.
+func (symmap *SymbolMap) RestoreFunction(address uint32) bool {
+	if !symmap.removed[address] {
+		return false
+	}
+	delete(symmap.removed, address)
+	return true
+}
+
+// AddLabel names address on the Go side, over the label of the bridge.
+func (symmap *SymbolMap) AddLabel(name string, address uint32) {
+	if old, ok := symmap.labels[address]; ok {
+		delete(symmap.labelAddrs, old)
+	}
+	symmap.labels[address] = name
+	symmap.labelAddrs[name] = address
+}
@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+type ThreadEventKind string
+
+const (
+	ThreadSwitchIn  ThreadEventKind = "switch_in"
+	ThreadSwitchOut ThreadEventKind = "switch_out"
+	ThreadStart     ThreadEventKind = "start"
+	ThreadName      ThreadEventKind = "name"
+	ThreadEnd       ThreadEventKind = "end"
+)
+
+type ThreadEvent struct {
+	Nts    RefTs           `json:"nts"`
+	Source int             `json:"source"`
+	ID     uint16          `json:"id"`
+	Name   string          `json:"name,omitempty"`
+	Kind   ThreadEventKind `json:"kind"`
+	PC     uint32          `json:"pc,omitempty"`
+}
+
+// ThreadSlice is an uninterrupted run of one thread, [Start, Stop) in Nts.
+type ThreadSlice struct {
+	Source int    `json:"source"`
+	ID     uint16 `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Start  RefTs  `json:"start"`
+	Stop   RefTs  `json:"stop"`
+}
+
+func (slice *ThreadSlice) Length() RefTs {
+	return slice.Stop - slice.Start
+}
+
+type ThreadStats struct {
+	Source   int     `json:"source"`
+	ID       uint16  `json:"id"`
+	Name     string  `json:"name,omitempty"`
+	StartPC  uint32  `json:"start_pc,omitempty"`
+	EndPC    uint32  `json:"end_pc,omitempty"`
+	Slices   int     `json:"slices"`
+	Total    RefTs   `json:"total"`
+	Longest  RefTs   `json:"longest"`
+	Average  float64 `json:"average"`
+	Share    float64 `json:"share"`
+	First    RefTs   `json:"first"`
+	LastSeen RefTs   `json:"last_seen"`
+}
+
+// ThreadTimeline records when every thread of every trace file was switched in and out.
+type ThreadTimeline struct {
+	Events []ThreadEvent
+	Slices []*ThreadSlice
+
+	// OnEvent is called for every event as it is recorded
+	OnEvent func(ev *ThreadEvent)
+
+	open *ThreadSlice
+}
+
+func NewThreadTimeline() *ThreadTimeline {
+	return &ThreadTimeline{}
+}
+
+func (tl *ThreadTimeline) push(ev ThreadEvent) {
+	tl.Events = append(tl.Events, ev)
+	if tl.OnEvent != nil {
+		tl.OnEvent(&ev)
+	}
+}
+
+func (tl *ThreadTimeline) addEvent(n RefTs, src int, thread *BBTraceThreadState, kind ThreadEventKind, pc uint32) {
+	tl.push(ThreadEvent{
+		Nts:    n,
+		Source: src,
+		ID:     thread.ID,
+		Name:   thread.Name,
+		Kind:   kind,
+		PC:     pc,
+	})
+}
+
+// SwitchIn opens a slice for thread, consecutive chunks of the same thread stay in one slice.
+func (tl *ThreadTimeline) SwitchIn(n RefTs, src int, thread *BBTraceThreadState) {
+	if tl.open != nil {
+		if tl.open.Source == src && tl.open.ID == thread.ID {
+			return
+		}
+		tl.SwitchOut(n)
+	}
+
+	tl.addEvent(n, src, thread, ThreadSwitchIn, thread.PC)
+	tl.open = &ThreadSlice{
+		Source: src,
+		ID:     thread.ID,
+		Name:   thread.Name,
+		Start:  n,
+	}
+}
+
+// SwitchOut closes the running slice.
+func (tl *ThreadTimeline) SwitchOut(n RefTs) {
+	if tl.open == nil {
+		return
+	}
+	tl.open.Stop = n
+	tl.Slices = append(tl.Slices, tl.open)
+	tl.push(ThreadEvent{
+		Nts:    n,
+		Source: tl.open.Source,
+		ID:     tl.open.ID,
+		Name:   tl.open.Name,
+		Kind:   ThreadSwitchOut,
+	})
+	tl.open = nil
+}
+
+func (tl *ThreadTimeline) OnStart(n RefTs, src int, thread *BBTraceThreadState, pc uint32) {
+	tl.addEvent(n, src, thread, ThreadStart, pc)
+}
+
+func (tl *ThreadTimeline) OnName(n RefTs, src int, thread *BBTraceThreadState) {
+	tl.addEvent(n, src, thread, ThreadName, 0)
+	if tl.open != nil && tl.open.Source == src && tl.open.ID == thread.ID {
+		tl.open.Name = thread.Name
+	}
+}
+
+func (tl *ThreadTimeline) OnEnd(n RefTs, src int, thread *BBTraceThreadState, end_pc uint32) {
+	tl.addEvent(n, src, thread, ThreadEnd, end_pc)
+}
+
+// Stats sums up the slices per thread, threads being keyed by source and ID.
+func (tl *ThreadTimeline) Stats(sources []*BBTraceSource) []*ThreadStats {
+	type threadKey struct {
+		src int
+		id  uint16
+	}
+	stats := make(map[threadKey]*ThreadStats)
+	var result []*ThreadStats
+	total := RefTs(0)
+
+	for _, slice := range tl.Slices {
+		key := threadKey{slice.Source, slice.ID}
+		st, ok := stats[key]
+		if !ok {
+			st = &ThreadStats{Source: slice.Source, ID: slice.ID, First: slice.Start}
+			stats[key] = st
+			result = append(result, st)
+		}
+		if slice.Name != "" {
+			st.Name = slice.Name
+		}
+		st.Slices++
+		st.Total += slice.Length()
+		if slice.Length() > st.Longest {
+			st.Longest = slice.Length()
+		}
+		st.LastSeen = slice.Stop
+		total += slice.Length()
+	}
+
+	for _, st := range result {
+		st.Average = float64(st.Total) / float64(st.Slices)
+		if total > 0 {
+			st.Share = float64(st.Total) * 100 / float64(total)
+		}
+		if st.Source < len(sources) {
+			if thread, ok := sources[st.Source].Threads[st.ID]; ok {
+				st.StartPC = thread.StartPC
+				st.EndPC = thread.EndPC
+			}
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Total > result[j].Total
+	})
+	return result
+}
+
+func (tl *ThreadTimeline) Dump(sources []*BBTraceSource) {
+	fmt.Printf("%-4s %-6s %-24s %8s %10s %10s %10s %7s\n", "src", "id", "name", "slices", "total", "longest", "average", "share")
+	for _, st := range tl.Stats(sources) {
+		fmt.Printf("%-4d %-6d %-24s %8d %10d %10d %10.1f %6.1f%%\n", st.Source, st.ID, st.Name,
+			st.Slices, st.Total, st.Longest, st.Average, st.Share)
+	}
+}
+
+func (tl *ThreadTimeline) WriteCSV(w io.Writer, sources []*BBTraceSource) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"kind", "source", "id", "name", "start", "stop", "pc", "end_pc",
+		"slices", "total", "longest", "average", "share"})
+
+	for _, ev := range tl.Events {
+		pc := ""
+		if ev.PC != 0 {
+			pc = fmt.Sprintf("0x%08x", ev.PC)
+		}
+		out.Write([]string{string(ev.Kind), strconv.Itoa(ev.Source), strconv.Itoa(int(ev.ID)), ev.Name,
+			strconv.Itoa(int(ev.Nts)), "", pc, "", "", "", "", "", ""})
+	}
+	for _, slice := range tl.Slices {
+		out.Write([]string{"slice", strconv.Itoa(slice.Source), strconv.Itoa(int(slice.ID)), slice.Name,
+			strconv.Itoa(int(slice.Start)), strconv.Itoa(int(slice.Stop)), "", "", "", "", "", "", ""})
+	}
+	for _, st := range tl.Stats(sources) {
+		end_pc := ""
+		if st.EndPC != 0 {
+			end_pc = fmt.Sprintf("0x%08x", st.EndPC)
+		}
+		out.Write([]string{"thread", strconv.Itoa(st.Source), strconv.Itoa(int(st.ID)), st.Name,
+			strconv.Itoa(int(st.First)), strconv.Itoa(int(st.LastSeen)), fmt.Sprintf("0x%08x", st.StartPC), end_pc,
+			strconv.Itoa(st.Slices), strconv.Itoa(int(st.Total)), strconv.Itoa(int(st.Longest)),
+			strconv.FormatFloat(st.Average, 'f', -1, 64), strconv.FormatFloat(st.Share, 'f', -1, 64)})
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+func (tl *ThreadTimeline) WriteJSON(w io.Writer, sources []*BBTraceSource) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Threads []*ThreadStats `json:"threads"`
+		Slices  []*ThreadSlice `json:"slices"`
+		Events  []ThreadEvent  `json:"events"`
+	}{
+		Threads: tl.Stats(sources),
+		Slices:  tl.Slices,
+		Events:  tl.Events,
+	})
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThreadTimeline(t *testing.T) {
+	dir := t.TempDir()
+	doc := newTestDocument()
+	// both threads spin on a `j` to their start
+	for _, addr := range []uint32{0x8804000, 0x8804100} {
+		putInstr(doc, addr, "j\t->$", models.MipsOpcode{IsBranch: true, HasDelaySlot: true, BranchTarget: addr})
+		putInstr(doc, addr+4, "nop", models.MipsOpcode{})
+	}
+	putFunction(doc, "main", 0x8804000, 0x8)
+	putFunction(doc, "worker", 0x8804100, 0x8)
+
+	writeTestTrace(t, filepath.Join(dir, "trace.rec"),
+		traceChunk(1, traceStart(0x8804000), traceName("user_main"), traceRecord(0x8804000, 0)),
+		traceChunk(2, traceStart(0x8804100), traceName("worker"), traceRecord(0x8804100, 0), traceRecord(0x8804100, 0x8804104)),
+		traceChunk(2, traceRecord(0x8804100, 0x8804104)),
+		traceChunk(1, traceRecord(0x8804000, 0x8804004), traceEnd(0x8804008)),
+	)
+
+	doc.Parser.SetTraceFiles([]string{filepath.Join(dir, "trace.rec")})
+	assert.NoError(t, doc.Parser.Parse(0))
+	assert.Empty(t, doc.Parser.Mismatches)
+
+	tl := doc.Parser.Timeline
+	assert.Len(t, tl.Slices, 3)
+	assert.Equal(t, "worker", tl.Slices[1].Name)
+	assert.Equal(t, RefTs(3), tl.Slices[1].Length())
+
+	stats := tl.Stats(doc.Parser.Sources)
+	assert.Len(t, stats, 2)
+	assert.Equal(t, uint16(2), stats[0].ID)
+	assert.Equal(t, 1, stats[0].Slices)
+	assert.InDelta(t, 60.0, stats[0].Share, 0.01)
+	assert.Equal(t, "user_main", stats[1].Name)
+	assert.Equal(t, 2, stats[1].Slices)
+	assert.Equal(t, uint32(0x8804000), stats[1].StartPC)
+	assert.Equal(t, uint32(0x8804008), stats[1].EndPC)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tl.WriteCSV(&buf, doc.Parser.Sources))
+	assert.Contains(t, buf.String(), "end,0,1,user_main,6,,0x08804008,")
+	assert.Contains(t, buf.String(), "slice,0,2,worker,2,5,,")
+	assert.Contains(t, buf.String(), "thread,0,1,user_main,1,6,0x08804000,0x08804008,2,2,1,1,40\n")
+
+	buf.Reset()
+	assert.NoError(t, tl.WriteJSON(&buf, doc.Parser.Sources))
+	assert.Contains(t, buf.String(), `"kind": "switch_out"`)
+}
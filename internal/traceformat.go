@@ -0,0 +1,404 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type TraceFormat string
+
+const (
+	TraceRaw     TraceFormat = "raw"
+	TraceGzip    TraceFormat = "gzip"
+	TraceZstd    TraceFormat = "zstd"
+	TraceCompact TraceFormat = "compact"
+)
+
+var (
+	gzipMagic    = []byte{0x1f, 0x8b}
+	zstdMagic    = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	compactMagic = []byte("SBTC")
+)
+
+const (
+	compactVersion  = 1
+	compactDictSize = 4096
+
+	compactControl = 0 // kind, word count, words
+	compactLiteral = 1 // pc delta, last_pc delta
+	compactDict    = 2 // and above, dictionary index + compactDict
+)
+
+type tracePair struct {
+	PC     uint32
+	LastPC uint32
+}
+
+type traceFile struct {
+	io.Reader
+	closers []io.Closer
+	Format  TraceFormat
+}
+
+func (tf *traceFile) Close() error {
+	var err error
+	for i := len(tf.closers) - 1; i >= 0; i-- {
+		if e := tf.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+type zstdCloser struct{ dec *zstd.Decoder }
+
+func (z zstdCloser) Close() error {
+	z.dec.Close()
+	return nil
+}
+
+// OpenTrace opens a recording as the raw chunk stream, gzip and zstd
+// compression and the compact format are detected by their magic. Formats
+// nest, e.g. a gzip compressed compact file.
+func OpenTrace(filename string) (*traceFile, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	tf := &traceFile{closers: []io.Closer{file}, Format: TraceRaw}
+	rd := bufio.NewReader(file)
+	tf.Reader = rd
+
+	for {
+		magic, _ := rd.Peek(4)
+		switch {
+		case bytes.HasPrefix(magic, gzipMagic):
+			gz, err := gzip.NewReader(rd)
+			if err != nil {
+				tf.Close()
+				return nil, err
+			}
+			tf.closers = append(tf.closers, gz)
+			tf.Format = TraceGzip
+			rd = bufio.NewReader(gz)
+		case bytes.HasPrefix(magic, zstdMagic):
+			dec, err := zstd.NewReader(rd)
+			if err != nil {
+				tf.Close()
+				return nil, err
+			}
+			tf.closers = append(tf.closers, zstdCloser{dec})
+			tf.Format = TraceZstd
+			rd = bufio.NewReader(dec)
+		case bytes.HasPrefix(magic, compactMagic):
+			cr, err := newCompactReader(rd)
+			if err != nil {
+				tf.Close()
+				return nil, err
+			}
+			tf.Reader = cr
+			tf.Format = TraceCompact
+			return tf, nil
+		default:
+			tf.Reader = rd
+			return tf, nil
+		}
+	}
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func unzigzag(u uint64) int64 {
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+// countPairs reads a raw trace and counts every (pc, last_pc) record.
+func countPairs(bin io.Reader) (map[tracePair]int, error) {
+	counts := make(map[tracePair]int)
+	for {
+		cur_ID, records, err := readChunk(bin)
+		if err == io.EOF {
+			return counts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk := DecodeChunk(cur_ID, records)
+		if chunk.Err != nil {
+			return nil, chunk.Err
+		}
+		for _, item := range chunk.Items {
+			if item.Kind == 0 {
+				counts[tracePair{item.PC, item.LastPC}]++
+			}
+		}
+	}
+}
+
+// WriteCompactTrace converts the raw trace of filename, in any format
+// OpenTrace reads, to the compact format: varint PC deltas and a dictionary
+// of the most frequent (pc, last_pc) pairs.
+func WriteCompactTrace(filename string, w io.Writer) error {
+	tf, err := OpenTrace(filename)
+	if err != nil {
+		return err
+	}
+	counts, err := countPairs(tf)
+	tf.Close()
+	if err != nil {
+		return err
+	}
+
+	var dict []tracePair
+	for pair, count := range counts {
+		if count > 1 {
+			dict = append(dict, pair)
+		}
+	}
+	sort.Slice(dict, func(i, j int) bool {
+		ci, cj := counts[dict[i]], counts[dict[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		if dict[i].PC != dict[j].PC {
+			return dict[i].PC < dict[j].PC
+		}
+		return dict[i].LastPC < dict[j].LastPC
+	})
+	if len(dict) > compactDictSize {
+		dict = dict[:compactDictSize]
+	}
+	dict_index := make(map[tracePair]int, len(dict))
+	for i, pair := range dict {
+		dict_index[pair] = i
+	}
+
+	bw := bufio.NewWriter(w)
+	varbuf := make([]byte, binary.MaxVarintLen64)
+	put := func(v uint64) {
+		n := binary.PutUvarint(varbuf, v)
+		bw.Write(varbuf[:n])
+	}
+
+	bw.Write(compactMagic)
+	bw.WriteByte(compactVersion)
+	put(uint64(len(dict)))
+	for _, pair := range dict {
+		put(uint64(pair.PC))
+		put(uint64(pair.LastPC))
+	}
+
+	tf, err = OpenTrace(filename)
+	if err != nil {
+		return err
+	}
+	defer tf.Close()
+
+	for {
+		cur_ID, records, err := readChunk(tf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk := DecodeChunk(cur_ID, records)
+		if chunk.Err != nil {
+			return chunk.Err
+		}
+
+		put(uint64(cur_ID))
+		put(uint64(chunk.Size))
+		prev_pc := uint32(0)
+		for _, item := range chunk.Items {
+			switch item.Kind {
+			case 0:
+				if idx, ok := dict_index[tracePair{item.PC, item.LastPC}]; ok {
+					put(uint64(idx + compactDict))
+				} else {
+					put(compactLiteral)
+					put(zigzag(int64(item.PC) - int64(prev_pc)))
+					if item.LastPC == 0 {
+						put(0)
+					} else {
+						put(zigzag(int64(item.LastPC)-int64(prev_pc)) + 1)
+					}
+				}
+				prev_pc = item.PC
+			default:
+				words := controlWords(item)
+				put(compactControl)
+				put(uint64(len(words)))
+				for _, word := range words {
+					put(uint64(word))
+				}
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// controlWords encodes a control item back to its raw words.
+func controlWords(item BBTraceItem) []uint32 {
+	words := []uint32{uint32(item.Kind)}
+	if item.Kind == KIND_NAME {
+		str := make([]byte, 32)
+		copy(str, item.Name)
+		for i := 0; i < 8; i++ {
+			words = append(words, binary.LittleEndian.Uint32(str[i*4:]))
+		}
+	} else {
+		words = append(words, item.PC)
+	}
+	return words
+}
+
+// compactReader expands the compact format back to raw chunks.
+type compactReader struct {
+	rd   *bufio.Reader
+	dict []tracePair
+	buf  bytes.Buffer
+}
+
+func newCompactReader(rd *bufio.Reader) (*compactReader, error) {
+	header := make([]byte, len(compactMagic)+1)
+	if _, err := io.ReadFull(rd, header); err != nil {
+		return nil, err
+	}
+	if header[len(compactMagic)] != compactVersion {
+		return nil, fmt.Errorf("unsupported compact trace version %d", header[len(compactMagic)])
+	}
+
+	cr := &compactReader{rd: rd}
+	n, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	for i := uint64(0); i < n; i++ {
+		pc, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		last_pc, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		cr.dict = append(cr.dict, tracePair{uint32(pc), uint32(last_pc)})
+	}
+	return cr, nil
+}
+
+func (cr *compactReader) Read(p []byte) (int, error) {
+	if cr.buf.Len() == 0 {
+		if err := cr.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	return cr.buf.Read(p)
+}
+
+func (cr *compactReader) nextChunk() error {
+	id, err := binary.ReadUvarint(cr.rd)
+	if err != nil {
+		return err
+	}
+	size, err := binary.ReadUvarint(cr.rd)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	words := make([]uint32, 0, size)
+	prev_pc := uint32(0)
+	for uint64(len(words)) < size {
+		tag, err := binary.ReadUvarint(cr.rd)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+
+		switch {
+		case tag == compactControl:
+			n, err := binary.ReadUvarint(cr.rd)
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			for ; n > 0; n-- {
+				word, err := binary.ReadUvarint(cr.rd)
+				if err != nil {
+					return unexpectedEOF(err)
+				}
+				words = append(words, uint32(word))
+			}
+		case tag == compactLiteral:
+			dpc, err := binary.ReadUvarint(cr.rd)
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			dlast, err := binary.ReadUvarint(cr.rd)
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			pc := uint32(int64(prev_pc) + unzigzag(dpc))
+			last_pc := uint32(0)
+			if dlast != 0 {
+				last_pc = uint32(int64(prev_pc) + unzigzag(dlast-1))
+			}
+			words = append(words, pc, last_pc)
+			prev_pc = pc
+		default:
+			idx := int(tag - compactDict)
+			if idx >= len(cr.dict) {
+				return fmt.Errorf("compact trace dictionary index %d out of %d", idx, len(cr.dict))
+			}
+			pair := cr.dict[idx]
+			words = append(words, pair.PC, pair.LastPC)
+			prev_pc = pair.PC
+		}
+	}
+
+	binary.Write(&cr.buf, binary.LittleEndian, KIND_ID)
+	binary.Write(&cr.buf, binary.LittleEndian, uint16(id))
+	binary.Write(&cr.buf, binary.LittleEndian, KIND_SZ)
+	binary.Write(&cr.buf, binary.LittleEndian, uint32(len(words)))
+	return binary.Write(&cr.buf, binary.LittleEndian, words)
+}
+
+// WriteCompressedTrace copies the raw trace of filename, in any format
+// OpenTrace reads, compressed as format.
+func WriteCompressedTrace(filename string, w io.Writer, format TraceFormat) error {
+	tf, err := OpenTrace(filename)
+	if err != nil {
+		return err
+	}
+	defer tf.Close()
+
+	var out io.WriteCloser
+	switch format {
+	case TraceGzip:
+		out = gzip.NewWriter(w)
+	case TraceZstd:
+		out, err = zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported compression %q", format)
+	}
+
+	if _, err := io.Copy(out, tf); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
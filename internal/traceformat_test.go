@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZigzag(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 0x7FFFFFFF, -0x80000000} {
+		assert.Equal(t, v, unzigzag(zigzag(v)))
+	}
+}
+
+func TestTraceFormats(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "trace.rec")
+
+	var chunks []testTraceChunk
+	for n := 0; n < 20; n++ {
+		chunks = append(chunks,
+			traceChunk(1, traceStart(0x8804000), traceName("user_main"),
+				traceRecord(0x8804000, 0),
+				traceRecord(0x8805000, 0x8804004),
+				traceRecord(0x8806000, 0x8805004),
+			),
+			traceChunk(2, traceRecord(0x8806000, 0)),
+			traceChunk(1,
+				traceRecord(0x8805008, 0x8806004),
+				traceRecord(0x8804008, 0x880500C),
+				traceEnd(0x8804008),
+			),
+		)
+	}
+	writeTestTrace(t, raw, chunks...)
+
+	convert := func(name string, write func(f *os.File) error) string {
+		filename := filepath.Join(dir, name)
+		f, err := os.Create(filename)
+		assert.NoError(t, err)
+		assert.NoError(t, write(f))
+		f.Close()
+		return filename
+	}
+
+	gz := convert("trace.rec.gz", func(f *os.File) error { return WriteCompressedTrace(raw, f, TraceGzip) })
+	zst := convert("trace.rec.zst", func(f *os.File) error { return WriteCompressedTrace(raw, f, TraceZstd) })
+	compact := convert("trace.sbtc", func(f *os.File) error { return WriteCompactTrace(raw, f) })
+	compact_gz := convert("trace.sbtc.gz", func(f *os.File) error {
+		gw := gzip.NewWriter(f)
+		if err := WriteCompactTrace(raw, gw); err != nil {
+			return err
+		}
+		return gw.Close()
+	})
+
+	raw_info, _ := os.Stat(raw)
+	compact_info, _ := os.Stat(compact)
+	assert.Less(t, compact_info.Size()*2, raw_info.Size())
+
+	raw_data, _ := os.ReadFile(raw)
+	for filename, format := range map[string]TraceFormat{gz: TraceGzip, zst: TraceZstd, compact: TraceCompact, compact_gz: TraceCompact} {
+		tf, err := OpenTrace(filename)
+		assert.NoError(t, err)
+		assert.Equal(t, format, tf.Format, filename)
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(tf)
+		assert.NoError(t, err)
+		tf.Close()
+		assert.Equal(t, raw_data, buf.Bytes(), filename)
+	}
+
+	raw_doc, raw_events, err := parseTestTrace(t, raw, 0, 0)
+	assert.NoError(t, err)
+	for _, filename := range []string{gz, zst, compact, compact_gz} {
+		doc, events, err := parseTestTrace(t, filename, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, raw_events, events, filename)
+		assert.Equal(t, raw_doc.Parser.Profile.BBCounts, doc.Parser.Profile.BBCounts)
+		assert.Equal(t, raw_doc.BBManager.Refs(), doc.BBManager.Refs())
+	}
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type TraceEventKind string
+
+const (
+	TraceBB        TraceEventKind = "bb"
+	TraceEnter     TraceEventKind = "enter"
+	TraceLeave     TraceEventKind = "leave"
+	TraceSwitchIn  TraceEventKind = TraceEventKind(ThreadSwitchIn)
+	TraceSwitchOut TraceEventKind = TraceEventKind(ThreadSwitchOut)
+	TraceStart     TraceEventKind = TraceEventKind(ThreadStart)
+	TraceName      TraceEventKind = TraceEventKind(ThreadName)
+	TraceEnd       TraceEventKind = TraceEventKind(ThreadEnd)
+)
+
+// TraceEvent is what the parser emits to OnEvent while it runs.
+type TraceEvent struct {
+	Kind       TraceEventKind `json:"kind"`
+	Nts        RefTs          `json:"nts"`
+	Source     int            `json:"source"`
+	ThreadID   uint16         `json:"thread_id"`
+	ThreadName string         `json:"thread_name,omitempty"`
+	Address    uint32         `json:"address"`
+	Prev       uint32         `json:"prev,omitempty"` // previous bb of the thread
+	Function   string         `json:"function,omitempty"`
+}
+
+func (ev *TraceEvent) String() string {
+	s := fmt.Sprintf("%d %s [%d:%d %s] 0x%08x", ev.Nts, ev.Kind, ev.Source, ev.ThreadID, ev.ThreadName, ev.Address)
+	if ev.Prev != 0 {
+		s += fmt.Sprintf(" from 0x%08x", ev.Prev)
+	}
+	if ev.Function != "" {
+		s += " " + ev.Function
+	}
+	return s
+}
+
+// AddrPattern matches addresses nibble by nibble, masked nibbles match anything.
+type AddrPattern struct {
+	Value uint32
+	Mask  uint32
+}
+
+// ParseAddrPattern reads patterns like 0x0880xxxx, x, y and ? being wildcards.
+func ParseAddrPattern(s string) (AddrPattern, error) {
+	digits := strings.TrimPrefix(strings.ToLower(s), "0x")
+	if len(digits) == 0 || len(digits) > 8 {
+		return AddrPattern{}, fmt.Errorf("invalid address pattern %q", s)
+	}
+	digits = strings.Repeat("0", 8-len(digits)) + digits
+
+	pat := AddrPattern{}
+	for _, c := range digits {
+		pat.Value <<= 4
+		pat.Mask <<= 4
+		switch {
+		case c >= '0' && c <= '9':
+			pat.Value |= uint32(c - '0')
+			pat.Mask |= 0xF
+		case c >= 'a' && c <= 'f':
+			pat.Value |= uint32(c-'a') + 10
+			pat.Mask |= 0xF
+		case c == 'x' || c == 'y' || c == '?':
+		default:
+			return AddrPattern{}, fmt.Errorf("invalid address pattern %q", s)
+		}
+	}
+	return pat, nil
+}
+
+func (pat AddrPattern) Match(addr uint32) bool {
+	return addr&pat.Mask == pat.Value
+}
+
+// TraceFilter accepts an event when every set field matches, it is the Go
+// side of ParseTraceQuery.
+type TraceFilter struct {
+	Kinds    []TraceEventKind
+	Source   *int
+	Thread   string // thread name glob, or its ID
+	Function string // function name glob
+	Address  *AddrPattern
+	Prev     *AddrPattern // the bb the thread was at before
+	MinNts   RefTs
+	MaxNts   RefTs // inclusive, 0 for no limit
+}
+
+func (filter *TraceFilter) Match(ev *TraceEvent) bool {
+	if len(filter.Kinds) > 0 {
+		found := false
+		for _, kind := range filter.Kinds {
+			if kind == ev.Kind {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if ev.Nts < filter.MinNts || (filter.MaxNts != 0 && ev.Nts > filter.MaxNts) {
+		return false
+	}
+	if filter.Source != nil && *filter.Source != ev.Source {
+		return false
+	}
+	if filter.Thread != "" {
+		if id, err := strconv.Atoi(filter.Thread); err == nil {
+			if uint16(id) != ev.ThreadID {
+				return false
+			}
+		} else if ok, _ := path.Match(filter.Thread, ev.ThreadName); !ok {
+			return false
+		}
+	}
+	if filter.Function != "" {
+		if ok, _ := path.Match(filter.Function, ev.Function); !ok {
+			return false
+		}
+	}
+	if filter.Address != nil && !filter.Address.Match(ev.Address) {
+		return false
+	}
+	if filter.Prev != nil && (ev.Prev == 0 || !filter.Prev.Match(ev.Prev)) {
+		return false
+	}
+	return true
+}
+
+func parseNts(s string) (RefTs, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return RefTs(n), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid nts %q", s)
+	}
+	return RefTs(f), nil
+}
+
+// ParseTraceQuery reads space separated key=value terms, all of them must match:
+//
+//	kind=enter,leave  one of bb, enter, leave, switch_in, switch_out, start, name, end
+//	func=sce*         function name glob
+//	thread=user_main  thread name glob or ID
+//	src=1             trace file index
+//	nts=1e6..2e6      Nts range, either end may be left out
+//	bb=0x0890yyyy     address pattern
+//	from=0x0880xxxx   previous bb pattern, "bb A followed by bb B" is from=A bb=B
+//
+// The word "and" between terms is allowed.
+func ParseTraceQuery(query string) (*TraceFilter, error) {
+	filter := &TraceFilter{}
+
+	for _, term := range strings.Fields(query) {
+		if strings.EqualFold(term, "and") {
+			continue
+		}
+		key, value, ok := strings.Cut(term, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid query term %q", term)
+		}
+
+		switch strings.ToLower(key) {
+		case "kind":
+			for _, kind := range strings.Split(value, ",") {
+				filter.Kinds = append(filter.Kinds, TraceEventKind(kind))
+			}
+		case "func", "function":
+			filter.Function = value
+		case "thread":
+			filter.Thread = value
+		case "src", "source":
+			src, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source %q", value)
+			}
+			filter.Source = &src
+		case "nts":
+			lo, hi, is_range := strings.Cut(value, "..")
+			var err error
+			if lo != "" {
+				if filter.MinNts, err = parseNts(lo); err != nil {
+					return nil, err
+				}
+			}
+			if !is_range {
+				filter.MaxNts = filter.MinNts
+			} else if hi != "" {
+				if filter.MaxNts, err = parseNts(hi); err != nil {
+					return nil, err
+				}
+			}
+		case "bb", "addr":
+			pat, err := ParseAddrPattern(value)
+			if err != nil {
+				return nil, err
+			}
+			filter.Address = &pat
+		case "from":
+			pat, err := ParseAddrPattern(value)
+			if err != nil {
+				return nil, err
+			}
+			filter.Prev = &pat
+		default:
+			return nil, fmt.Errorf("unknown query key %q", key)
+		}
+	}
+
+	return filter, nil
+}
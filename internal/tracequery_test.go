@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAddrPattern(t *testing.T) {
+	pat, err := ParseAddrPattern("0x0880xxxx")
+	assert.NoError(t, err)
+	assert.True(t, pat.Match(0x08801234))
+	assert.False(t, pat.Match(0x08901234))
+
+	pat, err = ParseAddrPattern("8804?00")
+	assert.NoError(t, err)
+	assert.True(t, pat.Match(0x08804100))
+
+	_, err = ParseAddrPattern("0x0880zz")
+	assert.Error(t, err)
+}
+
+func TestParseTraceQuery(t *testing.T) {
+	filter, err := ParseTraceQuery("kind=enter and func=sce* thread=user_main nts=1e6..2e6")
+	assert.NoError(t, err)
+	assert.Equal(t, []TraceEventKind{TraceEnter}, filter.Kinds)
+	assert.Equal(t, RefTs(1000000), filter.MinNts)
+	assert.Equal(t, RefTs(2000000), filter.MaxNts)
+
+	ev := &TraceEvent{Kind: TraceEnter, Nts: 1500000, ThreadName: "user_main", Function: "sceKernelDelayThread"}
+	assert.True(t, filter.Match(ev))
+	ev.Nts = 2000001
+	assert.False(t, filter.Match(ev))
+
+	filter, err = ParseTraceQuery("thread=3 nts=10..")
+	assert.NoError(t, err)
+	assert.True(t, filter.Match(&TraceEvent{ThreadID: 3, Nts: 99}))
+	assert.False(t, filter.Match(&TraceEvent{ThreadID: 3, Nts: 9}))
+
+	_, err = ParseTraceQuery("color=red")
+	assert.Error(t, err)
+	_, err = ParseTraceQuery("kind")
+	assert.Error(t, err)
+}
+
+func TestTraceEvents(t *testing.T) {
+	dir := t.TempDir()
+	doc := newTestDocument()
+	putCaller(doc, "main", 0x8804000, 0x8805000)
+	putCaller(doc, "sub", 0x8805000, 0x8806000)
+	putLeafFunction(doc, "leaf", 0x8806000)
+
+	writeTestTrace(t, filepath.Join(dir, "trace.rec"),
+		traceChunk(1, traceStart(0x8804000), traceName("user_main"),
+			traceRecord(0x8804000, 0),
+			traceRecord(0x8805000, 0x8804004),
+			traceRecord(0x8806000, 0x8805004),
+			traceRecord(0x8805008, 0x8806004),
+			traceRecord(0x8804008, 0x880500C),
+		),
+	)
+
+	var events []*TraceEvent
+	doc.Parser.OnEvent = func(ev *TraceEvent) { events = append(events, ev) }
+	doc.Parser.SetTraceFiles([]string{filepath.Join(dir, "trace.rec")})
+	assert.NoError(t, doc.Parser.Parse(0))
+
+	query := func(q string) []*TraceEvent {
+		filter, err := ParseTraceQuery(q)
+		assert.NoError(t, err)
+		var result []*TraceEvent
+		for _, ev := range events {
+			if filter.Match(ev) {
+				result = append(result, ev)
+			}
+		}
+		return result
+	}
+
+	enters := query("kind=enter thread=user_main")
+	assert.Len(t, enters, 3)
+	assert.Equal(t, "sub", enters[1].Function)
+
+	leaves := query("kind=leave func=*")
+	assert.Len(t, leaves, 2)
+	assert.Equal(t, "leaf", leaves[0].Function)
+
+	followed := query("from=0x08806xxx bb=0x08805xxx")
+	assert.Len(t, followed, 1)
+	assert.Equal(t, RefTs(4), followed[0].Nts)
+	assert.Equal(t, "sub", followed[0].Function)
+
+	assert.Len(t, query("kind=switch_in,switch_out"), 2)
+	assert.Len(t, query("kind=bb nts=2..3"), 2)
+}
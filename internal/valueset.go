@@ -0,0 +1,670 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type ValueKind string
+
+const (
+	ValueTop    ValueKind = ""       // anything
+	ValueConst  ValueKind = "const"  // one of Values
+	ValueStride ValueKind = "stride" // Base + k*Stride, k < Count or unbounded when Count is 0
+	ValueLoad   ValueKind = "load"   // the word at any Base + k*Stride, read when used
+)
+
+// maxValueSet bounds the constants a value keeps before it becomes Top,
+// maxTableScan the entries read from an unbounded table.
+const (
+	maxValueSet  = 64
+	maxTableScan = 256
+)
+
+// AbsValue is what the value-set analysis knows of a register, Src tells
+// where it comes from.
+type AbsValue struct {
+	Kind   ValueKind
+	Values []uint32
+	Base   uint32
+	Stride uint32
+	Count  int
+	Src    string
+}
+
+func topValue() AbsValue {
+	return AbsValue{}
+}
+
+func constValue(src string, values ...uint32) AbsValue {
+	if len(values) > maxValueSet {
+		return topValue()
+	}
+	values = append([]uint32{}, values...)
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	uniq := values[:0]
+	for i, val := range values {
+		if i == 0 || val != values[i-1] {
+			uniq = append(uniq, val)
+		}
+	}
+	return AbsValue{Kind: ValueConst, Values: uniq, Src: src}
+}
+
+func (val AbsValue) IsConst(c uint32) bool {
+	return val.Kind == ValueConst && len(val.Values) == 1 && val.Values[0] == c
+}
+
+func (val AbsValue) equal(other AbsValue) bool {
+	if val.Kind != other.Kind || val.Base != other.Base || val.Stride != other.Stride ||
+		val.Count != other.Count || len(val.Values) != len(other.Values) {
+		return false
+	}
+	for i := range val.Values {
+		if val.Values[i] != other.Values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (val AbsValue) String() string {
+	switch val.Kind {
+	case ValueConst:
+		var strs []string
+		for _, c := range val.Values {
+			strs = append(strs, fmt.Sprintf("0x%x", c))
+		}
+		return "{" + strings.Join(strs, ",") + "}"
+	case ValueStride:
+		return fmt.Sprintf("0x%x+%d*k[%d]", val.Base, val.Stride, val.Count)
+	case ValueLoad:
+		return fmt.Sprintf("*(0x%x+%d*k[%d])", val.Base, val.Stride, val.Count)
+	}
+	return "T"
+}
+
+func joinSrc(a, b string) string {
+	if a == b || b == "" {
+		return a
+	}
+	if a == "" {
+		return b
+	}
+	for _, src := range strings.Split(a, ", ") {
+		if src == b {
+			return a
+		}
+	}
+	return a + ", " + b
+}
+
+func joinValues(a, b AbsValue) AbsValue {
+	switch {
+	case a.equal(b):
+		a.Src = joinSrc(a.Src, b.Src)
+		return a
+	case a.Kind == ValueConst && b.Kind == ValueConst:
+		return constValue(joinSrc(a.Src, b.Src), append(append([]uint32{}, a.Values...), b.Values...)...)
+	}
+	return topValue()
+}
+
+func addValues(a, b AbsValue) AbsValue {
+	src := joinSrc(a.Src, b.Src)
+	switch {
+	case a.Kind == ValueConst && b.Kind == ValueConst:
+		if len(a.Values)*len(b.Values) > maxValueSet {
+			return topValue()
+		}
+		var sums []uint32
+		for _, x := range a.Values {
+			for _, y := range b.Values {
+				sums = append(sums, x+y)
+			}
+		}
+		return constValue(src, sums...)
+	case a.Kind == ValueStride && b.Kind == ValueConst && len(b.Values) == 1:
+		a.Base += b.Values[0]
+		a.Src = src
+		return a
+	case b.Kind == ValueStride && a.Kind == ValueConst && len(a.Values) == 1:
+		return addValues(b, a)
+	}
+	return topValue()
+}
+
+func mapValue(a AbsValue, fn func(uint32) uint32) AbsValue {
+	if a.Kind != ValueConst {
+		return topValue()
+	}
+	var values []uint32
+	for _, x := range a.Values {
+		values = append(values, fn(x))
+	}
+	return constValue(a.Src, values...)
+}
+
+func shiftValue(a AbsValue, sa uint32) AbsValue {
+	switch a.Kind {
+	case ValueConst:
+		return mapValue(a, func(x uint32) uint32 { return x << sa })
+	case ValueStride:
+		a.Base <<= sa
+		a.Stride <<= sa
+		return a
+	case ValueTop:
+		// an index scaled to the entry size
+		return AbsValue{Kind: ValueStride, Stride: 1 << sa}
+	}
+	return topValue()
+}
+
+func andValue(a AbsValue, mask uint32) AbsValue {
+	if a.Kind == ValueConst {
+		return mapValue(a, func(x uint32) uint32 { return x & mask })
+	}
+	if mask&(mask+1) == 0 && mask < maxTableScan {
+		// a bounded index
+		return AbsValue{Kind: ValueStride, Stride: 1, Count: int(mask) + 1}
+	}
+	return topValue()
+}
+
+func orValues(a, b AbsValue) AbsValue {
+	switch {
+	case a.IsConst(0):
+		return b
+	case b.IsConst(0):
+		return a
+	case a.Kind == ValueConst && b.Kind == ValueConst && len(b.Values) == 1:
+		c := b.Values[0]
+		val := mapValue(a, func(x uint32) uint32 { return x | c })
+		val.Src = joinSrc(a.Src, b.Src)
+		return val
+	}
+	return topValue()
+}
+
+// valueState maps registers to values, a register missing is Top.
+type valueState map[Register]AbsValue
+
+func (st valueState) get(reg Register) AbsValue {
+	if reg == RegZero {
+		return constValue("", 0)
+	}
+	return st[reg]
+}
+
+func (st valueState) set(reg Register, val AbsValue) {
+	if val.Kind == ValueTop {
+		delete(st, reg)
+	} else {
+		st[reg] = val
+	}
+}
+
+func (st valueState) clone() valueState {
+	out := make(valueState, len(st))
+	for reg, val := range st {
+		out[reg] = val
+	}
+	return out
+}
+
+func (st valueState) equal(other valueState) bool {
+	if len(st) != len(other) {
+		return false
+	}
+	for reg, val := range st {
+		if other_val, ok := other[reg]; !ok || !val.equal(other_val) {
+			return false
+		}
+	}
+	return true
+}
+
+func joinStates(a, b valueState) valueState {
+	out := make(valueState)
+	for reg, val := range a {
+		if other, ok := b[reg]; ok {
+			out.set(reg, joinValues(val, other))
+		}
+	}
+	return out
+}
+
+// IndirectSite is a jalr or jr with the targets the analysis found.
+type IndirectSite struct {
+	Address    uint32
+	Block      uint32 // start of the CFG block it ends
+	Fun        *SoraFunction
+	Reg        Register
+	Value      AbsValue
+	Targets    []uint32
+	Provenance string
+}
+
+// ValueSetAnalysis tracks the constant and table values of registers in
+// each function, with the arguments callers pass and the values callees
+// return, to find the targets of indirect jumps and calls. Memory is read
+// from the dump, stores are not tracked.
+type ValueSetAnalysis struct {
+	doc *SoraDocument
+
+	entries map[uint32]valueState // function -> arguments from its callers
+	returns map[uint32]AbsValue   // function -> v0 it returns
+
+	Sites []*IndirectSite
+}
+
+func NewValueSetAnalysis(doc *SoraDocument) *ValueSetAnalysis {
+	return &ValueSetAnalysis{
+		doc:     doc,
+		entries: make(map[uint32]valueState),
+		returns: make(map[uint32]AbsValue),
+	}
+}
+
+func (vsa *ValueSetAnalysis) read32(addr uint32) (uint32, bool) {
+	if addr&3 != 0 {
+		return 0, false
+	}
+	word, err := vsa.doc.Memory.Read32(addr)
+	return word, err == nil
+}
+
+// loadValue is the word read from addr.
+func (vsa *ValueSetAnalysis) loadValue(addr AbsValue) AbsValue {
+	switch addr.Kind {
+	case ValueConst:
+		var values []uint32
+		for _, a := range addr.Values {
+			word, ok := vsa.read32(a)
+			if !ok {
+				return topValue()
+			}
+			values = append(values, word)
+		}
+		src := fmt.Sprintf("load 0x%08x", addr.Values[0])
+		if len(addr.Values) > 1 {
+			src = fmt.Sprintf("loads 0x%08x..0x%08x", addr.Values[0], addr.Values[len(addr.Values)-1])
+		}
+		return constValue(joinSrc(addr.Src, src), values...)
+	case ValueStride:
+		if addr.Stride == 4 || (addr.Stride > 4 && addr.Stride%4 == 0) {
+			return AbsValue{Kind: ValueLoad, Base: addr.Base, Stride: addr.Stride, Count: addr.Count,
+				Src: joinSrc(addr.Src, fmt.Sprintf("table 0x%08x", addr.Base))}
+		}
+	}
+	return topValue()
+}
+
+// targets turns a jump register value into code addresses, entries of
+// unbounded tables are read while accept takes them.
+func (vsa *ValueSetAnalysis) targets(val AbsValue, accept func(uint32) bool) []uint32 {
+	var result []uint32
+	switch val.Kind {
+	case ValueConst:
+		for _, target := range val.Values {
+			if target&3 == 0 && accept(target) {
+				result = append(result, target)
+			}
+		}
+	case ValueLoad:
+		count := val.Count
+		if count == 0 {
+			count = maxTableScan
+		}
+		for k := 0; k < count; k++ {
+			word, ok := vsa.read32(val.Base + uint32(k)*val.Stride)
+			if !ok || word&3 != 0 || !accept(word) {
+				if val.Count == 0 {
+					break
+				}
+				continue
+			}
+			result = append(result, word)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	uniq := result[:0]
+	for i, target := range result {
+		if i == 0 || target != result[i-1] {
+			uniq = append(uniq, target)
+		}
+	}
+	return uniq
+}
+
+// transfer applies instr to st, a call only links ra here, see callReturn
+// for what it changes once its delay slot ran.
+func (vsa *ValueSetAnalysis) transfer(st valueState, instr *SoraInstruction) {
+	if instr.Op == "" {
+		return
+	}
+	oprs := instr.Operands
+	dst := func(val AbsValue) {
+		if len(oprs) > 0 && oprs[0].Kind == OperandReg {
+			st.set(oprs[0].Reg, val)
+		}
+	}
+
+	switch instr.Op {
+	case "lui":
+		dst(constValue("", oprs[1].UImm<<16))
+	case "addiu", "addi":
+		dst(addValues(st.get(oprs[1].Reg), constValue("", uint32(oprs[2].Imm))))
+	case "addu", "add":
+		dst(addValues(st.get(oprs[1].Reg), st.get(oprs[2].Reg)))
+	case "subu", "sub":
+		rhs := st.get(oprs[2].Reg)
+		if rhs.Kind == ValueConst && len(rhs.Values) == 1 {
+			dst(addValues(st.get(oprs[1].Reg), constValue(rhs.Src, -rhs.Values[0])))
+		} else {
+			dst(topValue())
+		}
+	case "ori":
+		dst(orValues(st.get(oprs[1].Reg), constValue("", oprs[2].UImm)))
+	case "or":
+		dst(orValues(st.get(oprs[1].Reg), st.get(oprs[2].Reg)))
+	case "andi":
+		dst(andValue(st.get(oprs[1].Reg), oprs[2].UImm))
+	case "sll":
+		dst(shiftValue(st.get(oprs[1].Reg), oprs[2].UImm))
+	case "lw":
+		addr := addValues(st.get(oprs[1].Reg), constValue("", uint32(oprs[1].Imm)))
+		dst(vsa.loadValue(addr))
+	case "jal", "jalr":
+		st.set(RegRA, constValue("", instr.Address+8))
+	default:
+		for _, reg := range instr.Writes {
+			delete(st, reg)
+		}
+	}
+}
+
+// callReturn applies the call instr to st after its delay slot, the
+// caller-saved registers are lost and v0 comes from the callee when it
+// returns a known value.
+func (vsa *ValueSetAnalysis) callReturn(st valueState, instr *SoraInstruction) {
+	for _, reg := range callerSaved {
+		delete(st, reg)
+	}
+	if instr.Op == "jal" {
+		target := instr.Operands[0].UImm
+		if ret, ok := vsa.returns[target]; ok {
+			ret.Src = joinSrc(ret.Src, fmt.Sprintf("return of 0x%08x", target))
+			st.set(GPR(2), ret)
+		}
+	}
+}
+
+// functionValues is the state before each instruction of fun.
+type functionValues struct {
+	cfg    *FunctionCFG
+	before map[uint32]valueState
+	outs   []valueState
+}
+
+// analyzeFunction runs the analysis to a fixpoint over the blocks of fun,
+// values still changing after a few visits are widened to Top.
+func (vsa *ValueSetAnalysis) analyzeFunction(fun *SoraFunction) *functionValues {
+	doc := vsa.doc
+	cfg := NewFunctionAnalyzer(doc, fun).BuildCFG()
+	fv := &functionValues{cfg: cfg, before: make(map[uint32]valueState)}
+
+	order := cfg.ReversePostorder()
+	ins := make([]valueState, len(cfg.Blocks))
+	outs := make([]valueState, len(cfg.Blocks))
+	visits := make([]int, len(cfg.Blocks))
+
+	for changed := true; changed; {
+		changed = false
+		for _, b := range order {
+			block := cfg.Blocks[b]
+			var in valueState
+			if b == 0 {
+				in = vsa.entries[fun.Address].clone()
+			}
+			for _, pred := range block.Preds {
+				if outs[pred] == nil {
+					continue
+				}
+				if in == nil {
+					in = outs[pred].clone()
+				} else {
+					in = joinStates(in, outs[pred])
+				}
+			}
+			if in == nil {
+				in = make(valueState)
+			}
+			visits[b]++
+			if visits[b] > 4 && ins[b] != nil {
+				for reg, val := range in {
+					if prev, ok := ins[b][reg]; !ok || !prev.equal(val) {
+						delete(in, reg)
+					}
+				}
+			}
+			ins[b] = in
+
+			st := in.clone()
+			var call *SoraInstruction
+			for addr := block.Address; addr <= block.LastAddress; addr += 4 {
+				fv.before[addr] = st.clone()
+				instr := doc.Disasm(addr)
+				if instr != nil {
+					vsa.transfer(st, instr)
+				}
+				if call != nil {
+					// the delay slot ran, now the callee
+					vsa.callReturn(st, call)
+					call = nil
+				} else if instr != nil && (instr.Op == "jal" || instr.Op == "jalr") {
+					if instr.Info.HasDelaySlot && addr < block.LastAddress {
+						call = instr
+					} else {
+						vsa.callReturn(st, instr)
+					}
+				}
+			}
+			if outs[b] == nil || !st.equal(outs[b]) {
+				outs[b] = st
+				changed = true
+			}
+		}
+	}
+	fv.outs = outs
+	return fv
+}
+
+// isCodeTarget accepts the start of a known function or any code address
+// of the function holding it.
+func (vsa *ValueSetAnalysis) isCodeTarget(target uint32, calls bool) bool {
+	if calls {
+		return vsa.doc.FunManager.Get(target) != nil
+	}
+	return vsa.doc.FunManager.FindByAddress(target) != nil
+}
+
+// Run analyzes every function, feeding the constant arguments of call sites
+// and the constant returns of callees back for a few rounds.
+func (vsa *ValueSetAnalysis) Run() []*IndirectSite {
+	doc := vsa.doc
+	var funcs []*SoraFunction
+	doc.FunManager.ForEach(func(fun *SoraFunction) {
+		funcs = append(funcs, fun)
+	})
+
+	results := make(map[uint32]*functionValues)
+	for round := 0; round < 3; round++ {
+		args := make(map[uint32][]valueState)
+		for _, fun := range funcs {
+			fv := vsa.analyzeFunction(fun)
+			results[fun.Address] = fv
+			vsa.summarize(fun, fv, args)
+		}
+
+		changed := false
+		for _, fun := range funcs {
+			entry := vsa.joinArgs(args[fun.Address])
+			if !entry.equal(vsa.entries[fun.Address]) {
+				vsa.entries[fun.Address] = entry
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	vsa.Sites = nil
+	for _, fun := range funcs {
+		vsa.Sites = append(vsa.Sites, vsa.indirectSites(fun, results[fun.Address])...)
+	}
+	return vsa.Sites
+}
+
+// summarize records the returned v0 of fun and the arguments of its calls.
+func (vsa *ValueSetAnalysis) summarize(fun *SoraFunction, fv *functionValues, args map[uint32][]valueState) {
+	doc := vsa.doc
+	var ret *AbsValue
+	for _, block := range fv.cfg.Blocks {
+		if block.BranchAddress == 0 || fv.outs[block.Index] == nil {
+			continue
+		}
+		instr := doc.Disasm(block.BranchAddress)
+		if instr == nil {
+			continue
+		}
+		if isReturnInstr(instr) {
+			val := fv.outs[block.Index].get(GPR(2))
+			if ret == nil {
+				ret = &val
+			} else {
+				*ret = joinValues(*ret, val)
+			}
+			continue
+		}
+		if !instr.Info.IsLinkedBranch {
+			continue
+		}
+
+		// arguments are set up to the delay slot
+		st := fv.before[block.BranchAddress].clone()
+		if delay := doc.Disasm(block.BranchAddress + 4); delay != nil && instr.Info.HasDelaySlot {
+			vsa.transfer(st, delay)
+		}
+		var callees []uint32
+		if instr.Info.IsBranchToRegister {
+			callees = vsa.targets(fv.before[block.BranchAddress].get(instr.Operands[1].Reg), func(target uint32) bool {
+				return vsa.isCodeTarget(target, true)
+			})
+		} else if doc.FunManager.Get(instr.Info.BranchTarget) != nil {
+			callees = []uint32{instr.Info.BranchTarget}
+		}
+		for _, callee := range callees {
+			arg := make(valueState)
+			for _, reg := range callArgs {
+				if val := st.get(reg); val.Kind != ValueTop {
+					val.Src = joinSrc(val.Src, fmt.Sprintf("arg %s of 0x%08x", reg.Name(), block.BranchAddress))
+					arg[reg] = val
+				}
+			}
+			args[callee] = append(args[callee], arg)
+		}
+	}
+	if ret != nil && ret.Kind != ValueTop {
+		vsa.returns[fun.Address] = *ret
+	} else {
+		delete(vsa.returns, fun.Address)
+	}
+}
+
+// joinArgs keeps the arguments every known caller agrees on the kind of.
+func (vsa *ValueSetAnalysis) joinArgs(calls []valueState) valueState {
+	if len(calls) == 0 {
+		return nil
+	}
+	entry := calls[0].clone()
+	for _, arg := range calls[1:] {
+		entry = joinStates(entry, arg)
+	}
+	return entry
+}
+
+func (vsa *ValueSetAnalysis) indirectSites(fun *SoraFunction, fv *functionValues) []*IndirectSite {
+	doc := vsa.doc
+	var sites []*IndirectSite
+	for _, block := range fv.cfg.Blocks {
+		if block.BranchAddress == 0 {
+			continue
+		}
+		instr := doc.Disasm(block.BranchAddress)
+		st, ok := fv.before[block.BranchAddress]
+		if instr == nil || !ok || !instr.Info.IsBranchToRegister || isReturnInstr(instr) || instr.Op == "" {
+			continue
+		}
+
+		calls := instr.Info.IsLinkedBranch
+		reg := instr.Operands[0].Reg
+		if calls {
+			reg = instr.Operands[1].Reg
+		}
+		site := &IndirectSite{Address: block.BranchAddress, Block: block.Address, Fun: fun, Reg: reg, Value: st.get(reg)}
+		site.Targets = vsa.targets(site.Value, func(target uint32) bool {
+			if calls {
+				return vsa.isCodeTarget(target, true)
+			}
+			return fun.Address <= target && target <= fun.LastAddress()
+		})
+		site.Provenance = site.Value.Src
+		sites = append(sites, site)
+	}
+	return sites
+}
+
+// ResolveIndirect runs the value-set analysis and records the targets it
+// finds as dynamic refs, the provenance on each. It returns the sites.
+func (doc *SoraDocument) ResolveIndirect() []*IndirectSite {
+	sites := NewValueSetAnalysis(doc).Run()
+	for _, site := range sites {
+		if len(site.Targets) == 0 {
+			continue
+		}
+		from, err := doc.Parser.EnsureBB(site.Block)
+		if err != nil {
+			doc.logf("WARNING:\t%s\n", err)
+			continue
+		}
+		for _, target := range site.Targets {
+			if _, err := doc.Parser.EnsureBB(target); err != nil {
+				doc.logf("WARNING:\t%s\n", err)
+				continue
+			}
+			ref := doc.BBManager.CreateReference(from.Address, target)
+			ref.SetKind(doc.BBManager.ClassifyEdge(from, target))
+			ref.IsDynamic = true
+			if ref.Provenance == "" {
+				ref.Provenance = "vsa: " + site.Provenance
+			}
+		}
+	}
+	return sites
+}
+
+func (doc *SoraDocument) DumpIndirect(sites []*IndirectSite) {
+	for _, site := range sites {
+		fmt.Printf("0x%08x %s %s = %s", site.Address, site.Fun.Name, site.Reg.Name(), site.Value)
+		for _, target := range site.Targets {
+			fmt.Printf(" ->0x%08x", target)
+		}
+		if site.Provenance != "" {
+			fmt.Printf(" (%s)", site.Provenance)
+		}
+		fmt.Println()
+	}
+}
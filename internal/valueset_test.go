@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var opJALR = models.MipsOpcode{IsBranch: true, IsBranchToRegister: true, IsLinkedBranch: true, HasDelaySlot: true}
+
+func TestValueSetTable(t *testing.T) {
+	doc := newEmuDocument()
+	putCode(doc, 0x8800000, models.MipsOpcode{},
+		0x30820003, // andi v0, a0, 0x3
+		0x00021080, // sll v0, v0, 2
+		0x3c010880, // lui at, 0x880
+		0x00220821, // addu at, at, v0
+		0x8c390100, // lw t9, 0x100(at)
+	)
+	putCode(doc, 0x8800014, opJALR, 0x0320f809, 0)
+	putCode(doc, 0x880001C, opJR, 0x03e00008, 0)
+	putFunction(doc, "dispatch", 0x8800000, 0x24)
+	putLeaf(doc, "handler0", 0x8800040)
+	putLeaf(doc, "handler1", 0x8800050)
+	putLeaf(doc, "handler2", 0x8800060)
+	putWords(doc, 0x8800100, 0x8800040, 0x8800050, 0x8800040, 0x8800060)
+
+	sites := doc.ResolveIndirect()
+	assert.Len(t, sites, 1)
+	assert.Equal(t, uint32(0x8800014), sites[0].Address)
+	assert.Equal(t, []uint32{0x8800040, 0x8800050, 0x8800060}, sites[0].Targets)
+	assert.Equal(t, "table 0x08800100", sites[0].Provenance)
+
+	ref := doc.BBManager.GetReference(0x8800000, 0x8800050)
+	if assert.NotNil(t, ref) {
+		assert.Equal(t, RefCall, ref.Kind)
+		assert.True(t, ref.IsDynamic)
+		assert.Equal(t, "vsa: table 0x08800100", ref.Provenance)
+	}
+}
+
+func TestValueSetArgument(t *testing.T) {
+	doc := newEmuDocument()
+	putCode(doc, 0x8800200, models.MipsOpcode{}, 0x3c040880) // lui a0, 0x880
+	putCode(doc, 0x8800204, models.MipsOpcode{IsBranch: true, IsLinkedBranch: true, HasDelaySlot: true, BranchTarget: 0x8800280},
+		0x0e2000a0, // jal 0x8800280
+		0x34840300, // ori a0, a0, 0x300
+	)
+	putCode(doc, 0x880020C, opJR, 0x03e00008, 0)
+	putFunction(doc, "caller", 0x8800200, 0x14)
+
+	putCode(doc, 0x8800280, models.MipsOpcode{},
+		0x8c820000, // lw v0, 0(a0)
+		0x8c590004, // lw t9, 4(v0)
+	)
+	putCode(doc, 0x8800288, opJALR, 0x0320f809, 0)
+	putCode(doc, 0x8800290, opJR, 0x03e00008, 0)
+	putFunction(doc, "method", 0x8800280, 0x18)
+	putLeaf(doc, "impl0", 0x8800040)
+	putLeaf(doc, "impl1", 0x8800050)
+
+	putWords(doc, 0x8800300, 0x8800310)
+	putWords(doc, 0x8800310, 0x8800040, 0x8800050)
+
+	sites := NewValueSetAnalysis(doc).Run()
+	assert.Len(t, sites, 1)
+	assert.Equal(t, []uint32{0x8800050}, sites[0].Targets)
+	assert.Equal(t, "arg a0 of 0x08800204, load 0x08800300, load 0x08800314", sites[0].Provenance)
+}
+
+func TestValueSetCallDelaySlot(t *testing.T) {
+	doc := newEmuDocument()
+	putCode(doc, 0x8800400, models.MipsOpcode{IsBranch: true, IsLinkedBranch: true, HasDelaySlot: true, BranchTarget: 0x8800480},
+		0x0e200120, // jal 0x8800480
+		0x3c021234, // lui v0, 0x1234
+	)
+	putCode(doc, 0x8800408, opJR, 0x03e00008, 0)
+	caller := putFunction(doc, "caller", 0x8800400, 0x10)
+	putCode(doc, 0x8800480, opJR, 0x03e00008, 0x3c020880) // jr ra; lui v0, 0x880
+	putFunction(doc, "getter", 0x8800480, 8)
+
+	vsa := NewValueSetAnalysis(doc)
+	vsa.Run()
+	st := vsa.analyzeFunction(caller).before[0x8800408]
+
+	// the delay slot runs before the callee sets v0
+	assert.Equal(t, []uint32{0x8800000}, st.get(GPR(2)).Values)
+	assert.Equal(t, []uint32{0x8800408}, st.get(RegRA).Values)
+}
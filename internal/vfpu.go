@@ -0,0 +1,489 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RegVFPUC is the VFPU control class, see vfpuCtrlNames.
+const RegVFPUC RegClass = "vfpuc"
+
+var vfpuCtrlNames = []string{
+	"SPFX", "TPFX", "DPFX", "CC", "INF4", "RSV5", "RSV6", "REV",
+	"RCX0", "RCX1", "RCX2", "RCX3", "RCX4", "RCX5", "RCX6", "RCX7",
+}
+
+var (
+	RegVFPUSPFX = Register{RegVFPUC, 0}
+	RegVFPUTPFX = Register{RegVFPUC, 1}
+	RegVFPUDPFX = Register{RegVFPUC, 2}
+	RegVFPUCC   = Register{RegVFPUC, 3}
+)
+
+var vfpuSizeSuffix = []string{".s", ".p", ".t", ".q"}
+
+var vcmpConds = []string{
+	"FL", "EQ", "LT", "LE", "TR", "NE", "GE", "GT",
+	"EZ", "EN", "EI", "ES", "NZ", "NN", "NI", "NS",
+}
+
+var vcstNames = []string{
+	"(undef)", "MaxFloat", "Sqrt(2)", "Sqrt(1/2)", "2/Sqrt(PI)", "2/PI", "1/PI", "PI/4",
+	"PI/2", "PI", "e", "Log2(e)", "Log10(e)", "ln(2)", "ln(10)", "2*PI",
+	"PI/6", "Log10(2)", "Log2(10)", "Sqrt(3)/2",
+}
+
+// vfpuSize is the vector length an instruction works on, 1 to 4.
+func vfpuSize(word uint32) int {
+	return int((word>>7)&1|(word>>14)&2) + 1
+}
+
+// vfpuRow is the starting row of a vector or matrix register of size n.
+func vfpuRow(num, n int) int {
+	switch n {
+	case 1:
+		return (num >> 5) & 3
+	case 3:
+		return (num >> 6) & 1
+	}
+	return (num >> 5) & 2
+}
+
+// VectorName names the n-vector register num, column vectors are C and
+// transposed ones R.
+func VectorName(num, n int) string {
+	if n == 1 {
+		return vfpuRegName(num)
+	}
+	mtx, col, row := (num>>2)&7, num&3, vfpuRow(num, n)
+	if (num>>5)&1 != 0 {
+		return fmt.Sprintf("R%d%d%d", mtx, row, col)
+	}
+	return fmt.Sprintf("C%d%d%d", mtx, col, row)
+}
+
+// MatrixName names the nxn matrix register num, transposed ones are E.
+func MatrixName(num, n int) string {
+	mtx, col, row := (num>>2)&7, num&3, vfpuRow(num, n)
+	if (num>>5)&1 != 0 {
+		return fmt.Sprintf("E%d%d%d", mtx, row, col)
+	}
+	return fmt.Sprintf("M%d%d%d", mtx, col, row)
+}
+
+// VectorRegs lists the single registers of the n-vector num.
+func VectorRegs(num, n int) []Register {
+	mtx, col, row := (num>>2)&7, num&3, vfpuRow(num, n)
+	transpose := n > 1 && (num>>5)&1 != 0
+	regs := make([]Register, n)
+	for i := 0; i < n; i++ {
+		index := mtx * 4
+		if transpose {
+			index += (row+i)&3 + col*32
+		} else {
+			index += col + ((row+i)&3)*32
+		}
+		regs[i] = Register{RegVFPU, index}
+	}
+	return regs
+}
+
+// MatrixRegs lists the single registers of the nxn matrix num.
+func MatrixRegs(num, n int) []Register {
+	mtx, col, row := (num>>2)&7, num&3, vfpuRow(num, n)
+	transpose := (num>>5)&1 != 0
+	var regs []Register
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			index := mtx * 4
+			if transpose {
+				index += (row+i)&3 + ((col+j)&3)*32
+			} else {
+				index += (col+j)&3 + ((row+i)&3)*32
+			}
+			regs = append(regs, Register{RegVFPU, index})
+		}
+	}
+	return regs
+}
+
+func VectorOperand(num, n int) Operand {
+	return Operand{Kind: OperandReg, Reg: Register{RegVFPU, num}, Size: n}
+}
+
+func MatrixOperand(num, n int) Operand {
+	return Operand{Kind: OperandReg, Reg: Register{RegVFPU, num}, Size: n, Matrix: true}
+}
+
+// Regs lists the registers an operand covers, the single components of
+// VFPU vectors and matrices.
+func (opr Operand) Regs() []Register {
+	switch {
+	case opr.Kind != OperandReg:
+		return nil
+	case opr.Reg.Class != RegVFPU:
+		return []Register{opr.Reg}
+	case opr.Matrix:
+		return MatrixRegs(opr.Reg.Num, opr.Size)
+	}
+	n := opr.Size
+	if n == 0 {
+		n = 1
+	}
+	return VectorRegs(opr.Reg.Num, n)
+}
+
+var vfpuConstants = [2][4]string{{"0", "1", "2", "1/2"}, {"3", "1/3", "1/4", "1/6"}}
+
+// VfpuPrefix formats the data of vpfxs and vpfxt, or of vpfxd when dest.
+func VfpuPrefix(data uint32, dest bool) string {
+	var lanes []string
+	for i := 0; i < 4; i++ {
+		var lane string
+		if dest {
+			switch (data >> (i * 2)) & 3 {
+			case 1:
+				lane = "0:1"
+			case 3:
+				lane = "-1:1"
+			}
+			if (data>>(8+i))&1 != 0 {
+				lane = "m"
+			}
+		} else {
+			swz := (data >> (i * 2)) & 3
+			abs := (data >> (8 + i)) & 1
+			if (data>>(12+i))&1 != 0 {
+				lane = vfpuConstants[abs][swz]
+			} else {
+				lane = string("xyzw"[swz])
+				if abs != 0 {
+					lane = "|" + lane + "|"
+				}
+			}
+			if (data>>(16+i))&1 != 0 {
+				lane = "-" + lane
+			}
+		}
+		lanes = append(lanes, lane)
+	}
+	return "[" + strings.Join(lanes, ",") + "]"
+}
+
+func (dec *DecodedInstruction) readOperands(oprs ...Operand) {
+	for _, opr := range oprs {
+		dec.read(opr.Regs()...)
+	}
+}
+
+func (dec *DecodedInstruction) writeOperands(oprs ...Operand) {
+	for _, opr := range oprs {
+		dec.write(opr.Regs()...)
+	}
+}
+
+// vfpuBinary is vd = vs op vt.
+func (dec *DecodedInstruction) vfpuBinary(name string, vd, vs, vt Operand, n int) *DecodedInstruction {
+	dec.Op = name + vfpuSizeSuffix[n-1]
+	dec.Operands = []Operand{vd, vs, vt}
+	dec.readOperands(vs, vt)
+	dec.writeOperands(vd)
+	return dec
+}
+
+// vfpuUnary is vd = op(vs).
+func (dec *DecodedInstruction) vfpuUnary(name string, vd, vs Operand, n int) *DecodedInstruction {
+	dec.Op = name + vfpuSizeSuffix[n-1]
+	dec.Operands = []Operand{vd, vs}
+	dec.readOperands(vs)
+	dec.writeOperands(vd)
+	return dec
+}
+
+var vfpu0Ops = map[uint32]string{0: "vadd", 1: "vsub", 2: "vsbn", 7: "vdiv"}
+var vfpu1Ops = map[uint32]string{0: "vmul", 1: "vdot", 2: "vscl", 4: "vhdp", 5: "vcrs", 6: "vdet"}
+var vfpu3Ops = map[uint32]string{2: "vmin", 3: "vmax", 5: "vscmp", 6: "vsge", 7: "vslt"}
+
+var vfpu4Ops = map[uint32]string{
+	0x00: "vmov", 0x01: "vabs", 0x02: "vneg", 0x03: "vidt", 0x04: "vsat0", 0x05: "vsat1",
+	0x06: "vzero", 0x07: "vone",
+	0x10: "vrcp", 0x11: "vrsq", 0x12: "vsin", 0x13: "vcos", 0x14: "vexp2", 0x15: "vlog2",
+	0x16: "vsqrt", 0x17: "vasin", 0x18: "vnrcp", 0x1a: "vnsin", 0x1c: "vrexp2",
+}
+
+var vfpu9Ops = map[uint32]string{
+	0x0: "vsrt1", 0x1: "vsrt2", 0x2: "vbfy1", 0x3: "vbfy2", 0x4: "vocp", 0x5: "vsocp",
+	0x6: "vfad", 0x7: "vavg", 0x8: "vsrt3", 0x9: "vsrt4", 0xa: "vsgn",
+}
+
+var vf2iOps = []string{"vf2in", "vf2iz", "vf2iu", "vf2id", "vi2f"}
+
+// decodeVfpu decodes the VFPU opcodes, nil when op is none of them.
+func decodeVfpu(f mipsFields, dec *DecodedInstruction) *DecodedInstruction {
+	word := f.word
+	n := vfpuSize(word)
+	vd, vs, vt := int(word&127), int((word>>8)&127), int((word>>16)&127)
+	sub := (word >> 23) & 7
+
+	switch f.op() {
+	case 0x18:
+		name, ok := vfpu0Ops[sub]
+		if !ok {
+			return nil
+		}
+		vt_n := n
+		if name == "vsbn" {
+			vt_n = 1
+		}
+		return dec.vfpuBinary(name, VectorOperand(vd, n), VectorOperand(vs, n), VectorOperand(vt, vt_n), n)
+
+	case 0x19:
+		name, ok := vfpu1Ops[sub]
+		if !ok {
+			return nil
+		}
+		vd_n, vt_n := n, n
+		switch name {
+		case "vdot", "vhdp", "vdet":
+			vd_n = 1
+		case "vscl":
+			vt_n = 1
+		}
+		return dec.vfpuBinary(name, VectorOperand(vd, vd_n), VectorOperand(vs, n), VectorOperand(vt, vt_n), n)
+
+	case 0x1b:
+		if sub == 0 {
+			dec.Op = "vcmp" + vfpuSizeSuffix[n-1]
+			cond := UImmOperand(word & 15)
+			dec.Operands = []Operand{cond, VectorOperand(vs, n), VectorOperand(vt, n)}
+			dec.readOperands(dec.Operands[1:]...)
+			dec.write(RegVFPUCC)
+			return dec
+		}
+		name, ok := vfpu3Ops[sub]
+		if !ok {
+			return nil
+		}
+		return dec.vfpuBinary(name, VectorOperand(vd, n), VectorOperand(vs, n), VectorOperand(vt, n), n)
+
+	case 0x12:
+		return decodeCop2(f, dec)
+
+	case 0x32, 0x3a:
+		num := int((word>>16)&31 | (word&3)<<5)
+		return dec.vfpuAccess(f, word>>26 == 0x32, "v.s", VectorOperand(num, 1), 4)
+
+	case 0x35, 0x36, 0x3d, 0x3e:
+		num := int((word>>16)&31 | (word&1)<<5)
+		load := f.op() == 0x35 || f.op() == 0x36
+		name := "v.q"
+		if f.op() == 0x35 || f.op() == 0x3d {
+			name = "vl.q"
+			if word&2 != 0 {
+				name = "vr.q"
+			}
+		}
+		return dec.vfpuAccess(f, load, name, VectorOperand(num, 4), 16)
+
+	case 0x34:
+		return decodeVfpu4(word, n, vd, vs, dec)
+
+	case 0x37:
+		switch (word >> 24) & 3 {
+		case 0, 1, 2:
+			pfx := Register{RegVFPUC, int((word >> 24) & 3)}
+			dec.Op = []string{"vpfxs", "vpfxt", "vpfxd"}[pfx.Num]
+			dec.Operands = []Operand{UImmOperand(word & 0xffffff)}
+			dec.write(pfx)
+		default:
+			dec.Op = "viim.s"
+			if (word>>23)&1 != 0 {
+				dec.Op = "vfim.s"
+			}
+			dst := VectorOperand(vt, 1)
+			dec.Operands = []Operand{dst, ImmOperand(f.imm())}
+			dec.writeOperands(dst)
+		}
+		return dec
+
+	case 0x3c:
+		return decodeVfpu6(word, n, vd, vs, vt, dec)
+	}
+	return nil
+}
+
+// vfpuAccess is a VFPU load or store, the mnemonic being l or s + name.
+func (dec *DecodedInstruction) vfpuAccess(f mipsFields, load bool, name string, reg Operand, size int) *DecodedInstruction {
+	offset := int32(int16(f.word & 0xfffc))
+	mem := MemOperand(f.rs(), offset)
+	dec.Operands = []Operand{reg, mem}
+	dec.read(f.rs())
+	dec.Access = &MemoryAccess{Base: f.rs(), Offset: offset, Size: size, Store: !load}
+	if load {
+		dec.Op = "l" + name
+		if name != "v.q" && name != "v.s" {
+			// unaligned loads merge into the register
+			dec.readOperands(reg)
+		}
+		dec.writeOperands(reg)
+	} else {
+		dec.Op = "s" + name
+		dec.readOperands(reg)
+	}
+	return dec
+}
+
+func decodeCop2(f mipsFields, dec *DecodedInstruction) *DecodedInstruction {
+	word := f.word
+	imm := int(word & 0xff)
+	reg := VectorOperand(imm&127, 1)
+	if imm >= 128 {
+		reg = RegOperand(Register{RegVFPUC, imm - 128})
+	}
+
+	switch f.rs().Num {
+	case 0x03:
+		dec.Op = "mfv"
+		if imm >= 128 {
+			dec.Op = "mfvc"
+		}
+		dec.Operands = []Operand{RegOperand(f.rt()), reg}
+		dec.readOperands(reg)
+		dec.write(f.rt())
+	case 0x07:
+		dec.Op = "mtv"
+		if imm >= 128 {
+			dec.Op = "mtvc"
+		}
+		dec.Operands = []Operand{RegOperand(f.rt()), reg}
+		dec.read(f.rt())
+		dec.writeOperands(reg)
+	case 0x08:
+		dec.Op = []string{"bvf", "bvt", "bvfl", "bvtl"}[(word>>16)&3]
+		dec.Operands = []Operand{UImmOperand((word >> 18) & 7), TargetOperand(f.branchTarget())}
+		dec.read(RegVFPUCC)
+	default:
+		return nil
+	}
+	return dec
+}
+
+func decodeVfpu4(word uint32, n, vd, vs int, dec *DecodedInstruction) *DecodedInstruction {
+	sub := (word >> 16) & 31
+	switch group := (word >> 21) & 31; {
+	case group == 0:
+		name, ok := vfpu4Ops[sub]
+		if !ok {
+			return nil
+		}
+		switch name {
+		case "vidt", "vzero", "vone":
+			dec.Op = name + vfpuSizeSuffix[n-1]
+			dec.Operands = []Operand{VectorOperand(vd, n)}
+			dec.writeOperands(dec.Operands[0])
+			return dec
+		}
+		return dec.vfpuUnary(name, VectorOperand(vd, n), VectorOperand(vs, n), n)
+
+	case group == 2:
+		name, ok := vfpu9Ops[sub]
+		if !ok {
+			return nil
+		}
+		vd_n := n
+		if name == "vfad" || name == "vavg" {
+			vd_n = 1
+		}
+		return dec.vfpuUnary(name, VectorOperand(vd, vd_n), VectorOperand(vs, n), n)
+
+	case group == 3:
+		dec.Op = "vcst" + vfpuSizeSuffix[n-1]
+		dec.Operands = []Operand{VectorOperand(vd, n), UImmOperand(sub)}
+		dec.writeOperands(dec.Operands[0])
+		return dec
+
+	case group >= 0x10 && group <= 0x14:
+		dec.vfpuUnary(vf2iOps[group-0x10], VectorOperand(vd, n), VectorOperand(vs, n), n)
+		dec.Operands = append(dec.Operands, UImmOperand(sub))
+		return dec
+
+	case group == 0x15:
+		name := "vcmovt"
+		if (word>>19)&3 == 1 {
+			name = "vcmovf"
+		} else if (word>>19)&3 != 0 {
+			return nil
+		}
+		dst := VectorOperand(vd, n)
+		dec.vfpuUnary(name, dst, VectorOperand(vs, n), n)
+		dec.Operands = append(dec.Operands, UImmOperand((word>>16)&7))
+		// lanes not moved keep their value
+		dec.readOperands(dst)
+		dec.read(RegVFPUCC)
+		return dec
+
+	case group >= 0x18:
+		dec.vfpuUnary("vwbn", VectorOperand(vd, n), VectorOperand(vs, n), n)
+		dec.Operands = append(dec.Operands, UImmOperand((word>>16)&0xff))
+		return dec
+	}
+	return nil
+}
+
+func decodeVfpu6(word uint32, n, vd, vs, vt int, dec *DecodedInstruction) *DecodedInstruction {
+	sub := (word >> 23) & 7
+	switch sub {
+	case 0:
+		return dec.vfpuBinary("vmmul", MatrixOperand(vd, n), MatrixOperand(vs, n), MatrixOperand(vt, n), n)
+
+	case 1, 2, 3:
+		side := int(sub) + 1
+		if n == side {
+			return dec.vfpuBinary(fmt.Sprintf("vtfm%d", side), VectorOperand(vd, side), MatrixOperand(vs, side), VectorOperand(vt, side), n)
+		}
+		if n == side-1 {
+			dec.vfpuBinary(fmt.Sprintf("vhtfm%d", side), VectorOperand(vd, side), MatrixOperand(vs, side), VectorOperand(vt, n), side)
+			return dec
+		}
+		return nil
+
+	case 4:
+		return dec.vfpuBinary("vmscl", MatrixOperand(vd, n), MatrixOperand(vs, n), VectorOperand(vt, 1), n)
+
+	case 5:
+		name := "vcrsp"
+		if n == 4 {
+			name = "vqmul"
+		}
+		return dec.vfpuBinary(name, VectorOperand(vd, n), VectorOperand(vs, n), VectorOperand(vt, n), n)
+
+	case 7:
+		switch (word >> 21) & 3 {
+		case 0:
+			switch (word >> 16) & 15 {
+			case 0:
+				dec.Op = "vmmov" + vfpuSizeSuffix[n-1]
+				dec.Operands = []Operand{MatrixOperand(vd, n), MatrixOperand(vs, n)}
+				dec.readOperands(dec.Operands[1])
+			case 3:
+				dec.Op = "vmidt" + vfpuSizeSuffix[n-1]
+				dec.Operands = []Operand{MatrixOperand(vd, n)}
+			case 6:
+				dec.Op = "vmzero" + vfpuSizeSuffix[n-1]
+				dec.Operands = []Operand{MatrixOperand(vd, n)}
+			case 7:
+				dec.Op = "vmone" + vfpuSizeSuffix[n-1]
+				dec.Operands = []Operand{MatrixOperand(vd, n)}
+			default:
+				return nil
+			}
+			dec.writeOperands(dec.Operands[0])
+			return dec
+		case 1:
+			dec.vfpuUnary("vrot", VectorOperand(vd, n), VectorOperand(vs, 1), n)
+			dec.Operands = append(dec.Operands, UImmOperand((word>>16)&31))
+			return dec
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/firodj/pspsora/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeVfpu(t *testing.T) {
+	dec := DecodeInstruction(0x8804000, 0xd8810010)
+	assert.Equal(t, "lv.q", dec.Op)
+	assert.Equal(t, "C010", dec.Operands[0].String())
+	assert.Equal(t, "0x10(a0)", dec.Operands[1].String())
+	assert.Equal(t, []Register{GPR(4)}, dec.Reads)
+	assert.Equal(t, []Register{{RegVFPU, 1}, {RegVFPU, 33}, {RegVFPU, 65}, {RegVFPU, 97}}, dec.Writes)
+	assert.Equal(t, &MemoryAccess{Base: GPR(4), Offset: 0x10, Size: 16}, dec.Access)
+
+	dec = DecodeInstruction(0x8804000, 0x60028180)
+	assert.Equal(t, "vadd.q", dec.Op)
+	assert.Equal(t, "C000", dec.Operands[0].String())
+	assert.Equal(t, "C020", dec.Operands[2].String())
+	assert.Len(t, dec.Reads, 8)
+
+	dec = DecodeInstruction(0x8804000, 0x64828180)
+	assert.Equal(t, "vdot.q", dec.Op)
+	assert.Equal(t, "S000", dec.Operands[0].String())
+	assert.Equal(t, []Register{{RegVFPU, 0}}, dec.Writes)
+
+	dec = DecodeInstruction(0x8804000, 0xf0088480)
+	assert.Equal(t, "vmmul.q", dec.Op)
+	assert.Equal(t, "M000", dec.Operands[0].String())
+	assert.Equal(t, "M100", dec.Operands[1].String())
+	assert.Equal(t, "M200", dec.Operands[2].String())
+	assert.Len(t, dec.Writes, 16)
+
+	dec = DecodeInstruction(0x8804000, 0x6c018082)
+	assert.Equal(t, "vcmp.q", dec.Op)
+	assert.Equal(t, []Register{RegVFPUCC}, dec.Writes)
+
+	dec = DecodeInstruction(0x8804000, 0x48620004)
+	assert.Equal(t, "mfv", dec.Op)
+	assert.Equal(t, []Register{{RegVFPU, 4}}, dec.Reads)
+	assert.Equal(t, []Register{GPR(2)}, dec.Writes)
+
+	dec = DecodeInstruction(0x8804000, 0xdc008064)
+	assert.Equal(t, "vpfxs", dec.Op)
+	assert.Equal(t, "[x,y,z,1]", VfpuPrefix(dec.Operands[0].UImm, false))
+	assert.Equal(t, []Register{RegVFPUSPFX}, dec.Writes)
+
+	assert.Equal(t, "R001", VectorName(0x21, 4))
+	assert.Equal(t, "E000", MatrixName(0x20, 4))
+}
+
+func TestDecodeFpu(t *testing.T) {
+	dec := DecodeInstruction(0x8804000, 0x460e6000)
+	assert.Equal(t, "add.s", dec.Op)
+	assert.Equal(t, []Operand{RegOperand(Register{RegFPR, 0}), RegOperand(Register{RegFPR, 12}), RegOperand(Register{RegFPR, 14})}, dec.Operands)
+
+	dec = DecodeInstruction(0x8804000, 0x460e603c)
+	assert.Equal(t, "c.lt.s", dec.Op)
+	assert.Equal(t, []Register{RegFCSR}, dec.Writes)
+
+	dec = DecodeInstruction(0x8804000, 0xc4800008)
+	assert.Equal(t, "lwc1", dec.Op)
+	assert.Equal(t, &MemoryAccess{Base: GPR(4), Offset: 8, Size: 4}, dec.Access)
+}
+
+func TestPseudoFloat(t *testing.T) {
+	doc := newTestDocument()
+	cases := map[uint32]string{
+		0xd8810010: "C010 = *(vec4 *)(a0 + 0x10)",
+		0x60028180: "C000 = C010 + C020",
+		0x64828180: "S000 = dot(C010, C020)",
+		0xf0088480: "M000 = M100 * M200",
+		0x6c018082: "CC = cmp_LT(C000, C010)",
+		0xdc008064: "/* vpfxs [x,y,z,1] */",
+		0x460e6000: "f0 = f12 + f14",
+		0x460e603c: "fpcond = f12 < f14",
+		0xd0128180: "C000 = vsin(C010)",
+	}
+	addr := uint32(0x8808000)
+	for word, want := range cases {
+		instr := putWord(doc, addr, word, models.MipsOpcode{})
+		assert.Equal(t, want, doc.PseudoStatement(instr), "%08x", word)
+		addr += 4
+	}
+}
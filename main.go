@@ -37,6 +37,14 @@ func testBBTrace(doc *internal.SoraDocument) {
 	err := doc.Parser.Parse(0)
 	doc.Parser.DumpAllFunGraph()
 	doc.Parser.DumpAllCallHistory()
+	doc.FunManager.DetectBoundaries()
+	doc.FunManager.DumpBoundaries()
+	doc.Parser.Profile.DumpHotSpots(50)
+	doc.DumpHotLoops(20)
+	doc.DumpIndirect(doc.ResolveIndirect())
+	doc.DiscoverData()
+	doc.Parser.Timeline.Dump(doc.Parser.Sources)
+	doc.Parser.DumpMismatches()
 	if err != nil {
 		panic(err)
 	}
@@ -53,6 +61,7 @@ func main() {
 	if err != nil {
 		fmt.Println(err)
 	}
+	doc.Parser.EnableCallHistory = true
 
 	testSysCall(doc)
 